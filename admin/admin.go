@@ -0,0 +1,895 @@
+// Package admin implements an HTTP API for administering a running server.
+// All requests must be authenticated with a bearer token, except for the
+// room API served by RoomHandler, which uses per-room passwords and tokens.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ban"
+	"github.com/fragglet/ipxbox/bridge"
+	"github.com/fragglet/ipxbox/capture"
+	"github.com/fragglet/ipxbox/debuglog"
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/recorder"
+	"github.com/fragglet/ipxbox/server"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+// Handler is an http.Handler that serves the admin API.
+type Handler struct {
+	server *server.Server
+	token  string
+	mux    *http.ServeMux
+
+	mu         sync.Mutex
+	bridges    map[string]*bridge.Bridge
+	recorder   *recorder.Recorder
+	bans       *ban.Store
+	network    *virtual.Network
+	packetDump PacketDumper
+	captureDir string
+	captures   map[ipx.Addr]*os.File
+}
+
+// PacketDumper dumps all network traffic to stdout while it is enabled.
+type PacketDumper interface {
+	SetEnabled(enabled bool)
+	Enabled() bool
+}
+
+// DebugSettings describes the debugging settings that can be changed at
+// runtime.
+type DebugSettings struct {
+	// Log level of each subsystem.
+	LogLevels map[string]string `json:"log_levels"`
+
+	// True if all network traffic is being dumped to stdout.
+	PacketDump bool `json:"packet_dump"`
+
+	// IPX addresses of clients whose packets are being captured.
+	Captures []string `json:"captures"`
+}
+
+// AddressEntry describes a node address known to the server, either as a
+// connected client or as a host seen on a bridged LAN.
+type AddressEntry struct {
+	Addr string `json:"addr"`
+
+	// How the node is connected: "dosbox" for clients, otherwise the
+	// name of the bridged device it was seen on.
+	Transport string `json:"transport"`
+
+	// UDP address of the client, for DOSBox clients.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// True if the same address is also known by another transport,
+	// which means that two nodes are using the same address.
+	Conflict bool `json:"conflict"`
+}
+
+var (
+	_ = (http.Handler)(&Handler{})
+)
+
+// New creates a new Handler that administers the given server. Requests must
+// include an "Authorization: Bearer <token>" header with the given token.
+func New(s *server.Server, token string) *Handler {
+	h := &Handler{
+		server: s,
+		token:  token,
+		mux:    http.NewServeMux(),
+
+		bridges:  map[string]*bridge.Bridge{},
+		captures: map[ipx.Addr]*os.File{},
+	}
+	h.mux.HandleFunc("/admin/addresses", h.handleAddresses)
+	h.mux.HandleFunc("/admin/clients", h.handleClients)
+	h.mux.HandleFunc("/admin/capabilities", h.handleCapabilities)
+	h.mux.HandleFunc("/admin/scanners", h.handleScanners)
+	h.mux.HandleFunc("/admin/alerts", h.handleAlerts)
+	h.mux.HandleFunc("/admin/quarantine", h.handleQuarantine(true))
+	h.mux.HandleFunc("/admin/release", h.handleQuarantine(false))
+	h.mux.HandleFunc("/admin/similar", h.handleSimilar)
+	h.mux.HandleFunc("/admin/rooms", h.handleRooms)
+	h.mux.HandleFunc("/admin/move", h.handleMove)
+	h.mux.HandleFunc("/admin/room/settings", h.handleRoomSettings)
+	h.mux.HandleFunc("/admin/placement", h.handlePlacement)
+	h.mux.HandleFunc("/admin/latency", h.handleLatency)
+	h.mux.HandleFunc("/admin/forwarding", h.handleForwarding)
+	h.mux.HandleFunc("/admin/sessions", h.handleSessions)
+	h.mux.HandleFunc("/admin/session/lock", h.handleSessionLock(true))
+	h.mux.HandleFunc("/admin/session/unlock", h.handleSessionLock(false))
+	h.mux.HandleFunc("/admin/drain", h.handleDrain(true))
+	h.mux.HandleFunc("/admin/undrain", h.handleDrain(false))
+	h.mux.HandleFunc("/admin/recordings", h.handleRecordings)
+	h.mux.HandleFunc("/admin/record/start", h.handleRecord(true))
+	h.mux.HandleFunc("/admin/record/stop", h.handleRecord(false))
+	h.mux.HandleFunc("/admin/traces", h.handleTraces)
+	h.mux.HandleFunc("/admin/trace", h.handleTrace)
+	h.mux.HandleFunc("/admin/trace/start", h.handleTraceStart)
+	h.mux.HandleFunc("/admin/trace/stop", h.handleTraceStop)
+	h.mux.HandleFunc("/admin/tiers", h.handleTiers)
+	h.mux.HandleFunc("/admin/tier", h.handleTier)
+	h.mux.HandleFunc("/admin/bans", h.handleBans)
+	h.mux.HandleFunc("/admin/ban", h.handleBan)
+	h.mux.HandleFunc("/admin/unban", h.handleUnban)
+	h.mux.HandleFunc("/admin/debug", h.handleDebug)
+	h.mux.HandleFunc("/admin/debug/log", h.handleLogLevel)
+	h.mux.HandleFunc("/admin/debug/dump", h.handlePacketDump)
+	h.mux.HandleFunc("/admin/debug/capture/start", h.handleCaptureStart)
+	h.mux.HandleFunc("/admin/debug/capture/stop", h.handleCaptureStop)
+	return h
+}
+
+// AddBridge adds a bridge whose learned LAN addresses are included in the
+// address table. The given device name identifies the bridge.
+func (h *Handler) AddBridge(device string, b *bridge.Bridge) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.bridges[device] = b
+}
+
+// SetNetwork sets the network of the default room, whose forwarding rules
+// can be inspected through the admin API. Other rooms use the same rules,
+// but their counts are not available.
+func (h *Handler) SetNetwork(n *virtual.Network) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.network = n
+}
+
+// SetRecorder sets the match recorder controlled through the admin API.
+func (h *Handler) SetRecorder(r *recorder.Recorder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.recorder = r
+}
+
+// SetBans sets the ban list controlled through the admin API.
+func (h *Handler) SetBans(b *ban.Store) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.bans = b
+}
+
+// getBans returns the ban list, writing an error response if none has been
+// set.
+func (h *Handler) getBans(w http.ResponseWriter) *ban.Store {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.bans == nil {
+		http.Error(w, "bans are not enabled", http.StatusNotFound)
+	}
+	return h.bans
+}
+
+// SetPacketDump sets the packet dumper controlled through the admin API.
+func (h *Handler) SetPacketDump(d PacketDumper) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.packetDump = d
+}
+
+// SetCaptureDir sets the directory that pcap files of the packets exchanged
+// with individual clients are written to. Capturing clients through the
+// admin API is only possible if this is set.
+func (h *Handler) SetCaptureDir(dir string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.captureDir = dir
+}
+
+// getRecorder returns the match recorder, writing an error response if none
+// has been set.
+func (h *Handler) getRecorder(w http.ResponseWriter) *recorder.Recorder {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.recorder == nil {
+		http.Error(w, "match recording is not enabled", http.StatusNotFound)
+	}
+	return h.recorder
+}
+
+// addresses returns every address known to the server, with conflicting
+// entries marked.
+func (h *Handler) addresses() []AddressEntry {
+	result := []AddressEntry{}
+	for _, c := range h.server.ClientStats() {
+		result = append(result, AddressEntry{
+			Addr:      c.IPXAddr,
+			Transport: "dosbox",
+			Endpoint:  c.Addr,
+			FirstSeen: c.ConnectTime,
+			LastSeen:  c.LastReceiveTime,
+		})
+	}
+	h.mu.Lock()
+	for device, b := range h.bridges {
+		for _, e := range b.Addresses() {
+			// Addresses on the virtual side of the bridge are
+			// the clients and services already listed.
+			if !e.LAN {
+				continue
+			}
+			result = append(result, AddressEntry{
+				Addr:      e.Addr,
+				Transport: device,
+				FirstSeen: e.FirstSeen,
+				LastSeen:  e.LastSeen,
+			})
+		}
+	}
+	h.mu.Unlock()
+	counts := map[string]int{}
+	for _, e := range result {
+		counts[e.Addr]++
+	}
+	for i := range result {
+		result[i].Conflict = counts[result[i].Addr] > 1
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Addr < result[j].Addr
+	})
+	return result
+}
+
+// ServeHTTP checks that the request is authenticated, then dispatches it to
+// the appropriate handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	want := "Bearer " + h.token
+	got := r.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// parseAddr parses the "addr" parameter of a request as an IPX address.
+func parseAddr(r *http.Request) (ipx.Addr, error) {
+	return ipx.ParseAddr(r.FormValue("addr"))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleAddresses lists all known node addresses, with counts of the total
+// number of entries and of conflicting entries.
+func (h *Handler) handleAddresses(w http.ResponseWriter, r *http.Request) {
+	entries := h.addresses()
+	conflicts := 0
+	for _, e := range entries {
+		if e.Conflict {
+			conflicts++
+		}
+	}
+	writeJSON(w, struct {
+		Entries   int            `json:"entries"`
+		Conflicts int            `json:"conflicts"`
+		Addresses []AddressEntry `json:"addresses"`
+	}{len(entries), conflicts, entries})
+}
+
+// handleClients lists all connected clients.
+func (h *Handler) handleClients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.server.ClientStats())
+}
+
+// handleScanners lists hosts that are being tarpitted for sending
+// non-protocol traffic.
+func (h *Handler) handleScanners(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.server.ScanSources())
+}
+
+// handleAlerts lists the most recent alerts about suspicious behavior by
+// clients, oldest first.
+func (h *Handler) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.server.Alerts())
+}
+
+// handleQuarantine returns a handler that quarantines or releases the client
+// with the address given in the "addr" parameter.
+func (h *Handler) handleQuarantine(quarantined bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		addr, err := parseAddr(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch err := h.server.SetQuarantined(addr, quarantined); {
+		case err == server.UnknownClientError:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]bool{"quarantined": quarantined})
+	}
+}
+
+// handleSimilar lists clients that are likely to be the same as the client
+// with the address given in the "addr" parameter, but connected from a
+// different IP address.
+func (h *Handler) handleSimilar(w http.ResponseWriter, r *http.Request) {
+	addr, err := parseAddr(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	matches, err := h.server.SimilarClients(addr)
+	switch {
+	case err == server.UnknownClientError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, matches)
+}
+
+// handleRooms lists the names of all rooms.
+func (h *Handler) handleRooms(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.server.Rooms())
+}
+
+// handleRoomSettings sets the password, player cap and moderator token of
+// the room given in the "room" parameter, from the "password", "max_players"
+// and "moderator_token" parameters. Empty parameters clear the setting.
+func (h *Handler) handleRoomSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	rs := server.RoomSettings{
+		Password:       r.FormValue("password"),
+		ModeratorToken: r.FormValue("moderator_token"),
+	}
+	if v := r.FormValue("max_players"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid max_players", http.StatusBadRequest)
+			return
+		}
+		rs.MaxPlayers = n
+	}
+	room := r.FormValue("room")
+	if err := h.server.SetRoomSettings(room, rs); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"room": room, "settings": rs})
+}
+
+// handleMove moves the client with the address given in the "addr" parameter
+// into the room given in the "room" parameter.
+func (h *Handler) handleMove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	addr, err := parseAddr(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	room := r.FormValue("room")
+	switch err := h.server.MoveClient(addr, room); {
+	case err == server.UnknownClientError, err == server.UnknownRoomError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == server.RoomNotAllowedError:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, map[string]string{"room": room})
+}
+
+// handleCapabilities shows which capabilities each connected client has.
+func (h *Handler) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.server.Capabilities())
+}
+
+// handlePlacement lists where the games in each room would best be hosted:
+// on this server, or on the satellite server closest to most of the players
+// in the room. Games cannot be moved automatically, because DOSBox clients
+// cannot be told to connect elsewhere; operators can use this to decide
+// which server a community should meet on.
+func (h *Handler) handlePlacement(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.server.Placements())
+}
+
+// handleForwarding lists the forwarding rules of the default room's network
+// in the order that they are checked, with the number of packets whose
+// delivery each rule has decided. Only packets in the default room are
+// counted, which the response says in its "room" field.
+func (h *Handler) handleForwarding(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	n := h.network
+	h.mu.Unlock()
+	if n == nil {
+		http.Error(w, "forwarding rules not available", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"room":  server.DefaultRoom,
+		"rules": n.Policy(),
+	})
+}
+
+// handleLatency measures the latency of the path between the clients whose
+// IPX addresses are given in the "a" and "b" parameters. It blocks until
+// the clients have answered, for up to a few seconds.
+func (h *Handler) handleLatency(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	a, err := ipx.ParseAddr(r.FormValue("a"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := ipx.ParseAddr(r.FormValue("b"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := h.server.MeasurePath(a, b)
+	switch {
+	case err == server.UnknownClientError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == server.ProbeTimeoutError:
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// handleSessions lists the game sessions in progress.
+func (h *Handler) handleSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.server.Sessions())
+}
+
+// handleSessionLock returns a handler that locks or unlocks the game session
+// on the socket given in the "socket" parameter in the room given in the
+// "room" parameter. Unlocking lets late joiners into a locked session.
+func (h *Handler) handleSessionLock(locked bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		socket, err := ipx.ParseSocket(r.FormValue("socket"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch err := h.server.SetSessionLocked(r.FormValue("room"), uint16(socket), locked); {
+		case err == server.UnknownSessionError:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]bool{"locked": locked})
+	}
+}
+
+// handleRecordings lists all match recordings, including those in progress.
+func (h *Handler) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	if rec := h.getRecorder(w); rec != nil {
+		writeJSON(w, rec.Recordings())
+	}
+}
+
+// handleRecord returns a handler that starts or stops recording the room
+// given in the "room" parameter.
+func (h *Handler) handleRecord(start bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		rec := h.getRecorder(w)
+		if rec == nil {
+			return
+		}
+		var recording recorder.Recording
+		var err error
+		if start {
+			recording, err = rec.Start(r.FormValue("room"))
+		} else {
+			recording, err = rec.Stop(r.FormValue("room"))
+		}
+		switch {
+		case err == recorder.UnknownRoomError:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err == recorder.AlreadyRecordingError, err == recorder.NotRecordingError:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, recording)
+	}
+}
+
+// handleDrain returns a handler that starts or stops draining the server.
+// While the server is draining it does not accept new clients, but clients
+// that are already connected can carry on, so that games are not cut off
+// mid-match. The response includes the number of clients still connected.
+func (h *Handler) handleDrain(drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		h.server.SetRegistrationClosed(drain)
+		writeJSON(w, struct {
+			Draining bool `json:"draining"`
+			Clients  int  `json:"clients"`
+		}{drain, h.server.Stats().Clients})
+	}
+}
+
+// handleTraces lists the IP addresses that are being traced.
+func (h *Handler) handleTraces(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.server.Traces())
+}
+
+// handleTrace returns the message exchange recorded so far with clients
+// from the IP address given in the "ip" parameter.
+func (h *Handler) handleTrace(w http.ResponseWriter, r *http.Request) {
+	t, err := h.server.Trace(r.FormValue("ip"))
+	switch {
+	case err == server.UnknownTraceError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, t)
+}
+
+// handleTraceStart starts tracing clients that connect from the IP address
+// given in the "ip" parameter. This is intended for diagnosing problems
+// with a particular player's connection: the trace shows the registration,
+// pings and packets exchanged with the player, and what the server did
+// with them.
+func (h *Handler) handleTraceStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := r.FormValue("ip")
+	if err := h.server.StartTrace(ip); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]string{"tracing": ip})
+}
+
+// handleTraceStop stops tracing the IP address given in the "ip" parameter,
+// returning the recorded trace.
+func (h *Handler) handleTraceStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	t, err := h.server.StopTrace(r.FormValue("ip"))
+	switch {
+	case err == server.UnknownTraceError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, t)
+}
+
+// handleTiers lists the trust tiers that have been assigned to IP addresses
+// through the admin API. Tiers assigned by IP range are not included.
+func (h *Handler) handleTiers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.server.Tiers())
+}
+
+// handleTier assigns clients from the IP address given in the "ip" parameter
+// to the trust tier given in the "tier" parameter: "trusted", "normal" or
+// "restricted". If the tier is empty, the assignment is removed.
+func (h *Handler) handleTier(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	ip, tier := r.FormValue("ip"), r.FormValue("tier")
+	if err := h.server.SetTier(ip, tier); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]string{"ip": ip, "tier": tier})
+}
+
+// handleBans lists all bans that have not expired.
+func (h *Handler) handleBans(w http.ResponseWriter, r *http.Request) {
+	if bans := h.getBans(w); bans != nil {
+		writeJSON(w, bans.List())
+	}
+}
+
+// handleBan adds a ban. The "kind" parameter is "cidr", "ipx" or
+// "fingerprint" and "value" is what to ban. "reason" and "admin" record why
+// the ban was issued and by whom. If "duration" is given (eg. "24h"), the
+// ban expires after that long; otherwise it is permanent. Connected clients
+// that match the ban are disconnected.
+func (h *Handler) handleBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	bans := h.getBans(w)
+	if bans == nil {
+		return
+	}
+	b := ban.Ban{
+		Kind:     r.FormValue("kind"),
+		Value:    r.FormValue("value"),
+		Reason:   r.FormValue("reason"),
+		IssuedBy: r.FormValue("admin"),
+	}
+	if d := r.FormValue("duration"); d != "" {
+		duration, err := time.ParseDuration(d)
+		if err != nil || duration <= 0 {
+			http.Error(w, fmt.Sprintf("invalid duration %q", d), http.StatusBadRequest)
+			return
+		}
+		expires := time.Now().Add(duration)
+		b.Expires = &expires
+	}
+	b, err := bans.Add(b)
+	switch err.(type) {
+	case nil:
+	case *ban.InvalidBanError:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.server.EnforceBans()
+	writeJSON(w, b)
+}
+
+// handleUnban removes the ban with the ID given in the "id" parameter.
+func (h *Handler) handleUnban(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	bans := h.getBans(w)
+	if bans == nil {
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch b, err := bans.Remove(id); {
+	case err == ban.UnknownBanError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, b)
+	}
+}
+
+// debugSettings returns the current debugging settings.
+func (h *Handler) debugSettings() DebugSettings {
+	result := DebugSettings{
+		LogLevels: map[string]string{},
+		Captures:  h.server.Captures(),
+	}
+	for name, level := range debuglog.Levels() {
+		result.LogLevels[name] = level.String()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.packetDump != nil {
+		result.PacketDump = h.packetDump.Enabled()
+	}
+	return result
+}
+
+// handleDebug returns the current debugging settings.
+func (h *Handler) handleDebug(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.debugSettings())
+}
+
+// handleLogLevel sets the log level of the subsystem given in the
+// "subsystem" parameter to the level given in the "level" parameter, which
+// is one of "quiet", "normal" or "verbose".
+func (h *Handler) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	level, err := debuglog.ParseLevel(r.FormValue("level"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch err := debuglog.SetLevel(r.FormValue("subsystem"), level); {
+	case err == debuglog.UnknownSubsystemError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, h.debugSettings())
+}
+
+// handlePacketDump turns the dump of all network traffic to stdout on or
+// off, according to the "enabled" parameter.
+func (h *Handler) handlePacketDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	d := h.packetDump
+	h.mu.Unlock()
+	if d == nil {
+		http.Error(w, "packet dumping is not available", http.StatusNotFound)
+		return
+	}
+	d.SetEnabled(enabled)
+	writeJSON(w, h.debugSettings())
+}
+
+// handleCaptureStart starts writing the packets exchanged with the client
+// with the address given in the "addr" parameter to a new pcap file in the
+// capture directory. The response includes the name of the file.
+func (h *Handler) handleCaptureStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	addr, err := parseAddr(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.captureDir == "" {
+		http.Error(w, "client capture is not enabled", http.StatusNotFound)
+		return
+	}
+	h.pruneCaptures()
+	if _, ok := h.captures[addr]; ok {
+		http.Error(w, "client is already being captured", http.StatusConflict)
+		return
+	}
+	name := fmt.Sprintf("%x-%s.pcap", addr[:], time.Now().Format("20060102-150405"))
+	f, err := os.Create(filepath.Join(h.captureDir, name))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cw, err := capture.NewWriter(f)
+	if err == nil {
+		// The server closes the file if the client leaves.
+		err = h.server.StartCapture(addr, captureFile{cw, f})
+	}
+	switch {
+	case err == server.UnknownClientError:
+		f.Close()
+		os.Remove(f.Name())
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		f.Close()
+		os.Remove(f.Name())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.captures[addr] = f
+	writeJSON(w, map[string]string{"file": name})
+}
+
+// captureFile is a pcap writer that closes its file when the capture ends.
+type captureFile struct {
+	*capture.Writer
+	f *os.File
+}
+
+func (c captureFile) Close() error {
+	return c.f.Close()
+}
+
+// pruneCaptures forgets the files of captures that the server has ended
+// because the client left; the server has already closed them. The caller
+// must hold the mutex.
+func (h *Handler) pruneCaptures() {
+	active := map[string]bool{}
+	for _, addr := range h.server.Captures() {
+		active[addr] = true
+	}
+	for addr := range h.captures {
+		if !active[addr.String()] {
+			delete(h.captures, addr)
+		}
+	}
+}
+
+// handleCaptureStop stops capturing the client with the address given in the
+// "addr" parameter and closes its pcap file.
+func (h *Handler) handleCaptureStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	addr, err := parseAddr(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pruneCaptures()
+	f, ok := h.captures[addr]
+	if !ok {
+		http.Error(w, server.NotCapturingError.Error(), http.StatusNotFound)
+		return
+	}
+	delete(h.captures, addr)
+	// If the client has just left, the server has already closed the
+	// file.
+	if h.server.StopCapture(addr) == nil {
+		if err := f.Close(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, map[string]string{"file": filepath.Base(f.Name())})
+}
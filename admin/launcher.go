@@ -0,0 +1,69 @@
+package admin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/fragglet/ipxbox/server"
+)
+
+// SetPublicAddr sets the host name and UDP port that DOSBox clients use to
+// connect to the server, for the configuration served at /rooms/dosbox.conf.
+// If host is empty, the host name the HTTP request was sent to is used.
+func (h *RoomHandler) SetPublicAddr(host string, port int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.publicHost, h.publicPort = host, port
+}
+
+// roomExists returns true if the server has a room with the given name.
+func (h *RoomHandler) roomExists(room string) bool {
+	for _, name := range h.server.Rooms() {
+		if name == room {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDOSBoxConfig returns a DOSBox configuration snippet that connects to
+// the server, for launchers and websites to hand to players. If the "room"
+// parameter names a room with its own port or address, the snippet connects
+// straight to it; otherwise it includes instructions for joining the room.
+func (h *RoomHandler) handleDOSBoxConfig(w http.ResponseWriter, r *http.Request) {
+	room := r.FormValue("room")
+	if room == "" {
+		room = server.DefaultRoom
+	}
+	if !h.roomExists(room) {
+		http.Error(w, server.UnknownRoomError.Error(), http.StatusNotFound)
+		return
+	}
+	h.mu.Lock()
+	host, port := h.publicHost, h.publicPort
+	h.mu.Unlock()
+	if host == "" {
+		host = r.Host
+		if hostOnly, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = hostOnly
+		}
+	}
+	roomPort, hasPort := h.server.RoomPort(room)
+	if hasPort {
+		port = roomPort
+	}
+	roomAddr, hasAddr := h.server.RoomAddr(room)
+	if hasAddr {
+		host = roomAddr.String()
+	}
+	direct := hasPort || hasAddr || room == server.DefaultRoom
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "[ipx]\nipx=true\n\n[autoexec]\n")
+	fmt.Fprintf(w, "ipxnet connect %s %d\n", host, port)
+	if !direct {
+		fmt.Fprintf(w, "# After connecting, join room %q by sending a POST request to\n", room)
+		fmt.Fprintf(w, "# /rooms/join with the room name and password, and the IPX address\n")
+		fmt.Fprintf(w, "# shown by \"ipxnet status\".\n")
+	}
+}
@@ -0,0 +1,231 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/server"
+)
+
+// RoomHandler is an http.Handler that serves the room API, which lets
+// players and room moderators manage a room without the admin token.
+// Players join a room by giving its password, and moderators authenticate
+// with the room's moderator token, which only gives control over that room.
+type RoomHandler struct {
+	server *server.Server
+	mux    *http.ServeMux
+
+	mu             sync.Mutex
+	publicHost     string
+	publicPort     int
+	directoryToken string
+	directoryRate  int
+	windowStart    time.Time
+	requests       map[string]int
+
+	joinWindowStart time.Time
+	joinFailures    map[string]int
+}
+
+// Number of times each IP address may fail to join a room each minute.
+const maxJoinFailures = 10
+
+var (
+	_ = (http.Handler)(&RoomHandler{})
+)
+
+// NewRoomHandler creates a new RoomHandler for the rooms of the given server.
+func NewRoomHandler(s *server.Server) *RoomHandler {
+	h := &RoomHandler{
+		server:       s,
+		mux:          http.NewServeMux(),
+		joinFailures: map[string]int{},
+	}
+	h.mux.HandleFunc("/rooms/join", h.handleJoin)
+	h.mux.HandleFunc("/rooms/dosbox.conf", h.handleDOSBoxConfig)
+	h.mux.HandleFunc("/rooms/clients", h.moderator(h.handleClients))
+	h.mux.HandleFunc("/rooms/kick", h.moderator(h.handleKick))
+	return h
+}
+
+// EnableDirectory serves a directory of the rooms that players can join at
+// /rooms/directory, for launchers that offer matchmaking. If token is
+// non-empty, requests must include it as a bearer token; otherwise the
+// directory is public. Each IP address may make at most rate requests a
+// minute, unless rate is zero.
+func (h *RoomHandler) EnableDirectory(token string, rate int) {
+	h.mu.Lock()
+	h.directoryToken, h.directoryRate = token, rate
+	h.requests = map[string]int{}
+	h.mu.Unlock()
+	h.mux.HandleFunc("/rooms/directory", h.handleDirectory)
+}
+
+// allowDirectoryRequest checks whether a directory request from the given
+// IP address is within the rate limit, counting it if so.
+func (h *RoomHandler) allowDirectoryRequest(ip string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.directoryRate == 0 {
+		return true
+	}
+	if now.Sub(h.windowStart) >= time.Minute {
+		h.windowStart = now
+		h.requests = map[string]int{}
+	}
+	if h.requests[ip] >= h.directoryRate {
+		return false
+	}
+	h.requests[ip]++
+	return true
+}
+
+func (h *RoomHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// moderator wraps a handler so that it can only be used with the moderator
+// token of the room given in the "room" parameter.
+func (h *RoomHandler) moderator(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !h.server.CheckRoomModerator(r.FormValue("room"), token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		f(w, r)
+	}
+}
+
+// handleJoin moves the client with the IPX address given in the "addr"
+// parameter into the room given in the "room" parameter, if the "password"
+// parameter is the room's password. If the server creates rooms on demand,
+// an unknown room is created with that password. Each IP address may only
+// fail to join a room a few times a minute, so that passwords cannot be
+// guessed by brute force.
+func (h *RoomHandler) handleJoin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	if !h.allowJoinAttempt(host, now) {
+		http.Error(w, "too many failed attempts", http.StatusTooManyRequests)
+		return
+	}
+	addr, err := ipx.ParseAddr(r.FormValue("addr"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	room := r.FormValue("room")
+	err = h.server.JoinRoom(addr, room, r.FormValue("password"))
+	if err != nil {
+		h.joinFailed(host)
+	}
+	switch {
+	case err == server.WrongPasswordError:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case err == server.InvalidRoomNameError:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err == server.UnknownClientError, err == server.UnknownRoomError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == server.RoomNotAllowedError:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err == server.TooManyRoomsError:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"room": room, "addr": addr.String()})
+}
+
+// allowJoinAttempt returns true if the given IP address has not failed to
+// join a room too often recently.
+func (h *RoomHandler) allowJoinAttempt(ip string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Sub(h.joinWindowStart) >= time.Minute {
+		h.joinWindowStart = now
+		h.joinFailures = map[string]int{}
+	}
+	return h.joinFailures[ip] < maxJoinFailures
+}
+
+// joinFailed counts a failed attempt to join a room from the given IP
+// address.
+func (h *RoomHandler) joinFailed(ip string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.joinFailures[ip]++
+}
+
+// handleDirectory lists the rooms that players can join, with the number of
+// players in each and the game being played.
+func (h *RoomHandler) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	token := h.directoryToken
+	h.mu.Unlock()
+	if token != "" {
+		want := "Bearer " + token
+		got := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.allowDirectoryRequest(host, time.Now()) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	writeJSON(w, h.server.RoomDirectory())
+}
+
+// handleClients lists the clients in the room given in the "room" parameter.
+func (h *RoomHandler) handleClients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.server.RoomClients(r.FormValue("room")))
+}
+
+// handleKick removes the client with the address given in the "addr"
+// parameter from the room given in the "room" parameter.
+func (h *RoomHandler) handleKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	addr, err := parseAddr(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch err := h.server.KickFromRoom(r.FormValue("room"), addr); {
+	case err == server.UnknownClientError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, map[string]string{"kicked": addr.String()})
+}
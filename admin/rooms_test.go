@@ -0,0 +1,26 @@
+package admin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJoinAttemptLimit(t *testing.T) {
+	h := NewRoomHandler(nil)
+	now := time.Now()
+	for i := 0; i < maxJoinFailures; i++ {
+		if !h.allowJoinAttempt("192.0.2.1", now) {
+			t.Fatalf("attempt %d refused before the limit", i)
+		}
+		h.joinFailed("192.0.2.1")
+	}
+	if h.allowJoinAttempt("192.0.2.1", now) {
+		t.Errorf("attempt allowed after %d failures", maxJoinFailures)
+	}
+	if !h.allowJoinAttempt("192.0.2.2", now) {
+		t.Errorf("attempt from another address refused")
+	}
+	if !h.allowJoinAttempt("192.0.2.1", now.Add(time.Minute)) {
+		t.Errorf("attempt refused after the window ended")
+	}
+}
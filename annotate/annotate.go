@@ -0,0 +1,183 @@
+// Package annotate produces human-readable descriptions of IPX packets,
+// interpreting well-known higher-layer protocols such as SAP and RIP.
+package annotate
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// Well-known IPX socket numbers.
+const (
+	socketNCP     = 0x451
+	socketSAP     = 0x452
+	socketRIP     = 0x453
+	socketNetBIOS = 0x455
+)
+
+// sockets maps well-known socket numbers to the names of the protocols or
+// programs that use them.
+var sockets = map[uint16]string{
+	0x0002:        "ipxbox ping",
+	socketNCP:     "NCP",
+	socketSAP:     "SAP",
+	socketRIP:     "RIP",
+	socketNetBIOS: "NetBIOS",
+	0x0456:        "diagnostics",
+	0x0457:        "serialization",
+	0x8060:        "ipxbox print gateway",
+	0x8062:        "ipxbox announcements",
+	0x869c:        "Doom",
+}
+
+// sapServiceTypes maps SAP service type numbers to descriptions.
+var sapServiceTypes = map[uint16]string{
+	0x0004: "file server",
+	0x0007: "print server",
+	0x0047: "advertising print server",
+	0x0278: "directory server",
+	0xffff: "any",
+}
+
+// packetTypes maps IPX packet type numbers to names.
+var packetTypes = map[byte]string{
+	0:  "unknown",
+	1:  "RIP",
+	4:  "PEP",
+	5:  "SPX",
+	17: "NCP",
+	20: "NetBIOS broadcast",
+}
+
+// Describe returns a one-line description of the given IPX packet, or a
+// description of why it could not be decoded.
+func Describe(packet []byte) string {
+	var hdr ipx.Header
+	if err := hdr.UnmarshalBinary(packet); err != nil {
+		return fmt.Sprintf("malformed packet: %v", err)
+	}
+	payload := packet[30:]
+	result := fmt.Sprintf("%s -> %s, type %s, %d bytes",
+		hdr.Src, hdr.Dest, packetTypeName(hdr.PacketType), len(payload))
+	if detail := describePayload(&hdr, payload); detail != "" {
+		result += ": " + detail
+	} else if name := socketName(hdr.Dest.Socket, hdr.Src.Socket); name != "" {
+		result += ": " + name
+	}
+	return result
+}
+
+func packetTypeName(t byte) string {
+	if name, ok := packetTypes[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", t)
+}
+
+// SocketName returns the name of the protocol or program that uses the given
+// well-known socket number, or an empty string if it is not known.
+func SocketName(socket uint16) string {
+	return sockets[socket]
+}
+
+// socketName returns the name of a well-known socket used by a packet,
+// preferring the destination socket.
+func socketName(nums ...uint16) string {
+	for _, s := range nums {
+		if name, ok := sockets[s]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// describePayload interprets the payload of packets sent to well-known
+// sockets. It returns an empty string if the packet is not understood.
+func describePayload(hdr *ipx.Header, payload []byte) string {
+	switch hdr.Dest.Socket {
+	case socketSAP:
+		return describeSAP(payload)
+	case socketRIP:
+		return describeRIP(payload)
+	case socketNetBIOS:
+		return describeNetBIOS(payload)
+	}
+	return ""
+}
+
+func uint16At(data []byte, offset int) uint16 {
+	return uint16(data[offset])<<8 | uint16(data[offset+1])
+}
+
+func sapServiceName(t uint16) string {
+	if name, ok := sapServiceTypes[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type 0x%04x", t)
+}
+
+// describeSAP describes a Service Advertising Protocol packet.
+func describeSAP(payload []byte) string {
+	if len(payload) < 4 {
+		return "SAP, truncated"
+	}
+	op := uint16At(payload, 0)
+	switch op {
+	case 1, 3:
+		kind := "general"
+		if op == 3 {
+			kind = "nearest"
+		}
+		return fmt.Sprintf("SAP %s query for %s", kind, sapServiceName(uint16At(payload, 2)))
+	case 2, 4:
+		// Each entry is a 2 byte service type, 48 byte name, 12 byte
+		// address and 2 byte hop count.
+		var entries []string
+		for data := payload[2:]; len(data) >= 64; data = data[64:] {
+			name := string(bytes.TrimRight(data[2:50], "\x00"))
+			var addr ipx.HeaderAddr
+			addr.UnmarshalBinary(data[50:62])
+			entries = append(entries, fmt.Sprintf("%q (%s) at %s, %d hops",
+				name, sapServiceName(uint16At(data, 0)), addr, uint16At(data, 62)))
+		}
+		return fmt.Sprintf("SAP response: %s", strings.Join(entries, "; "))
+	}
+	return fmt.Sprintf("SAP operation %d", op)
+}
+
+// describeRIP describes a Routing Information Protocol packet.
+func describeRIP(payload []byte) string {
+	if len(payload) < 2 {
+		return "RIP, truncated"
+	}
+	op := "request"
+	if uint16At(payload, 0) == 2 {
+		op = "response"
+	}
+	// Each entry is a 4 byte network number, 2 byte hop count and 2
+	// byte tick count.
+	var routes []string
+	for data := payload[2:]; len(data) >= 8; data = data[8:] {
+		var n ipx.Network
+		copy(n[:], data[0:4])
+		routes = append(routes, fmt.Sprintf("%s %d hops %d ticks",
+			n, uint16At(data, 4), uint16At(data, 6)))
+	}
+	return fmt.Sprintf("RIP %s: %s", op, strings.Join(routes, ", "))
+}
+
+// describeNetBIOS describes a NetBIOS over IPX packet. The payload starts
+// with a list of eight network numbers that the packet has been routed
+// through, two control bytes, then a 16 byte name.
+func describeNetBIOS(payload []byte) string {
+	if len(payload) < 50 {
+		return "NetBIOS, truncated"
+	}
+	name := payload[34:50]
+	suffix := name[15]
+	return fmt.Sprintf("NetBIOS name %q <%02x>",
+		strings.TrimRight(string(name[:15]), " \x00"), suffix)
+}
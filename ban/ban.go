@@ -0,0 +1,244 @@
+// Package ban implements a persistent list of banned clients. A ban matches
+// a range of IP addresses, an IPX address or a client fingerprint, and may
+// expire. The list is saved as a JSON file whenever it changes, so that bans
+// survive restarts of the server.
+package ban
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// Kinds of ban.
+const (
+	// Value is an IP address or range in CIDR notation, eg.
+	// "192.0.2.0/24".
+	KindCIDR = "cidr"
+
+	// Value is an IPX address, eg. "02:11:22:33:44:55".
+	KindIPX = "ipx"
+
+	// Value is a client fingerprint, as shown in the server's client
+	// statistics.
+	KindFingerprint = "fingerprint"
+)
+
+// UnknownBanError is returned by Remove if there is no ban with the given
+// ID.
+var UnknownBanError = errors.New("unknown ban")
+
+// InvalidBanError is returned by Add if the ban is not valid, as opposed to
+// the list failing to save.
+type InvalidBanError struct {
+	Err error
+}
+
+func (e *InvalidBanError) Error() string {
+	return e.Err.Error()
+}
+
+// Ban describes a single ban.
+type Ban struct {
+	ID    int    `json:"id"`
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+
+	// Why the ban was issued, and by whom.
+	Reason   string `json:"reason"`
+	IssuedBy string `json:"issued_by"`
+
+	// When the ban was issued, and when it expires. A ban with no
+	// expiry time is permanent.
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// expired returns true if the ban has expired by the given time.
+func (b *Ban) expired(now time.Time) bool {
+	return b.Expires != nil && !now.Before(*b.Expires)
+}
+
+// normalize checks that the ban's value is valid for its kind, and converts
+// it to a canonical form.
+func (b *Ban) normalize() error {
+	switch b.Kind {
+	case KindCIDR:
+		if ip := net.ParseIP(b.Value); ip != nil {
+			if ip.To4() != nil {
+				b.Value += "/32"
+			} else {
+				b.Value += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(b.Value)
+		if err != nil {
+			return fmt.Errorf("invalid IP address or range %q", b.Value)
+		}
+		b.Value = n.String()
+	case KindIPX:
+		addr, err := ipx.ParseAddr(b.Value)
+		if err != nil {
+			return err
+		}
+		b.Value = addr.String()
+	case KindFingerprint:
+		if b.Value == "" {
+			return errors.New("empty fingerprint")
+		}
+	default:
+		return fmt.Errorf("invalid ban kind %q; valid kinds are cidr, ipx and fingerprint", b.Kind)
+	}
+	return nil
+}
+
+// matches returns true if the ban matches a client with the given IP
+// address, IPX address and fingerprint.
+func (b *Ban) matches(ip net.IP, addr ipx.Addr, fingerprint string) bool {
+	switch b.Kind {
+	case KindCIDR:
+		_, n, err := net.ParseCIDR(b.Value)
+		return err == nil && ip != nil && n.Contains(ip)
+	case KindIPX:
+		return addr != ipx.AddrNull && addr.String() == b.Value
+	case KindFingerprint:
+		return fingerprint != "" && fingerprint == b.Value
+	}
+	return false
+}
+
+// Store is a list of bans that is saved to a file. It is safe for
+// concurrent use.
+type Store struct {
+	path string
+
+	mu     sync.Mutex
+	bans   []Ban
+	nextID int
+}
+
+// Open opens the ban list saved in the given file. If the file does not
+// exist, the list starts out empty and the file is created when the first
+// ban is added.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, nextID: 1}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.bans); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, b := range s.bans {
+		if b.ID >= s.nextID {
+			s.nextID = b.ID + 1
+		}
+	}
+	return s, nil
+}
+
+// save writes the given list to the file, first discarding expired bans,
+// and if successful makes it the store's list. The list in memory is left
+// unchanged if the file cannot be written, so that it never holds changes
+// that would be lost on restart. The file is replaced atomically so that a
+// crash cannot leave it truncated.
+func (s *Store) save(bans []Ban, now time.Time) error {
+	unexpired := []Ban{}
+	for _, b := range bans {
+		if !b.expired(now) {
+			unexpired = append(unexpired, b)
+		}
+	}
+	data, err := json.MarshalIndent(unexpired, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.bans = unexpired
+	return nil
+}
+
+// Add adds a ban to the list and saves it. The ID and creation time are
+// filled in; the ban as stored is returned. An InvalidBanError is returned
+// if the ban is not valid.
+func (s *Store) Add(b Ban) (Ban, error) {
+	if err := b.normalize(); err != nil {
+		return Ban{}, &InvalidBanError{err}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	b.ID = s.nextID
+	b.Created = now
+	bans := append(append([]Ban{}, s.bans...), b)
+	if err := s.save(bans, now); err != nil {
+		return Ban{}, err
+	}
+	s.nextID++
+	return b, nil
+}
+
+// Remove removes the ban with the given ID and saves the list.
+func (s *Store) Remove(id int) (Ban, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, b := range s.bans {
+		if b.ID != id {
+			continue
+		}
+		bans := append(append([]Ban{}, s.bans[:i]...), s.bans[i+1:]...)
+		if err := s.save(bans, time.Now()); err != nil {
+			return Ban{}, err
+		}
+		return b, nil
+	}
+	return Ban{}, UnknownBanError
+}
+
+// List returns all bans that have not expired, ordered by ID.
+func (s *Store) List() []Ban {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	result := []Ban{}
+	for _, b := range s.bans {
+		if !b.expired(now) {
+			result = append(result, b)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// Banned checks whether a client with the given IP address, IPX address and
+// fingerprint is banned, returning the reason if it is. Values that are not
+// known can be left empty, in which case they match no bans.
+func (s *Store) Banned(ip net.IP, addr ipx.Addr, fingerprint string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, b := range s.bans {
+		if !b.expired(now) && b.matches(ip, addr, fingerprint) {
+			return b.Reason, true
+		}
+	}
+	return "", false
+}
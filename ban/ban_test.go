@@ -0,0 +1,186 @@
+package ban
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		kind, value string
+		want        string
+		ok          bool
+	}{
+		{KindCIDR, "192.0.2.7", "192.0.2.7/32", true},
+		{KindCIDR, "2001:db8::1", "2001:db8::1/128", true},
+		{KindCIDR, "192.0.2.7/24", "192.0.2.0/24", true},
+		{KindCIDR, "2001:db8::1/32", "2001:db8::/32", true},
+		{KindCIDR, "not an address", "", false},
+		{KindIPX, "02:AA:BB:CC:DD:EE", "02:aa:bb:cc:dd:ee", true},
+		{KindIPX, "02:aa", "", false},
+		{KindFingerprint, "abc123", "abc123", true},
+		{KindFingerprint, "", "", false},
+		{"nickname", "bob", "", false},
+	}
+	for _, test := range tests {
+		b := Ban{Kind: test.kind, Value: test.value}
+		err := b.normalize()
+		switch {
+		case test.ok && err != nil:
+			t.Errorf("%s ban %q: normalize failed: %v", test.kind, test.value, err)
+		case !test.ok && err == nil:
+			t.Errorf("%s ban %q: normalize succeeded, want error", test.kind, test.value)
+		case test.ok && b.Value != test.want:
+			t.Errorf("%s ban %q: normalized to %q, want %q", test.kind, test.value, b.Value, test.want)
+		}
+	}
+}
+
+func openStore(t *testing.T) *Store {
+	s, err := Open(filepath.Join(t.TempDir(), "bans.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return s
+}
+
+func addBan(t *testing.T, s *Store, b Ban) Ban {
+	b, err := s.Add(b)
+	if err != nil {
+		t.Fatalf("Add(%+v) failed: %v", b, err)
+	}
+	return b
+}
+
+func TestBanned(t *testing.T) {
+	s := openStore(t)
+	addBan(t, s, Ban{Kind: KindCIDR, Value: "192.0.2.0/24", Reason: "range"})
+	addBan(t, s, Ban{Kind: KindCIDR, Value: "2001:db8::1", Reason: "v6"})
+	addBan(t, s, Ban{Kind: KindIPX, Value: "02:11:22:33:44:55", Reason: "ipx"})
+	addBan(t, s, Ban{Kind: KindFingerprint, Value: "abc123", Reason: "fingerprint"})
+
+	ipxAddr, _ := ipx.ParseAddr("02:11:22:33:44:55")
+	otherIPX, _ := ipx.ParseAddr("02:11:22:33:44:66")
+	tests := []struct {
+		ip          string
+		addr        ipx.Addr
+		fingerprint string
+		want        string
+	}{
+		{"192.0.2.200", ipx.AddrNull, "", "range"},
+		{"192.0.3.1", ipx.AddrNull, "", ""},
+		{"2001:db8::1", ipx.AddrNull, "", "v6"},
+		{"2001:db8::2", ipx.AddrNull, "", ""},
+		{"", ipxAddr, "", "ipx"},
+		{"", otherIPX, "", ""},
+		{"", ipx.AddrNull, "abc123", "fingerprint"},
+		{"", ipx.AddrNull, "abc1234", ""},
+		{"198.51.100.1", otherIPX, "xyz", ""},
+	}
+	for _, test := range tests {
+		reason, banned := s.Banned(net.ParseIP(test.ip), test.addr, test.fingerprint)
+		if banned != (test.want != "") || reason != test.want {
+			t.Errorf("Banned(%q, %s, %q) = %q, %v; want %q", test.ip, test.addr, test.fingerprint, reason, banned, test.want)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := openStore(t)
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	addBan(t, s, Ban{Kind: KindFingerprint, Value: "old", Expires: &past})
+	current := addBan(t, s, Ban{Kind: KindFingerprint, Value: "new", Expires: &future})
+	if _, banned := s.Banned(nil, ipx.AddrNull, "old"); banned {
+		t.Errorf("expired ban still matches")
+	}
+	if _, banned := s.Banned(nil, ipx.AddrNull, "new"); !banned {
+		t.Errorf("unexpired ban does not match")
+	}
+	if got := s.List(); len(got) != 1 || got[0].ID != current.ID {
+		t.Errorf("List() = %+v, want only ban %d", got, current.ID)
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	expires := time.Now().Add(time.Hour).Round(0)
+	b1 := addBan(t, s, Ban{Kind: KindCIDR, Value: "192.0.2.1", Reason: "a", IssuedBy: "admin"})
+	b2 := addBan(t, s, Ban{Kind: KindIPX, Value: "02:11:22:33:44:55", Expires: &expires})
+	b3 := addBan(t, s, Ban{Kind: KindFingerprint, Value: "abc"})
+	if _, err := s.Remove(b2.ID); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := s.Remove(b2.ID); err != UnknownBanError {
+		t.Errorf("removing ban twice = %v, want UnknownBanError", err)
+	}
+
+	loaded, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open of saved list failed: %v", err)
+	}
+	got, want := loaded.List(), s.List()
+	for i := range got {
+		// Times lose their monotonic clock reading and location
+		// when saved.
+		got[i].Created = got[i].Created.UTC()
+		want[i].Created = want[i].Created.UTC().Round(0)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %+v, want %+v", got, want)
+	}
+	if len(got) != 2 || got[0].ID != b1.ID || got[1].ID != b3.ID {
+		t.Errorf("loaded bans %+v, want %d and %d", got, b1.ID, b3.ID)
+	}
+	// IDs of removed bans are not reused.
+	if b := addBan(t, loaded, Ban{Kind: KindFingerprint, Value: "def"}); b.ID <= b3.ID {
+		t.Errorf("new ban has ID %d, want more than %d", b.ID, b3.ID)
+	}
+}
+
+func TestInvalidBan(t *testing.T) {
+	s := openStore(t)
+	_, err := s.Add(Ban{Kind: KindCIDR, Value: "nonsense"})
+	if _, ok := err.(*InvalidBanError); !ok {
+		t.Errorf("Add of invalid ban = %v, want InvalidBanError", err)
+	}
+}
+
+// TestSaveFailure checks that the list in memory is unchanged when it
+// cannot be saved.
+func TestSaveFailure(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(filepath.Join(dir, "bans.json"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	b := addBan(t, s, Ban{Kind: KindFingerprint, Value: "abc"})
+
+	// The temporary file cannot be written if a directory is in the way.
+	if err := os.Mkdir(filepath.Join(dir, "bans.json.tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Remove(b.ID); err == nil {
+		t.Fatalf("Remove succeeded when the list could not be saved")
+	}
+	if _, banned := s.Banned(nil, ipx.AddrNull, "abc"); !banned {
+		t.Errorf("ban was removed from memory although it was not saved")
+	}
+	_, err = s.Add(Ban{Kind: KindFingerprint, Value: "def"})
+	if _, ok := err.(*InvalidBanError); err == nil || ok {
+		t.Errorf("Add when the list could not be saved = %v, want an I/O error", err)
+	}
+	if _, banned := s.Banned(nil, ipx.AddrNull, "def"); banned {
+		t.Errorf("ban was added to memory although it was not saved")
+	}
+}
@@ -4,12 +4,106 @@ package bridge
 import (
 	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/fragglet/ipxbox/debuglog"
+	"github.com/fragglet/ipxbox/drop"
 	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/validate"
 )
 
-func copyPackets(in io.ReadCloser, out io.WriteCloser) {
-	localAddresses := map[ipx.Addr]bool{}
+var logger = debuglog.New("bridge")
+
+// Config contains configuration parameters for a bridge.
+type Config struct {
+	// Addresses are forgotten if nothing is received from them for
+	// this amount of time.
+	MaxAge time.Duration
+
+	// Maximum number of addresses in the learning table. When the table
+	// is full, the least recently seen address is forgotten.
+	MaxAddresses int
+
+	// If non-nil, controls which broadcast packets cross the bridge.
+	Filter *Filter
+
+	// Controls what happens when a node on the LAN uses the same
+	// address as a node on the virtual network.
+	ConflictPolicy ConflictPolicy
+
+	// If non-nil, this is called when an address conflict is detected.
+	// It is called at most once per address every MaxAge.
+	OnConflict func(addr ipx.Addr)
+
+	// If non-nil, broadcasts from the LAN that another bridge sharing
+	// the same Dedup has just forwarded are dropped.
+	Dedup *Dedup
+
+	// If non-nil, packets from the LAN that fail its checks are
+	// dropped before they reach the virtual network.
+	Validator *validate.Validator
+}
+
+// ConflictPolicy specifies how a bridge resolves address conflicts, where
+// a host on the LAN uses the same address as a node on the virtual network.
+type ConflictPolicy int
+
+const (
+	// PreferLocal keeps the node on the virtual network; packets from
+	// the conflicting LAN host are dropped.
+	PreferLocal ConflictPolicy = iota
+
+	// PreferRemote keeps the host on the LAN; packets from the node on
+	// the virtual network are dropped. OnConflict can be used to
+	// disconnect the node so that it reconnects with a new address.
+	PreferRemote
+)
+
+var DefaultConfig = &Config{
+	MaxAge:       5 * time.Minute,
+	MaxAddresses: 1024,
+}
+
+// Bridge ports.
+const (
+	portVirtual = iota
+	portLAN
+)
+
+// portDirections maps destination ports to the direction of packets sent
+// to them.
+var portDirections = map[int]Direction{
+	portVirtual: In,
+	portLAN:     Out,
+}
+
+// resolveConflict is called when a packet arrives from the given port with a
+// source address that is known to be on the other port. It returns true if
+// the packet should be accepted.
+func (b *Bridge) resolveConflict(addr ipx.Addr, from int, now time.Time) bool {
+	b.mu.Lock()
+	last, ok := b.conflicts[addr]
+	report := !ok || now.Sub(last) > b.config.MaxAge
+	if report {
+		b.conflicts[addr] = now
+	}
+	b.mu.Unlock()
+	if report {
+		atomic.AddUint64(&b.numConflicts, 1)
+		logger.Printf("bridge: address %s is in use both on the LAN and on the virtual network", addr)
+		if b.config.OnConflict != nil {
+			b.config.OnConflict(addr)
+		}
+	}
+	if b.config.ConflictPolicy == PreferRemote {
+		return from == portLAN
+	}
+	return from == portVirtual
+}
+
+func (b *Bridge) copyPackets(from, to int, in io.ReadCloser, out io.WriteCloser) {
+	cfg, t := b.config, b.table
 	for {
 		buf := make([]byte, 1500)
 		n, err := in.Read(buf)
@@ -20,14 +114,58 @@ func copyPackets(in io.ReadCloser, out io.WriteCloser) {
 
 		var hdr ipx.Header
 		if err := hdr.UnmarshalBinary(buf); err != nil {
+			b.drops.Drop(drop.Malformed, "%v", err)
 			continue
 		}
-		// Remember every address we see from the input device, and
-		// don't copy packets if the destination is on the input device.
-		localAddresses[hdr.Src.Addr] = true
-		if localAddresses[hdr.Dest.Addr] {
-			continue
+		now := time.Now()
+		if from == portLAN {
+			if r, check, ok := cfg.Validator.Validate(hdr.Src.Addr.String(), &hdr, buf, now); !ok {
+				b.drops.Drop(r, "from %s: failed %s", hdr.Src.Addr, check)
+				continue
+			}
+		}
+		// If the source address is known to be on the other side
+		// of the bridge, either this is a packet we forwarded
+		// ourselves that has come back (eg. because two bridged
+		// interfaces are attached to the same LAN) and must be
+		// dropped so it doesn't loop forever, or two nodes are
+		// using the same address.
+		if port, ok := t.lookup(hdr.Src.Addr, now); ok && port != from {
+			if b.echoes.contains(buf, now) {
+				b.drops.Drop(drop.Echo, "from %s", hdr.Src.Addr)
+				continue
+			}
+			if !b.resolveConflict(hdr.Src.Addr, from, now) {
+				b.drops.Drop(drop.Conflict, "from %s", hdr.Src.Addr)
+				continue
+			}
+		}
+		t.learn(hdr.Src.Addr, from, now)
+		if hdr.IsBroadcast() {
+			if cfg.Filter != nil && !cfg.Filter.allow(portDirections[to], &hdr) {
+				b.drops.Drop(drop.Filtered, "%s -> %s", hdr.Src, hdr.Dest)
+				continue
+			}
+			if cfg.Dedup != nil && to == portVirtual && cfg.Dedup.duplicate(buf, now) {
+				b.drops.Drop(drop.Duplicate, "from %s", hdr.Src.Addr)
+				continue
+			}
+		} else {
+			port, ok := t.lookup(hdr.Dest.Addr, now)
+			switch {
+			case ok && port != to:
+				// Destination is on the port the packet
+				// came from.
+				b.drops.Drop(drop.NotForwarded, "to %s", hdr.Dest.Addr)
+				continue
+			case !ok && to == portLAN:
+				// Unicast to an address never seen on
+				// the LAN; don't leak it onto the LAN.
+				b.drops.Drop(drop.NotForwarded, "to %s", hdr.Dest.Addr)
+				continue
+			}
 		}
+		b.echoes.add(buf, now)
 		out.Write(buf)
 	}
 	in.Close()
@@ -36,19 +174,91 @@ func copyPackets(in io.ReadCloser, out io.WriteCloser) {
 
 // Run implements an IPX bridge, copying IPX packets from in1 to out2 and from
 // in2 to out1. Copying will stop if an error occurs (eg. if one of the inputs
-// is closed) and all the devices will be closed.
+// is closed) and all the devices will be closed. DefaultConfig is used for
+// the learning table; see RunWithConfig.
 func Run(in1 io.ReadCloser, out1 io.WriteCloser, in2 io.ReadCloser, out2 io.WriteCloser) {
+	RunWithConfig(DefaultConfig, in1, out1, in2, out2)
+}
+
+// RunWithConfig is like Run but allows the bridge's learning table to be
+// configured. in1 and out1 are the virtual network side of the bridge; in2
+// and out2 are the physical LAN side. Unicast packets are only sent to the
+// LAN if their destination address has been seen there recently.
+//
+// Multiple interfaces can be attached to the same virtual network by
+// running a bridge for each one, using a separate tap for each. The
+// virtual network then acts as a switch between the interfaces.
+func RunWithConfig(cfg *Config, in1 io.ReadCloser, out1 io.WriteCloser, in2 io.ReadCloser, out2 io.WriteCloser) {
+	New(cfg).Run(in1, out1, in2, out2)
+}
+
+// Bridge is an IPX bridge whose learning table can be inspected while it
+// is running.
+type Bridge struct {
+	// Accessed atomically; kept first to ensure 64-bit alignment.
+	numConflicts uint64
+
+	config *Config
+	table  *table
+	echoes *echoCache
+	drops  *drop.Counter
+
+	mu        sync.Mutex
+	conflicts map[ipx.Addr]time.Time
+}
+
+// AddressEntry describes an address in a bridge's learning table.
+type AddressEntry struct {
+	Addr string `json:"addr"`
+
+	// True if the address was seen on the LAN side of the bridge, false
+	// if it was seen on the virtual network side.
+	LAN bool `json:"lan"`
+
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// New creates a new Bridge with the given configuration.
+func New(cfg *Config) *Bridge {
+	return &Bridge{
+		config:    cfg,
+		table:     newTable(cfg.MaxAge, cfg.MaxAddresses),
+		echoes:    newEchoCache(echoWindow),
+		drops:     drop.NewCounter("bridge"),
+		conflicts: map[ipx.Addr]time.Time{},
+	}
+}
+
+// Run runs the bridge; see RunWithConfig.
+func (b *Bridge) Run(in1 io.ReadCloser, out1 io.WriteCloser, in2 io.ReadCloser, out2 io.WriteCloser) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
-		copyPackets(in1, out2)
+		b.copyPackets(portVirtual, portLAN, in1, out2)
 		in2.Close()
 		wg.Done()
 	}()
 	go func() {
-		copyPackets(in2, out1)
+		b.copyPackets(portLAN, portVirtual, in2, out1)
 		in1.Close()
 		wg.Done()
 	}()
 	wg.Wait()
 }
+
+// Conflicts returns the number of address conflicts that have been detected.
+func (b *Bridge) Conflicts() uint64 {
+	return atomic.LoadUint64(&b.numConflicts)
+}
+
+// Drops returns the number of packets the bridge has dropped for each reason.
+func (b *Bridge) Drops() map[string]uint64 {
+	return b.drops.Counts()
+}
+
+// Addresses returns the contents of the bridge's learning table, excluding
+// entries that have aged out.
+func (b *Bridge) Addresses() []AddressEntry {
+	return b.table.entryList(time.Now())
+}
@@ -0,0 +1,101 @@
+package bridge
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	// Packets are remembered for this long after being forwarded.
+	echoWindow = 2 * time.Second
+
+	// Broadcasts are only duplicates if they arrive this close
+	// together. Copies of a packet that took different paths arrive
+	// within milliseconds of each other, but games repeat identical
+	// discovery broadcasts every second or so, and those must not be
+	// dropped.
+	dedupWindow = 100 * time.Millisecond
+
+	// Maximum number of packets remembered.
+	maxEchoEntries = 4096
+)
+
+// echoCache remembers packets that a bridge has recently forwarded, so that
+// a packet that comes back to the bridge (because of a loop in the network)
+// can be told apart from a different node using a conflicting address.
+type echoCache struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[uint64]time.Time
+}
+
+func newEchoCache(window time.Duration) *echoCache {
+	return &echoCache{window: window, entries: map[uint64]time.Time{}}
+}
+
+func packetHash(packet []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(packet)
+	return h.Sum64()
+}
+
+// add records that the given packet was forwarded.
+func (c *echoCache) add(packet []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addLocked(packetHash(packet), now)
+}
+
+func (c *echoCache) addLocked(h uint64, now time.Time) {
+	if len(c.entries) >= maxEchoEntries {
+		for h, t := range c.entries {
+			if now.Sub(t) > c.window {
+				delete(c.entries, h)
+			}
+		}
+	}
+	if len(c.entries) >= maxEchoEntries {
+		// Still full; the bridge is forwarding packets faster than
+		// we can remember them, so start again.
+		c.entries = map[uint64]time.Time{}
+	}
+	c.entries[h] = now
+}
+
+// contains returns true if the given packet was recently forwarded.
+func (c *echoCache) contains(packet []byte, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.entries[packetHash(packet)]
+	return ok && now.Sub(t) <= c.window
+}
+
+// Dedup drops broadcasts that arrive on the virtual network more than once,
+// because the same LAN is reachable through more than one bridge (eg. two
+// interfaces attached to the same network segment). Without it, local
+// clients see every discovery broadcast twice and may answer both, which
+// confuses some games. A Dedup is shared by bridges through Config.Dedup.
+type Dedup struct {
+	cache *echoCache
+}
+
+// NewDedup creates a new Dedup.
+func NewDedup() *Dedup {
+	return &Dedup{cache: newEchoCache(dedupWindow)}
+}
+
+// duplicate records the given broadcast, returning true if an identical
+// one was recorded very recently. The hash covers the whole packet,
+// including the source address, length and checksum fields.
+func (d *Dedup) duplicate(packet []byte, now time.Time) bool {
+	c := d.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := packetHash(packet)
+	if t, ok := c.entries[h]; ok && now.Sub(t) <= c.window {
+		return true
+	}
+	c.addLocked(h, now)
+	return false
+}
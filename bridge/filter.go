@@ -0,0 +1,151 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// Direction specifies which way across the bridge a filter rule applies.
+type Direction int
+
+const (
+	// In is traffic from the physical LAN to the virtual network.
+	In Direction = 1 << iota
+
+	// Out is traffic from the virtual network to the physical LAN.
+	Out
+
+	Both = In | Out
+)
+
+var directionNames = map[string]Direction{
+	"in":   In,
+	"out":  Out,
+	"both": Both,
+}
+
+// Rule is a rule that allows or denies broadcast packets crossing the bridge.
+type Rule struct {
+	Allow     bool
+	Direction Direction
+
+	// If non-zero, the rule only matches packets sent to this socket.
+	Socket uint16
+}
+
+// String returns the rule in the form accepted by ParseRule.
+func (r Rule) String() string {
+	action := "deny"
+	if r.Allow {
+		action = "allow"
+	}
+	var direction string
+	for name, d := range directionNames {
+		if d == r.Direction {
+			direction = name
+		}
+	}
+	if r.Socket == 0 {
+		return fmt.Sprintf("%s:%s", action, direction)
+	}
+	return fmt.Sprintf("%s:%s:%s", action, direction, ipx.Socket(r.Socket))
+}
+
+// ParseRule parses a rule of the form "action:direction[:socket]", where
+// action is "allow" or "deny" and direction is "in", "out" or "both". For
+// example, "deny:in:0x452" blocks SAP broadcasts from the LAN.
+func ParseRule(s string) (Rule, error) {
+	var r Rule
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return r, fmt.Errorf("invalid bridge filter rule %q: want action:direction[:socket]", s)
+	}
+	switch parts[0] {
+	case "allow":
+		r.Allow = true
+	case "deny":
+	default:
+		return r, fmt.Errorf("invalid action %q in bridge filter rule %q", parts[0], s)
+	}
+	d, ok := directionNames[parts[1]]
+	if !ok {
+		return r, fmt.Errorf("invalid direction %q in bridge filter rule %q", parts[1], s)
+	}
+	r.Direction = d
+	if len(parts) == 3 {
+		socket, err := ipx.ParseSocket(parts[2])
+		if err != nil {
+			return r, err
+		}
+		r.Socket = uint16(socket)
+	}
+	return r, nil
+}
+
+// RuleStats contains statistics about a filter rule.
+type RuleStats struct {
+	Rule    string `json:"rule"`
+	Packets uint64 `json:"packets"`
+}
+
+// Filter decides which broadcast packets may cross the bridge. Rules are
+// checked in order and the first matching rule applies; broadcasts that do
+// not match any rule are allowed. Unicast packets are not filtered.
+type Filter struct {
+	// Number of packets that matched each rule; accessed atomically.
+	counts []uint64
+	rules  []Rule
+}
+
+// NewFilter creates a new Filter with the given rules.
+func NewFilter(rules []Rule) *Filter {
+	return &Filter{
+		counts: make([]uint64, len(rules)),
+		rules:  rules,
+	}
+}
+
+// ParseFilter creates a Filter from a comma-separated list of rules in the
+// form accepted by ParseRule.
+func ParseFilter(s string) (*Filter, error) {
+	var rules []Rule
+	for _, rs := range strings.Split(s, ",") {
+		r, err := ParseRule(strings.TrimSpace(rs))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return NewFilter(rules), nil
+}
+
+// allow returns true if the given broadcast packet may cross the bridge in
+// the given direction.
+func (f *Filter) allow(d Direction, hdr *ipx.Header) bool {
+	for i, r := range f.rules {
+		if r.Direction&d == 0 {
+			continue
+		}
+		if r.Socket != 0 && r.Socket != hdr.Dest.Socket {
+			continue
+		}
+		atomic.AddUint64(&f.counts[i], 1)
+		return r.Allow
+	}
+	return true
+}
+
+// Stats returns the number of packets that have matched each rule.
+func (f *Filter) Stats() []RuleStats {
+	result := []RuleStats{}
+	for i, r := range f.rules {
+		result = append(result, RuleStats{
+			Rule:    r.String(),
+			Packets: atomic.LoadUint64(&f.counts[i]),
+		})
+	}
+	return result
+}
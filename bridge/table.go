@@ -0,0 +1,107 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// tableEntry records the bridge port on which an address was last seen.
+type tableEntry struct {
+	port      int
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// table is a learning table that maps IPX node addresses to the bridge port
+// they were observed on. Entries expire if the address is not seen for a
+// while, and the number of entries is capped so that a flood of packets
+// with forged source addresses cannot consume unbounded memory.
+type table struct {
+	mu         sync.Mutex
+	maxAge     time.Duration
+	maxEntries int
+	entries    map[ipx.Addr]*tableEntry
+}
+
+func newTable(maxAge time.Duration, maxEntries int) *table {
+	return &table{
+		maxAge:     maxAge,
+		maxEntries: maxEntries,
+		entries:    map[ipx.Addr]*tableEntry{},
+	}
+}
+
+// expire removes all entries that have aged out. It must be called with the
+// mutex held.
+func (t *table) expire(now time.Time) {
+	for addr, e := range t.entries {
+		if now.Sub(e.lastSeen) > t.maxAge {
+			delete(t.entries, addr)
+		}
+	}
+}
+
+// learn records that the given address was seen on the given port.
+func (t *table) learn(addr ipx.Addr, port int, now time.Time) {
+	if addr == ipx.AddrBroadcast || addr == ipx.AddrNull {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.entries[addr]; ok {
+		if e.port != port {
+			e.port = port
+			e.firstSeen = now
+		}
+		e.lastSeen = now
+		return
+	}
+	if len(t.entries) >= t.maxEntries {
+		t.expire(now)
+	}
+	if len(t.entries) >= t.maxEntries {
+		var oldestAddr ipx.Addr
+		var oldest *tableEntry
+		for addr, e := range t.entries {
+			if oldest == nil || e.lastSeen.Before(oldest.lastSeen) {
+				oldestAddr, oldest = addr, e
+			}
+		}
+		delete(t.entries, oldestAddr)
+	}
+	t.entries[addr] = &tableEntry{port: port, firstSeen: now, lastSeen: now}
+}
+
+// entryList returns all entries in the table that have not aged out.
+func (t *table) entryList(now time.Time) []AddressEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(now)
+	result := []AddressEntry{}
+	for addr, e := range t.entries {
+		result = append(result, AddressEntry{
+			Addr:      addr.String(),
+			LAN:       e.port == portLAN,
+			FirstSeen: e.firstSeen,
+			LastSeen:  e.lastSeen,
+		})
+	}
+	return result
+}
+
+// lookup returns the port on which the given address was last seen.
+func (t *table) lookup(addr ipx.Addr, now time.Time) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[addr]
+	if !ok {
+		return 0, false
+	}
+	if now.Sub(e.lastSeen) > t.maxAge {
+		delete(t.entries, addr)
+		return 0, false
+	}
+	return e.port, true
+}
@@ -0,0 +1,118 @@
+// Package capture implements writing of IPX packets to pcap files, so that
+// network traffic can be examined with standard tools like Wireshark, and
+// reading them back.
+package capture
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const etherTypeIPX = layers.EthernetType(0x8137)
+
+// Writer writes IPX packets to a pcap file. Each packet is wrapped in an
+// Ethernet II frame with source and destination MAC addresses taken from
+// the IPX header. Writer is safe for concurrent use.
+type Writer struct {
+	mu sync.Mutex
+	w  *pcapgo.Writer
+}
+
+var (
+	_ = (io.Writer)(&Writer{})
+)
+
+// NewWriter creates a new Writer that writes to the given io.Writer. The
+// pcap file header is written immediately.
+func NewWriter(w io.Writer) (*Writer, error) {
+	pw := pcapgo.NewWriter(w)
+	if err := pw.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		return nil, err
+	}
+	return &Writer{w: pw}, nil
+}
+
+// Write writes a single IPX packet to the pcap file, timestamped with the
+// current time.
+func (w *Writer) Write(packet []byte) (int, error) {
+	return len(packet), w.WritePacket(time.Now(), packet)
+}
+
+// WritePacket writes a single IPX packet to the pcap file with the given
+// timestamp.
+func (w *Writer) WritePacket(t time.Time, packet []byte) error {
+	var hdr ipx.Header
+	if err := hdr.UnmarshalBinary(packet); err != nil {
+		return err
+	}
+	buf := gopacket.NewSerializeBuffer()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr(hdr.Src.Addr[:]),
+		DstMAC:       net.HardwareAddr(hdr.Dest.Addr[:]),
+		EthernetType: etherTypeIPX,
+	}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, eth, gopacket.Payload(packet)); err != nil {
+		return err
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:     t,
+		CaptureLength: len(buf.Bytes()),
+		Length:        len(buf.Bytes()),
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.WritePacket(ci, buf.Bytes())
+}
+
+// Reader reads IPX packets from a pcap file written by a Writer.
+type Reader struct {
+	r *pcapgo.Reader
+}
+
+// NewReader creates a new Reader that reads from the given io.Reader. The
+// pcap file header is read immediately.
+func NewReader(r io.Reader) (*Reader, error) {
+	pr, err := pcapgo.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if pr.LinkType() != layers.LinkTypeEthernet {
+		return nil, fmt.Errorf("unsupported pcap link type %v", pr.LinkType())
+	}
+	return &Reader{r: pr}, nil
+}
+
+// ReadPacket reads the next IPX packet from the file, returning it with its
+// timestamp. Frames that do not contain IPX packets are skipped. io.EOF is
+// returned at the end of the file.
+func (r *Reader) ReadPacket() (time.Time, []byte, error) {
+	for {
+		data, ci, err := r.r.ReadPacketData()
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		var eth layers.Ethernet
+		if err := eth.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+			continue
+		}
+		if eth.EthernetType != etherTypeIPX {
+			continue
+		}
+		// Short frames are padded to the minimum Ethernet frame size,
+		// so trim the packet to the length given in its header.
+		packet := eth.Payload
+		var hdr ipx.Header
+		if err := hdr.UnmarshalBinary(packet); err == nil && int(hdr.Length) >= 30 && int(hdr.Length) <= len(packet) {
+			packet = packet[:hdr.Length]
+		}
+		return ci.Timestamp, packet, nil
+	}
+}
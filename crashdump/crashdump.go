@@ -0,0 +1,244 @@
+// Package crashdump keeps a record of recently received packets, so that if
+// the server crashes the packets can be written to disk and the cause of the
+// crash diagnosed.
+package crashdump
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Record is a single packet that was received.
+type Record struct {
+	Time time.Time
+	Addr *net.UDPAddr
+	Data []byte
+}
+
+// Ring is a ring buffer that holds the last N packets that were received.
+type Ring struct {
+	mu        sync.Mutex
+	localAddr *net.UDPAddr
+	records   []Record
+	next      int
+	full      bool
+}
+
+// summary is the JSON summary written alongside the pcap file.
+type summary struct {
+	Time    time.Time       `json:"time"`
+	Panic   string          `json:"panic"`
+	Stack   string          `json:"stack"`
+	Packets []packetSummary `json:"packets"`
+}
+
+type packetSummary struct {
+	Time   time.Time `json:"time"`
+	Addr   string    `json:"addr"`
+	Length int       `json:"length"`
+	Header string    `json:"header,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Data   string    `json:"data"`
+}
+
+// NewRing creates a new Ring that holds up to the given number of packets.
+// The local address is the address of the socket on which the packets are
+// received.
+func NewRing(size int, localAddr *net.UDPAddr) *Ring {
+	return &Ring{
+		localAddr: localAddr,
+		records:   make([]Record, size),
+	}
+}
+
+// Add adds a packet to the ring buffer, replacing the oldest packet if the
+// buffer is full. The packet is copied.
+func (r *Ring) Add(addr *net.UDPAddr, packet []byte) {
+	data := make([]byte, len(packet))
+	copy(data, packet)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.records) == 0 {
+		return
+	}
+	r.records[r.next] = Record{
+		Time: time.Now(),
+		Addr: addr,
+		Data: data,
+	}
+	r.next = (r.next + 1) % len(r.records)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Records returns the packets held in the ring buffer, oldest first.
+func (r *Ring) Records() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]Record{}, r.records[:r.next]...)
+	}
+	return append(append([]Record{}, r.records[r.next:]...), r.records[:r.next]...)
+}
+
+// writePcap writes the given records in pcap format. Each packet is wrapped
+// inside synthesized IPv4 and UDP headers so that the file can be opened by
+// standard tools like Wireshark.
+func (r *Ring) writePcap(f io.Writer, records []Record) error {
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeIPv4); err != nil {
+		return err
+	}
+	for _, record := range records {
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    record.Addr.IP.To4(),
+			DstIP:    r.localAddr.IP.To4(),
+		}
+		if ip.DstIP == nil {
+			ip.DstIP = net.IPv4zero.To4()
+		}
+		udp := &layers.UDP{
+			SrcPort: layers.UDPPort(record.Addr.Port),
+			DstPort: layers.UDPPort(r.localAddr.Port),
+		}
+		udp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{
+			FixLengths:       true,
+			ComputeChecksums: true,
+		}
+		if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(record.Data)); err != nil {
+			return err
+		}
+		ci := gopacket.CaptureInfo{
+			Timestamp:     record.Time,
+			CaptureLength: len(buf.Bytes()),
+			Length:        len(buf.Bytes()),
+		}
+		if err := w.WritePacket(ci, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSummary writes a JSON summary of the crash and the given records.
+func writeSummary(f io.Writer, s *summary, records []Record) error {
+	for _, record := range records {
+		ps := packetSummary{
+			Time:   record.Time,
+			Addr:   record.Addr.String(),
+			Length: len(record.Data),
+			Data:   hex.EncodeToString(record.Data),
+		}
+		var hdr ipx.Header
+		if err := hdr.UnmarshalBinary(record.Data); err != nil {
+			ps.Error = err.Error()
+		} else {
+			ps.Header = fmt.Sprintf("%+v", hdr)
+		}
+		s.Packets = append(s.Packets, ps)
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// createExclusive creates a new file, failing if it already exists.
+func createExclusive(filename string) (*os.File, error) {
+	return os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+}
+
+// createFiles creates the pcap file and JSON summary of a dump taken at the
+// given time, returning the common prefix of their filenames. If a dump with
+// the same name already exists, eg. because two goroutines crashed in the
+// same second, a number is added to the name rather than overwriting it.
+func createFiles(dir string, t time.Time) (string, *os.File, *os.File, error) {
+	base := filepath.Join(dir, "ipxbox-crash-"+t.Format("20060102-150405"))
+	prefix := base
+	for i := 2; ; i++ {
+		pcap, err := createExclusive(prefix + ".pcap")
+		if err == nil {
+			var summary *os.File
+			summary, err = createExclusive(prefix + ".json")
+			if err == nil {
+				return prefix, pcap, summary, nil
+			}
+			pcap.Close()
+			os.Remove(prefix + ".pcap")
+		}
+		if !os.IsExist(err) {
+			return "", nil, nil, err
+		}
+		prefix = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// Dump writes the contents of the ring buffer to the given directory, as a
+// pcap file and a JSON summary that also includes the given panic value and
+// stack trace. The common prefix of the two filenames is returned.
+func (r *Ring) Dump(dir string, panicValue interface{}, stack []byte) (string, error) {
+	records := r.Records()
+	now := time.Now()
+	prefix, pcap, summaryFile, err := createFiles(dir, now)
+	if err != nil {
+		return "", err
+	}
+	defer pcap.Close()
+	defer summaryFile.Close()
+	if err := r.writePcap(pcap, records); err != nil {
+		return "", err
+	}
+	s := &summary{
+		Time:  now,
+		Panic: fmt.Sprintf("%v", panicValue),
+		Stack: string(stack),
+	}
+	if err := writeSummary(summaryFile, s, records); err != nil {
+		return "", err
+	}
+	if err := pcap.Close(); err != nil {
+		return "", err
+	}
+	if err := summaryFile.Close(); err != nil {
+		return "", err
+	}
+	return prefix, nil
+}
+
+// HandlePanic should be invoked using defer. If a panic occurs, the contents
+// of the ring buffer are dumped to the given directory and the panic then
+// continues.
+func (r *Ring) HandlePanic(dir string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if prefix, err := r.Dump(dir, v, debug.Stack()); err != nil {
+		log.Printf("failed to write crash dump: %v", err)
+	} else {
+		log.Printf("crash dump written to %s.{pcap,json}", prefix)
+	}
+	panic(v)
+}
@@ -0,0 +1,53 @@
+package crashdump
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestDumpNotOverwritten checks that dumps taken in the same second are all
+// kept, with numbers added to their names.
+func TestDumpNotOverwritten(t *testing.T) {
+	dir := t.TempDir()
+	r := NewRing(4, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000})
+	r.Add(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 213}, make([]byte, 30))
+
+	// Only the JSON summary of a dump with the second number exists;
+	// it is skipped too.
+	base := filepath.Join(dir, "ipxbox-crash-"+time.Now().Format("20060102-150405"))
+	if err := os.WriteFile(base+"-2.json", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var prefixes []string
+	for i := 0; i < 2; i++ {
+		prefix, err := r.Dump(dir, "panic", nil)
+		if err != nil {
+			t.Fatalf("Dump failed: %v", err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	// The test may have run across a second boundary.
+	if filepath.Base(prefixes[0]) != filepath.Base(base) {
+		t.Skipf("dump taken in a different second")
+	}
+	if want := base + "-3"; prefixes[1] != want {
+		t.Errorf("second dump written to %s, want %s", prefixes[1], want)
+	}
+	if data, err := os.ReadFile(base + "-2.json"); err != nil || string(data) != "old" {
+		t.Errorf("existing file was overwritten")
+	}
+	if _, err := os.Stat(base + "-2.pcap"); !os.IsNotExist(err) {
+		t.Errorf("pcap file left behind for a name that was skipped")
+	}
+	for _, prefix := range prefixes {
+		for _, ext := range []string{".pcap", ".json"} {
+			if info, err := os.Stat(prefix + ext); err != nil || info.Size() == 0 {
+				t.Errorf("%s%s not written", prefix, ext)
+			}
+		}
+	}
+}
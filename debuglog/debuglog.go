@@ -0,0 +1,136 @@
+// Package debuglog implements logging whose verbosity can be changed for
+// each subsystem while the program is running.
+package debuglog
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Level controls which messages a Logger writes.
+type Level int32
+
+const (
+	// Quiet suppresses all messages.
+	Quiet Level = iota
+
+	// Normal writes the messages that are written by default.
+	Normal
+
+	// Verbose also writes debugging messages.
+	Verbose
+)
+
+var levelNames = map[Level]string{
+	Quiet:   "quiet",
+	Normal:  "normal",
+	Verbose: "verbose",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("Level(%d)", int32(l))
+}
+
+// ParseLevel parses the name of a level, eg. "verbose".
+func ParseLevel(s string) (Level, error) {
+	for level, name := range levelNames {
+		if name == s {
+			return level, nil
+		}
+	}
+	return Quiet, fmt.Errorf("invalid log level %q; valid levels are quiet, normal and verbose", s)
+}
+
+// UnknownSubsystemError is returned by SetLevel if there is no Logger for
+// the given subsystem.
+var UnknownSubsystemError = errors.New("unknown subsystem")
+
+var (
+	mu      sync.Mutex
+	loggers = map[string]*Logger{}
+)
+
+// Logger writes log messages for a subsystem.
+type Logger struct {
+	level int32
+	name  string
+}
+
+// New returns the Logger for the given subsystem, which starts at the
+// Normal level. Packages usually keep their Logger in a package variable.
+func New(subsystem string) *Logger {
+	mu.Lock()
+	defer mu.Unlock()
+	if l, ok := loggers[subsystem]; ok {
+		return l
+	}
+	l := &Logger{level: int32(Normal), name: subsystem}
+	loggers[subsystem] = l
+	return l
+}
+
+// Level returns the logger's current level.
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.level))
+}
+
+// SetLevel changes the logger's level.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// Printf writes a message unless the logger is Quiet.
+func (l *Logger) Printf(format string, args ...interface{}) {
+	if l.Level() >= Normal {
+		log.Printf(format, args...)
+	}
+}
+
+// Debugf writes a message only if the logger is Verbose.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	if l.Level() >= Verbose {
+		log.Printf(format, args...)
+	}
+}
+
+// Levels returns the current level of every subsystem.
+func Levels() map[string]Level {
+	mu.Lock()
+	defer mu.Unlock()
+	result := map[string]Level{}
+	for name, l := range loggers {
+		result[name] = l.Level()
+	}
+	return result
+}
+
+// Subsystems returns the names of all subsystems, sorted.
+func Subsystems() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	result := []string{}
+	for name := range loggers {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// SetLevel changes the level of the given subsystem.
+func SetLevel(subsystem string, level Level) error {
+	mu.Lock()
+	l, ok := loggers[subsystem]
+	mu.Unlock()
+	if !ok {
+		return UnknownSubsystemError
+	}
+	l.SetLevel(level)
+	return nil
+}
@@ -0,0 +1,132 @@
+// Package drop defines the reasons that packets are discarded, so that the
+// server and bridges describe drops in the same way, and counts the packets
+// dropped for each reason.
+package drop
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/fragglet/ipxbox/debuglog"
+)
+
+var logger = debuglog.New("drop")
+
+// Reason is the reason that a packet was discarded.
+type Reason int
+
+const (
+	// The packet could not be decoded as an IPX packet.
+	Malformed Reason = iota
+
+	// The packet came from a host that is not a registered client.
+	NotRegistered
+
+	// The packet's source address is not the sender's address.
+	Spoofed
+
+	// The sender is quarantined.
+	Quarantined
+
+	// The sender exceeded a rate limit.
+	RateLimited
+
+	// The packet was a broadcast into a locked game session.
+	SessionLocked
+
+	// A registration was refused, eg. because the client is banned.
+	Refused
+
+	// A bridge filter rule rejected the packet.
+	Filtered
+
+	// The packet was an echo of one that a bridge forwarded itself.
+	Echo
+
+	// The packet was a broadcast that already arrived through another
+	// bridge.
+	Duplicate
+
+	// The packet's source address is in use on both sides of a bridge,
+	// and the other side was preferred.
+	Conflict
+
+	// The packet is addressed to a node on the side of a bridge it came
+	// from, or to a node never seen on the LAN.
+	NotForwarded
+
+	// Writing the packet failed.
+	WriteError
+
+	numReasons
+)
+
+var reasonNames = [numReasons]string{
+	Malformed:     "malformed",
+	NotRegistered: "not_registered",
+	Spoofed:       "spoofed",
+	Quarantined:   "quarantined",
+	RateLimited:   "rate_limited",
+	SessionLocked: "session_locked",
+	Refused:       "refused",
+	Filtered:      "filtered",
+	Echo:          "echo",
+	Duplicate:     "duplicate",
+	Conflict:      "conflict",
+	NotForwarded:  "not_forwarded",
+	WriteError:    "write_error",
+}
+
+func (r Reason) String() string {
+	if r >= 0 && r < numReasons {
+		return reasonNames[r]
+	}
+	return fmt.Sprintf("Reason(%d)", int(r))
+}
+
+// sampleEvery is accessed atomically; see SetSampling.
+var sampleEvery uint64
+
+// SetSampling sets how often dropped packets are logged: one in every n
+// drops for each reason, if the "drop" subsystem's log level is Verbose.
+// Zero turns logging off.
+func SetSampling(n uint64) {
+	atomic.StoreUint64(&sampleEvery, n)
+}
+
+// Counter counts the packets dropped by a component for each reason.
+type Counter struct {
+	// Accessed atomically; kept first to ensure 64-bit alignment.
+	counts [numReasons]uint64
+
+	name string
+}
+
+// NewCounter creates a Counter for the component with the given name, which
+// is used in log messages.
+func NewCounter(name string) *Counter {
+	return &Counter{name: name}
+}
+
+// Drop counts a packet dropped for the given reason. The format string and
+// arguments describe the packet, and are only formatted if the drop is
+// logged.
+func (c *Counter) Drop(r Reason, format string, args ...interface{}) {
+	n := atomic.AddUint64(&c.counts[r], 1)
+	every := atomic.LoadUint64(&sampleEvery)
+	if every != 0 && (n-1)%every == 0 && logger.Level() >= debuglog.Verbose {
+		logger.Debugf("%s: dropped packet (%s, %d so far): %s", c.name, r, n, fmt.Sprintf(format, args...))
+	}
+}
+
+// Counts returns the number of packets dropped for each reason, omitting
+// reasons for which none have been.
+func (c *Counter) Counts() map[string]uint64 {
+	result := map[string]uint64{}
+	for r := Reason(0); r < numReasons; r++ {
+		if n := atomic.LoadUint64(&c.counts[r]); n != 0 {
+			result[r.String()] = n
+		}
+	}
+	return result
+}
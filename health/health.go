@@ -0,0 +1,144 @@
+// Package health implements monitoring of the server's own health, so that
+// a supervisor process can detect when the server has become wedged and
+// restart it.
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/debuglog"
+)
+
+var logger = debuglog.New("health")
+
+// Check is a function that checks some aspect of the server's health,
+// returning a non-nil error if something is wrong.
+type Check func() error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker periodically runs a set of health checks. It logs an alert when
+// a check starts failing, and implements http.Handler so that it can be
+// used to serve a /healthz endpoint.
+type Checker struct {
+	mu       sync.Mutex
+	interval time.Duration
+	checks   []namedCheck
+	failures map[string]error
+}
+
+var (
+	_ = (http.Handler)(&Checker{})
+)
+
+// New creates a new Checker that runs its checks at the given interval.
+func New(interval time.Duration) *Checker {
+	return &Checker{
+		interval: interval,
+		failures: map[string]error{},
+	}
+}
+
+// Add adds a new check with the given descriptive name.
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name, check})
+}
+
+// runChecks runs all checks once, logging any checks that have changed
+// state since the last time they were run.
+func (c *Checker) runChecks() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, nc := range c.checks {
+		err := nc.check()
+		_, wasFailing := c.failures[nc.name]
+		switch {
+		case err != nil && !wasFailing:
+			logger.Printf("health check %q failing: %v", nc.name, err)
+		case err == nil && wasFailing:
+			logger.Printf("health check %q recovered", nc.name)
+		}
+		if err != nil {
+			c.failures[nc.name] = err
+		} else {
+			delete(c.failures, nc.name)
+		}
+	}
+}
+
+// Run runs the health checks at the configured interval. It never returns.
+func (c *Checker) Run() {
+	for {
+		c.runChecks()
+		time.Sleep(c.interval)
+	}
+}
+
+// Err returns an error describing all checks that failed the last time
+// they were run, or nil if the server is healthy.
+func (c *Checker) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.failures) == 0 {
+		return nil
+	}
+	msgs := []string{}
+	for name, err := range c.failures {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", name, err))
+	}
+	sort.Strings(msgs)
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
+
+// ServeHTTP responds to an HTTP request with the current health status.
+// The status code is 200 if the server is healthy, or 503 otherwise.
+func (c *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := c.Err(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "unhealthy: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "ok\n")
+}
+
+// ErrorBudget returns a Check that fails if the value returned by the given
+// counter function increases by more than budget between consecutive runs
+// of the check.
+func ErrorBudget(counter func() uint64, budget uint64) Check {
+	last := counter()
+	return func() error {
+		value := counter()
+		delta := value - last
+		last = value
+		if delta > budget {
+			return fmt.Errorf("%d errors since last check exceeds budget of %d", delta, budget)
+		}
+		return nil
+	}
+}
+
+// GoroutineCheck returns a Check that fails if the number of running
+// goroutines exceeds the limit returned by the given function. The limit
+// is a function because the number of goroutines legitimately grows with
+// the number of connected clients.
+func GoroutineCheck(limit func() int) Check {
+	return func() error {
+		n, max := runtime.NumGoroutine(), limit()
+		if n > max {
+			return fmt.Errorf("%d goroutines running, more than limit of %d", n, max)
+		}
+		return nil
+	}
+}
@@ -5,33 +5,61 @@ package ipx
 import (
 	"bytes"
 	"encoding"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 )
 
 // Addr represents an IPX address (MAC address).
 type Addr [6]byte
 
-// HeaderAddr represents a full IPX address and socket number.
+// Network represents an IPX network number.
+type Network [4]byte
+
+// Socket represents an IPX socket number. HeaderAddr uses a plain uint16 for
+// socket numbers; this type exists so that socket numbers can be used as
+// flags and in config files.
+type Socket uint16
+
+// HeaderAddr represents a full IPX address and socket number. The doc tags
+// describe each field as it appears on the wire, in order and big-endian;
+// see package protodoc.
 type HeaderAddr struct {
-	Network [4]byte
-	Addr    Addr
-	Socket  uint16
+	Network Network `doc:"IPX network number"`
+	Addr    Addr    `doc:"Node address"`
+	Socket  uint16  `doc:"Socket number"`
 }
 
 // Header represents an IPX header.
 type Header struct {
-	Checksum     uint16
-	Length       uint16
-	TransControl byte
-	PacketType   byte
-	Dest, Src    HeaderAddr
+	Checksum     uint16     `doc:"Checksum; 0xffff if there is none"`
+	Length       uint16     `doc:"Length of the packet in bytes, including the header"`
+	TransControl byte       `doc:"Transport control (hop count)"`
+	PacketType   byte       `doc:"Packet type, eg. 4 for PEP or 5 for SPX"`
+	Dest         HeaderAddr `doc:"Destination address"`
+	Src          HeaderAddr `doc:"Source address"`
 }
 
 var (
 	// Check that the Address type implements the net.Addr interface.
 	_ = (net.Addr)(&AddrNull)
 
+	// Check the TextMarshaler/Unmarshaler and flag.Value interfaces
+	// are implemented, so that these types can be used in config files
+	// and as command line flags.
+	_ = (encoding.TextMarshaler)(&AddrNull)
+	_ = (encoding.TextUnmarshaler)(&AddrNull)
+	_ = (flag.Value)(&AddrNull)
+	_ = (encoding.TextMarshaler)(&Network{})
+	_ = (encoding.TextUnmarshaler)(&Network{})
+	_ = (flag.Value)(&Network{})
+	_ = (encoding.TextMarshaler)(new(Socket))
+	_ = (encoding.TextUnmarshaler)(new(Socket))
+	_ = (flag.Value)(new(Socket))
+
 	// Check the BinaryMarshaler/Unmarshaler interfaces are implemented.
 	_ = (encoding.BinaryMarshaler)(&HeaderAddr{})
 	_ = (encoding.BinaryUnmarshaler)(&HeaderAddr{})
@@ -49,10 +77,156 @@ func (a Addr) Network() string {
 	return "dosbox-ipx"
 }
 
+// String returns the address in colon-separated form, eg.
+// "02:ff:ab:03:04:05". This is the form accepted by ParseAddr.
 func (a Addr) String() string {
 	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", a[0], a[1], a[2], a[3], a[4], a[5])
 }
 
+// ParseAddr parses an IPX address in the form returned by Addr.String().
+// Hyphens may be used instead of colons as separators.
+func ParseAddr(s string) (Addr, error) {
+	var a Addr
+	parts := strings.Split(strings.ReplaceAll(s, "-", ":"), ":")
+	if len(parts) != len(a) {
+		return a, fmt.Errorf("invalid IPX address %q", s)
+	}
+	for i, part := range parts {
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil || len(part) == 0 || len(part) > 2 {
+			return a, fmt.Errorf("invalid IPX address %q", s)
+		}
+		a[i] = byte(b)
+	}
+	return a, nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (a Addr) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (a *Addr) UnmarshalText(text []byte) error {
+	return a.Set(string(text))
+}
+
+// Set implements flag.Value.
+func (a *Addr) Set(s string) error {
+	result, err := ParseAddr(s)
+	if err != nil {
+		return err
+	}
+	*a = result
+	return nil
+}
+
+// String returns the network number as eight hex digits, eg. "00000001".
+// This is the form accepted by ParseNetwork.
+func (n Network) String() string {
+	return hex.EncodeToString(n[:])
+}
+
+// ParseNetwork parses an IPX network number written in hex. Leading zeros
+// may be omitted, so "1" is the same as "00000001".
+func ParseNetwork(s string) (Network, error) {
+	var n Network
+	value, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 32)
+	if err != nil {
+		return n, fmt.Errorf("invalid IPX network number %q", s)
+	}
+	n[0] = byte(value >> 24)
+	n[1] = byte(value >> 16)
+	n[2] = byte(value >> 8)
+	n[3] = byte(value)
+	return n, nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (n Network) MarshalText() ([]byte, error) {
+	return []byte(n.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (n *Network) UnmarshalText(text []byte) error {
+	return n.Set(string(text))
+}
+
+// Set implements flag.Value.
+func (n *Network) Set(s string) error {
+	result, err := ParseNetwork(s)
+	if err != nil {
+		return err
+	}
+	*n = result
+	return nil
+}
+
+// String returns the socket number in hex, eg. "0x4002".
+func (s Socket) String() string {
+	return fmt.Sprintf("0x%04x", uint16(s))
+}
+
+// ParseSocket parses an IPX socket number. Socket numbers are usually
+// written in hex with a "0x" prefix, but decimal is also accepted.
+func ParseSocket(s string) (Socket, error) {
+	value, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid IPX socket number %q", s)
+	}
+	return Socket(value), nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Socket) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *Socket) UnmarshalText(text []byte) error {
+	return s.Set(string(text))
+}
+
+// Set implements flag.Value.
+func (s *Socket) Set(str string) error {
+	result, err := ParseSocket(str)
+	if err != nil {
+		return err
+	}
+	*s = result
+	return nil
+}
+
+// String returns the address in the form used by tcpdump, eg.
+// "00000000.02:ff:ff:ff:00:00.0002". This is the form accepted by
+// ParseHeaderAddr.
+func (a HeaderAddr) String() string {
+	return fmt.Sprintf("%s.%s.%04x", a.Network, a.Addr, a.Socket)
+}
+
+// ParseHeaderAddr parses a full IPX address in the form returned by
+// HeaderAddr.String().
+func ParseHeaderAddr(s string) (HeaderAddr, error) {
+	var a HeaderAddr
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return a, fmt.Errorf("invalid IPX address %q: want network.node.socket", s)
+	}
+	var err error
+	if a.Network, err = ParseNetwork(parts[0]); err != nil {
+		return a, err
+	}
+	if a.Addr, err = ParseAddr(parts[1]); err != nil {
+		return a, err
+	}
+	socket, err := strconv.ParseUint(parts[2], 16, 16)
+	if err != nil {
+		return a, fmt.Errorf("invalid IPX socket number %q", parts[2])
+	}
+	a.Socket = uint16(socket)
+	return a, nil
+}
+
 // UnmarshalBinary decodes an IPX header address from a slice of bytes.
 func (a *HeaderAddr) UnmarshalBinary(data []byte) error {
 	if len(data) < minHeaderAddressLength {
@@ -60,7 +234,7 @@ func (a *HeaderAddr) UnmarshalBinary(data []byte) error {
 	}
 	copy(a.Network[0:], data[0:4])
 	copy(a.Addr[0:], data[4:10])
-	a.Socket = uint16((data[10] << 8) | data[11])
+	a.Socket = uint16(data[10])<<8 | uint16(data[11])
 	return nil
 }
 
@@ -80,8 +254,8 @@ func (h *Header) UnmarshalBinary(packet []byte) error {
 		return fmt.Errorf("IPX header too short to decode: %d < %d", len(packet), minHeaderLength)
 	}
 
-	h.Checksum = uint16((packet[0] << 8) | packet[1])
-	h.Length = uint16((packet[2] << 8) | packet[3])
+	h.Checksum = uint16(packet[0])<<8 | uint16(packet[1])
+	h.Length = uint16(packet[2])<<8 | uint16(packet[3])
 	h.TransControl = packet[4]
 	h.PacketType = packet[5]
 
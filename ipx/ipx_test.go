@@ -0,0 +1,27 @@
+package ipx
+
+import (
+	"testing"
+)
+
+// TestHeaderDecodes16BitFields checks that the high byte of each 16-bit
+// header field is decoded, rather than shifted out of a byte.
+func TestHeaderDecodes16BitFields(t *testing.T) {
+	want := Header{
+		Checksum: 0xffff,
+		Length:   0x05c0,
+		Dest:     HeaderAddr{Addr: AddrBroadcast, Socket: 0x869c},
+		Src:      HeaderAddr{Addr: Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}, Socket: 0x4002},
+	}
+	encoded, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to encode header: %v", err)
+	}
+	var got Header
+	if err := got.UnmarshalBinary(encoded); err != nil {
+		t.Fatalf("failed to decode header: %v", err)
+	}
+	if got != want {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
@@ -2,19 +2,54 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/fragglet/ipxbox/admin"
+	"github.com/fragglet/ipxbox/annotate"
+	"github.com/fragglet/ipxbox/ban"
 	"github.com/fragglet/ipxbox/bridge"
+	"github.com/fragglet/ipxbox/capture"
+	"github.com/fragglet/ipxbox/client"
+	"github.com/fragglet/ipxbox/drop"
+	"github.com/fragglet/ipxbox/health"
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/discovery"
+	"github.com/fragglet/ipxbox/network/null"
 	"github.com/fragglet/ipxbox/phys"
+	"github.com/fragglet/ipxbox/recorder"
+	"github.com/fragglet/ipxbox/satellite"
+	"github.com/fragglet/ipxbox/selftest"
 	"github.com/fragglet/ipxbox/server"
+	"github.com/fragglet/ipxbox/service/announce"
+	"github.com/fragglet/ipxbox/service/printgw"
+	"github.com/fragglet/ipxbox/service/timesvc"
+	"github.com/fragglet/ipxbox/validate"
 	"github.com/fragglet/ipxbox/virtual"
 
 	"github.com/google/gopacket/pcap"
 	"github.com/songgao/water"
 )
 
+// version is the version of ipxbox, which can be set at build time with
+// -ldflags "-X main.version=...".
+var version = "devel"
+
 var framers = map[string]phys.Framer{
 	"802.2":    phys.Framer802_2,
 	"802.3raw": phys.Framer802_3Raw,
@@ -22,25 +57,199 @@ var framers = map[string]phys.Framer{
 	"eth-ii":   phys.FramerEthernetII,
 }
 
+var dropPolicies = map[string]virtual.DropPolicy{
+	"tail":   virtual.DropTail,
+	"oldest": virtual.DropOldest,
+}
+
+var hairpinPolicies = map[string]virtual.HairpinPolicy{
+	"deliver": virtual.HairpinDeliver,
+	"drop":    virtual.HairpinDrop,
+	"reflect": virtual.HairpinReflect,
+}
+
+var conflictPolicies = map[string]bridge.ConflictPolicy{
+	"local":  bridge.PreferLocal,
+	"remote": bridge.PreferRemote,
+}
+
 var (
-	pcapDevice      = flag.String("pcap_device", "", `Send and receive packets to the given device ("list" to list all devices)`)
 	enableTap       = flag.Bool("enable_tap", false, "Bridge the server to a tap device.")
-	dumpPackets     = flag.Bool("dump_packets", false, "Dump packets to stdout.")
+	dumpPackets     = flag.Bool("dump_packets", false, "Dump packets to stdout. This can also be turned on and off using the admin API.")
 	port            = flag.Int("port", 10000, "UDP port to listen on.")
 	clientTimeout   = flag.Duration("client_timeout", server.DefaultConfig.ClientTimeout, "Time of inactivity before disconnecting clients.")
 	ethernetFraming = flag.String("ethernet_framing", "802.2", `Framing to use when sending Ethernet packets. Valid values are "802.2", "802.3raw", "snap" and "eth-ii".`)
+	recvBufferSize  = flag.Int("receive_buffer_size", 0, "Size in bytes of the socket receive buffer. If zero, the OS default is used.")
+	sendBufferSize  = flag.Int("send_buffer_size", 0, "Size in bytes of the socket send buffer. If zero, the OS default is used.")
+	sockets         = flag.Int("sockets", 1, "Number of UDP sockets to receive packets on. Using more than one can improve throughput on multi-core hosts. Only supported on Linux.")
+	preserveLocal   = flag.Bool("preserve_local_addr", false, "Send replies to each client from the local address that its packets arrived on. Use this if the host has more than one address and some clients cannot connect. Only supported on Linux.")
+	rejoinWindow    = flag.Duration("rejoin_window", 0, "If non-zero, a client that times out and registers again within this long gets back its old IPX address and room.")
+	keepaliveMax    = flag.Duration("keepalive_max", 0, "If non-zero, learn how long each client's NAT keeps an idle connection open and send keepalives only as often as needed, at most this far apart. Clients may briefly become unreachable while this is learned.")
+	idleRoomTime    = flag.Duration("idle_room_time", 0, "If non-zero, rooms with no game traffic for this long are idle, and their clients are sent keepalives only every --idle_keepalive.")
+	idleKeepalive   = flag.Duration("idle_keepalive", server.DefaultConfig.IdleKeepaliveTime, "Interval between keepalives sent to clients in idle rooms.")
+	mtuProbe        = flag.Bool("mtu_probe", false, "Find the largest packet that can be delivered to each client, shown as max_packet_size in client statistics.")
+	resumeGrace     = flag.Duration("resume_grace_period", server.DefaultConfig.ResumeGracePeriod, "If the host is suspended, do not time out clients for this long after it resumes.")
+	crashDumpDir    = flag.String("crash_dump_dir", "", "If the server crashes, write a dump of recently received packets to this directory.")
+	queueLength     = flag.Int("queue_length", virtual.DefaultConfig.QueueLength, "Maximum number of packets queued for delivery to each client.")
+	validateUDP     = flag.String("validate_udp", "", `Comma-separated checks applied to packets from clients before they reach the network: "max_length=N" (bytes), "length_field" (the IPX header's length is not longer than the packet) and "source_rate=N" (packets per second from each client).`)
+	validateBridge  = flag.String("validate_bridge", "", "Checks applied to packets from bridged LANs, as for --validate_udp. Rates are per IPX address.")
+	validateUplink  = flag.String("validate_uplink", "", "Checks applied to packets from the --uplink server, as for --validate_udp. Rates are per IPX address.")
+	forwarding      = flag.String("forwarding", "", `Comma-separated forwarding rules, checked in order after the built-in split horizon and --hairpin rules, eg. "deny:tap:tap" to stop packets from one bridged device or uplink being sent out through another. Each rule is "allow" or "deny", where the packet comes from and where it is going ("node", "tap" or "any"), and an optional socket number.`)
+	hairpin         = flag.String("hairpin", "deliver", `What to do with packets that a client sends to itself. Valid values are "deliver", "drop", and "reflect" (also send clients their own broadcasts).`)
+	dropPolicy      = flag.String("drop_policy", "tail", `Packet to drop when a client's queue is full. Valid values are "tail" (the new packet) and "oldest".`)
+	printDir        = flag.String("print_dir", "", "If set, run a print gateway that saves print jobs sent over SPX to this directory.")
+	eventTime       = flag.String("event_time", "", `If set, warn clients of an event such as maintenance scheduled for this time, in RFC 3339 format (eg. "2024-01-02T15:04:05Z"). Warnings are broadcast to --announce_socket in the hour before the event.`)
+	eventMessage    = flag.String("event_message", "Server maintenance", "Description of the event given by --event_time, used in warnings.")
+	eventCloseReg   = flag.Bool("event_close_registration", false, "Stop accepting new clients when the event given by --event_time happens.")
+	timeService     = flag.Bool("time_service", false, "Run a service that DOS machines can use to set their clocks from the server.")
+	unicastDiscover = flag.String("unicast_discovery", "", `Comma-separated list of socket numbers, eg. "0x869c". Discovery broadcasts that clients send to these sockets are converted into unicast packets sent only to clients known to be using the same socket.`)
+	isolate         = flag.Bool("isolate", false, "Accept connections from clients but isolate them so that they cannot communicate with anything.")
+	captureDir      = flag.String("capture_dir", "", "If set, the packets exchanged with individual clients can be captured to pcap files in this directory using the admin API.")
+	pcapFile        = flag.String("pcap_file", "", "Write all network traffic to this pcap file, including packets from quarantined clients.")
+	httpListen      = flag.String("http_listen", "", `Address to listen on for HTTP requests, eg. "localhost:8080". The server's health status is served at /healthz, readiness to accept new clients at /readyz and statistics at /stats.`)
+	autoBridge      = flag.Bool("auto", false, `If no device to bridge to is given, pick one automatically. Run "ipxbox bridge list" to see which device would be chosen.`)
+	macPool         = flag.Int("mac_pool", 0, "If non-zero, open pcap devices without promiscuous mode and instead register the addresses of up to this many virtual network nodes on each device. Only supported on Linux.")
+	vlanID          = flag.Uint("vlan_id", 0, "If non-zero, packets sent and received on pcap devices are tagged with this 802.1Q VLAN ID.")
+	bridgeFilter    = flag.String("bridge_filter", "", `Comma-separated rules controlling which broadcasts cross the bridge, eg. "deny:in:0x452" to block SAP broadcasts from the LAN. Each rule is "allow" or "deny", a direction ("in", "out" or "both") and an optional socket number. Applies to all bridged devices that do not have their own rules.`)
+	bridgesShareLAN = flag.Bool("bridges_share_lan", false, "The bridged devices are all attached to the same LAN, so packets from the LAN that arrive through one of them are not sent back out through the others.")
+	conflictPolicy  = flag.String("conflict_policy", "local", `What to do when a host on a bridged LAN uses the same address as a client. Valid values are "local" (ignore the LAN host) and "remote" (give the client a new address if it uses the extended protocol, otherwise disconnect it, and it will get a new address if it reconnects).`)
+	roomPortStart   = flag.Int("room_port_start", 0, "If non-zero, each room named by --rooms gets its own UDP port, numbered consecutively from this one. Clients that connect to a room's port join that room.")
+	roomAddrs       = flag.String("room_addrs", "", "Comma-separated list of address=room mappings. Clients that connect to one of the host's addresses join its room, so that rooms can have their own DNS names. Implies --preserve_local_addr.")
+	ephemeralRooms  = flag.Bool("ephemeral_rooms", false, "If true, players joining an unknown room through /rooms/join (see --room_api), or registering with a room name using the extended protocol, create it, with the password they gave. Such rooms are removed once their last client leaves.")
+	maxEphemeral    = flag.Int("max_ephemeral_rooms", 64, "Maximum number of rooms that --ephemeral_rooms can create. Zero means no limit.")
+	roomAPI         = flag.Bool("room_api", false, "If true, serve the API that lets players join rooms by password, and that room moderators use, under /rooms/ on the HTTP listener.")
+	publicHost      = flag.String("public_host", "", "Host name that DOSBox clients use to connect to the server, for the configuration served at /rooms/dosbox.conf. If empty, the host name the HTTP request was sent to is used.")
+	roomDirectory   = flag.Bool("room_directory", false, "If true, serve a directory of the rooms that players can join at /rooms/directory on the HTTP listener. Implies --room_api.")
+	directoryToken  = flag.String("room_directory_token", "", "If set, requests to the room directory must be authenticated with this bearer token. Otherwise the directory is public.")
+	directoryRate   = flag.Int("room_directory_rate", 30, "Maximum number of room directory requests per minute from each IP address, or zero for no limit.")
+	rooms           = flag.String("rooms", "", `Comma-separated list of names of extra rooms: separate networks that clients can be moved into using the admin API. Clients always join the room named "default" when they connect.`)
+	guestDailyLimit = flag.Duration("guest_daily_limit", 0, "If non-zero, clients from each IP address may only be connected for this long each day. Clients are warned on --announce_socket before they are disconnected.")
+	floodRate       = flag.Int("flood_registration_rate", 0, "If non-zero, more than this many new clients per second is treated as a registration flood. During a flood, each IP address is limited to --flood_clients_per_ip clients.")
+	floodPerIP      = flag.Int("flood_clients_per_ip", server.DefaultConfig.FloodClientsPerIP, "Number of clients each IP address may have during a registration flood.")
+	floodWorkBits   = flag.Int("flood_work_bits", server.DefaultConfig.FloodWorkBits, "During a registration flood, clients using the extended protocol must do a proof of work of this many bits to register, instead of being limited by --flood_clients_per_ip. Zero holds them to the same limit as other clients.")
+	recordDir       = flag.String("record_dir", "", "If set, matches in each room can be recorded to this directory using the admin API.")
+	exportTick      = flag.Duration("export_tick", recorder.DefaultTick, `Length of each tick in timelines written by "ipxbox recording export".`)
+	dropLogSample   = flag.Uint64("drop_log_sample", 100, `When the "drop" subsystem's log level is verbose, log one in every this many dropped packets for each drop reason.`)
+	motdURL         = flag.String("motd_url", "", "URL of the server's message of the day, sent to clients that ask for the extended registration reply.")
+	dialAddrs       = flag.String("dial", "", "Comma-separated list of host:port client endpoints, eg. relays run by players behind symmetric NAT, that the server pings until they register, instead of waiting for them to contact it first.")
+	redirectAddrs   = flag.String("redirect", "", "Comma-separated list of host:port addresses of other servers on the same network, eg. satellites linked to this one, that new clients using the extended protocol are redirected to once this server has --redirect_above clients.")
+	redirectAbove   = flag.Int("redirect_above", 0, "If non-zero, number of clients above which new clients are redirected to the servers in --redirect.")
+	legacyPing      = flag.Bool("legacy_ping_reply", false, "Send keepalive pings from the address ff:ff:ff:ff:00:00 used by older versions of ipxbox, for deployments with relays that expect it.")
+	countersFile    = flag.String("counters_file", "", "If set, the server's cumulative counters are saved to this file every --counters_interval and restored from it on startup, so that they do not go back to zero when the server is restarted.")
+	countersEvery   = flag.Duration("counters_interval", time.Minute, "Interval between saves of --counters_file.")
+	drainTimeout    = flag.Duration("drain_timeout", 0, "If non-zero, on SIGTERM stop accepting new clients and wait up to this long for connected clients to leave before exiting.")
+	tarpitDelay     = flag.Duration("tarpit_delay", 0, "If non-zero, reply to non-IPX traffic such as port scans after this delay, and track the hosts that send it.")
+	trustedRanges   = flag.String("trusted_ranges", "", `Comma-separated list of IP ranges, eg. "192.0.2.0/24", whose clients are trusted: they are exempt from rate limits, --guest_daily_limit and registration flood limits.`)
+	restrictRanges  = flag.String("restricted_ranges", "", "Comma-separated list of IP ranges whose clients are restricted, and subject to the --restricted_* limits.")
+	packetRate      = flag.Int("packet_rate", 0, "If non-zero, the maximum number of packets per second that each client may send. Does not apply to trusted clients.")
+	broadcastRate   = flag.Int("broadcast_rate", 0, "If non-zero, the maximum number of broadcast packets per second that each client may send. Does not apply to trusted clients.")
+	restrictPackets = flag.Int("restricted_packet_rate", 0, "If non-zero, the maximum number of packets per second that each restricted client may send.")
+	restrictBcasts  = flag.Int("restricted_broadcast_rate", 0, "If non-zero, the maximum number of broadcast packets per second that each restricted client may send.")
+	restrictRooms   = flag.String("restricted_rooms", "", `If set, comma-separated list of rooms that restricted clients may be moved into, in addition to "default".`)
+	uplink          = flag.String("uplink", "", `If set, run as a satellite of the main server at this address, eg. "ipx.example.com:10000". Players connected to this server can play with those on the main server, which must list this server's address in --satellite_ranges.`)
+	uplinkProxy     = flag.String("uplink_proxy", "", `If set, connect to the --uplink server through this SOCKS5 proxy, eg. "socks5://proxy.example.com:1080". The main server sees the proxy's address, so that is the one that must be in its --satellite_ranges.`)
+	satelliteRanges = flag.String("satellite_ranges", "", "Comma-separated list of IP ranges from which satellite servers may connect.")
+	sessionLock     = flag.Duration("session_lock", 0, "If non-zero, once a game has been running for this long, stop other clients from sending broadcasts to its socket, so that late joiners cannot disrupt it. Sessions can be unlocked using the admin API.")
+	alertWebhook    = flag.String("alert_webhook", "", "If set, alerts about suspicious client behavior, such as sending from another client's address, are POSTed as JSON to this URL.")
+	banFile         = flag.String("ban_file", "", "If set, bans are loaded from and saved to this file, and can be managed using the admin API.")
+	adminToken      = flag.String("admin_token", "", "If set, serve the admin API under /admin/ on the HTTP listener. Requests must be authenticated with this bearer token.")
+)
+
+// stringList is a flag.Value for flags that can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+var (
+	printSocket = ipx.Socket(printgw.DefaultSocket)
+	timeSocket  = ipx.Socket(timesvc.DefaultSocket)
+	annSocket   = ipx.Socket(announce.DefaultSocket)
+	pcapDevices stringList
 )
 
-func printPackets(v *virtual.Network) {
-	tap := v.Tap()
-	defer tap.Close()
+func init() {
+	flag.Var(&pcapDevices, "pcap_device", `Send and receive packets to the given device. May be given more than once to bridge several devices. Bridge filter rules for just this device can be given after an "=", eg. "eth0=deny:in:0x452".`)
+	flag.Var(&printSocket, "print_socket", "IPX socket number on which the print gateway listens.")
+	flag.Var(&timeSocket, "time_socket", "IPX socket number on which the time service listens for NCP requests.")
+	flag.Var(&annSocket, "announce_socket", "IPX socket number to which warnings of the event given by --event_time, and of --guest_daily_limit, are sent. Change this if a game uses the same socket.")
+}
+
+const (
+	// Interval between running health checks, and the number of errors
+	// of each type that are tolerated between checks.
+	healthCheckInterval = 10 * time.Second
+	writeErrorBudget    = 100
+	decodeErrorBudget   = 1000
+
+	// Interval between updates of the addresses registered by
+	// --mac_pool.
+	macPoolSyncInterval = 5 * time.Second
+
+	// Goroutines we allow in addition to the one per connected client.
+	// Growth beyond this suggests that goroutines are being leaked.
+	extraGoroutines = 100
+)
+
+// capturePackets writes all network traffic to the given pcap writer.
+func capturePackets(v *virtual.Network, w *capture.Writer) {
+	spectator := v.Spectator()
+	defer spectator.Close()
+	for {
+		buf := make([]byte, 1500)
+		n, err := spectator.Read(buf)
+		if err != nil {
+			break
+		}
+		w.Write(buf[:n])
+	}
+}
+
+// packetDumper prints all network traffic to stdout while it is enabled. It
+// can be turned on and off through the admin API.
+type packetDumper struct {
+	v         *virtual.Network
+	mu        sync.Mutex
+	spectator *virtual.Spectator
+}
+
+// SetEnabled starts or stops printing packets.
+func (d *packetDumper) SetEnabled(enabled bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case enabled && d.spectator == nil:
+		d.spectator = d.v.Spectator()
+		go printPackets(d.spectator)
+	case !enabled && d.spectator != nil:
+		d.spectator.Close()
+		d.spectator = nil
+	}
+}
+
+// Enabled returns true if packets are being printed.
+func (d *packetDumper) Enabled() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.spectator != nil
+}
+
+// printPackets prints a hex dump of every packet read from the given
+// spectator until it is closed.
+func printPackets(spectator *virtual.Spectator) {
 	for {
 		buf := make([]byte, 1500)
-		n, err := tap.Read(buf)
+		n, err := spectator.Read(buf)
 		if err != nil {
 			break
 		}
-		fmt.Printf("packet:\n")
+		fmt.Printf("packet: %s\n", annotate.Describe(buf[:n]))
 		for i := 0; i < n; i++ {
 			fmt.Printf("%02x ", buf[i])
 			if (i+1)%16 == 0 {
@@ -51,45 +260,952 @@ func printPackets(v *virtual.Network) {
 	}
 }
 
+// Time to wait before reconnecting to the main server after losing the
+// connection to it.
+const uplinkRetryInterval = 10 * time.Second
+
+// satelliteLink connects the network to a main server as a satellite.
+type satelliteLink struct {
+	validator *validate.Validator
+
+	mu     sync.Mutex
+	uplink *satellite.Uplink
+}
+
+// run connects the given network to the main server at the given address,
+// reconnecting whenever the connection is lost.
+func (l *satelliteLink) run(v *virtual.Network, addr string) {
+	for {
+		cfg := *client.DefaultConfig
+		cfg.Proxy = *uplinkProxy
+		c, err := client.Dial(addr, &cfg)
+		if err != nil {
+			log.Printf("failed to connect to main server %s: %v", addr, err)
+			time.Sleep(uplinkRetryInterval)
+			continue
+		}
+		log.Printf("connected to main server %s as %s", addr, c.Address())
+		ucfg := *satellite.DefaultConfig
+		ucfg.Validator = l.validator
+		u := satellite.New(v, c, &ucfg)
+		l.mu.Lock()
+		l.uplink = u
+		l.mu.Unlock()
+		err = u.Run()
+		c.Close()
+		log.Printf("lost connection to main server %s: %v", addr, err)
+		time.Sleep(uplinkRetryInterval)
+	}
+}
+
+// stats returns statistics about the current connection to the main server,
+// or nil if there is none.
+func (l *satelliteLink) stats() *satellite.Stats {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.uplink == nil {
+		return nil
+	}
+	stats := l.uplink.Stats()
+	return &stats
+}
+
+// Time allowed for delivering an alert to --alert_webhook.
+const alertWebhookTimeout = 10 * time.Second
+
+// postAlert sends the given alert to a webhook as JSON.
+func postAlert(url string, a server.Alert) {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+	hc := &http.Client{Timeout: alertWebhookTimeout}
+	resp, err := hc.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("failed to send alert to webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("failed to send alert to webhook: %s", resp.Status)
+	}
+}
+
+// newHealthChecker creates a health.Checker that monitors the given server.
+func newHealthChecker(s *server.Server) *health.Checker {
+	hc := health.New(healthCheckInterval)
+	hc.Add("main loop", s.CheckPollLoop)
+	hc.Add("socket write errors", health.ErrorBudget(func() uint64 {
+		return s.Stats().WriteErrors
+	}, writeErrorBudget))
+	hc.Add("packet decode errors", health.ErrorBudget(func() uint64 {
+		return s.Stats().DecodeErrors
+	}, decodeErrorBudget))
+	hc.Add("goroutines", health.GoroutineCheck(func() int {
+		return s.Stats().Clients + extraGoroutines
+	}))
+	go hc.Run()
+	return hc
+}
+
+// readinessHandler returns an HTTP handler that reports whether the server is
+// ready to accept new clients: it must be healthy and not draining. This is
+// separate from /healthz so that a load balancer can stop sending new
+// clients to a draining server without it being restarted.
+func readinessHandler(s *server.Server, hc *health.Checker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if s.Stats().RegistrationClosed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready: not accepting new clients\n")
+			return
+		}
+		if err := hc.Err(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready: %v\n", err)
+			return
+		}
+		fmt.Fprintf(w, "ok\n")
+	})
+}
+
+// drainOnSignal waits for SIGTERM, then stops accepting new clients and exits
+// once all connected clients have gone or the drain timeout is reached.
+func drainOnSignal(s *server.Server, timeout time.Duration) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	<-sigs
+	log.Printf("received SIGTERM; draining for up to %v", timeout)
+	s.SetRegistrationClosed(true)
+	deadline := time.Now().Add(timeout)
+	for s.Stats().Clients > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+	log.Printf("exiting with %d clients connected", s.Stats().Clients)
+	if *countersFile != "" {
+		if err := saveCounters(s, *countersFile); err != nil {
+			log.Printf("failed to save counters: %v", err)
+		}
+	}
+	exit(0)
+}
+
+// atExit holds functions that are called before the process exits, to undo
+// changes made to the host, such as addresses registered on devices.
+var atExit []func()
+
+// exit calls the functions in atExit, then exits with the given status.
+func exit(code int) {
+	for _, f := range atExit {
+		f()
+	}
+	os.Exit(code)
+}
+
+// exitOnSignal exits through exit when one of the given signals is received.
+func exitOnSignal(sigs ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	log.Printf("received %v; exiting", <-c)
+	exit(0)
+}
+
+// loadCounters restores the server's cumulative counters from the given
+// file, if it exists.
+func loadCounters(s *server.Server, filename string) error {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var c server.Counters
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+	s.RestoreCounters(c)
+	return nil
+}
+
+// saveCounters saves the server's cumulative counters to the given file. The
+// file is replaced atomically, so a crash while saving cannot lose the
+// previous snapshot.
+func saveCounters(s *server.Server, filename string) error {
+	data, err := json.MarshalIndent(s.Counters(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// saveCountersPeriodically saves the server's cumulative counters to the
+// given file at the given interval. It never returns.
+func saveCountersPeriodically(s *server.Server, filename string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := saveCounters(s, filename); err != nil {
+			log.Printf("failed to save counters: %v", err)
+		}
+	}
+}
+
+// bridgeStats contains statistics about a device bridged to the network.
+type bridgeStats struct {
+	Device string `json:"device"`
+
+	// Number of addresses in the bridge's learning table that were
+	// seen on the device.
+	Addresses int                `json:"addresses"`
+	Conflicts uint64             `json:"conflicts"`
+	Filter    []bridge.RuleStats `json:"filter,omitempty"`
+
+	// Number of packets the bridge dropped for each reason.
+	Drops map[string]uint64 `json:"drops"`
+}
+
+// bridgedDevice is a physical device that is bridged to the network.
+type bridgedDevice struct {
+	name    string
+	cfg     bridge.Config
+	bridge  *bridge.Bridge
+	p       io.ReadWriteCloser
+	segment string
+}
+
+// newBridge creates a bridge for the given device. If non-empty, rules is a
+// list of bridge filter rules to apply to the device.
+func newBridge(name string, p io.ReadWriteCloser, policy bridge.ConflictPolicy, rules string) *bridgedDevice {
+	d := &bridgedDevice{name: name, cfg: *bridge.DefaultConfig, p: p}
+	d.cfg.ConflictPolicy = policy
+	if rules != "" {
+		f, err := bridge.ParseFilter(rules)
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		d.cfg.Filter = f
+	}
+	return d
+}
+
+// start bridges the device to the network. If the conflict policy prefers
+// hosts on the LAN, conflicting clients are renumbered if they can be, or
+// otherwise disconnected from the server.
+func (d *bridgedDevice) start(v *virtual.Network, s *server.Server) {
+	if d.cfg.ConflictPolicy == bridge.PreferRemote {
+		d.cfg.OnConflict = func(addr ipx.Addr) {
+			if s.Renumber(addr) != nil {
+				s.Disconnect(addr)
+			}
+		}
+	}
+	d.bridge = bridge.New(&d.cfg)
+	tap := v.TapOnSegment(d.segment)
+	go d.bridge.Run(tap, tap, d.p, d.p)
+}
+
+// syncMACPool keeps the addresses registered on a device up to date with the
+// nodes on the network.
+func syncMACPool(v *virtual.Network, device string, p *phys.MACPool) {
+	var lastErr string
+	for {
+		err := p.Sync(v.Addrs())
+		switch {
+		case err != nil && err.Error() != lastErr:
+			log.Printf("failed to register addresses on %s: %v", device, err)
+			lastErr = err.Error()
+		case err == nil && lastErr != "":
+			log.Printf("registered all addresses on %s", device)
+			lastErr = ""
+		}
+		time.Sleep(macPoolSyncInterval)
+	}
+}
+
+// listDevices prints a table of the devices that can be bridged to, marking
+// the one that would be chosen by the --auto flag.
+func listDevices() {
+	devs, err := phys.ListDevices()
+	if err != nil {
+		log.Fatalf("failed to list devices: %v", err)
+	}
+	auto, _ := phys.AutoDevice(devs)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "\tNAME\tLINK TYPE\tSTATUS\tADDRESSES\tDESCRIPTION\n")
+	for _, dev := range devs {
+		var mark, status string
+		if dev.Name == auto.Name {
+			mark = "*"
+		}
+		switch {
+		case dev.Loopback:
+			status = "loopback"
+		case dev.Up:
+			status = "up"
+		default:
+			status = "down"
+		}
+		linkType := dev.LinkType
+		if linkType == "" {
+			linkType = "?"
+		}
+		var addrs []string
+		for _, addr := range dev.Addresses {
+			addrs = append(addrs, addr.String())
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", mark, dev.Name, linkType,
+			status, strings.Join(addrs, ","), dev.Description)
+	}
+	w.Flush()
+	if auto.Name != "" {
+		fmt.Printf("\n* = device chosen by --auto\n")
+	}
+}
+
+// describeProtocol writes a description of the protocol spoken by the server,
+// with test vectors, to stdout.
+func describeProtocol() {
+	doc, err := server.Protocol()
+	if err != nil {
+		log.Fatalf("failed to describe protocol: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(doc)
+}
+
+// runSelfTest checks that the server given on the command line is working,
+// printing a report and exiting with an error if any check fails.
+func runSelfTest(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	addr := fs.String("server", "", `Address of the server to test, eg. "ipx.example.com:10000".`)
+	timeout := fs.Duration("timeout", 2*time.Second, "Time to wait for each reply.")
+	fs.Parse(args)
+	if *addr == "" || fs.NArg() != 0 {
+		log.Fatal("usage: ipxbox selftest --server=host:port [--timeout=duration]")
+	}
+	failed := false
+	for _, r := range selftest.Run(*addr, *timeout) {
+		status := "PASS"
+		if !r.Passed {
+			status = "FAIL"
+			failed = true
+		}
+		fmt.Printf("%s %-12s %s\n", status, r.Name, r.Detail)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// runStress runs a stress test against a server, printing the result.
+func runStress(args []string) {
+	fs := flag.NewFlagSet("stress", flag.ExitOnError)
+	addr := fs.String("server", "", `Address of the server to test, eg. "localhost:10000".`)
+	workers := fs.Int("clients", 50, "Number of clients connected at once.")
+	duration := fs.Duration("duration", 30*time.Second, "How long to run for.")
+	fs.Parse(args)
+	if *addr == "" || fs.NArg() != 0 {
+		log.Fatal("usage: ipxbox stress --server=host:port [--clients=n] [--duration=duration]")
+	}
+	r := selftest.Stress(*addr, *workers, *duration)
+	fmt.Printf("registrations: %d (%d failed)\nbroadcasts: %d sent, %d received\n", r.Registrations, r.Failures, r.Sent, r.Received)
+	if r.Failures > 0 {
+		os.Exit(1)
+	}
+}
+
+// Flags can also be set with environment variables named after them, eg.
+// IPXBOX_HTTP_LISTEN sets --http_listen.
+const envPrefix = "IPXBOX_"
+
+// setFlagsFromEnv sets flags that were not given on the command line from
+// the environment, which is convenient when running in a container.
+func setFlagsFromEnv() {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envPrefix + strings.ToUpper(f.Name))
+		if !ok || set[f.Name] {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			log.Fatalf("invalid value %q for %s%s: %v", value, envPrefix, strings.ToUpper(f.Name), err)
+		}
+	})
+}
+
+// Files written by "ipxbox init".
+var initFiles = []struct {
+	name     string
+	contents string
+}{
+	{"Dockerfile", `# Builds an ipxbox image from the source in this directory, so that the
+# image runs the same version as the ipxbox that wrote this file. Built by
+# "docker compose build".
+FROM golang:1 AS build
+RUN apt-get update && apt-get install -y libpcap-dev
+WORKDIR /src
+COPY . .
+RUN go build -o /ipxbox .
+
+FROM debian:stable-slim
+RUN apt-get update && apt-get install -y libpcap0.8 && rm -rf /var/lib/apt/lists/*
+COPY --from=build /ipxbox /usr/local/bin/ipxbox
+ENTRYPOINT ["/usr/local/bin/ipxbox"]
+`},
+	{"docker-compose.yml", `# Example ipxbox deployment with several rooms. Every ipxbox flag can be
+# set with an environment variable named after it, eg. IPXBOX_HTTP_LISTEN
+# sets --http_listen.
+services:
+  ipxbox:
+    build: .
+    restart: unless-stopped
+    ports:
+      - "10000:10000/udp"
+      - "8080:8080"
+    environment:
+      IPXBOX_PORT: "10000"
+      IPXBOX_HTTP_LISTEN: ":8080"
+      # Clients join the "default" room; the admin API can move them
+      # into these rooms.
+      IPXBOX_ROOMS: "match1,match2"
+      # Change this before exposing port 8080.
+      IPXBOX_ADMIN_TOKEN: "changeme"
+    healthcheck:
+      test: ["CMD", "/usr/local/bin/ipxbox", "healthcheck", "http://localhost:8080/healthz"]
+      interval: 30s
+`},
+}
+
+// initContainer writes example files for running ipxbox in a container to
+// the current directory, which should be the top of the ipxbox source tree.
+// Existing files are not overwritten.
+func initContainer() {
+	for _, f := range initFiles {
+		file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := file.WriteString(f.contents); err != nil {
+			log.Fatal(err)
+		}
+		if err := file.Close(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("wrote %s\n", f.name)
+	}
+}
+
+// checkHealth exits with an error unless the health endpoint at the given
+// URL reports that the server is healthy. It can be used as a container
+// health check in images that have no HTTP client.
+func checkHealth(url string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("%s: %s", url, resp.Status)
+	}
+}
+
+// exportRecording writes the timeline of a match recording to stdout.
+func exportRecording(dir string) {
+	tl, err := recorder.ExportTimeline(dir, *exportTick)
+	if err != nil {
+		log.Fatalf("failed to export recording: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(tl)
+}
+
+// runCommand runs a command given on the command line instead of starting
+// the server.
+func runCommand(args []string) {
+	switch {
+	case len(args) == 2 && args[0] == "bridge" && args[1] == "list":
+		listDevices()
+	case len(args) == 3 && args[0] == "recording" && args[1] == "export":
+		exportRecording(args[2])
+	case len(args) == 1 && args[0] == "init":
+		initContainer()
+	case len(args) == 2 && args[0] == "healthcheck":
+		checkHealth(args[1])
+	case len(args) == 1 && args[0] == "protocol":
+		describeProtocol()
+	case len(args) >= 1 && args[0] == "selftest":
+		runSelfTest(args[1:])
+	case len(args) >= 1 && args[0] == "stress":
+		runStress(args[1:])
+	default:
+		log.Fatalf("unknown command %q; valid commands are: bridge list, recording export <dir>, init, healthcheck <url>, protocol, selftest --server=<addr>, stress --server=<addr>", strings.Join(args, " "))
+	}
+}
+
+// statsHandler returns an HTTP handler that serves statistics about the
+// server and network as JSON.
+func statsHandler(s *server.Server, v *virtual.Network, bridges []*bridgedDevice, ann *announce.Service, link *satelliteLink, validators map[string]*validate.Validator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := struct {
+			Server     server.Stats                     `json:"server"`
+			Listeners  []server.ListenerStats           `json:"listeners"`
+			Clients    []server.ClientStats             `json:"clients"`
+			Network    virtual.Stats                    `json:"network"`
+			Nodes      []virtual.NodeStats              `json:"nodes"`
+			Bridges    []bridgeStats                    `json:"bridges,omitempty"`
+			Event      *announce.Event                  `json:"event,omitempty"`
+			Uplink     *satellite.Stats                 `json:"uplink,omitempty"`
+			Validation map[string][]validate.CheckStats `json:"validation,omitempty"`
+		}{s.Stats(), s.Listeners(), s.ClientStats(), v.Stats(), v.NodeStats(), nil, nil, link.stats(), nil}
+		for transport, val := range validators {
+			if stats.Validation == nil {
+				stats.Validation = map[string][]validate.CheckStats{}
+			}
+			stats.Validation[transport] = val.Stats()
+		}
+		if ann != nil {
+			if e, ok := ann.Pending(); ok {
+				stats.Event = &e
+			}
+		}
+		for _, d := range bridges {
+			bs := bridgeStats{
+				Device:    d.name,
+				Conflicts: d.bridge.Conflicts(),
+				Drops:     d.bridge.Drops(),
+			}
+			for _, e := range d.bridge.Addresses() {
+				if e.LAN {
+					bs.Addresses++
+				}
+			}
+			if d.cfg.Filter != nil {
+				bs.Filter = d.cfg.Filter.Stats()
+			}
+			stats.Bridges = append(stats.Bridges, bs)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&stats)
+	})
+}
+
 func main() {
 	flag.Parse()
+	setFlagsFromEnv()
+	if flag.NArg() > 0 {
+		runCommand(flag.Args())
+		return
+	}
+
+	drop.SetSampling(*dropLogSample)
 
 	framer, ok := framers[*ethernetFraming]
 	if !ok {
 		log.Fatalf("invalid Ethernet framing %q", *ethernetFraming)
 	}
 
+	policy, ok := dropPolicies[*dropPolicy]
+	if !ok {
+		log.Fatalf("invalid drop policy %q", *dropPolicy)
+	}
+
+	hairpinPolicy, ok := hairpinPolicies[*hairpin]
+	if !ok {
+		log.Fatalf("invalid hairpin policy %q", *hairpin)
+	}
+
+	conflicts, ok := conflictPolicies[*conflictPolicy]
+	if !ok {
+		log.Fatalf("invalid conflict policy %q", *conflictPolicy)
+	}
+
+	if *vlanID > 0xfff {
+		log.Fatalf("invalid VLAN ID %d", *vlanID)
+	}
+
 	var cfg server.Config
 	cfg = *server.DefaultConfig
 	cfg.ClientTimeout = *clientTimeout
-	v := virtual.New()
+	cfg.ReceiveBufferSize = *recvBufferSize
+	cfg.SendBufferSize = *sendBufferSize
+	cfg.CrashDumpDir = *crashDumpDir
+	cfg.ResumeGracePeriod = *resumeGrace
+	cfg.TarpitDelay = *tarpitDelay
+	cfg.DailyQuota = *guestDailyLimit
+	cfg.FloodRegistrationRate = *floodRate
+	cfg.FloodClientsPerIP = *floodPerIP
+	cfg.FloodWorkBits = *floodWorkBits
+	cfg.QuotaWarningSocket = uint16(annSocket)
+	cfg.Sockets = *sockets
+	cfg.PreserveLocalAddr = *preserveLocal
+	cfg.LegacyPingReply = *legacyPing
+	cfg.Version = version
+	cfg.MOTDURL = *motdURL
+	cfg.MTUProbe = *mtuProbe
+	cfg.KeepaliveMaxTime = *keepaliveMax
+	cfg.RejoinWindow = *rejoinWindow
+	validators := map[string]*validate.Validator{}
+	for transport, spec := range map[string]string{
+		"udp":    *validateUDP,
+		"bridge": *validateBridge,
+		"uplink": *validateUplink,
+	} {
+		if spec == "" {
+			continue
+		}
+		val, err := validate.Parse(spec)
+		if err != nil {
+			log.Fatalf("invalid --validate_%s: %v", transport, err)
+		}
+		validators[transport] = val
+	}
+	cfg.Validator = validators["udp"]
+	cfg.IdleRoomTime = *idleRoomTime
+	cfg.IdleKeepaliveTime = *idleKeepalive
+	cfg.SessionLockDelay = *sessionLock
+	if *alertWebhook != "" {
+		cfg.AlertHook = func(a server.Alert) {
+			postAlert(*alertWebhook, a)
+		}
+	}
+	vcfg := &virtual.Config{
+		QueueLength: *queueLength,
+		DropPolicy:  policy,
+		Hairpin:     hairpinPolicy,
+	}
+	if *forwarding != "" {
+		rules, err := virtual.ParsePolicy(*forwarding)
+		if err != nil {
+			log.Fatalf("invalid --forwarding: %v", err)
+		}
+		vcfg.Policy = rules
+	}
+	v := virtual.NewWithConfig(vcfg)
+	var bridges []*bridgedDevice
 	if *enableTap {
 		p, err := phys.New(water.Config{})
 		if err != nil {
 			log.Fatalf("failed to start tap: %v", err)
 		}
-		tap := v.Tap()
-		go bridge.Run(tap, tap, p, p)
-	} else if *pcapDevice != "" {
-		// TODO: List
-		handle, err := pcap.OpenLive(*pcapDevice, 1500, true, pcap.BlockForever)
+		bridges = append(bridges, newBridge("tap", p, conflicts, *bridgeFilter))
+	}
+	if *autoBridge && !*enableTap && len(pcapDevices) == 0 {
+		devs, err := phys.ListDevices()
+		if err != nil {
+			log.Fatalf("failed to list devices: %v", err)
+		}
+		dev, err := phys.AutoDevice(devs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("bridging to %s", dev.Name)
+		pcapDevices = append(pcapDevices, dev.Name)
+	}
+	for _, device := range pcapDevices {
+		rules := *bridgeFilter
+		if i := strings.Index(device, "="); i >= 0 {
+			device, rules = device[:i], device[i+1:]
+		}
+		device, err := phys.FindPcapDevice(device)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handle, err := pcap.OpenLive(device, 1500, *macPool == 0, pcap.BlockForever)
 		if err != nil {
 			log.Fatalf("failed to open pcap: %v", err)
 		}
-		p, err := phys.NewPcap(handle, framer)
+		p, err := phys.NewPcapVLAN(handle, framer, uint16(*vlanID))
 		if err != nil {
 			log.Fatalf("failed to create pcap physical wrapper: %v", err)
 		}
-		tap := v.Tap()
-		go bridge.Run(tap, tap, p, p)
+		bridges = append(bridges, newBridge(device, p, conflicts, rules))
+		if *macPool != 0 {
+			pool := phys.NewMACPool(device, *macPool)
+			atExit = append(atExit, func() {
+				if err := pool.Close(); err != nil {
+					log.Printf("failed to remove addresses from %s: %v", device, err)
+				}
+			})
+			go syncMACPool(v, device, pool)
+		}
+	}
+	dumper := &packetDumper{v: v}
+	dumper.SetEnabled(*dumpPackets)
+	if *pcapFile != "" {
+		f, err := os.Create(*pcapFile)
+		if err != nil {
+			log.Fatalf("failed to open pcap file: %v", err)
+		}
+		w, err := capture.NewWriter(f)
+		if err != nil {
+			log.Fatalf("failed to write pcap file: %v", err)
+		}
+		cfg.QuarantineTap = w
+		go capturePackets(v, w)
 	}
-	if *dumpPackets {
-		go printPackets(v)
+	if *printDir != "" {
+		g, err := printgw.New(v.NewNode(), uint16(printSocket), *printDir)
+		if err != nil {
+			log.Fatalf("failed to start print gateway: %v", err)
+		}
+		go g.Run()
+	}
+	if *timeService {
+		ts, err := timesvc.New(v.NewNode(), uint16(timeSocket))
+		if err != nil {
+			log.Fatalf("failed to start time service: %v", err)
+		}
+		go ts.Run()
+	}
+
+	cfg.Tiers = map[string]server.TierLimits{
+		server.TierTrusted: {Exempt: true},
+		server.TierNormal: {
+			PacketRate:    *packetRate,
+			BroadcastRate: *broadcastRate,
+		},
+		server.TierRestricted: {
+			PacketRate:    *restrictPackets,
+			BroadcastRate: *restrictBcasts,
+		},
+	}
+	if *restrictRooms != "" {
+		limits := cfg.Tiers[server.TierRestricted]
+		for _, name := range strings.Split(*restrictRooms, ",") {
+			limits.Rooms = append(limits.Rooms, strings.TrimSpace(name))
+		}
+		cfg.Tiers[server.TierRestricted] = limits
+	}
+	// Restricted ranges come first, so that they win if the ranges
+	// overlap.
+	for _, r := range []struct{ tier, ranges string }{
+		{server.TierRestricted, *restrictRanges},
+		{server.TierTrusted, *trustedRanges},
+	} {
+		if r.ranges == "" {
+			continue
+		}
+		tr, err := server.ParseTierRanges(r.tier, r.ranges)
+		if err != nil {
+			log.Fatalf("invalid %s IP ranges: %v", r.tier, err)
+		}
+		cfg.TierRanges = append(cfg.TierRanges, tr...)
 	}
 
-	s, err := server.New(fmt.Sprintf(":%d", *port), v, &cfg)
+	if *satelliteRanges != "" {
+		for _, str := range strings.Split(*satelliteRanges, ",") {
+			_, n, err := net.ParseCIDR(strings.TrimSpace(str))
+			if err != nil {
+				log.Fatalf("invalid satellite IP range: %v", err)
+			}
+			cfg.SatelliteRanges = append(cfg.SatelliteRanges, n)
+		}
+	}
+
+	var bans *ban.Store
+	if *banFile != "" {
+		var err error
+		bans, err = ban.Open(*banFile)
+		if err != nil {
+			log.Fatalf("failed to load bans: %v", err)
+		}
+		cfg.Bans = bans
+	}
+
+	var dcfg *discovery.Config
+	if *unicastDiscover != "" {
+		dcfg = &discovery.Config{}
+		*dcfg = *discovery.DefaultConfig
+		for _, str := range strings.Split(*unicastDiscover, ",") {
+			socket, err := ipx.ParseSocket(strings.TrimSpace(str))
+			if err != nil {
+				log.Fatal(err)
+			}
+			dcfg.Sockets = append(dcfg.Sockets, uint16(socket))
+		}
+	}
+	wrap := func(v *virtual.Network) network.Network {
+		if dcfg != nil {
+			return discovery.Wrap(v, dcfg)
+		}
+		return v
+	}
+	var n network.Network = wrap(v)
+	if *isolate {
+		n = null.New()
+	}
+	var rec *recorder.Recorder
+	if *recordDir != "" {
+		rec = recorder.New(*recordDir)
+		rec.AddRoom(server.DefaultRoom, v)
+	}
+	if *roomPortStart != 0 && *rooms != "" {
+		cfg.RoomPorts = map[int]string{}
+		for i, name := range strings.Split(*rooms, ",") {
+			cfg.RoomPorts[*roomPortStart+i] = strings.TrimSpace(name)
+		}
+	}
+	if *dialAddrs != "" {
+		for _, endpoint := range strings.Split(*dialAddrs, ",") {
+			addr, err := net.ResolveUDPAddr("udp4", strings.TrimSpace(endpoint))
+			if err != nil {
+				log.Fatalf("invalid --dial endpoint %q: %v", endpoint, err)
+			}
+			cfg.DialAddrs = append(cfg.DialAddrs, addr)
+		}
+	}
+	if *redirectAddrs != "" {
+		for _, addr := range strings.Split(*redirectAddrs, ",") {
+			cfg.RedirectAddrs = append(cfg.RedirectAddrs, strings.TrimSpace(addr))
+		}
+	}
+	cfg.RedirectAbove = *redirectAbove
+	if *roomAddrs != "" {
+		cfg.RoomAddrs = map[string]string{}
+		for _, mapping := range strings.Split(*roomAddrs, ",") {
+			parts := strings.SplitN(mapping, "=", 2)
+			ip := net.ParseIP(strings.TrimSpace(parts[0]))
+			if len(parts) != 2 || ip == nil {
+				log.Fatalf("invalid --room_addrs mapping %q: want address=room", mapping)
+			}
+			cfg.RoomAddrs[ip.String()] = strings.TrimSpace(parts[1])
+		}
+		cfg.PreserveLocalAddr = true
+	}
+	if *ephemeralRooms {
+		cfg.MaxEphemeralRooms = *maxEphemeral
+		cfg.NewRoom = func(name string) (network.Network, error) {
+			rv := virtual.NewWithConfig(vcfg)
+			if rec != nil {
+				rec.AddRoom(name, rv)
+			}
+			return wrap(rv), nil
+		}
+		cfg.RoomClosed = func(name string) {
+			if rec == nil {
+				return
+			}
+			if err := rec.RemoveRoom(name); err != nil {
+				log.Printf("room %q: failed to finish recording: %v", name, err)
+			}
+		}
+	}
+	s, err := server.New(fmt.Sprintf(":%d", *port), n, &cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	s.Run()
+	if *rooms != "" {
+		for _, name := range strings.Split(*rooms, ",") {
+			name = strings.TrimSpace(name)
+			rv := virtual.NewWithConfig(vcfg)
+			s.AddRoom(name, wrap(rv))
+			if rec != nil {
+				rec.AddRoom(name, rv)
+			}
+		}
+	}
+	// When more than one device is bridged, they may well be attached
+	// to the same LAN, so broadcasts arriving through more than one of
+	// them are only delivered once.
+	if len(bridges) > 1 {
+		dedup := bridge.NewDedup()
+		for _, d := range bridges {
+			d.cfg.Dedup = dedup
+			if *bridgesShareLAN {
+				d.segment = "lan"
+			}
+		}
+	}
+	for _, d := range bridges {
+		d.cfg.Validator = validators["bridge"]
+		d.start(v, s)
+	}
+	var link *satelliteLink
+	if *uplink != "" {
+		link = &satelliteLink{validator: validators["uplink"]}
+		go link.run(v, *uplink)
+	}
+	var ann *announce.Service
+	if *eventTime != "" {
+		t, err := time.Parse(time.RFC3339, *eventTime)
+		if err != nil {
+			log.Fatalf("invalid event time: %v", err)
+		}
+		var onEvent func()
+		if *eventCloseReg {
+			onEvent = func() {
+				s.SetRegistrationClosed(true)
+			}
+		}
+		e := announce.Event{Time: t, Message: *eventMessage}
+		ann, err = announce.New(v.NewNode(), uint16(annSocket), e, onEvent)
+		if err != nil {
+			log.Fatalf("failed to start announcement service: %v", err)
+		}
+		go ann.Run()
+	}
+	// Counters are restored before the HTTP server starts, so that
+	// /stats never shows them reset.
+	if *countersFile != "" {
+		if err := loadCounters(s, *countersFile); err != nil {
+			log.Fatalf("failed to load counters: %v", err)
+		}
+		go saveCountersPeriodically(s, *countersFile, *countersEvery)
+	}
+	if *httpListen != "" {
+		hc := newHealthChecker(s)
+		http.Handle("/healthz", hc)
+		http.Handle("/readyz", readinessHandler(s, hc))
+		http.Handle("/stats", statsHandler(s, v, bridges, ann, link, validators))
+		if *roomAPI || *roomDirectory {
+			rh := admin.NewRoomHandler(s)
+			rh.SetPublicAddr(*publicHost, *port)
+			if *roomDirectory {
+				rh.EnableDirectory(*directoryToken, *directoryRate)
+			}
+			http.Handle("/rooms/", rh)
+		}
+		if *adminToken != "" {
+			ah := admin.New(s, *adminToken)
+			for _, d := range bridges {
+				ah.AddBridge(d.name, d.bridge)
+			}
+			if rec != nil {
+				ah.SetRecorder(rec)
+			}
+			if bans != nil {
+				ah.SetBans(bans)
+			}
+			ah.SetPacketDump(dumper)
+			ah.SetNetwork(v)
+			ah.SetCaptureDir(*captureDir)
+			http.Handle("/admin/", ah)
+		}
+		go func() {
+			log.Fatal(http.ListenAndServe(*httpListen, nil))
+		}()
+	}
+	switch {
+	case *drainTimeout != 0:
+		go drainOnSignal(s, *drainTimeout)
+		if len(atExit) > 0 {
+			go exitOnSignal(os.Interrupt)
+		}
+	case len(atExit) > 0:
+		go exitOnSignal(os.Interrupt, syscall.SIGTERM)
+	}
+	s.Run(context.Background())
+	exit(0)
 }
@@ -0,0 +1,176 @@
+// Package discovery implements a network wrapper that converts games'
+// discovery broadcasts into unicast packets sent only to the nodes that
+// are playing the same game. This reduces the amount of broadcast traffic
+// that nodes uninterested in a game have to process.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+// Config contains configuration parameters for discovery conversion.
+type Config struct {
+	// Broadcasts to these sockets are converted. Any node that sends a
+	// packet from one of these sockets is assumed to be playing the
+	// game that uses it.
+	Sockets []uint16
+
+	// Broadcasts are still sent as real broadcasts at least this often
+	// for each socket, so that nodes that have just started the game
+	// can be discovered.
+	RefreshInterval time.Duration
+
+	// Nodes that have not sent anything from a socket in this long are
+	// assumed to have stopped playing.
+	MaxAge time.Duration
+}
+
+var DefaultConfig = &Config{
+	RefreshInterval: 5 * time.Second,
+	MaxAge:          time.Minute,
+}
+
+// socketState tracks the nodes using a particular socket.
+type socketState struct {
+	members       map[ipx.Addr]time.Time
+	lastBroadcast time.Time
+}
+
+// Network wraps another network, converting discovery broadcasts sent by its
+// nodes into unicasts.
+type Network struct {
+	mu      sync.Mutex
+	inner   network.Network
+	config  *Config
+	sockets map[uint16]*socketState
+}
+
+type node struct {
+	network.Node
+	net *Network
+}
+
+var (
+	_ = (network.AddrNetwork)(&Network{})
+	_ = (network.Node)(&node{})
+)
+
+// Wrap returns a Network that creates nodes on the given network, converting
+// broadcasts as specified by the given config. Only packets written by nodes
+// created by the returned Network are observed and converted; nodes that
+// attach to the inner network directly (such as bridges) are never learned,
+// and only see such broadcasts when they are periodically refreshed.
+func Wrap(inner network.Network, c *Config) *Network {
+	n := &Network{
+		inner:   inner,
+		config:  c,
+		sockets: map[uint16]*socketState{},
+	}
+	for _, socket := range c.Sockets {
+		n.sockets[socket] = &socketState{
+			members: map[ipx.Addr]time.Time{},
+		}
+	}
+	return n
+}
+
+// NewNode creates a new node on the inner network.
+func (n *Network) NewNode() network.Node {
+	return &node{
+		Node: n.inner.NewNode(),
+		net:  n,
+	}
+}
+
+// NewNodeWithAddr creates a node with the given address on the inner
+// network, if it supports that.
+func (n *Network) NewNodeWithAddr(addr ipx.Addr) (network.Node, error) {
+	an, ok := n.inner.(network.AddrNetwork)
+	if !ok {
+		return nil, fmt.Errorf("inner network cannot create nodes with a given address")
+	}
+	inner, err := an.NewNodeWithAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &node{Node: inner, net: n}, nil
+}
+
+// Close closes the inner network, if it can be closed.
+func (n *Network) Close() error {
+	if c, ok := n.inner.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// observe records which sockets the sender of the given packet is using. If
+// the packet is a broadcast that should be converted, it returns the nodes
+// that it should be sent to instead.
+func (n *Network) observe(hdr *ipx.Header) ([]ipx.Addr, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	if st, ok := n.sockets[hdr.Src.Socket]; ok {
+		st.members[hdr.Src.Addr] = now
+	}
+	st, ok := n.sockets[hdr.Dest.Socket]
+	if !ok || !hdr.IsBroadcast() {
+		return nil, false
+	}
+	if now.Sub(st.lastBroadcast) >= n.config.RefreshInterval {
+		st.lastBroadcast = now
+		return nil, false
+	}
+	targets := []ipx.Addr{}
+	for addr, lastSeen := range st.members {
+		switch {
+		case now.Sub(lastSeen) > n.config.MaxAge:
+			delete(st.members, addr)
+		case addr != hdr.Src.Addr:
+			targets = append(targets, addr)
+		}
+	}
+	return targets, true
+}
+
+// Write implements the io.Writer interface.
+func (n *node) Write(packet []byte) (int, error) {
+	if err := n.WritePacket(context.Background(), packet); err != nil {
+		return 0, err
+	}
+	return len(packet), nil
+}
+
+// WritePacket writes a packet to the inner network, converting it to unicast
+// packets if it is a discovery broadcast.
+func (n *node) WritePacket(ctx context.Context, packet []byte) error {
+	var hdr ipx.Header
+	if err := hdr.UnmarshalBinary(packet); err != nil {
+		return n.Node.WritePacket(ctx, packet)
+	}
+	targets, convert := n.net.observe(&hdr)
+	if !convert {
+		return n.Node.WritePacket(ctx, packet)
+	}
+	var firstErr error
+	for _, addr := range targets {
+		hdr.Dest.Addr = addr
+		unicast, err := hdr.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		unicast = append(unicast, packet[len(unicast):]...)
+		if err := n.Node.WritePacket(ctx, unicast); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
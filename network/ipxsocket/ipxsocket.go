@@ -0,0 +1,289 @@
+// Package ipxsocket implements a socket layer on top of a network node,
+// allowing packets for several different IPX socket numbers to be sent and
+// received over a single node. The API mirrors that of the DOS IPX driver,
+// and is intended as a base for services that run inside the server.
+package ipxsocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+// Number of received packets that can be waiting to be read from a socket
+// before further packets are dropped. Like the DOS IPX driver, we drop
+// packets when nobody is listening for them rather than blocking.
+const socketQueueLength = 64
+
+// Packet type used for packets sent using WriteTo unless overridden; this is
+// the packet type for the IPX Packet Exchange Protocol.
+const packetTypePEP = 4
+
+const (
+	// Range of socket numbers that are allocated dynamically when
+	// OpenSocket is called with a socket number of zero.
+	MinDynamicSocket = 0x4000
+	MaxDynamicSocket = 0x7fff
+
+	// Maximum number of sockets that can be open at once. This is the
+	// maximum supported by the DOS IPX driver.
+	maxSockets = 150
+)
+
+// Error is an error returned by the socket layer that corresponds to one of
+// the completion codes returned by the DOS IPX driver.
+type Error struct {
+	// Code is the IPX completion code.
+	Code    byte
+	message string
+}
+
+var (
+	// ErrSocketOpen is returned by OpenSocket if the socket is already
+	// open.
+	ErrSocketOpen = &Error{0xff, "socket already open"}
+
+	// ErrSocketTableFull is returned by OpenSocket if no more sockets can
+	// be opened, or no dynamic socket number is available.
+	ErrSocketTableFull = &Error{0xfe, "socket table full"}
+
+	// ErrClosed is returned when trying to use a socket or mux that has
+	// been closed.
+	ErrClosed = errors.New("socket closed")
+)
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (IPX error 0x%02x)", e.message, e.Code)
+}
+
+// Mux demultiplexes the packets received by a node, delivering them to the
+// socket with the matching destination socket number.
+type Mux struct {
+	node network.Node
+
+	mu         sync.Mutex
+	sockets    map[uint16]*Socket
+	reserved   map[uint16]bool
+	nextSocket uint16
+	closed     bool
+}
+
+// Socket is a binding to a particular IPX socket number on a Mux.
+type Socket struct {
+	mux     *Mux
+	num     uint16
+	packets chan []byte
+	closed  chan struct{}
+	once    sync.Once
+
+	// PacketType is the IPX packet type used for packets sent from the
+	// socket. It defaults to 4 (Packet Exchange Protocol).
+	PacketType byte
+}
+
+// New creates a new Mux that receives packets from the given node. The Mux
+// takes ownership of the node, which is closed when the Mux is closed.
+func New(node network.Node) *Mux {
+	m := &Mux{
+		node:       node,
+		sockets:    map[uint16]*Socket{},
+		reserved:   map[uint16]bool{},
+		nextSocket: MinDynamicSocket,
+	}
+	go m.run()
+	return m
+}
+
+// run continually reads packets from the node and delivers them to the
+// appropriate socket. It returns when the node is closed.
+func (m *Mux) run() {
+	var buf [1500]byte
+	for {
+		n, err := m.node.Read(buf[:])
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			continue
+		}
+		var hdr ipx.Header
+		if err := hdr.UnmarshalBinary(buf[:n]); err != nil {
+			continue
+		}
+		if hdr.Dest.Addr != m.node.Address() && !hdr.IsBroadcast() {
+			continue
+		}
+		m.mu.Lock()
+		s, ok := m.sockets[hdr.Dest.Socket]
+		m.mu.Unlock()
+		if ok {
+			s.deliver(buf[:n])
+		}
+	}
+	m.Close()
+}
+
+// Address returns the IPX address of the underlying node.
+func (m *Mux) Address() ipx.Addr {
+	return m.node.Address()
+}
+
+// Reserve reserves the given socket number, so that it will never be
+// returned by dynamic allocation; it can still be opened explicitly. This is
+// useful for well-known sockets used by services or games that fall inside
+// the dynamic range.
+func (m *Mux) Reserve(num uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reserved[num] = true
+}
+
+// allocateSocket returns an unused, unreserved socket number from the dynamic
+// range. Like the DOS IPX driver, numbers are allocated in ascending order,
+// wrapping around at the end of the range, so that a recently closed socket
+// number is not immediately reused.
+func (m *Mux) allocateSocket() (uint16, error) {
+	for i := 0; i <= MaxDynamicSocket-MinDynamicSocket; i++ {
+		num := m.nextSocket
+		m.nextSocket++
+		if m.nextSocket > MaxDynamicSocket {
+			m.nextSocket = MinDynamicSocket
+		}
+		_, open := m.sockets[num]
+		if !open && !m.reserved[num] {
+			return num, nil
+		}
+	}
+	return 0, ErrSocketTableFull
+}
+
+// OpenSocket opens the given socket number, so that packets sent to it can
+// be received. If the number is zero, a socket number is allocated from the
+// dynamic range. ErrSocketOpen is returned if the socket is already open,
+// and ErrSocketTableFull if too many sockets are open.
+func (m *Mux) OpenSocket(num uint16) (*Socket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	if len(m.sockets) >= maxSockets {
+		return nil, ErrSocketTableFull
+	}
+	if num == 0 {
+		var err error
+		num, err = m.allocateSocket()
+		if err != nil {
+			return nil, err
+		}
+	} else if _, ok := m.sockets[num]; ok {
+		return nil, ErrSocketOpen
+	}
+	s := &Socket{
+		mux:        m,
+		num:        num,
+		packets:    make(chan []byte, socketQueueLength),
+		closed:     make(chan struct{}),
+		PacketType: packetTypePEP,
+	}
+	m.sockets[num] = s
+	return s, nil
+}
+
+// Close closes all open sockets and the underlying node.
+func (m *Mux) Close() error {
+	m.mu.Lock()
+	sockets := []*Socket{}
+	for _, s := range m.sockets {
+		sockets = append(sockets, s)
+	}
+	m.closed = true
+	m.mu.Unlock()
+	for _, s := range sockets {
+		s.Close()
+	}
+	return m.node.Close()
+}
+
+// deliver queues a received packet to be read from the socket; the packet
+// is dropped if the queue is full.
+func (s *Socket) deliver(packet []byte) {
+	p := make([]byte, len(packet))
+	copy(p, packet)
+	select {
+	case s.packets <- p:
+	default:
+	}
+}
+
+// Addr returns the full IPX address of the socket.
+func (s *Socket) Addr() ipx.HeaderAddr {
+	return ipx.HeaderAddr{
+		Addr:   s.mux.Address(),
+		Socket: s.num,
+	}
+}
+
+// ReadFrom blocks until a packet is received on the socket or the context is
+// cancelled. The packet's payload (the data following the IPX header) is
+// copied into p and the packet's header is returned.
+func (s *Socket) ReadFrom(ctx context.Context, p []byte) (int, *ipx.Header, error) {
+	select {
+	case packet := <-s.packets:
+		var hdr ipx.Header
+		if err := hdr.UnmarshalBinary(packet); err != nil {
+			return 0, nil, err
+		}
+		return copy(p, packet[30:]), &hdr, nil
+	case <-s.closed:
+		return 0, nil, ErrClosed
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+// WriteTo sends a packet with the given payload from the socket to the given
+// destination address.
+func (s *Socket) WriteTo(ctx context.Context, p []byte, dest ipx.HeaderAddr) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, ErrClosed
+	default:
+	}
+	if len(p) > 1500-30 {
+		return 0, fmt.Errorf("packet too large: %d bytes", len(p))
+	}
+	hdr := &ipx.Header{
+		Checksum:   0xffff,
+		Length:     uint16(30 + len(p)),
+		PacketType: s.PacketType,
+		Dest:       dest,
+		Src:        s.Addr(),
+	}
+	encoded, err := hdr.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	if err := s.mux.node.WritePacket(ctx, append(encoded, p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the socket, so that packets sent to its socket number are no
+// longer received. The socket number can then be opened again.
+func (s *Socket) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+		s.mux.mu.Lock()
+		if s.mux.sockets[s.num] == s {
+			delete(s.mux.sockets, s.num)
+		}
+		s.mux.mu.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,162 @@
+package ipxsocket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+// openSocket opens the given socket number, failing the test on error.
+func openSocket(t *testing.T, m *Mux, num uint16) *Socket {
+	s, err := m.OpenSocket(num)
+	if err != nil {
+		t.Fatalf("OpenSocket(0x%04x) failed: %v", num, err)
+	}
+	return s
+}
+
+func TestDynamicAllocation(t *testing.T) {
+	m := New(virtual.New().NewNode())
+	defer m.Close()
+	m.Reserve(MinDynamicSocket + 1)
+	openSocket(t, m, MinDynamicSocket+2)
+
+	// Sockets are allocated in ascending order, skipping the reserved
+	// and open sockets.
+	for _, want := range []uint16{MinDynamicSocket, MinDynamicSocket + 3} {
+		if got := openSocket(t, m, 0).num; got != want {
+			t.Errorf("allocated socket 0x%04x, want 0x%04x", got, want)
+		}
+	}
+
+	// Closing a socket does not make it the next one allocated.
+	s := openSocket(t, m, 0)
+	s.Close()
+	if got := openSocket(t, m, 0).num; got != s.num+1 {
+		t.Errorf("allocated socket 0x%04x after closing 0x%04x, want 0x%04x", got, s.num, s.num+1)
+	}
+
+	// Allocation wraps around at the end of the range, to the first
+	// socket that is free.
+	m.nextSocket = MaxDynamicSocket
+	for _, want := range []uint16{MaxDynamicSocket, MinDynamicSocket + 4} {
+		if got := openSocket(t, m, 0).num; got != want {
+			t.Errorf("allocated socket 0x%04x, want 0x%04x", got, want)
+		}
+	}
+}
+
+func TestSocketOpen(t *testing.T) {
+	m := New(virtual.New().NewNode())
+	defer m.Close()
+	s := openSocket(t, m, 0x869c)
+	_, err := m.OpenSocket(0x869c)
+	if err != ErrSocketOpen {
+		t.Fatalf("opening socket twice = %v, want ErrSocketOpen", err)
+	}
+	if code := err.(*Error).Code; code != 0xff {
+		t.Errorf("ErrSocketOpen has code 0x%02x, want 0xff", code)
+	}
+	// The socket can be opened again once it is closed.
+	s.Close()
+	openSocket(t, m, 0x869c)
+}
+
+func TestSocketTableFull(t *testing.T) {
+	m := New(virtual.New().NewNode())
+	defer m.Close()
+	var sockets []*Socket
+	for i := 0; i < maxSockets; i++ {
+		sockets = append(sockets, openSocket(t, m, 0))
+	}
+	for _, num := range []uint16{0, 0x869c} {
+		_, err := m.OpenSocket(num)
+		if err != ErrSocketTableFull {
+			t.Fatalf("OpenSocket(0x%04x) with %d open = %v, want ErrSocketTableFull", num, maxSockets, err)
+		}
+		if code := err.(*Error).Code; code != 0xfe {
+			t.Errorf("ErrSocketTableFull has code 0x%02x, want 0xfe", code)
+		}
+	}
+	sockets[0].Close()
+	openSocket(t, m, 0x869c)
+}
+
+// readPacket reads a packet from the given socket, returning nil if none
+// arrives.
+func readPacket(s *Socket) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var buf [1500]byte
+	n, _, err := s.ReadFrom(ctx, buf[:])
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+func TestDelivery(t *testing.T) {
+	v := virtual.New()
+	sender := New(v.NewNode())
+	defer sender.Close()
+	m1, m2 := New(v.NewNode()), New(v.NewNode())
+	defer m1.Close()
+	defer m2.Close()
+	src := openSocket(t, sender, 0x5000)
+	s1a, s1b := openSocket(t, m1, 0x6000), openSocket(t, m1, 0x6001)
+	s2a := openSocket(t, m2, 0x6000)
+
+	ctx := context.Background()
+	tests := []struct {
+		dest ipx.HeaderAddr
+		want []*Socket
+	}{
+		// Packets are delivered by destination socket.
+		{ipx.HeaderAddr{Addr: m1.Address(), Socket: 0x6000}, []*Socket{s1a}},
+		{ipx.HeaderAddr{Addr: m1.Address(), Socket: 0x6001}, []*Socket{s1b}},
+		{ipx.HeaderAddr{Addr: m2.Address(), Socket: 0x6000}, []*Socket{s2a}},
+		// Nobody has this socket open.
+		{ipx.HeaderAddr{Addr: m1.Address(), Socket: 0x6002}, nil},
+		// Broadcasts go to the socket on every node.
+		{ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 0x6000}, []*Socket{s1a, s2a}},
+	}
+	for _, test := range tests {
+		if _, err := src.WriteTo(ctx, []byte("hello"), test.dest); err != nil {
+			t.Fatalf("WriteTo(%s) failed: %v", test.dest, err)
+		}
+		for _, s := range []*Socket{s1a, s1b, s2a} {
+			wantPacket := false
+			for _, w := range test.want {
+				wantPacket = wantPacket || w == s
+			}
+			got := readPacket(s)
+			switch {
+			case wantPacket && string(got) != "hello":
+				t.Errorf("packet to %s: socket %s got %q, want \"hello\"", test.dest, s.Addr(), got)
+			case !wantPacket && got != nil:
+				t.Errorf("packet to %s: socket %s got a packet, want none", test.dest, s.Addr())
+			}
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	v := virtual.New()
+	m := New(v.NewNode())
+	s := openSocket(t, m, 0x6000)
+	s.Close()
+	var buf [1500]byte
+	if _, _, err := s.ReadFrom(context.Background(), buf[:]); err != ErrClosed {
+		t.Errorf("ReadFrom on a closed socket = %v, want ErrClosed", err)
+	}
+	if _, err := s.WriteTo(context.Background(), nil, s.Addr()); err != ErrClosed {
+		t.Errorf("WriteTo on a closed socket = %v, want ErrClosed", err)
+	}
+	m.Close()
+	if _, err := m.OpenSocket(0); err != ErrClosed {
+		t.Errorf("OpenSocket on a closed mux = %v, want ErrClosed", err)
+	}
+}
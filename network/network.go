@@ -2,6 +2,7 @@
 package network
 
 import (
+	"context"
 	"io"
 
 	"github.com/fragglet/ipxbox/ipx"
@@ -13,10 +14,32 @@ type Network interface {
 	NewNode() Node
 }
 
-// Node represents a node attached to an IPX network.
+// AddrNetwork is implemented by networks that can create a node with a
+// particular address, eg. so that a client can be moved from one network to
+// another without its address changing.
+type AddrNetwork interface {
+	Network
+
+	// NewNodeWithAddr creates a new node with the given address. An
+	// error is returned if the address is already in use.
+	NewNodeWithAddr(addr ipx.Addr) (Node, error)
+}
+
+// Node represents a node attached to an IPX network. Read and Write are
+// equivalent to ReadPacket and WritePacket called with a context that is
+// never cancelled.
 type Node interface {
 	io.ReadWriteCloser
 
+	// ReadPacket reads a packet from the network, blocking until a
+	// packet is received, the node is closed (in which case io.EOF is
+	// returned), or the context is cancelled.
+	ReadPacket(ctx context.Context, data []byte) (int, error)
+
+	// WritePacket writes a packet into the network. It returns an error
+	// without writing the packet if the context is already cancelled.
+	WritePacket(ctx context.Context, packet []byte) error
+
 	// Address returns the IPX address of the node.
 	Address() ipx.Addr
 }
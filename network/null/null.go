@@ -0,0 +1,106 @@
+// Package null implements an IPX network where nodes are completely isolated:
+// packets written to a node are discarded, and nothing is ever received. It
+// is useful as a baseline when benchmarking, and for accepting clients while
+// isolating them from each other.
+package null
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"sync"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+// Source of random node addresses; tests replace it.
+var randRead = rand.Read
+
+// Network is a network where nodes cannot communicate.
+type Network struct {
+	mu    sync.Mutex
+	addrs map[ipx.Addr]bool
+}
+
+type node struct {
+	net       *Network
+	addr      ipx.Addr
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var (
+	_ = (network.Network)(&Network{})
+	_ = (network.Node)(&node{})
+)
+
+// New creates a new null network.
+func New() *Network {
+	return &Network{
+		addrs: map[ipx.Addr]bool{},
+	}
+}
+
+// NewNode creates a new node on the network. Like nodes on other networks,
+// each node is assigned a unique address, which is never one of the
+// addresses that the server reserves for its own use (see virtual.Reserved).
+func (n *Network) NewNode() network.Node {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		var addr ipx.Addr
+		addr[0] = 0x02
+		randRead(addr[1:])
+		if !n.addrs[addr] && !virtual.Reserved(addr) {
+			n.addrs[addr] = true
+			return &node{
+				net:    n,
+				addr:   addr,
+				closed: make(chan struct{}),
+			}
+		}
+	}
+}
+
+// Read blocks until the node is closed, then returns io.EOF.
+func (n *node) Read(data []byte) (int, error) {
+	return n.ReadPacket(context.Background(), data)
+}
+
+// ReadPacket blocks until the node is closed or the context is cancelled.
+func (n *node) ReadPacket(ctx context.Context, data []byte) (int, error) {
+	select {
+	case <-n.closed:
+		return 0, io.EOF
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Write discards the given packet.
+func (n *node) Write(packet []byte) (int, error) {
+	return len(packet), nil
+}
+
+// WritePacket discards the given packet.
+func (n *node) WritePacket(ctx context.Context, packet []byte) error {
+	return ctx.Err()
+}
+
+// Address returns the address of the node.
+func (n *node) Address() ipx.Addr {
+	return n.addr
+}
+
+// Close closes the node; any blocked calls to Read() will return io.EOF.
+func (n *node) Close() error {
+	n.closeOnce.Do(func() {
+		close(n.closed)
+		n.net.mu.Lock()
+		delete(n.net.addrs, n.addr)
+		n.net.mu.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,32 @@
+package null
+
+import (
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+// TestReservedAddrs checks that nodes are never given addresses that the
+// server reserves for its own use.
+func TestReservedAddrs(t *testing.T) {
+	reserved := ipx.Addr{0x02, 0xff, 0xff, 0xfe, 0x05, 0xc0}
+	ordinary := ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	addrs := []ipx.Addr{reserved, reserved, ordinary}
+	oldRandRead := randRead
+	defer func() { randRead = oldRandRead }()
+	randRead = func(b []byte) (int, error) {
+		copy(b, addrs[0][1:])
+		addrs = addrs[1:]
+		return len(b), nil
+	}
+
+	node := New().NewNode()
+	defer node.Close()
+	if virtual.Reserved(node.Address()) {
+		t.Errorf("node was given reserved address %s", node.Address())
+	}
+	if got := node.Address(); got != ordinary {
+		t.Errorf("node was given address %s, want %s", got, ordinary)
+	}
+}
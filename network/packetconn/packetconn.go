@@ -0,0 +1,212 @@
+// Package packetconn implements an adapter that allows a network node to be
+// used as a standard net.PacketConn, so that existing Go networking code can
+// run over an IPX network.
+package packetconn
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+// Addr is the net.Addr implementation used by Conn; it identifies an IPX
+// node and socket number.
+type Addr struct {
+	ipx.HeaderAddr
+}
+
+// Conn adapts a network.Node to the net.PacketConn interface. A Conn is
+// bound to a single IPX socket number on the node; packets received by the
+// node for any other socket are discarded.
+type Conn struct {
+	node  network.Node
+	local Addr
+
+	mu              sync.Mutex
+	readDeadline    time.Time
+	writeDeadline   time.Time
+	deadlineChanged chan struct{}
+}
+
+var (
+	_ = (net.Addr)(&Addr{})
+	_ = (net.PacketConn)(&Conn{})
+)
+
+// Packet type used for packets sent using WriteTo; this is the packet type
+// for the IPX Packet Exchange Protocol.
+const packetTypePEP = 4
+
+func (a *Addr) Network() string {
+	return "ipx"
+}
+
+// New creates a new Conn that sends and receives packets on the given IPX
+// socket number. The Conn takes ownership of the node, which is closed when
+// the Conn is closed.
+func New(node network.Node, socket uint16) *Conn {
+	return &Conn{
+		node: node,
+		local: Addr{ipx.HeaderAddr{
+			Addr:   node.Address(),
+			Socket: socket,
+		}},
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+// deadlineContext returns a context that expires at the given deadline, or
+// is cancelled if the deadline is changed.
+func (c *Conn) deadlineContext(deadline *time.Time) (context.Context, context.CancelFunc) {
+	c.mu.Lock()
+	d, changed := *deadline, c.deadlineChanged
+	c.mu.Unlock()
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if !d.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, d)
+	}
+	ctx, cancel2 := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-changed:
+			cancel2()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		cancel2()
+		cancel()
+	}
+}
+
+// isForUs returns true if the given packet header is addressed to this Conn.
+func (c *Conn) isForUs(hdr *ipx.Header) bool {
+	if hdr.Dest.Socket != c.local.Socket {
+		return false
+	}
+	return hdr.Dest.Addr == c.local.Addr || hdr.IsBroadcast()
+}
+
+// readPacket reads the next packet addressed to this Conn, copying its
+// payload into p and returning the payload length and source address.
+func (c *Conn) readPacket(ctx context.Context, p []byte) (int, *Addr, error) {
+	var buf [1500]byte
+	for {
+		n, err := c.node.ReadPacket(ctx, buf[:])
+		switch {
+		case err == io.EOF:
+			return 0, nil, net.ErrClosed
+		case err != nil:
+			return 0, nil, err
+		}
+		var hdr ipx.Header
+		if err := hdr.UnmarshalBinary(buf[:n]); err != nil || !c.isForUs(&hdr) {
+			continue
+		}
+		return copy(p, buf[30:n]), &Addr{hdr.Src}, nil
+	}
+}
+
+// ReadFrom reads a packet sent to the Conn's socket, copying the payload
+// into p and returning the address of the sender.
+func (c *Conn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		ctx, cancel := c.deadlineContext(&c.readDeadline)
+		n, addr, err := c.readPacket(ctx, p)
+		cancel()
+		switch {
+		case err == context.DeadlineExceeded:
+			return 0, nil, c.opError("read", nil, os.ErrDeadlineExceeded)
+		case err == context.Canceled:
+			// Deadline was changed; try again.
+			continue
+		case err != nil:
+			return 0, nil, c.opError("read", nil, err)
+		}
+		return n, addr, nil
+	}
+}
+
+// WriteTo sends a packet with the given payload to the given address, which
+// must be an *Addr.
+func (c *Conn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	dest, ok := addr.(*Addr)
+	if !ok {
+		return 0, c.opError("write", addr, fmt.Errorf("invalid address type %T", addr))
+	}
+	if len(p) > 1500-30 {
+		return 0, c.opError("write", addr, fmt.Errorf("packet too large: %d bytes", len(p)))
+	}
+	hdr := &ipx.Header{
+		Checksum:   0xffff,
+		Length:     uint16(30 + len(p)),
+		PacketType: packetTypePEP,
+		Dest:       dest.HeaderAddr,
+		Src:        c.local.HeaderAddr,
+	}
+	encoded, err := hdr.MarshalBinary()
+	if err != nil {
+		return 0, c.opError("write", addr, err)
+	}
+	ctx, cancel := c.deadlineContext(&c.writeDeadline)
+	defer cancel()
+	switch err := c.node.WritePacket(ctx, append(encoded, p...)); {
+	case err == context.DeadlineExceeded:
+		return 0, c.opError("write", addr, os.ErrDeadlineExceeded)
+	case err != nil:
+		return 0, c.opError("write", addr, err)
+	}
+	return len(p), nil
+}
+
+func (c *Conn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    c.local.Network(),
+		Source: &c.local,
+		Addr:   addr,
+		Err:    err,
+	}
+}
+
+// Close closes the Conn and its underlying node.
+func (c *Conn) Close() error {
+	return c.node.Close()
+}
+
+// LocalAddr returns the IPX address and socket number of the Conn.
+func (c *Conn) LocalAddr() net.Addr {
+	return &c.local
+}
+
+// setDeadlines updates the given deadlines and interrupts any blocked calls
+// so that they pick up the new deadline.
+func (c *Conn) setDeadlines(t time.Time, deadlines ...*time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, d := range deadlines {
+		*d = t
+	}
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.setDeadlines(t, &c.readDeadline, &c.writeDeadline)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.setDeadlines(t, &c.readDeadline)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.setDeadlines(t, &c.writeDeadline)
+}
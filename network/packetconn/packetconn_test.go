@@ -0,0 +1,123 @@
+package packetconn
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+// newPair returns two Conns on the same network, bound to the given socket
+// numbers.
+func newPair(t *testing.T, socketA, socketB uint16) (*Conn, *Conn) {
+	v := virtual.New()
+	a, b := New(v.NewNode(), socketA), New(v.NewNode(), socketB)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// isTimeout returns true if the given error is a deadline being exceeded.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) && errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func TestReadFrom(t *testing.T) {
+	a, b := newPair(t, 0x4002, 0x869c)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+
+	// Packets for other sockets are not received.
+	other := &Addr{b.local.HeaderAddr}
+	other.Socket = 0x869d
+	a.WriteTo([]byte("other socket"), other)
+
+	broadcast := &Addr{ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 0x869c}}
+	for _, dest := range []net.Addr{b.LocalAddr(), broadcast} {
+		if _, err := a.WriteTo([]byte("hello"), dest); err != nil {
+			t.Fatalf("WriteTo(%s) failed: %v", dest, err)
+		}
+		var buf [1500]byte
+		n, addr, err := b.ReadFrom(buf[:])
+		if err != nil {
+			t.Fatalf("ReadFrom failed: %v", err)
+		}
+		if got := string(buf[:n]); got != "hello" {
+			t.Errorf("read %q, want \"hello\"", got)
+		}
+		if got, want := addr.(*Addr).HeaderAddr, a.local.HeaderAddr; got != want {
+			t.Errorf("packet to %s came from %s, want %s", dest, got, want)
+		}
+	}
+}
+
+func TestWriteToInvalidAddress(t *testing.T) {
+	a, _ := newPair(t, 0x4002, 0x869c)
+	if _, err := a.WriteTo(nil, &net.UDPAddr{}); err == nil {
+		t.Errorf("WriteTo with a UDP address succeeded")
+	}
+	if _, err := a.WriteTo(make([]byte, 1500), a.LocalAddr()); err == nil {
+		t.Errorf("WriteTo with an oversized packet succeeded")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	_, b := newPair(t, 0x4002, 0x869c)
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var buf [1500]byte
+	if _, _, err := b.ReadFrom(buf[:]); !isTimeout(err) {
+		t.Errorf("ReadFrom after deadline = %v, want timeout", err)
+	}
+	// Changing the deadline interrupts a blocked read, which then
+	// waits for the new deadline.
+	b.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	}()
+	start := time.Now()
+	if _, _, err := b.ReadFrom(buf[:]); !isTimeout(err) {
+		t.Errorf("ReadFrom after deadline was set = %v, want timeout", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("ReadFrom returned after %v, before the new deadline", d)
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	a, b := newPair(t, 0x4002, 0x869c)
+	a.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := a.WriteTo([]byte("hello"), b.LocalAddr()); !isTimeout(err) {
+		t.Errorf("WriteTo after deadline = %v, want timeout", err)
+	}
+	a.SetWriteDeadline(time.Time{})
+	if _, err := a.WriteTo([]byte("hello"), b.LocalAddr()); err != nil {
+		t.Errorf("WriteTo after deadline was cleared failed: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	_, b := newPair(t, 0x4002, 0x869c)
+	result := make(chan error)
+	go func() {
+		var buf [1500]byte
+		_, _, err := b.ReadFrom(buf[:])
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	b.Close()
+	select {
+	case err := <-result:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("ReadFrom after Close = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ReadFrom did not return after Close")
+	}
+}
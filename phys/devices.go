@@ -0,0 +1,121 @@
+package phys
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// FindPcapDevice returns the pcap name of a network device. As well as the
+// pcap name itself, the device can be identified by its pcap description or
+// by the OS's name for the interface. On Windows, Npcap device names look
+// like "\Device\NPF_{GUID}", so this allows the friendly name shown in the
+// control panel (eg. "Ethernet") to be used instead.
+func FindPcapDevice(name string) (string, error) {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return "", err
+	}
+	for _, dev := range devs {
+		if dev.Name == name {
+			return dev.Name, nil
+		}
+	}
+	for _, dev := range devs {
+		if strings.EqualFold(dev.Description, name) {
+			return dev.Name, nil
+		}
+	}
+	// There is no direct mapping between OS interface names and pcap
+	// device names, so match them up by IP address.
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("no such device %q", name)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		for _, dev := range devs {
+			for _, devAddr := range dev.Addresses {
+				if devAddr.IP.Equal(ipnet.IP) {
+					return dev.Name, nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("interface %q found, but no matching pcap device; "+
+		"it must have an IP address to be found by name", name)
+}
+
+// Flags from the pcap_if struct.
+const (
+	pcapIfLoopback = 0x1
+	pcapIfUp       = 0x2
+)
+
+// DeviceInfo describes a network device that can be used for bridging.
+type DeviceInfo struct {
+	Name        string
+	Description string
+	Addresses   []net.IP
+	Loopback    bool
+	Up          bool
+
+	// Link type of the device, eg. "Ethernet". This is empty if the
+	// device could not be opened to find out.
+	LinkType string
+}
+
+// ListDevices returns all network devices that pcap can capture from.
+func ListDevices() ([]DeviceInfo, error) {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+	var result []DeviceInfo
+	for _, dev := range devs {
+		info := DeviceInfo{
+			Name:        dev.Name,
+			Description: dev.Description,
+			Loopback:    dev.Flags&pcapIfLoopback != 0,
+			Up:          dev.Flags&pcapIfUp != 0,
+		}
+		for _, addr := range dev.Addresses {
+			info.Addresses = append(info.Addresses, addr.IP)
+		}
+		if handle, err := pcap.OpenLive(dev.Name, 1500, false, time.Millisecond); err == nil {
+			info.LinkType = handle.LinkType().String()
+			handle.Close()
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+// AutoDevice picks a sensible device to bridge to from the given list: the
+// first Ethernet device that is up and has an IPv4 address, which is likely
+// to be the device that connects to the local network.
+func AutoDevice(devs []DeviceInfo) (DeviceInfo, error) {
+	for _, dev := range devs {
+		if dev.Loopback || !dev.Up || dev.LinkType != layers.LinkTypeEthernet.String() {
+			continue
+		}
+		for _, addr := range dev.Addresses {
+			if addr.To4() != nil && !addr.IsLoopback() && !addr.IsLinkLocalUnicast() {
+				return dev, nil
+			}
+		}
+	}
+	return DeviceInfo{}, errors.New("no suitable device found; use --pcap_device to choose one")
+}
@@ -46,6 +46,11 @@ func GetIPXPayload(pkt gopacket.Packet) ([]byte, bool) {
 	if eth == nil {
 		return nil, false
 	}
+	if len(nextLayers) > 0 {
+		if tag, ok := nextLayers[0].(*layers.Dot1Q); ok {
+			return getTaggedIPXPayload(tag)
+		}
+	}
 	switch eth.EthernetType {
 	case etherTypeIPX:
 		// ETHERNET_II framing type.
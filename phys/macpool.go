@@ -0,0 +1,86 @@
+package phys
+
+import (
+	"net"
+	"sync"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// MACPool registers the addresses of nodes on the virtual network as
+// secondary unicast addresses on a physical network interface. The interface
+// then accepts frames sent to those nodes without needing to be put into
+// promiscuous mode, which some networks and hypervisors forbid.
+type MACPool struct {
+	ifname   string
+	maxAddrs int
+
+	mu     sync.Mutex
+	addrs  map[ipx.Addr]bool
+	closed bool
+}
+
+// NewMACPool creates a MACPool that registers at most maxAddrs addresses on
+// the named interface.
+func NewMACPool(ifname string, maxAddrs int) *MACPool {
+	return &MACPool{
+		ifname:   ifname,
+		maxAddrs: maxAddrs,
+		addrs:    map[ipx.Addr]bool{},
+	}
+}
+
+// Sync updates the addresses registered on the interface to match the given
+// list, removing any that are no longer present. If there are more than the
+// maximum number of addresses, the extra ones are not registered. The first
+// error encountered is returned, but Sync continues past errors so that one
+// bad address does not prevent the others from being registered. Once the
+// pool is closed, Sync does nothing.
+func (p *MACPool) Sync(addrs []ipx.Addr) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	return p.sync(addrs)
+}
+
+// sync implements Sync. The caller must hold the mutex.
+func (p *MACPool) sync(addrs []ipx.Addr) error {
+	var firstErr error
+	wanted := map[ipx.Addr]bool{}
+	for _, addr := range addrs {
+		wanted[addr] = true
+	}
+	for addr := range p.addrs {
+		if wanted[addr] {
+			continue
+		}
+		if err := setUnicastAddr(p.ifname, net.HardwareAddr(addr[:]), false); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(p.addrs, addr)
+	}
+	for _, addr := range addrs {
+		if p.addrs[addr] || len(p.addrs) >= p.maxAddrs {
+			continue
+		}
+		if err := setUnicastAddr(p.ifname, net.HardwareAddr(addr[:]), true); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		p.addrs[addr] = true
+	}
+	return firstErr
+}
+
+// Close removes all addresses that were registered on the interface. It is
+// safe to call while another goroutine is calling Sync.
+func (p *MACPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return p.sync(nil)
+}
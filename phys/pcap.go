@@ -3,6 +3,7 @@
 package phys
 
 import (
+	"fmt"
 	"io"
 	"net"
 
@@ -19,10 +20,25 @@ type PcapPhys struct {
 	handle *pcap.Handle
 	ps     *gopacket.PacketSource
 	framer Framer
+	vlan   uint16
 }
 
 func NewPcap(handle *pcap.Handle, framer Framer) (*PcapPhys, error) {
-	if err := handle.SetBPFFilter("ipx"); err != nil {
+	return NewPcapVLAN(handle, framer, 0)
+}
+
+// NewPcapVLAN is like NewPcap, but if vlan is non-zero, only packets with an
+// 802.1Q tag for that VLAN are received, and sent packets are tagged.
+func NewPcapVLAN(handle *pcap.Handle, framer Framer, vlan uint16) (*PcapPhys, error) {
+	filter := "ipx"
+	if vlan != 0 {
+		if vlan > 0xfff {
+			return nil, fmt.Errorf("invalid VLAN ID %d", vlan)
+		}
+		filter = fmt.Sprintf("vlan %d and ipx", vlan)
+		framer = VLANFramer(framer, vlan)
+	}
+	if err := handle.SetBPFFilter(filter); err != nil {
 		return nil, err
 	}
 	ps := gopacket.NewPacketSource(handle, handle.LinkType())
@@ -30,6 +46,7 @@ func NewPcap(handle *pcap.Handle, framer Framer) (*PcapPhys, error) {
 		handle: handle,
 		ps:     ps,
 		framer: framer,
+		vlan:   vlan,
 	}, nil
 }
 
@@ -46,6 +63,9 @@ func (p *PcapPhys) Read(result []byte) (int, error) {
 		if err != nil {
 			return 0, nil
 		}
+		if vlan, _ := getVLAN(pkt); vlan != p.vlan {
+			continue
+		}
 		payload, ok := GetIPXPayload(pkt)
 		if ok {
 			cnt := len(payload)
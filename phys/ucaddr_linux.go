@@ -0,0 +1,101 @@
+package phys
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Netlink constants not defined by the syscall package.
+const (
+	nudPermanent = 0x80
+	ntfSelf      = 0x02
+	ndaLLAddr    = 2
+	sizeofNdMsg  = 12
+)
+
+// ndMsg is the Linux struct ndmsg.
+type ndMsg struct {
+	Family  uint8
+	Pad1    uint8
+	Pad2    uint16
+	Ifindex int32
+	State   uint16
+	Flags   uint8
+	Type    uint8
+}
+
+// setUnicastAddr adds or removes a secondary unicast address on the given
+// network interface, so that the interface accepts frames sent to that
+// address without being in promiscuous mode. This is the equivalent of
+// "bridge fdb add <addr> dev <ifname> self permanent".
+func setUnicastAddr(ifname string, addr net.HardwareAddr, add bool) error {
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return err
+	}
+
+	attrLen := syscall.SizeofRtAttr + len(addr)
+	msgLen := syscall.SizeofNlMsghdr + sizeofNdMsg + (attrLen+3)&^3
+	msg := make([]byte, msgLen)
+	hdr := (*syscall.NlMsghdr)(unsafe.Pointer(&msg[0]))
+	*hdr = syscall.NlMsghdr{
+		Len:   uint32(msgLen),
+		Type:  syscall.RTM_DELNEIGH,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,
+		Seq:   1,
+	}
+	if add {
+		hdr.Type = syscall.RTM_NEWNEIGH
+		hdr.Flags |= syscall.NLM_F_CREATE | syscall.NLM_F_EXCL
+	}
+	*(*ndMsg)(unsafe.Pointer(&msg[syscall.SizeofNlMsghdr])) = ndMsg{
+		Family:  syscall.AF_BRIDGE,
+		Ifindex: int32(ifi.Index),
+		State:   nudPermanent,
+		Flags:   ntfSelf,
+	}
+	attrOffset := syscall.SizeofNlMsghdr + sizeofNdMsg
+	*(*syscall.RtAttr)(unsafe.Pointer(&msg[attrOffset])) = syscall.RtAttr{
+		Len:  uint16(attrLen),
+		Type: ndaLLAddr,
+	}
+	copy(msg[attrOffset+syscall.SizeofRtAttr:], addr)
+
+	if err := syscall.Sendto(fd, msg, 0, sa); err != nil {
+		return err
+	}
+	buf := make([]byte, syscall.Getpagesize())
+	n, _, err := syscall.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return err
+	}
+	replies, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if reply.Header.Type != syscall.NLMSG_ERROR || len(reply.Data) < 4 {
+			continue
+		}
+		errno := -*(*int32)(unsafe.Pointer(&reply.Data[0]))
+		switch {
+		case errno == 0:
+		case add && syscall.Errno(errno) == syscall.EEXIST:
+		case !add && syscall.Errno(errno) == syscall.ENOENT:
+		default:
+			return fmt.Errorf("%s: %v", ifname, syscall.Errno(errno))
+		}
+	}
+	return nil
+}
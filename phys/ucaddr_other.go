@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package phys
+
+import (
+	"errors"
+	"net"
+)
+
+// setUnicastAddr adds or removes a secondary unicast address on the given
+// network interface. This is only supported on Linux.
+func setUnicastAddr(ifname string, addr net.HardwareAddr, add bool) error {
+	return errors.New("adding unicast addresses to interfaces not supported on this OS")
+}
@@ -0,0 +1,81 @@
+package phys
+
+import (
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type vlanFramer struct {
+	framer Framer
+	vlan   uint16
+}
+
+// VLANFramer returns a Framer that wraps the frames generated by the given
+// Framer in an 802.1Q tag with the given VLAN ID.
+func VLANFramer(framer Framer, vlan uint16) Framer {
+	return vlanFramer{framer, vlan}
+}
+
+func (f vlanFramer) Frame(dest net.HardwareAddr, packet []byte) ([]gopacket.SerializableLayer, error) {
+	ls, err := f.framer.Frame(dest, packet)
+	if err != nil {
+		return nil, err
+	}
+	eth := ls[0].(*layers.Ethernet)
+	tag := &layers.Dot1Q{
+		VLANIdentifier: f.vlan,
+		Type:           eth.EthernetType,
+	}
+	// With the 802.2, SNAP and raw framing types, the field after the
+	// tag holds the frame length rather than an Ethernet type.
+	if eth.Length != 0 || eth.EthernetType == layers.EthernetTypeLLC {
+		tag.Type = layers.EthernetType(eth.Length)
+	}
+	outer := &layers.Ethernet{
+		SrcMAC:       eth.SrcMAC,
+		DstMAC:       eth.DstMAC,
+		EthernetType: layers.EthernetTypeDot1Q,
+	}
+	return append([]gopacket.SerializableLayer{outer, tag}, ls[1:]...), nil
+}
+
+// getVLAN returns the VLAN ID of the given packet, if it has an 802.1Q tag.
+func getVLAN(pkt gopacket.Packet) (uint16, bool) {
+	tag, ok := pkt.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q)
+	if !ok {
+		return 0, false
+	}
+	return tag.VLANIdentifier, true
+}
+
+// getTaggedIPXPayload extracts an IPX payload from the given 802.1Q tag
+// layer. gopacket does not decode length-framed frames inside a tag, so the
+// LLC header is decoded here.
+func getTaggedIPXPayload(tag *layers.Dot1Q) ([]byte, bool) {
+	payload := tag.LayerPayload()
+	if tag.Type == etherTypeIPX {
+		return payload, true
+	}
+	if tag.Type >= 0x0600 {
+		return nil, false
+	}
+	if int(tag.Type) < len(payload) {
+		// Strip any padding after the end of the frame.
+		payload = payload[:tag.Type]
+	}
+	switch {
+	case len(payload) >= 2 && payload[0] == 0xff && payload[1] == 0xff:
+		// Novell "raw" 802.3.
+		return payload, true
+	case len(payload) >= 3 && payload[0] == lsapNovell && payload[1] == lsapNovell:
+		// 802.2.
+		return payload[3:], true
+	case len(payload) >= 8 && payload[0] == lsapSNAP && payload[1] == lsapSNAP &&
+		layers.EthernetType(uint16(payload[6])<<8|uint16(payload[7])) == etherTypeIPX:
+		// SNAP.
+		return payload[8:], true
+	}
+	return nil, false
+}
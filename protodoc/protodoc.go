@@ -0,0 +1,192 @@
+// Package protodoc generates machine-readable descriptions of the wire formats
+// that ipxbox implements, so that authors of other clients and servers can
+// interoperate with it. Formats are described by the Go structs that
+// represent them: fields appear on the wire in the order that they are
+// declared, with integers in big-endian byte order, and each field has a
+// "doc" struct tag describing it. Nested structs are flattened, with their
+// field names prefixed by the name of the containing field.
+package protodoc
+
+import (
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+)
+
+// Field describes a single field in a wire format.
+type Field struct {
+	Name        string `json:"name"`
+	Offset      int    `json:"offset"`
+	Size        int    `json:"size"`
+	Description string `json:"description"`
+}
+
+// Format describes the layout of a fixed-size wire format.
+type Format struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Size        int     `json:"size"`
+	Fields      []Field `json:"fields"`
+}
+
+// Message is an example of a message sent using one of the formats, which
+// can be used as a test vector.
+type Message struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Format      string `json:"format"`
+
+	// The encoded message, in hex, and the value of each field in
+	// the format.
+	Encoded string            `json:"encoded"`
+	Values  map[string]string `json:"values"`
+
+	// Data that follows the format in the encoded message, in hex, if
+	// any. It is included in Encoded.
+	Trailer string `json:"trailer,omitempty"`
+}
+
+// Option describes one of the type-length-value options of an extension.
+type Option struct {
+	Type        int    `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Extension describes an optional extension to a protocol, which adds
+// type-length-value options (see package tlv) to the end of messages in
+// one of its formats.
+type Extension struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Options     []Option  `json:"options"`
+	Messages    []Message `json:"messages"`
+}
+
+// Document describes a protocol.
+type Document struct {
+	Protocol    string      `json:"protocol"`
+	Description string      `json:"description"`
+	Formats     []Format    `json:"formats"`
+	Messages    []Message   `json:"messages"`
+	Extensions  []Extension `json:"extensions,omitempty"`
+}
+
+// walk calls the given function for each field of the given struct value, in
+// wire order, returning the total size.
+func walk(prefix string, v reflect.Value, offset int, f func(Field, reflect.Value)) (int, error) {
+	t := v.Type()
+	start := offset
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		fv := v.Field(i)
+		name := prefix + sf.Name
+		doc, ok := sf.Tag.Lookup("doc")
+		if !ok {
+			return 0, fmt.Errorf("field %s of %s has no doc tag", name, t)
+		}
+		var size int
+		switch fv.Kind() {
+		case reflect.Struct:
+			n, err := walk(name+".", fv, offset, f)
+			if err != nil {
+				return 0, err
+			}
+			offset += n
+			continue
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			size = int(fv.Type().Size())
+		case reflect.Array:
+			if fv.Type().Elem().Kind() != reflect.Uint8 {
+				return 0, fmt.Errorf("field %s of %s: unsupported type %s", name, t, fv.Type())
+			}
+			size = fv.Len()
+		default:
+			return 0, fmt.Errorf("field %s of %s: unsupported type %s", name, t, fv.Type())
+		}
+		f(Field{
+			Name:        name,
+			Offset:      offset,
+			Size:        size,
+			Description: doc,
+		}, fv)
+		offset += size
+	}
+	return offset - start, nil
+}
+
+// structValue returns the struct value that v points to.
+func structValue(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("%T is not a struct", v)
+	}
+	return rv, nil
+}
+
+// Describe returns a description of the wire format represented by the type
+// of v, which must be a struct or a pointer to one.
+func Describe(name, description string, v interface{}) (Format, error) {
+	rv, err := structValue(v)
+	if err != nil {
+		return Format{}, err
+	}
+	result := Format{
+		Name:        name,
+		Description: description,
+	}
+	result.Size, err = walk("", rv, 0, func(f Field, _ reflect.Value) {
+		result.Fields = append(result.Fields, f)
+	})
+	return result, err
+}
+
+// Example returns an example message of the given format. The size of the
+// encoded message is checked against the format, so that the description
+// cannot silently disagree with the encoder.
+func Example(name, description string, format Format, v encoding.BinaryMarshaler) (Message, error) {
+	encoded, err := v.MarshalBinary()
+	if err != nil {
+		return Message{}, err
+	}
+	if len(encoded) != format.Size {
+		return Message{}, fmt.Errorf("%s: encoded size %d does not match size %d of format %s", name, len(encoded), format.Size, format.Name)
+	}
+	rv, err := structValue(v)
+	if err != nil {
+		return Message{}, err
+	}
+	result := Message{
+		Name:        name,
+		Description: description,
+		Format:      format.Name,
+		Encoded:     hex.EncodeToString(encoded),
+		Values:      map[string]string{},
+	}
+	_, err = walk("", rv, 0, func(f Field, fv reflect.Value) {
+		if fv.Kind() == reflect.Array {
+			b := make([]byte, fv.Len())
+			reflect.Copy(reflect.ValueOf(b), fv)
+			result.Values[f.Name] = hex.EncodeToString(b)
+		} else {
+			result.Values[f.Name] = fmt.Sprintf("0x%0*x", f.Size*2, fv.Uint())
+		}
+	})
+	return result, err
+}
+
+// ExampleWithTrailer is like Example, but the encoded message is followed
+// by the given trailer.
+func ExampleWithTrailer(name, description string, format Format, v encoding.BinaryMarshaler, trailer []byte) (Message, error) {
+	result, err := Example(name, description, format, v)
+	if err != nil {
+		return Message{}, err
+	}
+	result.Encoded += hex.EncodeToString(trailer)
+	result.Trailer = hex.EncodeToString(trailer)
+	return result, nil
+}
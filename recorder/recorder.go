@@ -0,0 +1,245 @@
+// Package recorder implements a match recorder, which records all traffic
+// in a room to a timestamped archive for later review. Each recording is a
+// directory containing the traffic in pcap format (match.pcap) and a JSON
+// file describing the recording (match.json).
+package recorder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/capture"
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+const (
+	pcapFile     = "match.pcap"
+	metadataFile = "match.json"
+)
+
+var (
+	// UnknownRoomError is returned if there is no room with the given
+	// name.
+	UnknownRoomError = errors.New("unknown room")
+
+	// AlreadyRecordingError is returned by Start if the room is already
+	// being recorded.
+	AlreadyRecordingError = errors.New("room is already being recorded")
+
+	// NotRecordingError is returned by Stop if the room is not being
+	// recorded.
+	NotRecordingError = errors.New("room is not being recorded")
+)
+
+// Recording describes a recording of a match. This is also the content of
+// the metadata file saved with the recording.
+type Recording struct {
+	Room  string     `json:"room"`
+	Dir   string     `json:"dir"`
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"`
+
+	// Number of packets and bytes recorded.
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+
+	// Addresses of the nodes that sent packets during the match.
+	Nodes []string `json:"nodes"`
+}
+
+// recording is a recording in progress.
+type recording struct {
+	spectator *virtual.Spectator
+	file      *os.File
+	done      chan struct{}
+
+	mu    sync.Mutex
+	meta  Recording
+	nodes map[ipx.Addr]bool
+}
+
+// Recorder records matches in rooms.
+type Recorder struct {
+	dir string
+
+	mu       sync.Mutex
+	rooms    map[string]*virtual.Network
+	active   map[string]*recording
+	finished []Recording
+}
+
+// New creates a new Recorder that saves recordings under the given
+// directory.
+func New(dir string) *Recorder {
+	return &Recorder{
+		dir:    dir,
+		rooms:  map[string]*virtual.Network{},
+		active: map[string]*recording{},
+	}
+}
+
+// AddRoom adds a room that can be recorded.
+func (r *Recorder) AddRoom(name string, n *virtual.Network) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rooms[name] = n
+}
+
+// RemoveRoom removes a room so that it can no longer be recorded, finishing
+// any recording of it in progress.
+func (r *Recorder) RemoveRoom(name string) error {
+	r.mu.Lock()
+	delete(r.rooms, name)
+	_, active := r.active[name]
+	r.mu.Unlock()
+	if !active {
+		return nil
+	}
+	_, err := r.Stop(name)
+	return err
+}
+
+// snapshot returns a description of the recording so far.
+func (rec *recording) snapshot() Recording {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	result := rec.meta
+	result.Nodes = []string{}
+	for addr := range rec.nodes {
+		result.Nodes = append(result.Nodes, addr.String())
+	}
+	sort.Strings(result.Nodes)
+	return result
+}
+
+// run copies packets from the spectator into the pcap file until the
+// spectator is closed.
+func (rec *recording) run(w *capture.Writer) {
+	defer close(rec.done)
+	var buf [1500]byte
+	for {
+		n, err := rec.spectator.Read(buf[:])
+		if err != nil {
+			return
+		}
+		var hdr ipx.Header
+		if err := hdr.UnmarshalBinary(buf[:n]); err != nil {
+			continue
+		}
+		w.Write(buf[:n])
+		rec.mu.Lock()
+		rec.meta.Packets++
+		rec.meta.Bytes += uint64(n)
+		rec.nodes[hdr.Src.Addr] = true
+		rec.mu.Unlock()
+	}
+}
+
+// makeDir creates a new directory for a recording of the given room that
+// starts at the given time.
+func (r *Recorder) makeDir(room string, t time.Time) (string, error) {
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return "", err
+	}
+	base := filepath.Join(r.dir, fmt.Sprintf("%s-%s", room, t.Format("20060102-150405")))
+	dir := base
+	for i := 2; ; i++ {
+		err := os.Mkdir(dir, 0755)
+		if !os.IsExist(err) {
+			return dir, err
+		}
+		dir = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// Start starts recording the given room.
+func (r *Recorder) Start(room string) (Recording, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.rooms[room]
+	if !ok {
+		return Recording{}, UnknownRoomError
+	}
+	if _, ok := r.active[room]; ok {
+		return Recording{}, AlreadyRecordingError
+	}
+	now := time.Now()
+	dir, err := r.makeDir(room, now)
+	if err != nil {
+		return Recording{}, err
+	}
+	f, err := os.Create(filepath.Join(dir, pcapFile))
+	if err != nil {
+		return Recording{}, err
+	}
+	w, err := capture.NewWriter(f)
+	if err != nil {
+		f.Close()
+		return Recording{}, err
+	}
+	rec := &recording{
+		spectator: n.Spectator(),
+		file:      f,
+		done:      make(chan struct{}),
+		meta: Recording{
+			Room:  room,
+			Dir:   dir,
+			Start: now,
+		},
+		nodes: map[ipx.Addr]bool{},
+	}
+	r.active[room] = rec
+	go rec.run(w)
+	return rec.snapshot(), nil
+}
+
+// Stop stops recording the given room and saves the recording's metadata.
+func (r *Recorder) Stop(room string) (Recording, error) {
+	r.mu.Lock()
+	rec, ok := r.active[room]
+	delete(r.active, room)
+	r.mu.Unlock()
+	if !ok {
+		return Recording{}, NotRecordingError
+	}
+	rec.spectator.Close()
+	<-rec.done
+	now := time.Now()
+	rec.mu.Lock()
+	rec.meta.End = &now
+	rec.mu.Unlock()
+	result := rec.snapshot()
+	if err := rec.file.Close(); err != nil {
+		return result, err
+	}
+	data, err := json.MarshalIndent(&result, "", "  ")
+	if err != nil {
+		return result, err
+	}
+	if err := os.WriteFile(filepath.Join(result.Dir, metadataFile), data, 0644); err != nil {
+		return result, err
+	}
+	r.mu.Lock()
+	r.finished = append(r.finished, result)
+	r.mu.Unlock()
+	return result, nil
+}
+
+// Recordings returns all recordings made since the recorder was created,
+// including those in progress.
+func (r *Recorder) Recordings() []Recording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := append([]Recording{}, r.finished...)
+	for _, rec := range r.active {
+		result = append(result, rec.snapshot())
+	}
+	return result
+}
@@ -0,0 +1,147 @@
+package recorder
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fragglet/ipxbox/annotate"
+	"github.com/fragglet/ipxbox/capture"
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// DefaultTick is the default length of a tick in a timeline: the length of
+// a game tic in Doom and other games using its engine.
+const DefaultTick = time.Second / 35
+
+// Timeline is a normalized timeline of the packets in a recording, grouped
+// into fixed length ticks. It is intended for tools that reconstruct demos
+// or videos of a match for games that they understand.
+type Timeline struct {
+	Room  string    `json:"room,omitempty"`
+	Start time.Time `json:"start"`
+
+	// Length of each tick, in milliseconds.
+	TickMS float64 `json:"tick_ms"`
+
+	// Addresses of the nodes that sent packets, in order of their first
+	// packet. Packets identify nodes by their index in this list.
+	Nodes []string `json:"nodes"`
+
+	// Ticks in which packets were sent. Ticks with no packets are
+	// omitted.
+	Ticks []Tick `json:"ticks"`
+}
+
+// Tick contains the packets sent during one tick of a timeline.
+type Tick struct {
+	Tick    int             `json:"tick"`
+	Packets []PacketSummary `json:"packets"`
+}
+
+// PacketSummary summarizes a packet in a timeline.
+type PacketSummary struct {
+	// Time since the start of the recording, in milliseconds.
+	OffsetMS float64 `json:"offset_ms"`
+
+	// Index in Timeline.Nodes of the sender, and of the destination, or
+	// -1 for broadcasts and packets sent to nodes that never sent
+	// anything themselves.
+	Src  int `json:"src"`
+	Dest int `json:"dest"`
+
+	Socket ipx.Socket `json:"socket"`
+
+	// Name of the program or protocol using the socket, if known.
+	Game string `json:"game,omitempty"`
+
+	// Length of the packet's payload and a description of the packet.
+	Length  int    `json:"length"`
+	Summary string `json:"summary"`
+
+	// Payload of the packet, for tools that decode it themselves.
+	Payload []byte `json:"payload"`
+}
+
+// packetRecord is a packet read from a capture file.
+type packetRecord struct {
+	t      time.Time
+	header ipx.Header
+	packet []byte
+}
+
+// ExportTimeline reads the recording in the given directory and converts it
+// into a timeline with ticks of the given length.
+func ExportTimeline(dir string, tick time.Duration) (*Timeline, error) {
+	tl := &Timeline{
+		TickMS: float64(tick) / float64(time.Millisecond),
+		Nodes:  []string{},
+		Ticks:  []Tick{},
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, metadataFile)); err == nil {
+		var meta Recording
+		if err := json.Unmarshal(data, &meta); err == nil {
+			tl.Room = meta.Room
+			tl.Start = meta.Start
+		}
+	}
+	f, err := os.Open(filepath.Join(dir, pcapFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := capture.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var packets []packetRecord
+	nodes := map[ipx.Addr]int{}
+	for {
+		t, packet, err := r.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var hdr ipx.Header
+		if err := hdr.UnmarshalBinary(packet); err != nil {
+			continue
+		}
+		if _, ok := nodes[hdr.Src.Addr]; !ok {
+			nodes[hdr.Src.Addr] = len(tl.Nodes)
+			tl.Nodes = append(tl.Nodes, hdr.Src.Addr.String())
+		}
+		packets = append(packets, packetRecord{t, hdr, packet})
+	}
+	if len(packets) == 0 {
+		return tl, nil
+	}
+	if tl.Start.IsZero() || packets[0].t.Before(tl.Start) {
+		tl.Start = packets[0].t
+	}
+	for _, p := range packets {
+		offset := p.t.Sub(tl.Start)
+		n := int(offset / tick)
+		if len(tl.Ticks) == 0 || tl.Ticks[len(tl.Ticks)-1].Tick != n {
+			tl.Ticks = append(tl.Ticks, Tick{Tick: n})
+		}
+		dest, ok := nodes[p.header.Dest.Addr]
+		if !ok {
+			dest = -1
+		}
+		t := &tl.Ticks[len(tl.Ticks)-1]
+		t.Packets = append(t.Packets, PacketSummary{
+			OffsetMS: float64(offset) / float64(time.Millisecond),
+			Src:      nodes[p.header.Src.Addr],
+			Dest:     dest,
+			Socket:   ipx.Socket(p.header.Dest.Socket),
+			Game:     annotate.SocketName(p.header.Dest.Socket),
+			Length:   len(p.packet) - 30,
+			Summary:  annotate.Describe(p.packet),
+			Payload:  p.packet[30:],
+		})
+	}
+	return tl, nil
+}
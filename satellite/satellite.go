@@ -0,0 +1,209 @@
+// Package satellite implements the uplink of a satellite server: a server
+// near a group of players that is connected to a main server far away, so
+// that distributed communities can play together without every player
+// connecting to the main server directly.
+//
+// The uplink connects to the main server as a single DOSBox client. Packets
+// between local players never cross the uplink. Broadcasts from the main
+// server cross it once and are delivered to every local player, instead of
+// once for each of them. Local broadcasts are only sent to the main server
+// for sockets that remote nodes have recently been seen using, and
+// otherwise only occasionally, so that new games can still be discovered.
+//
+// The main server must accept the uplink as a satellite (see
+// server.Config.SatelliteRanges), since packets sent over it come from the
+// addresses of the local players rather than the uplink's own address.
+package satellite
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/validate"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+// Config contains configuration parameters for an uplink.
+type Config struct {
+	// Remote nodes are assumed to have stopped using a socket if no
+	// packet has been received over the uplink to or from it for this
+	// long.
+	MaxAge time.Duration
+
+	// Local broadcasts to sockets that no remote node is using are still
+	// sent over the uplink at most this often for each socket, so that
+	// remote players can discover new games.
+	RefreshInterval time.Duration
+
+	// If non-nil, packets from the main server that fail its checks
+	// are dropped before they reach the local network.
+	Validator *validate.Validator
+}
+
+var DefaultConfig = &Config{
+	MaxAge:          time.Minute,
+	RefreshInterval: 5 * time.Second,
+}
+
+// Stats contains counters describing the operation of an uplink.
+type Stats struct {
+	// Number of packets sent to and received from the main server.
+	PacketsUp   uint64 `json:"packets_up"`
+	PacketsDown uint64 `json:"packets_down"`
+
+	// Number of local broadcasts that were not sent to the main server
+	// because no remote node was using the socket.
+	BroadcastsSuppressed uint64 `json:"broadcasts_suppressed"`
+
+	// Number of sockets that remote nodes are currently using.
+	RemoteSockets int `json:"remote_sockets"`
+}
+
+// Uplink forwards packets between a local network and a main server.
+type Uplink struct {
+	// These are accessed atomically and are kept at the start of the
+	// struct to ensure 64-bit alignment.
+	packetsUp   uint64
+	packetsDown uint64
+	suppressed  uint64
+
+	config   *Config
+	local    *virtual.Network
+	tap      *virtual.Tap
+	upstream network.Node
+
+	mu sync.Mutex
+	// Time that each socket was last used by a remote node, and that a
+	// local broadcast to each unused socket was last sent upstream.
+	remoteSockets map[uint16]time.Time
+	lastRefresh   map[uint16]time.Time
+}
+
+// New creates an uplink that forwards packets between the given local
+// network and the given connection to the main server, usually a
+// *client.Client.
+func New(local *virtual.Network, upstream network.Node, c *Config) *Uplink {
+	return &Uplink{
+		config:        c,
+		local:         local,
+		tap:           local.Tap(),
+		upstream:      upstream,
+		remoteSockets: map[uint16]time.Time{},
+		lastRefresh:   map[uint16]time.Time{},
+	}
+}
+
+// Run forwards packets until the connection to the main server is closed,
+// returning the error that stopped it.
+func (u *Uplink) Run() error {
+	defer u.tap.Close()
+	go u.runUp()
+	var buf [1500]byte
+	for {
+		n, err := u.upstream.Read(buf[:])
+		if err != nil {
+			return err
+		}
+		var hdr ipx.Header
+		if err := hdr.UnmarshalBinary(buf[:n]); err != nil {
+			continue
+		}
+		// The main server sends our own broadcasts back to us.
+		if u.isLocal(hdr.Src.Addr) {
+			continue
+		}
+		if _, _, ok := u.config.Validator.Validate(hdr.Src.Addr.String(), &hdr, buf[:n], time.Now()); !ok {
+			continue
+		}
+		u.observeRemote(&hdr)
+		atomic.AddUint64(&u.packetsDown, 1)
+		u.tap.Write(buf[:n])
+	}
+}
+
+// runUp forwards packets from the local network to the main server until
+// the tap is closed.
+func (u *Uplink) runUp() {
+	var buf [1500]byte
+	for {
+		n, err := u.tap.Read(buf[:])
+		if err != nil {
+			return
+		}
+		var hdr ipx.Header
+		if err := hdr.UnmarshalBinary(buf[:n]); err != nil {
+			continue
+		}
+		if !u.shouldForward(&hdr) {
+			continue
+		}
+		if _, err := u.upstream.Write(buf[:n]); err == nil {
+			atomic.AddUint64(&u.packetsUp, 1)
+		}
+	}
+}
+
+// isLocal returns true if the given address belongs to a node on the local
+// network.
+func (u *Uplink) isLocal(addr ipx.Addr) bool {
+	for _, a := range u.local.Addrs() {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// observeRemote records the sockets used by a packet received from the
+// main server.
+func (u *Uplink) observeRemote(hdr *ipx.Header) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	u.remoteSockets[hdr.Src.Socket] = now
+	u.remoteSockets[hdr.Dest.Socket] = now
+}
+
+// shouldForward returns true if the given packet from the local network
+// should be sent to the main server.
+func (u *Uplink) shouldForward(hdr *ipx.Header) bool {
+	if !hdr.IsBroadcast() {
+		return !u.isLocal(hdr.Dest.Addr)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	if last, ok := u.remoteSockets[hdr.Dest.Socket]; ok && now.Sub(last) < u.config.MaxAge {
+		return true
+	}
+	if now.Sub(u.lastRefresh[hdr.Dest.Socket]) >= u.config.RefreshInterval {
+		u.lastRefresh[hdr.Dest.Socket] = now
+		return true
+	}
+	atomic.AddUint64(&u.suppressed, 1)
+	return false
+}
+
+// Stats returns a snapshot of the uplink's counters.
+func (u *Uplink) Stats() Stats {
+	u.mu.Lock()
+	now := time.Now()
+	remote := 0
+	for socket, last := range u.remoteSockets {
+		if now.Sub(last) < u.config.MaxAge {
+			remote++
+		} else {
+			delete(u.remoteSockets, socket)
+		}
+	}
+	u.mu.Unlock()
+	return Stats{
+		PacketsUp:            atomic.LoadUint64(&u.packetsUp),
+		PacketsDown:          atomic.LoadUint64(&u.packetsDown),
+		BroadcastsSuppressed: atomic.LoadUint64(&u.suppressed),
+		RemoteSockets:        remote,
+	}
+}
@@ -0,0 +1,209 @@
+// Package selftest checks that a remote server works, using two clients that
+// behave like DOSBox. It is intended for operators checking a deployment, and
+// for players checking whether a problem is with the server or with their
+// own network.
+package selftest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/fragglet/ipxbox/client"
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// Socket that test packets are sent to. It is in the dynamic range, so it
+// should not be used by any game listening on the server.
+const testSocket = 0x7ffe
+
+// Sizes of datagrams, including the IPX header, used to probe the largest
+// packet that can be delivered through the server. 576 bytes is the minimum
+// that every IPv4 path must support and 1472 bytes is the most that fits in
+// a 1500 byte Ethernet frame.
+var probeSizes = []int{576, 1024, 1280, 1400, 1472}
+
+// Result is the result of one check.
+type Result struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+}
+
+// tester holds the state of a self-test run.
+type tester struct {
+	timeout time.Duration
+	a, b    *client.Client
+	results []Result
+}
+
+func (t *tester) pass(name, format string, args ...interface{}) {
+	t.results = append(t.results, Result{name, true, fmt.Sprintf(format, args...)})
+}
+
+func (t *tester) fail(name, format string, args ...interface{}) {
+	t.results = append(t.results, Result{name, false, fmt.Sprintf(format, args...)})
+}
+
+// Run runs all checks against the server at the given address. Each check
+// waits up to the given timeout for packets to arrive. Checks that depend on
+// an earlier check that failed are skipped.
+func Run(addr string, timeout time.Duration) []Result {
+	t := &tester{timeout: timeout}
+	cfg := *client.DefaultConfig
+	cfg.RegistrationTimeout = timeout
+	var err error
+	if t.a, err = client.Dial(addr, &cfg); err != nil {
+		t.fail("registration", "%v", err)
+		return t.results
+	}
+	defer t.a.Close()
+	if t.b, err = client.Dial(addr, &cfg); err != nil {
+		t.fail("registration", "first client registered as %s, but second client failed: %v", t.a.Address(), err)
+		return t.results
+	}
+	defer t.b.Close()
+	switch a, b := t.a.Address(), t.b.Address(); {
+	case a == b:
+		t.fail("registration", "both clients were assigned %s", a)
+		return t.results
+	case a == ipx.AddrNull || a == ipx.AddrBroadcast || b == ipx.AddrNull || b == ipx.AddrBroadcast:
+		t.fail("registration", "invalid addresses assigned: %s and %s", a, b)
+		return t.results
+	default:
+		t.pass("registration", "clients registered as %s and %s", a, b)
+	}
+	t.checkUnicast()
+	t.checkBroadcast()
+	t.checkEcho()
+	t.checkMTU()
+	return t.results
+}
+
+// packet returns a packet from the given client to the given destination,
+// with a random payload so that it can be recognized, padded to the given
+// total size.
+func packet(from *client.Client, dest ipx.HeaderAddr, size int) ([]byte, error) {
+	hdr := &ipx.Header{
+		Checksum:   0xffff,
+		Length:     uint16(size),
+		PacketType: 4,
+		Dest:       dest,
+		Src: ipx.HeaderAddr{
+			Addr:   from.Address(),
+			Socket: dest.Socket,
+		},
+	}
+	result, err := hdr.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, size-len(result))
+	if _, err := rand.Read(payload); err != nil {
+		return nil, err
+	}
+	return append(result, payload...), nil
+}
+
+// exchange sends a packet of the given size from one client and waits for
+// the other client to receive it.
+func (t *tester) exchange(from, to *client.Client, dest ipx.HeaderAddr, size int) error {
+	p, err := packet(from, dest, size)
+	if err != nil {
+		return err
+	}
+	if _, err := from.Write(p); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	var buf [1500]byte
+	for {
+		n, err := to.ReadPacket(ctx, buf[:])
+		if err == context.DeadlineExceeded {
+			return fmt.Errorf("not received after %v", t.timeout)
+		} else if err != nil {
+			return err
+		}
+		// Other clients of the server may be sending packets too.
+		if bytes.Equal(buf[:n], p) {
+			return nil
+		}
+	}
+}
+
+// checkUnicast checks that a packet sent from one client to the other is
+// delivered.
+func (t *tester) checkUnicast() {
+	dest := ipx.HeaderAddr{Addr: t.b.Address(), Socket: testSocket}
+	if err := t.exchange(t.a, t.b, dest, 64); err != nil {
+		t.fail("unicast", "%v", err)
+		return
+	}
+	t.pass("unicast", "packet from %s delivered to %s", t.a.Address(), t.b.Address())
+}
+
+// checkBroadcast checks that a broadcast sent by one client is seen by the
+// other, which is how most games find each other.
+func (t *tester) checkBroadcast() {
+	dest := ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: testSocket}
+	if err := t.exchange(t.a, t.b, dest, 64); err != nil {
+		t.fail("broadcast", "%v; games will not be able to find each other", err)
+		return
+	}
+	t.pass("broadcast", "broadcast from %s seen by %s", t.a.Address(), t.b.Address())
+}
+
+// checkEcho checks that a ping broadcast by one client is answered by the
+// other, as when running "IPXNET PING" in DOSBox.
+func (t *tester) checkEcho() {
+	start := time.Now()
+	p, err := packet(t.a, ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 2}, 30)
+	if err != nil {
+		t.fail("echo", "%v", err)
+		return
+	}
+	if _, err := t.a.Write(p); err != nil {
+		t.fail("echo", "%v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	var buf [1500]byte
+	for {
+		n, err := t.a.ReadPacket(ctx, buf[:])
+		if err != nil {
+			t.fail("echo", "no ping reply from %s after %v", t.b.Address(), t.timeout)
+			return
+		}
+		var hdr ipx.Header
+		if hdr.UnmarshalBinary(buf[:n]) == nil && hdr.Src.Addr == t.b.Address() && hdr.Dest.Socket == 2 {
+			t.pass("echo", "ping reply from %s after %v", t.b.Address(), time.Since(start).Round(time.Microsecond))
+			return
+		}
+	}
+}
+
+// checkMTU checks which packet sizes can be delivered through the server.
+// Some paths silently drop large packets, which makes games appear to be
+// broken rather than slow.
+func (t *tester) checkMTU() {
+	dest := ipx.HeaderAddr{Addr: t.b.Address(), Socket: testSocket}
+	largest := 0
+	for _, size := range probeSizes {
+		if err := t.exchange(t.a, t.b, dest, size); err != nil {
+			break
+		}
+		largest = size
+	}
+	switch {
+	case largest == 0:
+		t.fail("mtu", "%d byte packets were not delivered", probeSizes[0])
+	case largest < probeSizes[len(probeSizes)-1]:
+		t.fail("mtu", "largest packet delivered was %d bytes; larger packets are being dropped", largest)
+	default:
+		t.pass("mtu", "%d byte packets delivered", largest)
+	}
+}
@@ -0,0 +1,91 @@
+package selftest
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fragglet/ipxbox/client"
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// StressResult describes the outcome of a stress test.
+type StressResult struct {
+	// Number of clients that registered, and number whose registration
+	// failed.
+	Registrations uint64 `json:"registrations"`
+	Failures      uint64 `json:"failures"`
+
+	// Number of broadcasts sent and received by all clients.
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+}
+
+// Stress runs a stress test against the server at the given address for the
+// given duration. The given number of workers each repeatedly connect a
+// client, broadcast from it for a random part of a second while reading
+// what other clients broadcast, and then disconnect it. It is intended to be
+// run against a server built with the race detector (go build -race), to
+// shake out data races in the handling of the client table, counters and
+// node lifecycle; the server should still be healthy afterwards.
+func Stress(addr string, workers int, duration time.Duration) StressResult {
+	var result StressResult
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				stressClient(ctx, addr, &result)
+			}
+		}()
+	}
+	wg.Wait()
+	return result
+}
+
+// stressClient connects one client for the stress test and broadcasts from
+// it for a while, updating the given result.
+func stressClient(ctx context.Context, addr string, result *StressResult) {
+	c, err := client.Dial(addr, client.DefaultConfig)
+	if err != nil {
+		atomic.AddUint64(&result.Failures, 1)
+		return
+	}
+	defer c.Close()
+	atomic.AddUint64(&result.Registrations, 1)
+	// The reader must finish before we return, since the caller reads
+	// the result once every client has finished.
+	readCtx, cancel := context.WithCancel(ctx)
+	var reader sync.WaitGroup
+	defer reader.Wait()
+	defer cancel()
+	reader.Add(1)
+	go func() {
+		defer reader.Done()
+		var buf [1500]byte
+		for {
+			if _, err := c.ReadPacket(readCtx, buf[:]); err != nil {
+				return
+			}
+			atomic.AddUint64(&result.Received, 1)
+		}
+	}()
+	dest := ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: testSocket}
+	until := time.Now().Add(time.Duration(rand.Int63n(int64(time.Second))))
+	for time.Now().Before(until) && ctx.Err() == nil {
+		p, err := packet(c, dest, 64)
+		if err != nil {
+			return
+		}
+		if _, err := c.Write(p); err != nil {
+			return
+		}
+		atomic.AddUint64(&result.Sent, 1)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// Number of recent alerts that are kept.
+	maxAlerts = 100
+
+	// An alert of each kind is raised at most this often for each
+	// client.
+	alertInterval = time.Minute
+
+	// Thresholds, per second, above which a client's behavior is
+	// suspicious. Games use one or two sockets, so a client sending
+	// from many in a short time is probably a tool probing the network.
+	maxSocketsPerSecond   = 8
+	maxMalformedPerSecond = 20
+)
+
+// Kinds of alert.
+const (
+	// The client sent from many different source sockets in a second.
+	AlertSocketSpread = "socket_spread"
+
+	// The client sent packets from an address other than its own.
+	AlertSpoof = "spoof"
+
+	// The client sent from an address that is already in use by
+	// another node.
+	AlertDuplicateAddress = "duplicate_address"
+
+	// The client sent many packets in a second that could not be
+	// decoded.
+	AlertMalformedFlood = "malformed_flood"
+)
+
+// Alert describes suspicious behavior by a client, which tournament staff
+// may want to look into.
+type Alert struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Addr    string    `json:"addr"`
+	IPXAddr string    `json:"ipx_addr"`
+	Detail  string    `json:"detail"`
+}
+
+// anomalies tracks a client's behavior in the current one second window. It
+// is only accessed while holding the server's mutex.
+type anomalies struct {
+	windowStart time.Time
+	sockets     map[uint16]bool
+	malformed   int
+	lastAlert   map[string]time.Time
+}
+
+// window starts a new window if the current one is over.
+func (a *anomalies) window(now time.Time) {
+	if now.Sub(a.windowStart) >= time.Second {
+		a.windowStart = now
+		a.sockets = map[uint16]bool{}
+		a.malformed = 0
+	}
+}
+
+// raiseAlert records an alert about the given client, unless one of the same
+// kind was raised recently, and passes it to Config.AlertHook.
+func (s *Server) raiseAlert(c *client, kind string, now time.Time, format string, args ...interface{}) {
+	if c.anomalies.lastAlert == nil {
+		c.anomalies.lastAlert = map[string]time.Time{}
+	}
+	if last, ok := c.anomalies.lastAlert[kind]; ok && now.Sub(last) < alertInterval {
+		return
+	}
+	c.anomalies.lastAlert[kind] = now
+	a := Alert{
+		Time:    now,
+		Kind:    kind,
+		Addr:    c.addr.String(),
+		IPXAddr: c.node.Address().String(),
+		Detail:  fmt.Sprintf(format, args...),
+	}
+	logger.Printf("client %s (%s): alert: %s: %s", a.Addr, a.IPXAddr, kind, a.Detail)
+	s.alerts = append(s.alerts, a)
+	if len(s.alerts) > maxAlerts {
+		s.alerts = s.alerts[len(s.alerts)-maxAlerts:]
+	}
+	if s.config.AlertHook != nil {
+		go s.runAlertHook(a)
+	}
+}
+
+// runAlertHook calls Config.AlertHook with the given alert.
+func (s *Server) runAlertHook(a Alert) {
+	if s.crashRing != nil {
+		defer s.crashRing.HandlePanic(s.config.CrashDumpDir)
+	}
+	s.config.AlertHook(a)
+}
+
+// observeSocket records the source socket of a packet sent by the client.
+// Satellite uplinks carry the traffic of many players, so they are expected
+// to send from many sockets.
+func (s *Server) observeSocket(c *client, socket uint16, now time.Time) {
+	if c.satellite {
+		return
+	}
+	c.anomalies.window(now)
+	c.anomalies.sockets[socket] = true
+	if n := len(c.anomalies.sockets); n > maxSocketsPerSecond {
+		s.raiseAlert(c, AlertSocketSpread, now, "sent from %d source sockets in a second", n)
+	}
+}
+
+// observeMalformed records an undecodable packet sent by the client.
+func (s *Server) observeMalformed(c *client, now time.Time) {
+	c.anomalies.window(now)
+	c.anomalies.malformed++
+	if c.anomalies.malformed > maxMalformedPerSecond {
+		s.raiseAlert(c, AlertMalformedFlood, now, "sent more than %d malformed packets in a second", maxMalformedPerSecond)
+	}
+}
+
+// Alerts returns the most recent alerts, oldest first.
+func (s *Server) Alerts() []Alert {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Alert{}, s.alerts...)
+}
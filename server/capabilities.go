@@ -0,0 +1,127 @@
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/fragglet/ipxbox/tlv"
+)
+
+// knownCapabilities are the capabilities that clients can advertise in the
+// optCapabilities option. Apart from no_keepalive, which means that the
+// client keeps its own NAT mapping open and does not need to be pinged, and
+// path_echo, which means that it answers optPathEcho, the server does not
+// implement any of them yet; they are only recorded, so that operators can
+// see which clients would benefit if it did. Unknown names are ignored.
+var knownCapabilities = map[string]bool{
+	"compression":  true,
+	"encryption":   true,
+	"resume":       true,
+	"nickname":     true,
+	"no_keepalive": true,
+	"path_echo":    true,
+}
+
+// hasCapability returns true if the given capability is in the list.
+func hasCapability(capabilities []string, name string) bool {
+	for _, c := range capabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// advertisedCapabilities returns the known capabilities advertised in the
+// given registration options.
+func advertisedCapabilities(options tlv.Options) []string {
+	value, ok := options.Get(optCapabilities)
+	if !ok {
+		return nil
+	}
+	seen := map[string]bool{}
+	var result []string
+	for _, name := range strings.Split(string(value), ",") {
+		if knownCapabilities[name] && !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// capabilities returns the capabilities the client has: those it advertised,
+// prefixed with "advertised:", and those the server has observed. The caller
+// must hold the server's mutex.
+func (c *client) capabilities() []string {
+	result := []string{}
+	if c.protocolVersion != 0 {
+		result = append(result, "extended")
+	}
+	if c.legacyPing {
+		result = append(result, "legacy_ping")
+	}
+	if c.mtu.largest != 0 {
+		result = append(result, "mtu_probe")
+	}
+	if c.satellite {
+		result = append(result, "satellite")
+	}
+	for _, name := range c.advertised {
+		result = append(result, "advertised:"+name)
+	}
+	return result
+}
+
+// CapabilityMatrix shows which capabilities each connected client has.
+type CapabilityMatrix struct {
+	// Every capability that any client has.
+	Capabilities []string `json:"capabilities"`
+
+	// Number of clients with each capability.
+	Counts map[string]int `json:"counts"`
+
+	Clients []ClientCapabilities `json:"clients"`
+}
+
+// ClientCapabilities shows which capabilities a client has.
+type ClientCapabilities struct {
+	Addr            string          `json:"addr"`
+	IPXAddr         string          `json:"ipx_addr"`
+	Flavor          string          `json:"flavor"`
+	ProtocolVersion int             `json:"protocol_version"`
+	Has             map[string]bool `json:"has"`
+}
+
+// Capabilities returns a matrix of the capabilities of every connected
+// client, to help operators understand deployments with a mix of clients.
+func (s *Server) Capabilities() CapabilityMatrix {
+	result := CapabilityMatrix{
+		Capabilities: []string{},
+		Counts:       map[string]int{},
+		Clients:      []ClientCapabilities{},
+	}
+	for _, c := range s.ClientStats() {
+		cc := ClientCapabilities{
+			Addr:            c.Addr,
+			IPXAddr:         c.IPXAddr,
+			Flavor:          c.Flavor,
+			ProtocolVersion: c.ProtocolVersion,
+			Has:             map[string]bool{},
+		}
+		for _, name := range c.Capabilities {
+			cc.Has[name] = true
+			if result.Counts[name] == 0 {
+				result.Capabilities = append(result.Capabilities, name)
+			}
+			result.Counts[name]++
+		}
+		result.Clients = append(result.Clients, cc)
+	}
+	sort.Strings(result.Capabilities)
+	sort.Slice(result.Clients, func(i, j int) bool {
+		return result.Clients[i].IPXAddr < result.Clients[j].IPXAddr
+	})
+	return result
+}
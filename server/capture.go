@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync/atomic"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// NotCapturingError is returned when packets for a client are not being
+// captured.
+var NotCapturingError = errors.New("client is not being captured")
+
+// StartCapture starts writing every packet sent to or received from the
+// client with the given IPX address to the given writer, one packet per
+// call to Write. The packets are the raw IPX packets exchanged with the
+// client, including pings. UnknownClientError is returned if there is no
+// such client. The capture stops when the client is removed from the
+// server; if w is an io.Closer, it is closed then, since otherwise nothing
+// might.
+func (s *Server) StartCapture(addr ipx.Addr, w io.Writer) error {
+	s.mu.Lock()
+	found := false
+	for _, c := range s.clients {
+		if c.node.Address() == addr {
+			found = true
+			break
+		}
+	}
+	s.mu.Unlock()
+	if !found {
+		return UnknownClientError
+	}
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	s.captures[addr] = w
+	atomic.StoreInt32(&s.numCaptures, int32(len(s.captures)))
+	return nil
+}
+
+// StopCapture stops capturing packets for the given IPX address. The writer
+// that was passed to StartCapture is not closed.
+func (s *Server) StopCapture(addr ipx.Addr) error {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	if _, ok := s.captures[addr]; !ok {
+		return NotCapturingError
+	}
+	delete(s.captures, addr)
+	atomic.StoreInt32(&s.numCaptures, int32(len(s.captures)))
+	return nil
+}
+
+// endCapture stops capturing packets for the given client, if they are being
+// captured, closing the writer if it is an io.Closer. It is called when the
+// client is removed.
+func (s *Server) endCapture(c *client) {
+	if atomic.LoadInt32(&s.numCaptures) == 0 {
+		return
+	}
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	addr := c.node.Address()
+	w, ok := s.captures[addr]
+	if !ok {
+		return
+	}
+	delete(s.captures, addr)
+	atomic.StoreInt32(&s.numCaptures, int32(len(s.captures)))
+	if closer, ok := w.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Printf("client %s (%s): error closing capture: %v", c.addr, addr, err)
+		}
+	}
+}
+
+// renameCapture moves the capture of the client with the given address, if
+// any, to the client's new address.
+func (s *Server) renameCapture(old, addr ipx.Addr) {
+	if atomic.LoadInt32(&s.numCaptures) == 0 {
+		return
+	}
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	if w, ok := s.captures[old]; ok {
+		delete(s.captures, old)
+		s.captures[addr] = w
+	}
+}
+
+// Captures returns the IPX addresses of the clients being captured.
+func (s *Server) Captures() []string {
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	result := []string{}
+	for addr := range s.captures {
+		result = append(result, addr.String())
+	}
+	sort.Strings(result)
+	return result
+}
+
+// capturePacket writes a packet sent to or received from the given client
+// if it is being captured. It is cheap to call when nothing is being
+// captured.
+func (s *Server) capturePacket(c *client, packet []byte) {
+	if atomic.LoadInt32(&s.numCaptures) == 0 {
+		return
+	}
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	if w, ok := s.captures[c.node.Address()]; ok {
+		w.Write(packet)
+	}
+}
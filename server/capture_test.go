@@ -0,0 +1,44 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+// closeRecorder is a capture writer that records whether it was closed.
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestCaptureEndsWhenClientLeaves(t *testing.T) {
+	s := newTestServer(t, nil)
+	runServer(s, contextForTest(t))
+	c := newTestClient(t, s)
+	c.register(nil)
+
+	w := &closeRecorder{}
+	if err := s.StartCapture(c.addr, w); err != nil {
+		t.Fatalf("StartCapture failed: %v", err)
+	}
+	if err := s.Disconnect(c.addr); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+	if captures := s.Captures(); len(captures) != 0 {
+		t.Errorf("still capturing %v after the client left", captures)
+	}
+	s.captureMu.Lock()
+	closed := w.closed
+	s.captureMu.Unlock()
+	if !closed {
+		t.Errorf("capture writer was not closed when the client left")
+	}
+	if err := s.StopCapture(c.addr); err != NotCapturingError {
+		t.Errorf("StopCapture after the client left = %v, want NotCapturingError", err)
+	}
+}
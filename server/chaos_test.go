@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// chaosWriteError is the error returned by writes that chaos testing makes
+// fail.
+var chaosWriteError = errors.New("chaos: injected write error")
+
+// chaosConfig configures chaos testing, where random faults are injected into
+// the server to check that its timeout, keepalive and client table logic
+// copes with them.
+type chaosConfig struct {
+	// Seed for the random number generator, so that a run can be
+	// repeated.
+	seed int64
+
+	// Probabilities, between 0 and 1, that sending a packet to a client
+	// fails, or is delayed by up to maxDelay.
+	writeError float64
+	writeDelay float64
+	maxDelay   time.Duration
+
+	// Probability that each check of the clock sees it jump forward by
+	// up to maxClockJump. Jumps accumulate.
+	clockJump    float64
+	maxClockJump time.Duration
+
+	// Probability that a received packet is corrupted before it is
+	// processed.
+	malformed float64
+}
+
+// chaos is a faultInjector that injects the faults configured by a
+// chaosConfig.
+type chaos struct {
+	config chaosConfig
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	offset time.Duration
+}
+
+var _ = (faultInjector)(&chaos{})
+
+func newChaos(cfg chaosConfig) *chaos {
+	return &chaos{
+		config: cfg,
+		rand:   rand.New(rand.NewSource(cfg.seed)),
+	}
+}
+
+// roll returns true with the given probability. The caller must hold the
+// mutex.
+func (ch *chaos) roll(p float64) bool {
+	return p > 0 && ch.rand.Float64() < p
+}
+
+// duration returns a random duration up to max. The caller must hold the
+// mutex.
+func (ch *chaos) duration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(ch.rand.Int63n(int64(max)))
+}
+
+func (ch *chaos) writeFault() (time.Duration, error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.roll(ch.config.writeError) {
+		return 0, chaosWriteError
+	}
+	if ch.roll(ch.config.writeDelay) {
+		return ch.duration(ch.config.maxDelay), nil
+	}
+	return 0, nil
+}
+
+func (ch *chaos) corrupt(packet []byte) []byte {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if !ch.roll(ch.config.malformed) || len(packet) == 0 {
+		return packet
+	}
+	result := append([]byte{}, packet...)
+	if ch.rand.Intn(2) == 0 {
+		return result[:ch.rand.Intn(len(result))]
+	}
+	for i := 0; i < 1+ch.rand.Intn(4); i++ {
+		result[ch.rand.Intn(len(result))] ^= byte(1 + ch.rand.Intn(255))
+	}
+	return result
+}
+
+func (ch *chaos) clockOffset() time.Duration {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.roll(ch.config.clockJump) {
+		ch.offset += ch.duration(ch.config.maxClockJump)
+	}
+	return ch.offset
+}
+
+// checkClientTable checks that the server's client table is consistent with
+// its client count and with the nodes on the network.
+func checkClientTable(t *testing.T, s *Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := atomic.LoadInt64(&s.numClients); int(n) != len(s.clients) {
+		t.Errorf("numClients = %d, but %d clients in table", n, len(s.clients))
+	}
+	seen := map[ipx.Addr]bool{}
+	for key, c := range s.clients {
+		if key != c.addr.String() {
+			t.Errorf("client %s stored under key %q", c.addr, key)
+		}
+		if seen[c.node.Address()] {
+			t.Errorf("address %s used by more than one client", c.node.Address())
+		}
+		seen[c.node.Address()] = true
+	}
+}
+
+func TestChaos(t *testing.T) {
+	for _, seed := range []int64{1, 2, 3} {
+		s := newTestServer(t, func(cfg *Config) {
+			cfg.ClientTimeout = 2 * time.Second
+			cfg.KeepaliveTime = 100 * time.Millisecond
+		})
+		s.faults = newChaos(chaosConfig{
+			seed:         seed,
+			writeError:   0.05,
+			writeDelay:   0.1,
+			maxDelay:     20 * time.Millisecond,
+			clockJump:    0.05,
+			maxClockJump: time.Second,
+			malformed:    0.05,
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := runServer(s, ctx)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			c := newTestClient(t, s)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				deadline := time.Now().Add(500 * time.Millisecond)
+				for time.Now().Before(deadline) {
+					// Registrations may be corrupted, or
+					// the replies fail, so keep trying.
+					c.conn.Write(registrationPacket(t, nil)[:30])
+					if reply, ok := c.read(50 * time.Millisecond); ok && len(reply) >= 30 {
+						var hdr ipx.Header
+						if hdr.UnmarshalBinary(reply) == nil && hdr.Src.Addr == ipx.AddrBroadcast {
+							c.addr = hdr.Dest.Addr
+						}
+					}
+					c.send(ipx.AddrBroadcast, 0x869c, []byte("chaos"))
+				}
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case err := <-done:
+			t.Fatalf("seed %d: server stopped: %v", seed, err)
+		default:
+		}
+		checkClientTable(t, s)
+		cancel()
+		<-done
+	}
+}
+
+func TestChaosRepeatable(t *testing.T) {
+	cfg := chaosConfig{seed: 42, writeError: 0.3, writeDelay: 0.3, maxDelay: time.Second}
+	a, b := newChaos(cfg), newChaos(cfg)
+	for i := 0; i < 100; i++ {
+		da, ea := a.writeFault()
+		db, eb := b.writeFault()
+		if da != db || ea != eb {
+			t.Fatalf("fault %d differs with the same seed: (%v, %v) vs (%v, %v)", i, da, ea, db, eb)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"time"
+)
+
+// processStart is the epoch for timestamps that are stored as integers so
+// that they can be accessed atomically.
+var processStart = time.Now()
+
+// monotonicNow returns the time since processStart in nanoseconds. Unlike
+// UnixNano, this is not affected by changes to the system clock such as NTP
+// steps, because time.Since uses the monotonic clock reading recorded by
+// time.Now.
+func monotonicNow() int64 {
+	return int64(time.Since(processStart))
+}
+
+// If the time between checks of client timeouts is more than this much
+// longer than expected, the host is assumed to have been suspended.
+const suspendThreshold = 30 * time.Second
+
+// suspended returns true if the host appears to have been suspended between
+// the given times, which are the expected and actual times of a check.
+// Depending on the OS, the monotonic clock may or may not advance while the
+// host is suspended, so both it and the wall clock are checked.
+func suspended(expected, now time.Time) bool {
+	monotonic := now.Sub(expected)
+	wall := now.Round(0).Sub(expected.Round(0))
+	return monotonic > suspendThreshold || wall-monotonic > suspendThreshold
+}
+
+// checkResume checks whether the host has just resumed from being suspended.
+// If it has, timeouts are suspended for a grace period, and every client is
+// pinged so that those that are still there can reply before the grace
+// period ends.
+func (s *Server) checkResume(now time.Time) {
+	if !suspended(s.timeoutCheckTime, now) {
+		return
+	}
+	logger.Printf("host appears to have been suspended; not timing out clients for %v", s.config.ResumeGracePeriod)
+	s.graceUntil = now.Add(s.config.ResumeGracePeriod)
+	for _, c := range s.clients {
+		// Suspended time is not counted towards the daily quota.
+		c.lastChargeTime = now
+		s.sendPing(c)
+	}
+}
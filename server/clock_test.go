@@ -0,0 +1,121 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// clockJumper is a faultInjector that only makes the clock seen by the
+// server's timeout checks jump, by however much the test says.
+type clockJumper struct {
+	mu     sync.Mutex
+	offset time.Duration
+}
+
+func (j *clockJumper) writeFault() (time.Duration, error) { return 0, nil }
+func (j *clockJumper) corrupt(packet []byte) []byte       { return packet }
+
+func (j *clockJumper) clockOffset() time.Duration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.offset
+}
+
+func (j *clockJumper) jump(d time.Duration) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.offset += d
+}
+
+func TestSuspended(t *testing.T) {
+	expected := time.Now()
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		{expected, false},
+		{expected.Add(5 * time.Second), false},
+		{expected.Add(-time.Hour), false},
+		{expected.Add(suspendThreshold + time.Second), true},
+		{expected.Add(time.Hour), true},
+	}
+	for _, test := range tests {
+		if got := suspended(expected, test.now); got != test.want {
+			t.Errorf("suspended(%v later) = %v, want %v", test.now.Sub(expected), got, test.want)
+		}
+	}
+}
+
+func TestMonotonicNow(t *testing.T) {
+	last := monotonicNow()
+	for i := 0; i < 1000; i++ {
+		now := monotonicNow()
+		if now < last {
+			t.Fatalf("monotonicNow went backwards: %d after %d", now, last)
+		}
+		last = now
+	}
+}
+
+func TestFloodGuardUsesMonotonicClock(t *testing.T) {
+	f := newFloodGuard(1, 1, 0)
+	now := time.Now()
+	f.allow("192.0.2.1", now)
+	f.allow("192.0.2.2", now)
+	if !f.flooding(now) {
+		t.Fatalf("flood not detected")
+	}
+	// Stripping the monotonic reading makes no difference, since the
+	// flood's end is stored relative to processStart.
+	if !f.flooding(now.Round(0)) {
+		t.Errorf("flood not seen at the same wall clock time")
+	}
+	if f.flooding(now.Add(floodHoldTime + time.Second)) {
+		t.Errorf("flood still in progress after it should have ended")
+	}
+}
+
+// TestClockJumpDoesNotDisconnect checks that when the clock jumps forward by
+// far more than the client timeout, as it does when the host resumes from
+// being suspended, clients are pinged rather than all timed out.
+func TestClockJumpDoesNotDisconnect(t *testing.T) {
+	jumper := &clockJumper{}
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.ClientTimeout = 5 * time.Second
+		cfg.ResumeGracePeriod = time.Minute
+	})
+	s.faults = jumper
+	runServer(s, contextForTest(t))
+
+	var clients []*testClient
+	for i := 0; i < 4; i++ {
+		c := newTestClient(t, s)
+		c.register(nil)
+		clients = append(clients, c)
+	}
+	jumper.jump(time.Hour)
+	// Wake the main loop, so that it notices the jump.
+	clients[0].send(ipx.AddrBroadcast, 0x4000, nil)
+
+	for i, c := range clients {
+		var pinged bool
+		deadline := time.Now().Add(2 * time.Second)
+		for !pinged && time.Now().Before(deadline) {
+			packet, ok := c.read(time.Until(deadline))
+			if !ok {
+				break
+			}
+			var hdr ipx.Header
+			pinged = hdr.UnmarshalBinary(packet) == nil && hdr.Src.Addr == addrPingReply
+		}
+		if !pinged {
+			t.Errorf("client %d was not pinged after the clock jumped", i)
+		}
+	}
+	if n := len(s.ClientStats()); n != len(clients) {
+		t.Errorf("%d clients connected after the clock jumped, want %d", n, len(clients))
+	}
+}
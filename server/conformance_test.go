@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// loadGolden reads a packet from testdata/golden; see the README there for
+// the format.
+func loadGolden(t testing.TB, name string) []byte {
+	data, err := os.ReadFile(filepath.Join("testdata", "golden", name))
+	if err != nil {
+		t.Fatalf("failed to read golden packet: %v", err)
+	}
+	var digits strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		digits.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+	packet, err := hex.DecodeString(digits.String())
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return packet
+}
+
+var (
+	goldenClientAddr = ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	goldenPeerAddr   = ipx.Addr{0x02, 0x66, 0x77, 0x88, 0x99, 0xaa}
+)
+
+var goldenPackets = []struct {
+	file   string
+	header ipx.Header
+}{
+	{
+		"registration.hex",
+		ipx.Header{
+			Checksum: 0xffff,
+			Length:   30,
+			Dest:     ipx.HeaderAddr{Socket: 2},
+			Src:      ipx.HeaderAddr{Socket: 2},
+		},
+	},
+	{
+		"registration_reply.hex",
+		ipx.Header{
+			Checksum: 0xffff,
+			Length:   30,
+			Dest:     ipx.HeaderAddr{Addr: goldenClientAddr, Socket: 2},
+			Src: ipx.HeaderAddr{
+				Network: [4]byte{0, 0, 0, 1},
+				Addr:    ipx.AddrBroadcast,
+				Socket:  2,
+			},
+		},
+	},
+	{
+		"registration_with_source.hex",
+		ipx.Header{
+			Checksum:   0xffff,
+			Length:     30,
+			PacketType: 4,
+			Dest:       ipx.HeaderAddr{Socket: 2},
+			Src:        ipx.HeaderAddr{Addr: goldenClientAddr, Socket: 2},
+		},
+	},
+	{
+		"registration_with_trailer.hex",
+		ipx.Header{
+			Checksum: 0xffff,
+			Length:   34,
+			Dest:     ipx.HeaderAddr{Socket: 2},
+			Src:      ipx.HeaderAddr{Socket: 2},
+		},
+	},
+	{
+		"ping.hex",
+		ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 2},
+			Src:  ipx.HeaderAddr{Addr: addrPingReply},
+		},
+	},
+	{
+		"ping_reply.hex",
+		ipx.Header{
+			Checksum: 0xffff,
+			Length:   30,
+			Dest:     ipx.HeaderAddr{Addr: addrPingReply, Socket: 2},
+			Src:      ipx.HeaderAddr{Addr: goldenClientAddr, Socket: 2},
+		},
+	},
+	{
+		"game_broadcast.hex",
+		ipx.Header{
+			Checksum:   0xffff,
+			Length:     38,
+			PacketType: 4,
+			Dest:       ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 0x869c},
+			Src:        ipx.HeaderAddr{Addr: goldenClientAddr, Socket: 0x869c},
+		},
+	},
+	{
+		"game_unicast.hex",
+		ipx.Header{
+			Checksum:   0xffff,
+			Length:     34,
+			PacketType: 4,
+			Dest:       ipx.HeaderAddr{Addr: goldenPeerAddr, Socket: 0x869c},
+			Src:        ipx.HeaderAddr{Addr: goldenClientAddr, Socket: 0x869c},
+		},
+	},
+}
+
+// TestGoldenDecode checks that every golden packet decodes to the expected
+// header, and that the header encodes back to the same bytes.
+func TestGoldenDecode(t *testing.T) {
+	for _, g := range goldenPackets {
+		packet := loadGolden(t, g.file)
+		if int(g.header.Length) != 0 && int(g.header.Length) != len(packet) {
+			t.Errorf("%s: packet is %d bytes, but header says %d", g.file, len(packet), g.header.Length)
+		}
+		var hdr ipx.Header
+		if err := hdr.UnmarshalBinary(packet); err != nil {
+			t.Errorf("%s: failed to decode: %v", g.file, err)
+			continue
+		}
+		if hdr != g.header {
+			t.Errorf("%s: decoded %+v, want %+v", g.file, hdr, g.header)
+		}
+		encoded, err := hdr.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: failed to encode: %v", g.file, err)
+			continue
+		}
+		if !bytes.Equal(encoded, packet[:30]) {
+			t.Errorf("%s: encoded header %x, want %x", g.file, encoded, packet[:30])
+		}
+	}
+}
+
+// TestGoldenServerPackets checks that the packets the server builds match
+// the golden ones byte for byte.
+func TestGoldenServerPackets(t *testing.T) {
+	tests := []struct {
+		file   string
+		header *ipx.Header
+	}{
+		{"registration_reply.hex", registrationReply(goldenClientAddr)},
+		{"ping.hex", pingHeader()},
+	}
+	for _, test := range tests {
+		got, err := test.header.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: failed to encode: %v", test.file, err)
+			continue
+		}
+		if want := loadGolden(t, test.file); !bytes.Equal(got, want) {
+			t.Errorf("%s: server sends %x, want %x", test.file, got, want)
+		}
+	}
+}
+
+// withAddrs returns a copy of a golden packet with its source and
+// destination addresses replaced.
+func withAddrs(packet []byte, dest, src ipx.Addr) []byte {
+	result := append([]byte{}, packet...)
+	copy(result[10:16], dest[:])
+	copy(result[22:28], src[:])
+	return result
+}
+
+// TestGoldenExchange runs the golden client packets through a server and
+// checks that the replies and forwarded packets match the golden ones.
+func TestGoldenExchange(t *testing.T) {
+	s := newTestServer(t, nil)
+	runServer(s, contextForTest(t))
+
+	a, b := newTestClient(t, s), newTestClient(t, s)
+	for _, c := range []*testClient{a, b} {
+		if _, err := c.conn.Write(loadGolden(t, "registration.hex")); err != nil {
+			t.Fatalf("failed to send registration: %v", err)
+		}
+		reply, ok := c.read(2 * time.Second)
+		if !ok {
+			t.Fatalf("no reply to golden registration")
+		}
+		var hdr ipx.Header
+		hdr.UnmarshalBinary(reply)
+		c.addr = hdr.Dest.Addr
+		want := withAddrs(loadGolden(t, "registration_reply.hex"), c.addr, ipx.AddrBroadcast)
+		if !bytes.Equal(reply, want) {
+			t.Errorf("registration reply %x, want %x", reply, want)
+		}
+	}
+
+	for _, file := range []string{"game_broadcast.hex", "game_unicast.hex"} {
+		dest := ipx.AddrBroadcast
+		if file == "game_unicast.hex" {
+			dest = b.addr
+		}
+		packet := withAddrs(loadGolden(t, file), dest, a.addr)
+		a.conn.Write(packet)
+		got, ok := b.read(2 * time.Second)
+		if !ok {
+			t.Errorf("%s: packet was not forwarded", file)
+			continue
+		}
+		if !bytes.Equal(got, packet) {
+			t.Errorf("%s: forwarded %x, want %x unchanged", file, got, packet)
+		}
+	}
+}
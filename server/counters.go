@@ -0,0 +1,42 @@
+package server
+
+import (
+	"sync/atomic"
+)
+
+// Counters contains the server's cumulative counters, which only ever
+// increase. They can be saved and given to RestoreCounters when the server
+// is restarted, so that they carry on from where they left off instead of
+// going back to zero.
+type Counters struct {
+	WriteErrors          uint64 `json:"write_errors"`
+	DecodeErrors         uint64 `json:"decode_errors"`
+	KernelDrops          uint64 `json:"kernel_drops"`
+	ScanPackets          uint64 `json:"scan_packets"`
+	RefusedRegistrations uint64 `json:"refused_registrations"`
+}
+
+// Counters returns the current values of the server's cumulative counters.
+func (s *Server) Counters() Counters {
+	stats := s.Stats()
+	return Counters{
+		WriteErrors:          stats.WriteErrors,
+		DecodeErrors:         stats.DecodeErrors,
+		KernelDrops:          stats.KernelDrops,
+		ScanPackets:          stats.ScanPackets,
+		RefusedRegistrations: stats.RefusedRegistrations,
+	}
+}
+
+// RestoreCounters adds counter values saved by a previous run of the server
+// to its cumulative counters. It should be called before Run.
+func (s *Server) RestoreCounters(c Counters) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	atomic.AddUint64(&s.writeErrors, c.WriteErrors)
+	atomic.AddUint64(&s.decodeErrors, c.DecodeErrors)
+	atomic.AddUint64(&s.kernelDrops, c.KernelDrops)
+	atomic.AddUint64(&s.scanPackets, c.ScanPackets)
+	atomic.AddUint64(&s.refusedRegs, c.RefusedRegistrations)
+	s.kernelDropsBase += c.KernelDrops
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+// panicNetwork is a network whose nodes panic when they are read from.
+type panicNetwork struct {
+	*virtual.Network
+}
+
+type panicNode struct {
+	network.Node
+}
+
+func (n panicNetwork) NewNode() network.Node {
+	return panicNode{n.Network.NewNode()}
+}
+
+func (n panicNode) Read(data []byte) (int, error) {
+	panic("test panic")
+}
+
+// TestClientPanicDumped checks that a crash dump is written if the goroutine
+// that forwards packets to a client panics. The panic is in a child process,
+// since it cannot be recovered from.
+func TestClientPanicDumped(t *testing.T) {
+	if dir := os.Getenv("IPXBOX_TEST_CRASH_DIR"); dir != "" {
+		cfg := *DefaultConfig
+		cfg.CrashDumpDir = dir
+		s, err := New("127.0.0.1:0", panicNetwork{virtual.New()}, &cfg)
+		if err != nil {
+			t.Fatalf("failed to create server: %v", err)
+		}
+		runServer(s, contextForTest(t))
+		newTestClient(t, s).register(nil)
+		time.Sleep(5 * time.Second)
+		return
+	}
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestClientPanicDumped$")
+	cmd.Env = append(os.Environ(), "IPXBOX_TEST_CRASH_DIR="+dir)
+	if err := cmd.Run(); err == nil {
+		t.Fatalf("child process did not panic")
+	}
+	dumps, _ := filepath.Glob(filepath.Join(dir, "*.pcap"))
+	if len(dumps) == 0 {
+		t.Errorf("no crash dump written")
+	}
+}
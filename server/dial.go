@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// dialClients sends a ping to each of the endpoints in Config.DialAddrs that
+// has not yet registered, so that the server starts the exchange rather
+// than waiting for the client to. The ping opens a mapping on any NAT or
+// firewall in front of the server, and tells a relay at the endpoint that
+// the server is there, so that it can register its client through the
+// mapping. Endpoints are pinged every KeepaliveTime until they register.
+// It returns the time that it should next be called.
+func (s *Server) dialClients(now time.Time) time.Time {
+	next := s.lastDialTime.Add(s.config.KeepaliveTime)
+	if now.Before(next) {
+		return next
+	}
+	s.lastDialTime = now
+	header := pingHeader()
+	if s.config.LegacyPingReply {
+		header.Src.Addr = addrLegacyPingReply
+	}
+	encodedHeader, err := header.MarshalBinary()
+	if err != nil {
+		return now.Add(s.config.KeepaliveTime)
+	}
+	for _, addr := range s.config.DialAddrs {
+		if _, ok := s.clients[addr.String()]; ok {
+			continue
+		}
+		s.dialAddr(encodedHeader, addr)
+	}
+	return now.Add(s.config.KeepaliveTime)
+}
+
+// dialAddr sends the given packet to an endpoint that has not registered.
+func (s *Server) dialAddr(packet []byte, addr *net.UDPAddr) {
+	if _, err := s.socket.WriteToUDP(packet, addr); err != nil {
+		logger.Debugf("dialing %s: %v", addr, err)
+		s.tracePacket(addr, traceOut, packet, err.Error())
+		return
+	}
+	s.tracePacket(addr, traceOut, packet, "dial")
+}
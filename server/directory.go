@@ -0,0 +1,61 @@
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+// RoomListing describes a room that players can join, for the room
+// directory.
+type RoomListing struct {
+	Name       string `json:"name"`
+	Players    int    `json:"players"`
+	MaxPlayers int    `json:"max_players,omitempty"`
+
+	// Name of the game most recently played in the room, if it uses a
+	// well-known socket.
+	Game string `json:"game,omitempty"`
+
+	// True if the room has had no game traffic for Config.IdleRoomTime.
+	Idle bool `json:"idle"`
+
+	// True if the room has a locked game session, so that anyone
+	// joining now cannot take part in the current game.
+	InGame bool `json:"in_game"`
+}
+
+// RoomDirectory returns the rooms that players can join with JoinRoom: those
+// that have a password.
+func (s *Server) RoomDirectory() []RoomListing {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	players := map[string]int{}
+	for _, c := range s.clients {
+		players[c.room]++
+	}
+	inGame := map[string]bool{}
+	for key, sess := range s.sessions {
+		if sess.locked && now.Sub(sess.lastActivity) < sessionIdleTime {
+			inGame[key.room] = true
+		}
+	}
+	result := []RoomListing{}
+	for name, rs := range s.roomSettings {
+		if rs.Password == "" {
+			continue
+		}
+		result = append(result, RoomListing{
+			Name:       name,
+			Players:    players[name],
+			MaxPlayers: rs.MaxPlayers,
+			Game:       s.roomGames[name],
+			Idle:       s.roomIdle(name, now),
+			InGame:     inGame[name],
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// socketInode returns the inode number of the given socket.
+func socketInode(conn *net.UDPConn) (string, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var link string
+	var lerr error
+	if err := rc.Control(func(fd uintptr) {
+		link, lerr = os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	}); err != nil {
+		return "", err
+	}
+	if lerr != nil {
+		return "", lerr
+	}
+	// Link is of the form "socket:[12345]".
+	if !strings.HasPrefix(link, "socket:[") || !strings.HasSuffix(link, "]") {
+		return "", fmt.Errorf("unexpected socket link %q", link)
+	}
+	return link[8 : len(link)-1], nil
+}
+
+// findSocketDrops searches the given file (in /proc/net/udp format) for the
+// socket with the given inode number and returns its count of drops.
+func findSocketDrops(filename, inode string) (uint64, bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Fields: sl local_address rem_address st tx_queue:rx_queue
+		// tr:tm->when retrnsmt uid timeout inode ref pointer drops
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 || fields[9] != inode {
+			continue
+		}
+		drops, err := strconv.ParseUint(fields[12], 10, 64)
+		return drops, true, err
+	}
+	return 0, false, scanner.Err()
+}
+
+// socketDrops returns the number of inbound packets that the kernel has
+// dropped for the given socket.
+func socketDrops(conn *net.UDPConn) (uint64, error) {
+	inode, err := socketInode(conn)
+	if err != nil {
+		return 0, err
+	}
+	for _, filename := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		drops, ok, err := findSocketDrops(filename, inode)
+		if ok || (err != nil && !os.IsNotExist(err)) {
+			return drops, err
+		}
+	}
+	return 0, fmt.Errorf("socket inode %s not found", inode)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// socketDrops returns the number of inbound packets that the kernel has
+// dropped for the given socket. This is only supported on Linux.
+func socketDrops(conn *net.UDPConn) (uint64, error) {
+	return 0, errors.New("reading socket drop counters not supported on this OS")
+}
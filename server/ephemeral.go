@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/fragglet/ipxbox/network"
+)
+
+// Ephemeral rooms are not removed until they have existed for this long,
+// so that a room is not removed before its creator has been moved into it.
+const ephemeralGrace = time.Minute
+
+var (
+	// InvalidRoomNameError is returned by JoinRoom if it would create a
+	// room with a name that is not allowed.
+	InvalidRoomNameError = errors.New("invalid room name")
+
+	// TooManyRoomsError is returned by JoinRoom if it would create a
+	// room when Config.MaxEphemeralRooms already exist.
+	TooManyRoomsError = errors.New("too many rooms")
+)
+
+var roomNameRE = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ephemeralRoom tracks a room created on demand by JoinRoom or an extended
+// registration. It is only
+// accessed while holding the server's mutex.
+type ephemeralRoom struct {
+	created time.Time
+	peak    int
+}
+
+// createRoom creates an ephemeral room with the given name and password, if
+// Config.NewRoom is set. The caller must hold the server's mutex.
+func (s *Server) createRoom(name, password string) error {
+	if s.config.NewRoom == nil {
+		return UnknownRoomError
+	}
+	if !roomNameRE.MatchString(name) {
+		return InvalidRoomNameError
+	}
+	if password == "" {
+		return WrongPasswordError
+	}
+	if max := s.config.MaxEphemeralRooms; max > 0 && len(s.ephemeral) >= max {
+		return TooManyRoomsError
+	}
+	n, err := s.config.NewRoom(name)
+	if err != nil {
+		return err
+	}
+	s.rooms[name] = n
+	s.roomSettings[name] = RoomSettings{Password: password}
+	s.ephemeral[name] = &ephemeralRoom{created: time.Now()}
+	logger.Printf("room %q: created on demand", name)
+	return nil
+}
+
+// expireEphemeralRooms removes ephemeral rooms that no longer have any
+// clients. Each room's network is closed once Config.RoomClosed, if set,
+// has been called.
+func (s *Server) expireEphemeralRooms(now time.Time) {
+	if len(s.ephemeral) == 0 {
+		return
+	}
+	counts := map[string]int{}
+	for _, c := range s.clients {
+		counts[c.room]++
+	}
+	for name, e := range s.ephemeral {
+		if counts[name] > e.peak {
+			e.peak = counts[name]
+		}
+		if counts[name] > 0 || now.Sub(e.created) < ephemeralGrace {
+			continue
+		}
+		n := s.rooms[name]
+		delete(s.ephemeral, name)
+		delete(s.rooms, name)
+		delete(s.roomSettings, name)
+		delete(s.roomTraffic, name)
+		delete(s.roomGames, name)
+		for key := range s.sessions {
+			if key.room == name {
+				delete(s.sessions, key)
+			}
+		}
+		logger.Printf("room %q: removed after %v; at most %d clients", name, now.Sub(e.created).Round(time.Second), e.peak)
+		go s.closeRoom(name, n)
+	}
+}
+
+// closeRoom finishes with a removed ephemeral room: Config.RoomClosed is
+// called, then the room's network is closed if it can be, so that anything
+// still attached to it, such as a spectator, is disconnected.
+func (s *Server) closeRoom(name string, n network.Network) {
+	if s.crashRing != nil {
+		defer s.crashRing.HandlePanic(s.config.CrashDumpDir)
+	}
+	if s.config.RoomClosed != nil {
+		s.config.RoomClosed(name)
+	}
+	if c, ok := n.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// requestedRoom returns the room that an extended client asked to join in
+// its registration packet with the optRoom and optRoomPassword options. The
+// room is created if it does not exist and Config.NewRoom is set. False is
+// returned if the client did not ask for a room, or cannot join the one it
+// asked for, in which case it joins the room it would have otherwise. The
+// caller must hold the server's mutex.
+func (s *Server) requestedRoom(packet []byte, tier string) (string, bool) {
+	options, ok := extendedOptions(packet)
+	if !ok {
+		return "", false
+	}
+	room, ok := options.Get(optRoom)
+	if !ok {
+		return "", false
+	}
+	password, _ := options.Get(optRoomPassword)
+	name := string(room)
+	var err error
+	switch _, exists := s.rooms[name]; {
+	case !exists:
+		err = s.createRoom(name, string(password))
+	case !s.roomPasswordOK(name, string(password)):
+		err = WrongPasswordError
+	case !s.roomAllowed(tier, name):
+		err = UnknownRoomError
+	case s.roomFull(name):
+		err = RoomFullError
+	}
+	if err != nil {
+		logger.Debugf("registration asked for room %q: %v", name, err)
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/tlv"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+// ephemeralServer returns a running server that creates up to maxRooms rooms
+// on demand, and a function returning the rooms that have been closed.
+func ephemeralServer(t *testing.T, maxRooms int) (*Server, func() []string) {
+	var mu sync.Mutex
+	var closed []string
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.MaxEphemeralRooms = maxRooms
+		cfg.NewRoom = func(name string) (network.Network, error) {
+			return virtual.New(), nil
+		}
+		cfg.RoomClosed = func(name string) {
+			mu.Lock()
+			defer mu.Unlock()
+			closed = append(closed, name)
+		}
+	})
+	runServer(s, contextForTest(t))
+	return s, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, closed...)
+	}
+}
+
+func roomExists(s *Server, room string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.rooms[room]
+	return ok
+}
+
+func TestJoinRoomWithoutClientsCreatesNothing(t *testing.T) {
+	s, _ := ephemeralServer(t, 0)
+	addr := ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	if err := s.JoinRoom(addr, "lobby", "secret"); err != UnknownClientError {
+		t.Errorf("JoinRoom with no clients = %v, want UnknownClientError", err)
+	}
+	if roomExists(s, "lobby") {
+		t.Errorf("room was created with no clients to move into it")
+	}
+}
+
+func TestJoinRoomCreatesRoom(t *testing.T) {
+	s, _ := ephemeralServer(t, 0)
+	c := newTestClient(t, s)
+	c.register(nil)
+	if err := s.JoinRoom(c.addr, "lobby", "secret"); err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	if got := s.ClientStats()[0].Room; got != "lobby" {
+		t.Errorf("client is in room %q after joining, want \"lobby\"", got)
+	}
+
+	// Another client behind the same IP address is not moved along with
+	// it, and must know the password to follow.
+	c2 := newTestClient(t, s)
+	c2.register(nil)
+	if err := s.JoinRoom(c2.addr, "lobby", "wrong"); err != WrongPasswordError {
+		t.Errorf("JoinRoom with the wrong password = %v, want WrongPasswordError", err)
+	}
+	for _, stats := range s.ClientStats() {
+		if stats.IPXAddr == c2.addr.String() && stats.Room != DefaultRoom {
+			t.Errorf("second client is in room %q, want %q", stats.Room, DefaultRoom)
+		}
+	}
+}
+
+func TestEphemeralRoomLimit(t *testing.T) {
+	s, _ := ephemeralServer(t, 2)
+	c := newTestClient(t, s)
+	c.register(nil)
+	for i := 0; i < 2; i++ {
+		if err := s.JoinRoom(c.addr, fmt.Sprintf("room%d", i), "pw"); err != nil {
+			t.Fatalf("JoinRoom %d failed: %v", i, err)
+		}
+	}
+	if err := s.JoinRoom(c.addr, "room2", "pw"); err != TooManyRoomsError {
+		t.Errorf("JoinRoom beyond the limit = %v, want TooManyRoomsError", err)
+	}
+}
+
+func TestRegisterWithRoom(t *testing.T) {
+	s, _ := ephemeralServer(t, 0)
+	opts, _ := tlv.Append(nil, optRoom, []byte("lobby"))
+	opts, _ = tlv.Append(opts, optRoomPassword, []byte("pw"))
+	c := newTestClient(t, s)
+	reply := c.register(opts)
+	options, ok := extendedOptions(reply)
+	if !ok {
+		t.Fatalf("registration reply was not extended")
+	}
+	if room, _ := options.Get(optRoom); string(room) != "lobby" {
+		t.Errorf("reply names room %q, want \"lobby\"", room)
+	}
+
+	// A second client with the wrong password joins the default room.
+	opts, _ = tlv.Append(nil, optRoom, []byte("lobby"))
+	opts, _ = tlv.Append(opts, optRoomPassword, []byte("wrong"))
+	c2 := newTestClient(t, s)
+	options, _ = extendedOptions(c2.register(opts))
+	if room, _ := options.Get(optRoom); string(room) != DefaultRoom {
+		t.Errorf("client with wrong password joined %q, want %q", room, DefaultRoom)
+	}
+}
+
+func TestEphemeralRoomExpiry(t *testing.T) {
+	s, closed := ephemeralServer(t, 0)
+	c := newTestClient(t, s)
+	c.register(nil)
+	if err := s.JoinRoom(c.addr, "lobby", "pw"); err != nil {
+		t.Fatalf("JoinRoom failed: %v", err)
+	}
+	s.mu.Lock()
+	room := s.rooms["lobby"].(*virtual.Network)
+	s.mu.Unlock()
+	spectator := room.Spectator()
+	if err := s.MoveClient(c.addr, DefaultRoom); err != nil {
+		t.Fatalf("MoveClient failed: %v", err)
+	}
+	s.mu.Lock()
+	s.expireEphemeralRooms(time.Now().Add(ephemeralGrace))
+	s.mu.Unlock()
+	if roomExists(s, "lobby") {
+		t.Fatalf("empty room was not removed")
+	}
+	var buf [1500]byte
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := spectator.ReadPacket(ctx, buf[:]); err != io.EOF {
+		t.Errorf("room's network was not closed")
+	}
+	if got := closed(); len(got) != 1 || got[0] != "lobby" {
+		t.Errorf("RoomClosed called for %v, want [lobby]", got)
+	}
+}
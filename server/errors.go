@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// errorCategory categorizes the errors that can occur when forwarding
+// packets to or from a client.
+type errorCategory int
+
+const (
+	// The client's host or port is unreachable (we received an ICMP
+	// unreachable message in response to an earlier packet).
+	errorUnreachable errorCategory = iota
+
+	// The OS socket buffer was full, so the packet was dropped.
+	errorBufferFull
+
+	// The network rejected a packet sent by the client, eg. because it
+	// was addressed to an unknown node.
+	errorNetwork
+
+	// Any other kind of error.
+	errorOther
+
+	numErrorCategories
+)
+
+// Minimum time between logging errors for a particular client.
+const errorLogInterval = time.Minute
+
+var errorCategoryNames = [numErrorCategories]string{
+	errorUnreachable: "unreachable",
+	errorBufferFull:  "buffer full",
+	errorNetwork:     "network",
+	errorOther:       "other",
+}
+
+func (c errorCategory) String() string {
+	return errorCategoryNames[c]
+}
+
+// categorizeError returns the category for the given error from sending a
+// packet to a client.
+func categorizeError(err error) errorCategory {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorUnreachable
+	case errors.Is(err, syscall.ENOBUFS), errors.Is(err, syscall.EAGAIN):
+		return errorBufferFull
+	default:
+		return errorOther
+	}
+}
+
+// recordError counts an error in the given category that occurred when
+// forwarding packets for the given client. To avoid flooding the logs,
+// errors for a client are logged at most once every errorLogInterval.
+func (c *client) recordError(category errorCategory, err error) {
+	atomic.AddUint64(&c.errors[category], 1)
+
+	now := monotonicNow()
+	last := atomic.LoadInt64(&c.lastErrorLogTime)
+	if last != 0 && now-last < int64(errorLogInterval) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&c.lastErrorLogTime, last, now) {
+		return
+	}
+	logger.Printf("client %s: error forwarding packet (%v): %v; error counts: %v", c.addr, category, err, c.errorCounts())
+}
+
+// errorCounts returns the number of errors in each category for a client.
+func (c *client) errorCounts() map[string]uint64 {
+	result := map[string]uint64{}
+	for i := errorCategory(0); i < numErrorCategories; i++ {
+		result[i.String()] = atomic.LoadUint64(&c.errors[i])
+	}
+	return result
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/tlv"
+)
+
+// extMagic marks the trailing data of a registration packet from a client
+// that understands the extended registration reply, and of the reply
+// itself. It follows the 30 byte IPX header.
+var extMagic = []byte("IPXB")
+
+// Options in the extended registration reply, encoded with package tlv.
+const (
+	// Version of the server software, as a string.
+	optVersion = 1
+
+	// URL of the server's message of the day, as a string.
+	optMOTD = 2
+
+	// Name of the room that the client joined, as a string. Clients may
+	// send this in their registration packet to ask to join a room, with
+	// optRoomPassword; the room is created if the server creates rooms
+	// on demand. If the room cannot be joined, the client joins the room
+	// it would have otherwise, and the reply names that room instead.
+	optRoom = 3
+
+	// Bitmap of the features the server has enabled, as a 32-bit
+	// big-endian integer; see the feature constants.
+	optFeatures = 4
+
+	// Version of the extended protocol that the server chose, as a
+	// single byte.
+	optProtocolVersion = 5
+
+	// Range of extended protocol versions that the client offered, as
+	// two bytes: the lowest and highest. Clients may send this in their
+	// registration packet; the server echoes what it received, so that
+	// a client can check that its offer arrived intact. The echo is not
+	// authenticated, so it only catches offers that were corrupted or
+	// stripped in transit by accident: anyone on the path who can
+	// change the offer to force a downgrade can change the echo too.
+	optOfferedVersions = 6
+
+	// Capabilities that the client has, as a comma-separated list of
+	// names; see knownCapabilities. Only sent by clients.
+	optCapabilities = 7
+
+	// Password of the room named in optRoom, as a string. Only sent by
+	// clients.
+	optRoomPassword = 8
+
+	// Why the server could not give the extended reply that the client
+	// asked for, as a string. A reply with this option carries no
+	// other options except optSupportedVersions; the client is still
+	// registered, as a vanilla client.
+	optError = 9
+
+	// Range of extended protocol versions that the server supports, as
+	// two bytes: the lowest and highest. Sent with optError when the
+	// client offered no version that the server supports.
+	optSupportedVersions = 10
+
+	// Ignored by the server. Clients may send this to make their
+	// registration packet longer; see appendOptions.
+	optPadding = 11
+
+	// New IPX address of the client, as 6 bytes. Sent in a notice when
+	// the server renumbers the client; see Renumber.
+	optNewAddress = 12
+
+	// Proof of work that a client must do before it can register
+	// during a registration flood: the number of leading zero bits
+	// required, as one byte, then an 8 byte challenge. Sent instead of
+	// the registration reply, with no address assigned.
+	optChallenge = 13
+
+	// Solution to the proof of work given in optChallenge, as 8 bytes:
+	// the SHA-256 hash of the challenge followed by the solution must
+	// start with the required number of zero bits. Only sent by
+	// clients, in a repeated registration packet.
+	optSolution = 14
+
+	// Address and port that the client's registration came from, as
+	// seen by the server: a 4 byte IPv4 or 16 byte IPv6 address, then
+	// a 16-bit big-endian port. If it differs from the client's own
+	// address, the client is behind NAT. Only sent by the server.
+	optObservedAddress = 15
+
+	// Size in bytes of the largest packet, including the IPX header,
+	// that the server found it could deliver to the client, as a
+	// 16-bit big-endian integer, or zero if no probe got through. Sent
+	// in a notice once probing has finished, if Config.MTUProbe is set.
+	optMaxPacketSize = 16
+
+	// Address of another server on the same network, as a "host:port"
+	// string, that the client should register with instead. Sent instead
+	// of the registration reply, with a null destination address, if
+	// this server is busy; see Config.RedirectAddrs.
+	optRedirect = 17
+
+	// Request to measure the path between two clients, as an 8 byte
+	// token then a 6 byte IPX address. Sent in a notice to a client that
+	// advertised the path_echo capability, which sends the option on,
+	// with its own address in place of the one it was sent, in a packet
+	// from its socket 2 to socket 2 of the given address. A client that
+	// receives such a packet echoes the option back the same way, with
+	// a null address; a client that receives the option with a null
+	// address ignores it. See MeasurePath.
+	optPathEcho = 18
+)
+
+// Range of extended protocol versions that the server supports. Clients
+// that send the magic but no optOfferedVersions option speak version 1.
+const (
+	minProtocolVersion = 1
+	maxProtocolVersion = 1
+)
+
+var (
+	// invalidOfferError is returned by negotiateVersion if the
+	// optOfferedVersions option is malformed.
+	invalidOfferError = errors.New("invalid offered versions")
+
+	// noCommonVersionError is returned by negotiateVersion if the
+	// client offered no version that the server supports.
+	noCommonVersionError = errors.New("no common protocol version")
+)
+
+// Features reported in the optFeatures option.
+const (
+	featureMTUProbe    = 1 << 0
+	featureSessionLock = 1 << 1
+	featureSatellites  = 1 << 2
+	featureLegacyPing  = 1 << 3
+)
+
+// extendedOptions returns the options in the given registration packet, if
+// the client asked for the extended registration reply and its options can
+// be parsed.
+func extendedOptions(packet []byte) (tlv.Options, bool) {
+	if len(packet) < 30+len(extMagic) || !bytes.Equal(packet[30:30+len(extMagic)], extMagic) {
+		return nil, false
+	}
+	options, err := tlv.Parse(packet[30+len(extMagic):])
+	if err != nil {
+		return nil, false
+	}
+	return options, true
+}
+
+// negotiateVersion returns the extended protocol version to use in the reply
+// to a registration packet with the given options, and the versions offered
+// by the client, if it sent any. The highest version that both support is
+// chosen; there is no way for the server to choose a lower one. An error is
+// returned if the client has no version in common with the server, or its
+// offer is malformed. Such clients get the reply built by errorReply.
+func negotiateVersion(options tlv.Options) (byte, []byte, error) {
+	offered, ok := options.Get(optOfferedVersions)
+	if !ok {
+		return 1, nil, nil
+	}
+	if len(offered) != 2 || offered[0] > offered[1] {
+		return 0, nil, invalidOfferError
+	}
+	min, max := offered[0], offered[1]
+	if max < minProtocolVersion || min > maxProtocolVersion {
+		return 0, offered, noCommonVersionError
+	}
+	if max > maxProtocolVersion {
+		max = maxProtocolVersion
+	}
+	return max, offered, nil
+}
+
+// appendOptions appends the magic and the given options to the given
+// encoded registration reply. Options with empty values are left out, as
+// are options that would make the result longer than limit, which is the
+// length of the registration packet being replied to. Since the source
+// address of a registration packet is not checked, a reply longer than it
+// would let the server be used to amplify a flood of packets with a forged
+// source address. Options are given most important first, and clients that
+// want every option should pad their registration packet with optPadding.
+func appendOptions(reply []byte, options []tlv.Option, limit int) ([]byte, error) {
+	result := append(append([]byte{}, reply...), extMagic...)
+	for _, opt := range options {
+		if len(opt.Value) == 0 || len(result)+tlv.HeaderLen+len(opt.Value) > limit {
+			continue
+		}
+		var err error
+		if result, err = tlv.Append(result, opt.Type, opt.Value); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// errorReply appends an extended trailer to the given encoded registration
+// reply that only explains, with optError, why the client cannot have the
+// extended reply it asked for. Like the normal extended reply, the first
+// 30 bytes are unchanged, so the client can still use the address it was
+// assigned, as a vanilla client. The reply is no longer than limit; see
+// appendOptions.
+func errorReply(reply []byte, err error, limit int) ([]byte, error) {
+	return appendOptions(reply, []tlv.Option{
+		{Type: optSupportedVersions, Value: []byte{minProtocolVersion, maxProtocolVersion}},
+		{Type: optError, Value: []byte(err.Error())},
+	}, limit)
+}
+
+// notice returns a notice for an extended client: a packet that the server
+// sends of its own accord, rather than in reply to a registration, with
+// the header of a registration reply to the given address followed by the
+// magic and the given options. Only clients that negotiated a protocol
+// version are sent notices, so they are never seen by vanilla clients.
+func notice(dest ipx.Addr, options []tlv.Option) ([]byte, error) {
+	encoded, err := registrationReply(dest).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return appendOptions(encoded, options, maxNoticeLength)
+}
+
+// Notices are sent to registered clients, so they cannot be used for
+// amplification, but they must still fit in a packet.
+const maxNoticeLength = 576
+
+// observedAddress returns the value of the optObservedAddress option for the
+// given address.
+func observedAddress(addr *net.UDPAddr) []byte {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], uint16(addr.Port))
+	return append(append([]byte{}, ip...), port[:]...)
+}
+
+// features returns the bitmap of features that the server has enabled.
+func (s *Server) features() uint32 {
+	var result uint32
+	if s.config.MTUProbe {
+		result |= featureMTUProbe
+	}
+	if s.config.SessionLockDelay != 0 {
+		result |= featureSessionLock
+	}
+	if len(s.config.SatelliteRanges) > 0 {
+		result |= featureSatellites
+	}
+	if s.config.LegacyPingReply {
+		result |= featureLegacyPing
+	}
+	return result
+}
+
+// extendedReply appends the extended trailer to the given encoded
+// registration reply for the given client, using the given protocol version
+// and echoing the versions the client offered. The first 30 bytes, and the
+// length in the IPX header, are unchanged, so the reply still looks like a
+// normal registration reply to anything that ignores the trailer. The reply
+// is no longer than limit; see appendOptions.
+func (s *Server) extendedReply(reply []byte, c *client, version byte, offered []byte, limit int) ([]byte, error) {
+	var features [4]byte
+	binary.BigEndian.PutUint32(features[:], s.features())
+	return appendOptions(reply, []tlv.Option{
+		{Type: optProtocolVersion, Value: []byte{version}},
+		{Type: optOfferedVersions, Value: offered},
+		{Type: optRoom, Value: []byte(c.room)},
+		{Type: optFeatures, Value: features[:]},
+		{Type: optObservedAddress, Value: observedAddress(c.addr)},
+		{Type: optVersion, Value: []byte(s.config.Version)},
+		{Type: optMOTD, Value: []byte(s.config.MOTDURL)},
+	}, limit)
+}
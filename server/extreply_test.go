@@ -0,0 +1,231 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/tlv"
+)
+
+// registrationPacket returns a registration packet carrying the extended
+// magic followed by the given option bytes.
+func registrationPacket(t testing.TB, opts []byte) []byte {
+	reg := &ipx.Header{
+		Checksum: 0xffff,
+		Length:   30,
+		Dest:     ipx.HeaderAddr{Socket: 2},
+		Src:      ipx.HeaderAddr{Socket: 2},
+	}
+	hdr, err := reg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to encode header: %v", err)
+	}
+	packet := append(hdr, extMagic...)
+	return append(packet, opts...)
+}
+
+// padded returns the given options followed by enough padding for the reply
+// to carry every option.
+func padded(opts []byte) []byte {
+	result, _ := tlv.Append(opts, optPadding, make([]byte, 128))
+	return result
+}
+
+func TestExtendedOptions(t *testing.T) {
+	plain := registrationPacket(t, nil)[:30]
+	if _, ok := extendedOptions(plain); ok {
+		t.Errorf("plain registration packet parsed as extended")
+	}
+	opts, _ := tlv.Append(nil, optCapabilities, []byte("no_keepalive,bogus,no_keepalive"))
+	options, ok := extendedOptions(registrationPacket(t, opts))
+	if !ok {
+		t.Fatalf("extended registration packet not recognized")
+	}
+	caps := advertisedCapabilities(options)
+	if len(caps) != 1 || caps[0] != "no_keepalive" {
+		t.Errorf("advertisedCapabilities = %v, want [no_keepalive]", caps)
+	}
+	truncated := registrationPacket(t, []byte{optCapabilities, 0, 10, 'x'})
+	if _, ok := extendedOptions(truncated); ok {
+		t.Errorf("registration packet with truncated options was accepted")
+	}
+}
+
+// FuzzRegistrationOptions checks that the parsers for the trailer of a
+// registration packet never panic, and that whatever version is negotiated
+// is one the server supports.
+func FuzzRegistrationOptions(f *testing.F) {
+	versions, _ := tlv.Append(nil, optOfferedVersions, []byte{1, 3})
+	caps, _ := tlv.Append(nil, optCapabilities, []byte("resume,no_keepalive"))
+	f.Add([]byte{})
+	f.Add(versions)
+	f.Add(append(versions, caps...))
+	f.Add([]byte{optOfferedVersions, 0, 2, 5, 1})
+	f.Add([]byte{optOfferedVersions, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, opts []byte) {
+		options, ok := extendedOptions(registrationPacket(t, opts))
+		if !ok {
+			return
+		}
+		version, _, err := negotiateVersion(options)
+		if err == nil && (version < minProtocolVersion || version > maxProtocolVersion) {
+			t.Fatalf("negotiated unsupported version %d", version)
+		}
+		if err != nil && version != 0 {
+			t.Fatalf("negotiation failed with %v, but returned version %d", err, version)
+		}
+		for _, name := range advertisedCapabilities(options) {
+			if !knownCapabilities[name] {
+				t.Fatalf("unknown capability %q returned", name)
+			}
+		}
+	})
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		offered []byte
+		version byte
+		err     error
+	}{
+		// No offer means version 1.
+		{nil, 1, nil},
+		{[]byte{1, 1}, 1, nil},
+		// The highest common version is chosen.
+		{[]byte{1, 200}, maxProtocolVersion, nil},
+		{[]byte{0, 1}, 1, nil},
+		{[]byte{maxProtocolVersion + 1, 200}, 0, noCommonVersionError},
+		{[]byte{0, 0}, 0, noCommonVersionError},
+		{[]byte{2, 1}, 0, invalidOfferError},
+		{[]byte{1}, 0, invalidOfferError},
+		{[]byte{1, 2, 3}, 0, invalidOfferError},
+	}
+	for _, test := range tests {
+		var opts []byte
+		if test.offered != nil {
+			opts, _ = tlv.Append(nil, optOfferedVersions, test.offered)
+		}
+		options, err := tlv.Parse(opts)
+		if err != nil {
+			t.Fatalf("failed to parse options: %v", err)
+		}
+		version, _, err := negotiateVersion(options)
+		if version != test.version || err != test.err {
+			t.Errorf("offer %v: got version %d, error %v; want %d, %v", test.offered, version, err, test.version, test.err)
+		}
+	}
+}
+
+// TestVersionNegotiationReplies checks the replies that clients get to
+// registrations with and without a version in common with the server.
+func TestVersionNegotiationReplies(t *testing.T) {
+	s := newTestServer(t, nil)
+	runServer(s, contextForTest(t))
+
+	// A vanilla client gets the plain reply.
+	if reply := newTestClient(t, s).register(nil); len(reply) != 30 {
+		t.Errorf("vanilla client got %d byte reply, want 30", len(reply))
+	}
+
+	opts, _ := tlv.Append(nil, optOfferedVersions, []byte{1, 5})
+	options, ok := extendedOptions(newTestClient(t, s).register(padded(opts)))
+	if !ok {
+		t.Fatalf("extended client got no extended reply")
+	}
+	if v, _ := options.Get(optProtocolVersion); len(v) != 1 || v[0] != maxProtocolVersion {
+		t.Errorf("reply chose version %v, want %d", v, maxProtocolVersion)
+	}
+	if echo, _ := options.Get(optOfferedVersions); string(echo) != string([]byte{1, 5}) {
+		t.Errorf("reply echoed offer %v, want [1 5]", echo)
+	}
+	if _, ok := options.Get(optError); ok {
+		t.Errorf("successful negotiation returned an error option")
+	}
+
+	// A client from the future still registers, but is told why it
+	// did not get the extended reply.
+	opts, _ = tlv.Append(nil, optOfferedVersions, []byte{maxProtocolVersion + 1, maxProtocolVersion + 2})
+	c := newTestClient(t, s)
+	reply := c.register(padded(opts))
+	options, ok = extendedOptions(reply)
+	if !ok {
+		t.Fatalf("client with no common version got no extended trailer")
+	}
+	if msg, _ := options.Get(optError); string(msg) != noCommonVersionError.Error() {
+		t.Errorf("error option = %q, want %q", msg, noCommonVersionError)
+	}
+	if v, _ := options.Get(optSupportedVersions); string(v) != string([]byte{minProtocolVersion, maxProtocolVersion}) {
+		t.Errorf("supported versions = %v, want [%d %d]", v, minProtocolVersion, maxProtocolVersion)
+	}
+	if _, ok := options.Get(optProtocolVersion); ok {
+		t.Errorf("error reply chose a protocol version")
+	}
+	if c.addr == ipx.AddrNull {
+		t.Errorf("client with no common version was not assigned an address")
+	}
+}
+
+// TestReplyNoLongerThanRegistration checks that the extended reply never
+// amplifies the registration packet it answers, and that options are left
+// out least important first.
+func TestReplyNoLongerThanRegistration(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Version = "ipxbox-test"
+		cfg.MOTDURL = "https://example.com/a/rather/long/message/of/the/day"
+	})
+	runServer(s, contextForTest(t))
+
+	bare := registrationPacket(t, nil)
+	reply := newTestClient(t, s).register([]byte{})
+	if len(reply) > len(bare) {
+		t.Errorf("%d byte reply to %d byte registration", len(reply), len(bare))
+	}
+	options, ok := extendedOptions(reply)
+	if !ok {
+		t.Fatalf("bare extended registration got no extended reply")
+	}
+	if len(options) != 0 {
+		t.Errorf("options %v sent in a reply with no room for them", options)
+	}
+
+	opts, _ := tlv.Append(nil, optOfferedVersions, []byte{1, 1})
+	for _, length := range []int{0, 8, 16, 32, 64} {
+		var pad []byte
+		if length > 0 {
+			pad, _ = tlv.Append(nil, optPadding, make([]byte, length))
+		}
+		request := registrationPacket(t, append(append([]byte{}, opts...), pad...))
+		reply := newTestClient(t, s).register(request[30+len(extMagic):])
+		if len(reply) > len(request) {
+			t.Errorf("%d byte reply to %d byte registration", len(reply), len(request))
+		}
+		options, _ := extendedOptions(reply)
+		if _, ok := options.Get(optProtocolVersion); !ok {
+			t.Errorf("%d byte registration: reply did not choose a version", len(request))
+		}
+	}
+
+	options, _ = extendedOptions(newTestClient(t, s).register(padded(opts)))
+	if motd, _ := options.Get(optMOTD); string(motd) != s.config.MOTDURL {
+		t.Errorf("padded registration got MOTD %q, want %q", motd, s.config.MOTDURL)
+	}
+}
+
+func TestObservedAddress(t *testing.T) {
+	s := newTestServer(t, nil)
+	runServer(s, contextForTest(t))
+	c := newTestClient(t, s)
+	options, _ := extendedOptions(c.register(padded(nil)))
+	got, ok := options.Get(optObservedAddress)
+	if !ok {
+		t.Fatalf("reply has no observed address")
+	}
+	local := c.conn.LocalAddr().(*net.UDPAddr)
+	if want := observedAddress(local); string(got) != string(want) {
+		t.Errorf("observed address %x, want %x (%s)", got, want, local)
+	}
+	if len(got) != 6 {
+		t.Errorf("observed IPv4 address is %d bytes, want 6", len(got))
+	}
+}
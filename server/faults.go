@@ -0,0 +1,39 @@
+package server
+
+import "time"
+
+// faultInjector injects faults into the server, so that tests can check
+// that its timeout, keepalive and client table logic copes with them. Only
+// tests set one; see chaos_test.go.
+type faultInjector interface {
+	// writeFault is called before a packet is sent to a client. It
+	// returns an error if the write should fail, or how long the write
+	// should be delayed by.
+	writeFault() (time.Duration, error)
+
+	// corrupt returns the given received packet, or a corrupted copy
+	// of it.
+	corrupt(packet []byte) []byte
+
+	// clockOffset returns how far the clock seen by the server's
+	// timeout checks has jumped forward.
+	clockOffset() time.Duration
+}
+
+// now returns the current time as seen by the server's timeout checks,
+// which includes any clock jumps that have been injected.
+func (s *Server) now() time.Time {
+	if s.faults == nil {
+		return time.Now()
+	}
+	return time.Now().Add(s.faults.clockOffset())
+}
+
+// corrupt returns the given received packet, or a corrupted copy of it if
+// faults are being injected.
+func (s *Server) corrupt(packet []byte) []byte {
+	if s.faults == nil {
+		return packet
+	}
+	return s.faults.corrupt(packet)
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+const (
+	// Maximum number of distinct source sockets recorded per client.
+	maxFingerprintSockets = 16
+
+	// Number of buckets in the histogram of gaps between packets. Gaps
+	// are bucketed by powers of two milliseconds.
+	numGapBuckets = 16
+
+	// Number of departed clients whose fingerprints are remembered.
+	maxDepartedClients = 256
+)
+
+// fingerprint accumulates the observed behavior of a client that is used to
+// derive its fingerprint. It is only accessed while holding the server's
+// mutex.
+type fingerprint struct {
+	registrations int
+	sockets       map[uint16]bool
+	gaps          [numGapBuckets]uint32
+}
+
+// observePacket records a packet sent by the client, which arrived the given
+// time after the previous one.
+func (f *fingerprint) observePacket(header *ipx.Header, gap time.Duration) {
+	if f.sockets == nil {
+		f.sockets = map[uint16]bool{}
+	}
+	if len(f.sockets) < maxFingerprintSockets {
+		f.sockets[header.Src.Socket] = true
+	}
+	bucket := bits.Len64(uint64(gap / time.Millisecond))
+	if bucket >= numGapBuckets {
+		bucket = numGapBuckets - 1
+	}
+	f.gaps[bucket]++
+}
+
+// key returns the client's fingerprint, derived from its registration
+// behavior, the sockets it uses and the most common gap between packets.
+// It is a soft fingerprint: unrelated clients running the same game may
+// well share one, so matches are only hints.
+func (f *fingerprint) key(flavor string) string {
+	var sockets []string
+	for s := range f.sockets {
+		sockets = append(sockets, ipx.Socket(s).String())
+	}
+	sort.Strings(sockets)
+	var gap int
+	for i, n := range f.gaps {
+		if n > f.gaps[gap] {
+			gap = i
+		}
+	}
+	// Clients normally register once; any more than that is a sign of
+	// a lossy connection or an unusual client, but the exact count is
+	// not interesting.
+	registrations := f.registrations
+	if registrations > 3 {
+		registrations = 3
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%d/%s/%d", flavor, registrations, strings.Join(sockets, ","), gap)
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// FingerprintMatch describes a client whose fingerprint matches another's.
+type FingerprintMatch struct {
+	Addr        string    `json:"addr"`
+	IPXAddr     string    `json:"ipx_addr"`
+	Fingerprint string    `json:"fingerprint"`
+	Connected   bool      `json:"connected"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// departedClient is a client that has been removed from the server.
+type departedClient struct {
+	FingerprintMatch
+	ip net.IP
+}
+
+// departClient remembers the fingerprint of a client that is being removed,
+// so that it can later be matched against new clients.
+func (s *Server) departClient(c *client) {
+	s.departed = append(s.departed, departedClient{
+		FingerprintMatch: FingerprintMatch{
+			Addr:        c.addr.String(),
+			IPXAddr:     c.node.Address().String(),
+			Fingerprint: c.fingerprint.key(c.flavor),
+			LastSeen:    c.lastReceiveTime,
+		},
+		ip: c.addr.IP,
+	})
+	if len(s.departed) > maxDepartedClients {
+		s.departed = s.departed[len(s.departed)-maxDepartedClients:]
+	}
+}
+
+// SimilarClients returns clients that are likely to be the same as the
+// client with the given IPX address, but which connected from a different IP
+// address. Both connected clients and recently departed ones are included.
+// This can help to spot a banned user reconnecting from somewhere else. The
+// matches are only hints; see ClientStats.Fingerprint. UnknownClientError is
+// returned if there is no such client.
+func (s *Server) SimilarClients(addr ipx.Addr) ([]FingerprintMatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var target *client
+	for _, c := range s.clients {
+		if c.node.Address() == addr {
+			target = c
+		}
+	}
+	if target == nil {
+		return nil, UnknownClientError
+	}
+	key := target.fingerprint.key(target.flavor)
+	result := []FingerprintMatch{}
+	for _, c := range s.clients {
+		if c.addr.IP.Equal(target.addr.IP) || c.fingerprint.key(c.flavor) != key {
+			continue
+		}
+		result = append(result, FingerprintMatch{
+			Addr:        c.addr.String(),
+			IPXAddr:     c.node.Address().String(),
+			Fingerprint: key,
+			Connected:   true,
+			LastSeen:    c.lastReceiveTime,
+		})
+	}
+	for _, d := range s.departed {
+		if d.ip.Equal(target.addr.IP) || d.Fingerprint != key {
+			continue
+		}
+		result = append(result, d.FingerprintMatch)
+	}
+	return result, nil
+}
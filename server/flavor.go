@@ -0,0 +1,35 @@
+package server
+
+import (
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// Client flavors, as reported in ClientStats.
+const (
+	// The registration packet exactly matches the one sent by
+	// mainline DOSBox: a bare 30 byte header with zeroed source and
+	// destination addresses.
+	flavorDOSBox = "dosbox"
+
+	// The registration packet differs from the mainline DOSBox one,
+	// eg. by carrying a source address or trailing data. Some builds
+	// of DOSBox-X send an extended handshake like this.
+	flavorExtended = "extended"
+)
+
+// registrationFlavor inspects a registration packet to determine what kind
+// of client sent it. Both kinds are handled identically; the flavor is only
+// recorded to help diagnose compatibility problems.
+func registrationFlavor(header *ipx.Header, packet []byte) string {
+	canonical := ipx.HeaderAddr{Socket: 2}
+	switch {
+	case len(packet) != 30 || header.Length != 30:
+		return flavorExtended
+	case header.Src != canonical || header.Dest != canonical:
+		return flavorExtended
+	case header.TransControl != 0 || header.PacketType != 0:
+		return flavorExtended
+	default:
+		return flavorDOSBox
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+var flavorTests = []struct {
+	file   string
+	flavor string
+}{
+	{"registration.hex", flavorDOSBox},
+	{"registration_with_source.hex", flavorExtended},
+	{"registration_with_trailer.hex", flavorExtended},
+}
+
+func TestRegistrationFlavor(t *testing.T) {
+	for _, test := range flavorTests {
+		packet := loadGolden(t, test.file)
+		var hdr ipx.Header
+		if err := hdr.UnmarshalBinary(packet); err != nil {
+			t.Fatalf("%s: failed to decode: %v", test.file, err)
+		}
+		if !hdr.IsRegistrationPacket() {
+			t.Errorf("%s: not recognized as a registration", test.file)
+		}
+		if got := registrationFlavor(&hdr, packet); got != test.flavor {
+			t.Errorf("%s: flavor %q, want %q", test.file, got, test.flavor)
+		}
+	}
+}
+
+// TestRegistrationHandshakes registers with each kind of handshake, twice,
+// and checks that both registrations get the same address and that the
+// client's flavor is reported.
+func TestRegistrationHandshakes(t *testing.T) {
+	s := newTestServer(t, nil)
+	runServer(s, contextForTest(t))
+	for _, test := range flavorTests {
+		c := newTestClient(t, s)
+		packet := loadGolden(t, test.file)
+		var replies [][]byte
+		for i := 0; i < 2; i++ {
+			c.conn.Write(packet)
+			reply, ok := c.read(2 * time.Second)
+			if !ok {
+				t.Fatalf("%s: no reply to registration %d", test.file, i+1)
+			}
+			replies = append(replies, reply)
+		}
+		if !bytes.Equal(replies[0], replies[1]) {
+			t.Errorf("%s: repeated registration got %x, then %x", test.file, replies[0], replies[1])
+		}
+		var hdr ipx.Header
+		hdr.UnmarshalBinary(replies[0])
+		var found bool
+		for _, cs := range s.ClientStats() {
+			if cs.IPXAddr != hdr.Dest.Addr.String() {
+				continue
+			}
+			found = true
+			if cs.Flavor != test.flavor {
+				t.Errorf("%s: client stats give flavor %q, want %q", test.file, cs.Flavor, test.flavor)
+			}
+		}
+		if !found {
+			t.Errorf("%s: client %s not in stats", test.file, hdr.Dest.Addr)
+		}
+	}
+}
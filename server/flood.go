@@ -0,0 +1,179 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/tlv"
+)
+
+// Once a registration flood has been detected, the server stays in flood
+// mode until no flood has been seen for this long.
+const floodHoldTime = time.Minute
+
+// A proof-of-work challenge changes this often. Solutions to the previous
+// challenge are also accepted, so a client has at least this long to
+// solve one.
+const challengeLifetime = 30 * time.Second
+
+// floodGuard detects floods of registrations from new clients, and limits
+// the number of clients that each IP address may have while a flood is in
+// progress. It is only accessed while holding the server's mutex, except for
+// floodUntil.
+type floodGuard struct {
+	// Time since processStart at which the flood ends. Accessed
+	// atomically, so that the server's stats can be read without
+	// locking; kept first to ensure 64-bit alignment.
+	floodUntil int64
+
+	rate        int
+	perIP       int
+	windowStart time.Time
+	windowCount int
+	clients     map[string]int
+
+	// Number of leading zero bits that a proof of work must have, or
+	// zero if extended clients are not offered one, and the key that
+	// challenges are derived from.
+	workBits int
+	key      [32]byte
+}
+
+func newFloodGuard(rate, perIP, workBits int) *floodGuard {
+	f := &floodGuard{
+		rate:     rate,
+		perIP:    perIP,
+		clients:  map[string]int{},
+		workBits: workBits,
+	}
+	if _, err := rand.Read(f.key[:]); err != nil {
+		// Without a secret key, challenges could be solved in
+		// advance.
+		f.workBits = 0
+	}
+	return f
+}
+
+// flooding returns true if a flood is in progress.
+func (f *floodGuard) flooding(now time.Time) bool {
+	return now.Sub(processStart) < time.Duration(atomic.LoadInt64(&f.floodUntil))
+}
+
+// allow is called when a new client registers from the given IP address. It
+// returns false if the registration should be refused.
+func (f *floodGuard) allow(ip string, now time.Time) bool {
+	if now.Sub(f.windowStart) >= time.Second {
+		f.windowStart, f.windowCount = now, 0
+	}
+	f.windowCount++
+	if f.windowCount > f.rate {
+		if !f.flooding(now) {
+			logger.Printf("registration flood detected; limiting clients to %d per IP address", f.perIP)
+		}
+		atomic.StoreInt64(&f.floodUntil, int64(now.Add(floodHoldTime).Sub(processStart)))
+	}
+	return !f.flooding(now) || f.clients[ip] < f.perIP
+}
+
+// added and removed keep count of the clients from each IP address.
+func (f *floodGuard) added(ip string) {
+	f.clients[ip]++
+}
+
+func (f *floodGuard) removed(ip string) {
+	if f.clients[ip]--; f.clients[ip] <= 0 {
+		delete(f.clients, ip)
+	}
+}
+
+// allowDuringFlood counts a registration from a new client, and returns
+// false if it must be refused because a flood is in progress. Vanilla
+// clients are held to the per-IP limit. If proofs of work are enabled,
+// extended clients must instead solve a challenge, which they are sent if
+// they have not.
+func (s *Server) allowDuringFlood(socket *net.UDPConn, packet []byte, addr *net.UDPAddr) bool {
+	f := s.flood
+	now := time.Now()
+	allowed := f.allow(addr.IP.String(), now)
+	options, extended := extendedOptions(packet)
+	if !extended || f.workBits == 0 || !f.flooding(now) {
+		return allowed
+	}
+	if f.solved(options, addr, now) {
+		return true
+	}
+	reply, err := f.challengeReply(addr, len(packet), now)
+	if err == nil && reply != nil {
+		socket.WriteToUDP(reply, addr)
+	}
+	return false
+}
+
+// challenge returns the proof-of-work challenge for the given address in
+// the given period. Challenges are derived from the address and a secret
+// key, so that the server keeps no state for clients it has not accepted,
+// and a solution cannot be used from another address.
+func (f *floodGuard) challenge(addr *net.UDPAddr, period int64) []byte {
+	mac := hmac.New(sha256.New, f.key[:])
+	var p [8]byte
+	binary.BigEndian.PutUint64(p[:], uint64(period))
+	mac.Write(p[:])
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:8]
+}
+
+// solves returns true if the given solution solves the given challenge: the
+// SHA-256 hash of the challenge followed by the solution must start with
+// workBits zero bits.
+func solves(challenge, solution []byte, workBits int) bool {
+	sum := sha256.Sum256(append(append([]byte{}, challenge...), solution...))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros >= workBits
+}
+
+// solved returns true if the given registration options contain a solution
+// to the current or previous challenge for the given address.
+func (f *floodGuard) solved(options tlv.Options, addr *net.UDPAddr, now time.Time) bool {
+	solution, ok := options.Get(optSolution)
+	if !ok || len(solution) != 8 {
+		return false
+	}
+	period := now.Unix() / int64(challengeLifetime/time.Second)
+	return solves(f.challenge(addr, period), solution, f.workBits) ||
+		solves(f.challenge(addr, period-1), solution, f.workBits)
+}
+
+// challengeReply returns a reply to a registration packet of the given
+// length from the given address, which asks it to solve a proof of work
+// before it can register. It carries the challenge in an optChallenge
+// option, with no address assigned. Nil is returned if the registration
+// packet was too short for the challenge to fit in the reply; see
+// appendOptions.
+func (f *floodGuard) challengeReply(addr *net.UDPAddr, length int, now time.Time) ([]byte, error) {
+	period := now.Unix() / int64(challengeLifetime/time.Second)
+	value := append([]byte{byte(f.workBits)}, f.challenge(addr, period)...)
+	encoded, err := registrationReply(ipx.AddrNull).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := appendOptions(encoded, []tlv.Option{
+		{Type: optChallenge, Value: value},
+	}, length)
+	if err != nil || len(reply) == len(encoded)+len(extMagic) {
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/tlv"
+)
+
+// solve finds a solution to the given proof-of-work challenge.
+func solve(challenge []byte, workBits int) []byte {
+	solution := make([]byte, 8)
+	for i := uint64(0); ; i++ {
+		binary.BigEndian.PutUint64(solution, i)
+		if solves(challenge, solution, workBits) {
+			return solution
+		}
+	}
+}
+
+func TestSolves(t *testing.T) {
+	challenge := []byte("challen")
+	solution := solve(challenge, 12)
+	if !solves(challenge, solution, 12) {
+		t.Errorf("solution does not solve the challenge")
+	}
+	if solves([]byte("another"), solution, 12) {
+		t.Errorf("solution solves a different challenge")
+	}
+}
+
+func TestFloodProofOfWork(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.FloodRegistrationRate = 1
+		cfg.FloodClientsPerIP = 1
+		cfg.FloodWorkBits = 8
+	})
+	runServer(s, contextForTest(t))
+	newTestClient(t, s).register(nil)
+
+	// The second registration in a second starts a flood, and the
+	// vanilla client is over its IP address's limit.
+	vanilla := newTestClient(t, s)
+	vanilla.conn.Write(registrationPacket(t, nil)[:30])
+	if _, ok := vanilla.read(200 * time.Millisecond); ok {
+		t.Errorf("vanilla client registered during a flood")
+	}
+
+	// An extended client too short to carry the challenge gets no reply.
+	c := newTestClient(t, s)
+	c.conn.Write(registrationPacket(t, nil))
+	if _, ok := c.read(200 * time.Millisecond); ok {
+		t.Errorf("reply to registration too short for a challenge")
+	}
+
+	// A padded one is challenged, and registers once it solves it.
+	c.conn.Write(registrationPacket(t, padded(nil)))
+	reply, ok := c.read(2 * time.Second)
+	if !ok {
+		t.Fatalf("extended client was not challenged")
+	}
+	var hdr ipx.Header
+	hdr.UnmarshalBinary(reply)
+	options, _ := extendedOptions(reply)
+	value, ok := options.Get(optChallenge)
+	if hdr.Dest.Addr != ipx.AddrNull || !ok || len(value) != 9 {
+		t.Fatalf("challenge reply to %s with challenge %x", hdr.Dest.Addr, value)
+	}
+	if len(s.ClientStats()) != 1 {
+		t.Errorf("challenged client was given an address")
+	}
+	opts, _ := tlv.Append(nil, optSolution, solve(value[1:], int(value[0])))
+	c.register(padded(opts))
+	if c.addr == ipx.AddrNull {
+		t.Errorf("client with a solution was not given an address")
+	}
+	if n := len(s.ClientStats()); n != 2 {
+		t.Errorf("%d clients connected, want 2", n)
+	}
+}
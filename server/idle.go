@@ -0,0 +1,32 @@
+package server
+
+import (
+	"time"
+)
+
+// roomIdle returns true if no client in the given room has sent any game
+// traffic for IdleRoomTime. Replies to pings are not game traffic.
+func (s *Server) roomIdle(room string, now time.Time) bool {
+	if s.config.IdleRoomTime == 0 {
+		return false
+	}
+	last, ok := s.roomTraffic[room]
+	if !ok {
+		last = processStart
+	}
+	return now.Sub(last) >= s.config.IdleRoomTime
+}
+
+// idleKeepaliveInterval returns the keepalive interval to use for a client
+// in an idle room, given the interval that would otherwise be used. Once
+// the client's NAT timeout has been learned, it is never exceeded.
+func (s *Server) idleKeepaliveInterval(c *client, interval time.Duration) time.Duration {
+	idle := s.config.IdleKeepaliveTime
+	if c.keepalive != nil && c.keepalive.converged() && idle > interval {
+		idle = interval
+	}
+	if idle < interval {
+		return interval
+	}
+	return idle
+}
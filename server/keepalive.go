@@ -0,0 +1,138 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How long to wait for a reply to a ping before assuming that it was lost.
+const pingReplyTimeout = 3 * time.Second
+
+// Keepalive tuning stops once the largest idle gap known to be survived and
+// the smallest known not to be are this close together.
+const keepaliveResolution = time.Second
+
+// keepaliveTuner learns how long a client can be left idle before its NAT
+// forgets the mapping, so that keepalives are only sent as often as needed.
+// It does a binary search on the idle gap before each ping: if a ping sent
+// after a gap is answered, the mapping survived that long.
+type keepaliveTuner struct {
+	// Largest idle gap after which a ping was answered, and smallest
+	// gap after which one was not.
+	good, bad time.Duration
+
+	// If non-zero, a ping was sent after an idle gap of this length at
+	// the given time, and no reply has been received yet.
+	pending     time.Duration
+	pendingSent time.Time
+}
+
+// newKeepaliveTuner returns a tuner that starts from the given interval,
+// which is assumed to be safe, and never goes above the given maximum.
+func newKeepaliveTuner(min, max time.Duration) *keepaliveTuner {
+	return &keepaliveTuner{good: min, bad: max + keepaliveResolution}
+}
+
+// interval returns the time that the client should next be left idle for.
+func (k *keepaliveTuner) interval() time.Duration {
+	if k.bad-k.good <= keepaliveResolution {
+		return k.good
+	}
+	return (k.good + k.bad) / 2
+}
+
+// converged returns true if tuning has finished.
+func (k *keepaliveTuner) converged() bool {
+	return k.bad-k.good <= keepaliveResolution
+}
+
+// pingSent records that a ping was sent after the given idle gap. Only gaps
+// between those already known to be survived and not survived tell us
+// anything; longer gaps can happen while the client's room is idle.
+func (k *keepaliveTuner) pingSent(gap time.Duration, now time.Time) {
+	if k.pending == 0 && gap > k.good && gap < k.bad && !k.converged() {
+		k.pending = gap
+		k.pendingSent = now
+	}
+}
+
+// pingReply records that a ping reply was received.
+func (k *keepaliveTuner) pingReply() {
+	if k.pending != 0 {
+		k.good = k.pending
+		k.pending = 0
+	}
+}
+
+// check records a pending ping as unanswered if no reply has arrived in
+// time. If anything else was received from the client since the ping was
+// sent, the client may have refreshed the mapping itself, so the result is
+// discarded.
+func (k *keepaliveTuner) check(lastReceive, now time.Time) {
+	if k.pending == 0 || now.Sub(k.pendingSent) < pingReplyTimeout {
+		return
+	}
+	if !lastReceive.After(k.pendingSent) {
+		k.bad = k.pending
+	}
+	k.pending = 0
+}
+
+// keepaliveInterval returns how long the given client may go without being
+// sent anything before it must be sent a keepalive.
+func (s *Server) keepaliveInterval(c *client, now time.Time) time.Duration {
+	interval := s.config.KeepaliveTime
+	if c.keepalive != nil {
+		interval = c.keepalive.interval()
+	}
+	if s.roomIdle(c.room, now) {
+		interval = s.idleKeepaliveInterval(c, interval)
+	}
+	return interval
+}
+
+// lastForward returns the last time that game traffic was forwarded to the
+// given client, or the zero time if none has been.
+func lastForward(c *client) time.Time {
+	fwd := atomic.LoadInt64(&c.lastForwardTime)
+	if fwd == 0 {
+		return time.Time{}
+	}
+	return processStart.Add(time.Duration(fwd))
+}
+
+// nextKeepalive returns the time that the next keepalive should be sent to
+// the given client. Game traffic forwarded to the client keeps its NAT
+// mapping open just as well as a ping, so it counts as a keepalive, but only
+// while the client is sending too; otherwise it is pinged anyway, so that
+// its replies show that it is still there. Clients that advertise the
+// no_keepalive capability are only pinged when nothing has been received
+// from them for half of ClientTimeout.
+func (s *Server) nextKeepalive(c *client, now time.Time) time.Time {
+	if c.noKeepalive {
+		last := c.lastSendTime
+		if c.lastReceiveTime.After(last) {
+			last = c.lastReceiveTime
+		}
+		return last.Add(s.config.ClientTimeout / 2)
+	}
+	interval := s.keepaliveInterval(c, now)
+	last := c.lastSendTime
+	if fwd := lastForward(c); fwd.After(last) && now.Sub(c.lastReceiveTime) < interval {
+		last = fwd
+	}
+	return last.Add(interval)
+}
+
+// idleTime returns how long it has been since anything was sent to or
+// received from the given client.
+func idleTime(c *client, now time.Time) time.Duration {
+	last := c.lastSendTime
+	if fwd := lastForward(c); fwd.After(last) {
+		last = fwd
+	}
+	if c.lastReceiveTime.After(last) {
+		last = c.lastReceiveTime
+	}
+	return now.Sub(last)
+}
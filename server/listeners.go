@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/tlv"
+)
+
+// ListenerStats describes the load on one of the server's sockets, or on
+// one of the servers in Config.RedirectAddrs.
+type ListenerStats struct {
+	Addr string `json:"addr"`
+
+	// Room that clients registering on the socket join. Empty for
+	// other servers.
+	Room string `json:"room,omitempty"`
+
+	// Number of clients that registered on the socket, or that were
+	// redirected to the other server, and number of packets received
+	// on the socket.
+	Clients int    `json:"clients"`
+	Packets uint64 `json:"packets"`
+
+	// True if this is another server that clients are redirected to.
+	Redirect bool `json:"redirect,omitempty"`
+}
+
+// Listeners returns statistics about the load on each of the server's
+// sockets, in the order they were opened, followed by the servers that
+// clients are redirected to. When Config.Sockets is more than one, the
+// kernel chooses the socket for each client, so this shows how evenly it
+// is spreading them.
+func (s *Server) Listeners() []ListenerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clients := map[*net.UDPConn]int{}
+	for _, c := range s.clients {
+		clients[c.socket]++
+	}
+	result := []ListenerStats{}
+	for _, socket := range s.sockets {
+		result = append(result, ListenerStats{
+			Addr:    socket.LocalAddr().String(),
+			Room:    s.registrationRoom(socket, nil),
+			Clients: clients[socket],
+			Packets: s.socketPackets[socket],
+		})
+	}
+	for _, addr := range s.config.RedirectAddrs {
+		result = append(result, ListenerStats{
+			Addr:     addr,
+			Clients:  s.redirects[addr],
+			Redirect: true,
+		})
+	}
+	return result
+}
+
+// redirectTarget returns the server in Config.RedirectAddrs that the fewest
+// clients have been redirected to, or false if new clients should not be
+// redirected.
+func (s *Server) redirectTarget() (string, bool) {
+	if s.config.RedirectAbove == 0 || len(s.config.RedirectAddrs) == 0 {
+		return "", false
+	}
+	if atomic.LoadInt64(&s.numClients) < int64(s.config.RedirectAbove) {
+		return "", false
+	}
+	target := s.config.RedirectAddrs[0]
+	for _, addr := range s.config.RedirectAddrs[1:] {
+		if s.redirects[addr] < s.redirects[target] {
+			target = addr
+		}
+	}
+	return target, true
+}
+
+// redirect sends a new client to another server if this one is busy,
+// returning true if it did. Only clients using the extended protocol can be
+// redirected, and only if their registration packet is long enough to
+// carry the reply.
+func (s *Server) redirect(socket *net.UDPConn, packet []byte, addr *net.UDPAddr) bool {
+	if _, extended := extendedOptions(packet); !extended {
+		return false
+	}
+	target, ok := s.redirectTarget()
+	if !ok {
+		return false
+	}
+	encoded, err := registrationReply(ipx.AddrNull).MarshalBinary()
+	if err != nil {
+		return false
+	}
+	reply, err := appendOptions(encoded, []tlv.Option{
+		{Type: optRedirect, Value: []byte(target)},
+	}, len(packet))
+	if err != nil || len(reply) == len(encoded)+len(extMagic) {
+		return false
+	}
+	logger.Debugf("client %s: redirected to %s", addr, target)
+	s.redirects[target]++
+	socket.WriteToUDP(reply, addr)
+	return true
+}
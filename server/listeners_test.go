@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+func TestRedirect(t *testing.T) {
+	peers := []string{"192.0.2.1:10000", "192.0.2.2:10000"}
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.RedirectAddrs = peers
+		cfg.RedirectAbove = 1
+	})
+	runServer(s, contextForTest(t))
+	newTestClient(t, s).register(padded(nil))
+
+	// Once the server is busy, extended clients are spread between the
+	// other servers.
+	for i := 0; i < 4; i++ {
+		reply := newTestClient(t, s).register(padded(nil))
+		var hdr ipx.Header
+		hdr.UnmarshalBinary(reply)
+		if hdr.Dest.Addr != ipx.AddrNull {
+			t.Errorf("client %d: redirect sent to %s, want null address", i, hdr.Dest.Addr)
+		}
+		options, ok := extendedOptions(reply)
+		if !ok {
+			t.Fatalf("client %d: registered, not redirected", i)
+		}
+		if got, _ := options.Get(optRedirect); string(got) != peers[i%2] {
+			t.Errorf("client %d: redirected to %q, want %q", i, got, peers[i%2])
+		}
+	}
+
+	// Other clients cannot be redirected.
+	vanilla := newTestClient(t, s)
+	vanilla.register(nil)
+	if vanilla.addr == ipx.AddrNull {
+		t.Errorf("vanilla client was not registered")
+	}
+	if n := len(s.ClientStats()); n != 2 {
+		t.Errorf("%d clients registered, want 2", n)
+	}
+	for _, l := range s.Listeners() {
+		if l.Redirect && l.Clients != 2 {
+			t.Errorf("%d clients redirected to %s, want 2", l.Clients, l.Addr)
+		}
+	}
+}
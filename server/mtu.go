@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/tlv"
+)
+
+// Sizes of the probes sent to discover the largest packet that can be
+// delivered to a client, including the IPX header. They range from the
+// smallest datagram that every IPv4 host must accept to the largest that
+// fits in an unfragmented 1500 byte Ethernet frame.
+var mtuProbeSizes = []int{576, 1024, 1280, 1400, 1472}
+
+// Number of times that each probe is sent before the client is assumed to be
+// unable to receive packets of that size.
+const mtuProbeRounds = 2
+
+// Minimum time between rounds of probes.
+const mtuProbeInterval = 10 * time.Second
+
+// mtuProbe tracks the probing of the largest packet deliverable to a client.
+type mtuProbe struct {
+	// Number of rounds of probes sent so far, and when the last one
+	// was sent.
+	rounds int
+	sent   time.Time
+
+	// Largest probe that the client replied to, or zero if none.
+	largest int
+
+	// True once probing has finished, and extended clients have been
+	// sent the result.
+	done bool
+}
+
+// A probe is a ping padded to the size being probed. DOSBox replies to every
+// ping, whatever its size, by sending a packet to socket 2 of the ping's
+// source address, so each probe is sent from an address that encodes its
+// size: the reply's destination tells us which probe got through. These
+// addresses are reserved, so that they are never given to a node (see
+// virtual.Reserved).
+func mtuProbeAddr(size int) ipx.Addr {
+	return ipx.Addr{0x02, 0xff, 0xff, 0xfe, byte(size >> 8), byte(size)}
+}
+
+// mtuProbeSize returns the size encoded in the given probe address, or false
+// if it is not a probe address.
+func mtuProbeSize(addr ipx.Addr) (int, bool) {
+	if addr[0] != 0x02 || addr[1] != 0xff || addr[2] != 0xff || addr[3] != 0xfe {
+		return 0, false
+	}
+	return int(addr[4])<<8 | int(addr[5]), true
+}
+
+// probeMTU sends the next round of probes to the given client, if it is due.
+// Probes no larger than ones that have already been answered are not sent
+// again. Once probing has finished, extended clients are sent the result.
+func (s *Server) probeMTU(c *client, now time.Time) {
+	largestAnswered := c.mtu.largest >= mtuProbeSizes[len(mtuProbeSizes)-1]
+	switch {
+	case c.mtu.done:
+		return
+	case !largestAnswered && now.Sub(c.mtu.sent) < mtuProbeInterval:
+		return
+	case largestAnswered || c.mtu.rounds >= mtuProbeRounds:
+		c.mtu.done = true
+		s.sendMTUNotice(c, now)
+		return
+	}
+	c.mtu.rounds++
+	c.mtu.sent = now
+	for _, size := range mtuProbeSizes {
+		if size <= c.mtu.largest {
+			continue
+		}
+		header := pingHeader()
+		header.Length = uint16(size)
+		header.Src.Addr = mtuProbeAddr(size)
+		encoded, err := header.MarshalBinary()
+		if err != nil {
+			return
+		}
+		probe := make([]byte, size)
+		copy(probe, encoded)
+		s.writeToUDP(probe, c)
+	}
+	c.lastSendTime = now
+}
+
+// mtuProbeReply handles a packet received from the given client, returning
+// true if it was a reply to a probe.
+func (s *Server) mtuProbeReply(c *client, header *ipx.Header) bool {
+	if header.Dest.Socket != 2 {
+		return false
+	}
+	size, ok := mtuProbeSize(header.Dest.Addr)
+	if !ok {
+		return false
+	}
+	if size > c.mtu.largest {
+		c.mtu.largest = size
+	}
+	return true
+}
+
+// sendMTUNotice tells an extended client the largest packet that can be
+// delivered to it.
+func (s *Server) sendMTUNotice(c *client, now time.Time) {
+	if c.protocolVersion == 0 {
+		return
+	}
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(c.mtu.largest))
+	packet, err := notice(c.node.Address(), []tlv.Option{
+		{Type: optMaxPacketSize, Value: size[:]},
+	})
+	if err != nil {
+		logger.Printf("client %s (%s): failed to build MTU notice: %v", c.addr, c.node.Address(), err)
+		return
+	}
+	c.lastSendTime = now
+	s.writeToUDP(packet, c)
+}
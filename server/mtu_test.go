@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// checkNow makes the server check its clients at once, rather than waiting
+// for the next scheduled check. The given client wakes its main loop.
+func checkNow(s *Server, c *testClient) {
+	s.mu.Lock()
+	s.timeoutCheckTime = time.Now()
+	s.mu.Unlock()
+	c.send(ipx.AddrBroadcast, 0x4000, nil)
+}
+
+// TestMTUNotice checks that once probing has finished, an extended client is
+// told the largest packet that can be delivered to it.
+func TestMTUNotice(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.MTUProbe = true
+		cfg.IdleRoomTime = 0
+		cfg.KeepaliveTime = 100 * time.Millisecond
+	})
+	runServer(s, contextForTest(t))
+	c := newTestClient(t, s)
+	c.register(padded(nil))
+
+	// Probing starts at the next check.
+	checkNow(s, c)
+
+	// Answering the largest probe finishes probing straight away.
+	largest := mtuProbeSizes[len(mtuProbeSizes)-1]
+	var answered bool
+	deadline := time.Now().Add(5 * time.Second)
+	for !answered && time.Now().Before(deadline) {
+		packet, ok := c.read(time.Until(deadline))
+		if !ok {
+			break
+		}
+		var hdr ipx.Header
+		if hdr.UnmarshalBinary(packet) != nil {
+			continue
+		}
+		if size, ok := mtuProbeSize(hdr.Src.Addr); ok && size == largest {
+			answered = true
+			c.send(hdr.Src.Addr, 2, nil)
+		}
+	}
+	if !answered {
+		t.Fatalf("no %d byte MTU probe received", largest)
+	}
+
+	checkNow(s, c)
+	_, options, ok := readNotice(c, 2*time.Second)
+	if !ok {
+		t.Fatalf("no MTU notice")
+	}
+	value, ok := options.Get(optMaxPacketSize)
+	if !ok || len(value) != 2 {
+		t.Fatalf("notice has max packet size %x", value)
+	}
+	if got := int(binary.BigEndian.Uint16(value)); got != largest {
+		t.Errorf("max packet size = %d, want %d", got, largest)
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/tlv"
+)
+
+// How often MeasurePath checks whether its probes have been answered.
+const pathProbeInterval = 10 * time.Millisecond
+
+// Clients that advertise this capability answer path echo requests; see
+// optPathEcho.
+const pathEchoCapability = "path_echo"
+
+// Length of the value of the optPathEcho option: an 8 byte token, then an
+// IPX address.
+const pathEchoLen = 8 + 6
+
+// ProbeTimeoutError is returned by MeasurePath if a client does not answer
+// its probe.
+var ProbeTimeoutError = errors.New("no reply to latency probe")
+
+// PathLatency describes the latency of the path between two clients through
+// the server. Packets between clients are relayed by the server, so the
+// path is made of the two legs from each client to the server.
+type PathLatency struct {
+	A string `json:"a"`
+	B string `json:"b"`
+
+	// True if the latency is an estimate, summed from pings of each
+	// client, rather than measured by echoing a packet between them.
+	Estimate bool `json:"estimate"`
+
+	// Round trip times measured just now between the server and each
+	// client. Only set for estimates.
+	RTTAMS float64 `json:"rtt_a_ms,omitempty"`
+	RTTBMS float64 `json:"rtt_b_ms,omitempty"`
+
+	// Time for a packet to get from one client to the other, and for a
+	// reply to come back. The one way time is half of the round trip.
+	OneWayMS    float64 `json:"one_way_ms"`
+	RoundTripMS float64 `json:"round_trip_ms"`
+}
+
+// pathEcho is a path measurement that is waiting for its echo.
+type pathEcho struct {
+	a, b *client
+
+	// When the request was sent to the first client, and when the echo
+	// from the second client passed through the server.
+	sent, replied time.Time
+}
+
+// milliseconds converts a duration to a number of milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// MeasurePath measures the latency between the clients with the given IPX
+// addresses. This can help to explain lag between two particular players.
+// If both clients advertise the path_echo capability, the first is asked to
+// send a packet to the second, which echoes it back. Otherwise, as DOSBox
+// clients cannot be asked to echo a probe to each other, both are pinged and
+// the latency is estimated from the two legs via the server, which is the
+// path their packets take anyway. UnknownClientError is returned if either
+// client is not connected, and ProbeTimeoutError if either does not reply.
+func (s *Server) MeasurePath(a, b ipx.Addr) (PathLatency, error) {
+	s.mu.Lock()
+	ca, cb := s.clientByAddr(a), s.clientByAddr(b)
+	if ca == nil || cb == nil {
+		s.mu.Unlock()
+		return PathLatency{}, UnknownClientError
+	}
+	if hasCapability(ca.advertised, pathEchoCapability) && hasCapability(cb.advertised, pathEchoCapability) {
+		s.mu.Unlock()
+		return s.measureEcho(ca, cb)
+	}
+	s.sendPing(ca)
+	s.sendPing(cb)
+	sentA, sentB := ca.pingSentTime, cb.pingSentTime
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(pingReplyTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(pathProbeInterval)
+		s.mu.Lock()
+		rttA, okA := ca.probeRTT(sentA)
+		rttB, okB := cb.probeRTT(sentB)
+		s.mu.Unlock()
+		if okA && okB {
+			return PathLatency{
+				A:           a.String(),
+				B:           b.String(),
+				Estimate:    true,
+				RTTAMS:      milliseconds(rttA),
+				RTTBMS:      milliseconds(rttB),
+				OneWayMS:    milliseconds(rttA+rttB) / 2,
+				RoundTripMS: milliseconds(rttA + rttB),
+			}, nil
+		}
+	}
+	return PathLatency{}, ProbeTimeoutError
+}
+
+// measureEcho measures the path between the given clients, which both answer
+// path echo requests. The request is sent to a, which sends it on to b; the
+// time is taken when the echo from b, on its way back to a, reaches the
+// server. The packets cross the same four legs (server to a, a to server,
+// server to b and b to server) as a packet sent from a to b and back, just
+// starting from a different place in the loop.
+func (s *Server) measureEcho(a, b *client) (PathLatency, error) {
+	var token [8]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return PathLatency{}, err
+	}
+	addrA, addrB := a.node.Address(), b.node.Address()
+	packet, err := notice(addrA, []tlv.Option{
+		{Type: optPathEcho, Value: append(token[:], addrB[:]...)},
+	})
+	if err != nil {
+		return PathLatency{}, err
+	}
+	e := &pathEcho{a: a, b: b}
+	s.mu.Lock()
+	e.sent = time.Now()
+	a.lastSendTime = e.sent
+	s.pathEchoes[token] = e
+	s.writeToUDP(packet, a)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pathEchoes, token)
+		s.mu.Unlock()
+	}()
+
+	deadline := time.Now().Add(pingReplyTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(pathProbeInterval)
+		s.mu.Lock()
+		replied := e.replied
+		s.mu.Unlock()
+		if !replied.IsZero() {
+			rtt := replied.Sub(e.sent)
+			return PathLatency{
+				A:           addrA.String(),
+				B:           addrB.String(),
+				OneWayMS:    milliseconds(rtt) / 2,
+				RoundTripMS: milliseconds(rtt),
+			}, nil
+		}
+	}
+	return PathLatency{}, ProbeTimeoutError
+}
+
+// observePathEcho checks whether the given packet from the given client is
+// the echo of a path measurement, on its way back to the client that the
+// request was sent to, and if it is, records when it arrived. The packet is
+// still delivered as normal. The caller must hold the server's mutex.
+func (s *Server) observePathEcho(c *client, header *ipx.Header, packet []byte, now time.Time) {
+	if len(s.pathEchoes) == 0 || header.Dest.Socket != 2 {
+		return
+	}
+	options, ok := extendedOptions(packet)
+	if !ok {
+		return
+	}
+	value, ok := options.Get(optPathEcho)
+	if !ok || len(value) != pathEchoLen {
+		return
+	}
+	var token [8]byte
+	var addr ipx.Addr
+	copy(token[:], value)
+	copy(addr[:], value[8:])
+	e, ok := s.pathEchoes[token]
+	if !ok || c != e.b || addr != ipx.AddrNull || header.Dest.Addr != e.a.node.Address() || !e.replied.IsZero() {
+		return
+	}
+	e.replied = now
+}
+
+// clientByAddr returns the client with the given IPX address, or nil if
+// there is none. The caller must hold the server's mutex.
+func (s *Server) clientByAddr(addr ipx.Addr) *client {
+	for _, c := range s.clients {
+		if c.node.Address() == addr {
+			return c
+		}
+	}
+	return nil
+}
+
+// probeRTT returns the round trip time of the ping sent to the client at the
+// given time, if it has been answered. Another ping sent in the meantime,
+// eg. a keepalive, replaces it, and the reply is then matched to that one
+// instead; it was sent later, so it still measures the current latency.
+func (c *client) probeRTT(sent time.Time) (time.Duration, bool) {
+	if !c.pingSentTime.IsZero() || c.lastPingReply.Before(sent) {
+		return 0, false
+	}
+	return c.lastPingRTT, true
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/tlv"
+)
+
+// registerWithCapabilities registers an extended client that advertises the
+// given capabilities.
+func registerWithCapabilities(c *testClient, capabilities string) {
+	opts, err := tlv.Append(nil, optCapabilities, []byte(capabilities))
+	if err != nil {
+		c.t.Fatalf("failed to encode options: %v", err)
+	}
+	c.register(padded(opts))
+}
+
+// measurePath runs MeasurePath in the background.
+func measurePath(s *Server, a, b ipx.Addr) <-chan PathLatency {
+	result := make(chan PathLatency, 1)
+	go func() {
+		l, err := s.MeasurePath(a, b)
+		if err != nil {
+			close(result)
+			return
+		}
+		result <- l
+	}()
+	return result
+}
+
+// answerPings replies to pings sent to the client until the test ends.
+func answerPings(c *testClient) {
+	for {
+		packet, ok := c.read(5 * time.Second)
+		if !ok {
+			return
+		}
+		var hdr ipx.Header
+		if hdr.UnmarshalBinary(packet) == nil && isPingReplyAddr(ipx.HeaderAddr{Addr: hdr.Src.Addr, Socket: 2}) {
+			c.send(hdr.Src.Addr, 2, nil)
+		}
+	}
+}
+
+// TestPathEcho checks that the path between two clients that answer path
+// echo requests is measured by echoing a packet between them.
+func TestPathEcho(t *testing.T) {
+	s := newTestServer(t, nil)
+	runServer(s, contextForTest(t))
+	a, b := newTestClient(t, s), newTestClient(t, s)
+	registerWithCapabilities(a, "path_echo")
+	registerWithCapabilities(b, "nickname,path_echo")
+	result := measurePath(s, a.addr, b.addr)
+
+	// a is asked to send the token to b.
+	_, options, ok := readNotice(a, 2*time.Second)
+	if !ok {
+		t.Fatalf("no path echo request")
+	}
+	value, _ := options.Get(optPathEcho)
+	var addr ipx.Addr
+	if len(value) == pathEchoLen {
+		copy(addr[:], value[8:])
+	}
+	if addr != b.addr {
+		t.Fatalf("path echo request = %x, want token then %s", value, b.addr)
+	}
+	token := value[:8]
+	request, _ := tlv.Append(append([]byte{}, extMagic...), optPathEcho, append(append([]byte{}, token...), a.addr[:]...))
+	a.send(b.addr, 2, request)
+
+	// b echoes it back to a.
+	packet, ok := b.read(2 * time.Second)
+	if !ok {
+		t.Fatalf("path echo request not delivered to b")
+	}
+	var hdr ipx.Header
+	if err := hdr.UnmarshalBinary(packet); err != nil || hdr.Src.Addr != a.addr {
+		t.Fatalf("b received a packet from %s, want %s (%v)", hdr.Src.Addr, a.addr, err)
+	}
+	echo, _ := tlv.Append(append([]byte{}, extMagic...), optPathEcho, append(append([]byte{}, token...), ipx.AddrNull[:]...))
+	b.send(a.addr, 2, echo)
+
+	select {
+	case l, ok := <-result:
+		switch {
+		case !ok:
+			t.Fatalf("MeasurePath failed")
+		case l.Estimate:
+			t.Errorf("path latency is an estimate, want it measured by echo")
+		case l.RoundTripMS <= 0 || l.OneWayMS != l.RoundTripMS/2:
+			t.Errorf("path latency = %+v", l)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("MeasurePath did not return")
+	}
+	// The echo is still delivered to a.
+	if packet, ok := a.read(2 * time.Second); !ok || len(packet) != 30+len(echo) {
+		t.Errorf("echo not delivered to a")
+	}
+}
+
+// TestPathEstimate checks that the path latency is estimated from pings if
+// either client does not answer path echo requests.
+func TestPathEstimate(t *testing.T) {
+	s := newTestServer(t, nil)
+	runServer(s, contextForTest(t))
+	a, b := newTestClient(t, s), newTestClient(t, s)
+	registerWithCapabilities(a, "path_echo")
+	b.register(nil)
+	go answerPings(a)
+	go answerPings(b)
+
+	select {
+	case l, ok := <-measurePath(s, a.addr, b.addr):
+		switch {
+		case !ok:
+			t.Fatalf("MeasurePath failed")
+		case !l.Estimate:
+			t.Errorf("path latency is not labeled as an estimate")
+		case math.Abs(l.RoundTripMS-(l.RTTAMS+l.RTTBMS)) > 1e-6:
+			t.Errorf("path latency = %+v, want sum of the two round trips", l)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("MeasurePath did not return")
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// Older versions of ipxbox sent pings from this address instead of
+// addrPingReply. Clients reply to whatever address a ping came from, but
+// some deployments (eg. satellites or relays built against the old server)
+// still send replies to it.
+var addrLegacyPingReply = [6]byte{0xff, 0xff, 0xff, 0xff, 0x00, 0x00}
+
+// isPingReplyAddr returns true if a packet sent to the given address and
+// socket is a reply to a ping, using either the current or legacy address.
+func isPingReplyAddr(addr ipx.HeaderAddr) bool {
+	return addr.Socket == 2 && (addr.Addr == addrPingReply || addr.Addr == addrLegacyPingReply)
+}
+
+// observePingReply records which ping reply address the given client uses.
+// Once a client is seen replying to the legacy address, it is pinged from
+// that address from then on, so that its replies keep being recognized.
+func (s *Server) observePingReply(c *client, header *ipx.Header) {
+	if header.Dest.Addr == addrLegacyPingReply && !c.legacyPing {
+		c.legacyPing = true
+		logger.Printf("client %s (%s): replies to the legacy ping address; pinging it from there", c.addr, c.node.Address())
+	}
+}
+
+// pingSource returns the address that pings to the given client are sent
+// from.
+func (s *Server) pingSource(c *client) ipx.Addr {
+	if s.config.LegacyPingReply || c.legacyPing {
+		return addrLegacyPingReply
+	}
+	return addrPingReply
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// enablePktinfo sets the IP_PKTINFO option on the given socket, so that the
+// local address that each packet was received on is reported.
+func enablePktinfo(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// parsePktinfo returns the local address from the IP_PKTINFO control message
+// in the given out-of-band data, or nil if there is none.
+func parsePktinfo(oob []byte) net.IP {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.IPPROTO_IP || m.Header.Type != syscall.IP_PKTINFO || len(m.Data) < syscall.SizeofInet4Pktinfo {
+			continue
+		}
+		info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0]))
+		return net.IPv4(info.Addr[0], info.Addr[1], info.Addr[2], info.Addr[3])
+	}
+	return nil
+}
+
+// pktinfoControl returns out-of-band data for sending a packet from the given
+// local address.
+func pktinfoControl(ip net.IP) []byte {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil
+	}
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet4Pktinfo))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_IP
+	h.Type = syscall.IP_PKTINFO
+	h.SetLen(syscall.CmsgLen(syscall.SizeofInet4Pktinfo))
+	info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)]))
+	copy(info.Spec_dst[:], ip4)
+	return oob
+}
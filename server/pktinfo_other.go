@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// enablePktinfo sets the IP_PKTINFO option on the given socket. This is only
+// supported on Linux.
+func enablePktinfo(conn *net.UDPConn) error {
+	return errors.New("preserving the local address not supported on this OS")
+}
+
+func parsePktinfo(oob []byte) net.IP {
+	return nil
+}
+
+func pktinfoControl(ip net.IP) []byte {
+	return nil
+}
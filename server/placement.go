@@ -0,0 +1,138 @@
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+// Weight given to each new measurement when updating a client's smoothed
+// round trip time.
+const rttSmoothing = 0.25
+
+// PlacementMain is the home server given in a Placement when a room's games
+// are best hosted on this server rather than on one of its satellites.
+const PlacementMain = "main"
+
+// Placement describes where the games in a room would best be hosted, given
+// the round trip times measured to the players in it. Players behind a
+// satellite are assumed to be close to it, so games between them are best
+// hosted on the satellite if they are the majority.
+type Placement struct {
+	Room string `json:"room"`
+
+	// The server where the room's games would best be hosted: either
+	// PlacementMain or the UDP address of a satellite.
+	Home string `json:"home"`
+
+	// Number of players in the room whose round trip time is known,
+	// by the server that they are connected to.
+	Players map[string]int `json:"players"`
+
+	// Average round trip time in milliseconds from the players to the
+	// home server, and to this server.
+	HomeRTTMS float64 `json:"home_rtt_ms"`
+	MainRTTMS float64 `json:"main_rtt_ms"`
+}
+
+// pingReplied updates the client's round trip time when a reply to a ping
+// is received. Replies that arrive too late to be matched with the last
+// ping are ignored.
+func (c *client) pingReplied(now time.Time) {
+	if c.pingSentTime.IsZero() {
+		return
+	}
+	rtt := now.Sub(c.pingSentTime)
+	c.pingSentTime = time.Time{}
+	if rtt > pingReplyTimeout {
+		return
+	}
+	c.lastPingReply, c.lastPingRTT = now, rtt
+	if c.rtt == 0 {
+		c.rtt = rtt
+	} else {
+		c.rtt += time.Duration(rttSmoothing * float64(rtt-c.rtt))
+	}
+}
+
+// Placements returns the best placement of the games in each room that has
+// players whose round trip time is known.
+func (s *Server) Placements() []Placement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	type site struct {
+		rtt     time.Duration
+		players int
+	}
+	rooms := map[string]map[string]*site{}
+	for _, c := range s.clients {
+		if c.rtt == 0 {
+			continue
+		}
+		sites, ok := rooms[c.room]
+		if !ok {
+			sites = map[string]*site{PlacementMain: {}}
+			rooms[c.room] = sites
+		}
+		switch {
+		case c.satellite && len(c.members) > 0:
+			sites[c.addr.String()] = &site{rtt: c.rtt, players: len(c.members)}
+		case !c.satellite:
+			// Clients connected directly are treated as
+			// satellites with one player each, except that
+			// they cannot host games.
+			sites[PlacementMain].rtt += c.rtt
+			sites[PlacementMain].players++
+		}
+	}
+	result := []Placement{}
+	for room, sites := range rooms {
+		p := Placement{Room: room, Players: map[string]int{}}
+		// Total round trip time from every player to the given
+		// home server.
+		cost := func(home string) time.Duration {
+			var total time.Duration
+			for name, st := range sites {
+				switch {
+				case name == PlacementMain:
+					// Players connected directly have
+					// their own round trip times to
+					// this server; st.rtt is their sum.
+					total += st.rtt
+					if home != PlacementMain {
+						total += time.Duration(st.players) * sites[home].rtt
+					}
+				case name == home:
+				case home == PlacementMain:
+					total += time.Duration(st.players) * st.rtt
+				default:
+					total += time.Duration(st.players) * (st.rtt + sites[home].rtt)
+				}
+			}
+			return total
+		}
+		total := 0
+		for name, st := range sites {
+			if st.players > 0 {
+				p.Players[name] = st.players
+				total += st.players
+			}
+		}
+		if total == 0 {
+			continue
+		}
+		p.Home = PlacementMain
+		best := cost(PlacementMain)
+		p.MainRTTMS = float64(best) / float64(total) / float64(time.Millisecond)
+		for name := range sites {
+			if c := cost(name); c < best {
+				p.Home, best = name, c
+			}
+		}
+		p.HomeRTTMS = float64(best) / float64(total) / float64(time.Millisecond)
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Room < result[j].Room
+	})
+	return result
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// addPlacementClient adds a client with the given round trip time to the
+// server's client table. If members is non-zero, the client is a satellite
+// with that many members.
+func addPlacementClient(s *Server, n int, rtt time.Duration, members int) string {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(n)), Port: 10000}
+	c := &client{
+		addr:      addr,
+		node:      s.net.NewNode(),
+		room:      DefaultRoom,
+		rtt:       rtt,
+		satellite: members > 0,
+		members:   map[ipx.Addr]*satelliteMember{},
+	}
+	for i := 0; i < members; i++ {
+		c.members[ipx.Addr{0x02, byte(n), 0, 0, 0, byte(i)}] = &satelliteMember{}
+	}
+	s.clients[addr.String()] = c
+	return addr.String()
+}
+
+func TestPlacements(t *testing.T) {
+	tests := []struct {
+		name      string
+		direct    []time.Duration
+		satRTT    time.Duration
+		satPlayer int
+		wantSat   bool
+		wantMain  time.Duration
+	}{
+		{
+			// With only direct players, the average RTT to the
+			// main server is the players' own average.
+			name:     "direct only",
+			direct:   []time.Duration{10 * time.Millisecond, 30 * time.Millisecond},
+			wantMain: 20 * time.Millisecond,
+		},
+		{
+			// Two direct players far away should not outweigh
+			// three players close together behind a satellite.
+			name:      "satellite majority",
+			direct:    []time.Duration{100 * time.Millisecond, 100 * time.Millisecond},
+			satRTT:    200 * time.Millisecond,
+			satPlayer: 3,
+			wantSat:   true,
+			wantMain:  160 * time.Millisecond,
+		},
+		{
+			// Here the direct players are close to the main
+			// server, so it must win even though the satellite
+			// would be the home if their RTT was ignored.
+			name:      "main majority",
+			direct:    []time.Duration{5 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond},
+			satRTT:    200 * time.Millisecond,
+			satPlayer: 1,
+			wantSat:   false,
+			wantMain:  (15*time.Millisecond + 200*time.Millisecond) / 4,
+		},
+	}
+	for _, test := range tests {
+		s := newTestServer(t, nil)
+		for i, rtt := range test.direct {
+			addPlacementClient(s, i+1, rtt, 0)
+		}
+		var sat string
+		if test.satPlayer > 0 {
+			sat = addPlacementClient(s, 100, test.satRTT, test.satPlayer)
+		}
+		placements := s.Placements()
+		if len(placements) != 1 {
+			t.Errorf("%s: got %d placements, want 1", test.name, len(placements))
+			continue
+		}
+		p := placements[0]
+		want := PlacementMain
+		if test.wantSat {
+			want = sat
+		}
+		if p.Home != want {
+			t.Errorf("%s: home = %q, want %q", test.name, p.Home, want)
+		}
+		wantMS := float64(test.wantMain) / float64(time.Millisecond)
+		if diff := p.MainRTTMS - wantMS; diff > 0.01 || diff < -0.01 {
+			t.Errorf("%s: main RTT = %vms, want %vms", test.name, p.MainRTTMS, wantMS)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"net"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/protodoc"
+	"github.com/fragglet/ipxbox/tlv"
+)
+
+// Addresses used in example messages.
+var (
+	exampleAddr    = ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	exampleUDPAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+)
+
+// Protocol returns a description of the DOSBox IPX protocol as implemented by
+// the server. The example messages are built by the same code that the server
+// uses, so they can be used as test vectors by other implementations.
+func Protocol() (*protodoc.Document, error) {
+	header, err := protodoc.Describe("ipx_header", "IPX header. Every UDP datagram contains exactly one IPX packet: this header, followed by the packet's payload.", &ipx.Header{})
+	if err != nil {
+		return nil, err
+	}
+	doc := &protodoc.Document{
+		Protocol:    "dosbox-ipx",
+		Description: "IPX packets tunneled over UDP, as used by DOSBox. Clients register with the server, which assigns each one an address and forwards packets between them.",
+		Formats:     []protodoc.Format{header},
+	}
+	examples := []struct {
+		name, description string
+		header            *ipx.Header
+	}{
+		{
+			"registration",
+			"Sent by a client to register. The destination is the null address on socket 2; the server ignores the rest of the packet.",
+			&ipx.Header{
+				Checksum: 0xffff,
+				Length:   30,
+				Dest:     ipx.HeaderAddr{Socket: 2},
+				Src:      ipx.HeaderAddr{Socket: 2},
+			},
+		},
+		{
+			"registration_reply",
+			"Sent by the server in reply to every registration packet. The destination is the address assigned to the client.",
+			registrationReply(exampleAddr),
+		},
+		{
+			"ping",
+			"Sent by the server as a keepalive when nothing else has been sent to a client recently. It is a broadcast to socket 2, from the ping reply address.",
+			pingHeader(),
+		},
+		{
+			"ping_reply",
+			"Sent by a client in reply to a ping, to socket 2 of the ping's source address.",
+			&ipx.Header{
+				Checksum: 0xffff,
+				Length:   30,
+				Dest:     ipx.HeaderAddr{Addr: addrPingReply, Socket: 2},
+				Src:      ipx.HeaderAddr{Addr: exampleAddr, Socket: 2},
+			},
+		},
+	}
+	for _, e := range examples {
+		msg, err := protodoc.Example(e.name, e.description, header, e.header)
+		if err != nil {
+			return nil, err
+		}
+		doc.Messages = append(doc.Messages, msg)
+	}
+	ext, err := extendedRegistration(header)
+	if err != nil {
+		return nil, err
+	}
+	doc.Extensions = append(doc.Extensions, ext)
+	return doc, nil
+}
+
+// extOptionDocs describes the options of the extended registration.
+var extOptionDocs = []protodoc.Option{
+	{Type: optVersion, Name: "version", Description: "Version of the server software, as a string. Only sent by the server."},
+	{Type: optMOTD, Name: "motd", Description: "URL of the server's message of the day, as a string. Only sent by the server."},
+	{Type: optRoom, Name: "room", Description: "Name of a room, as a string. Sent by a client to ask to join the room, with the room_password option; the server names the room that the client joined, which is the room it would otherwise have joined if the one asked for cannot be joined."},
+	{Type: optFeatures, Name: "features", Description: "Features that the server has enabled, as a 32-bit big-endian bitmap: 1 is MTU probing, 2 is game session locking, 4 is satellite servers and 8 is replies to legacy pings. Only sent by the server."},
+	{Type: optProtocolVersion, Name: "protocol_version", Description: "Version of the extension that the server chose, as one byte: the highest version offered by the client that the server supports. Only sent by the server."},
+	{Type: optOfferedVersions, Name: "offered_versions", Description: "Lowest and highest versions of the extension that the client supports, as one byte each. Clients that do not send this speak version 1. The server echoes the offer it received, so that a client can check that it arrived intact; the echo is not authenticated, so it cannot detect an offer changed on purpose."},
+	{Type: optCapabilities, Name: "capabilities", Description: "Comma-separated list of capabilities that the client has; \"no_keepalive\" means that the client sends its own keepalives, so the server need not, and \"path_echo\" that it answers the path_echo option. Unknown capabilities are ignored. Only sent by clients."},
+	{Type: optRoomPassword, Name: "room_password", Description: "Password of the room named by the room option, as a string. Only sent by clients."},
+	{Type: optError, Name: "error", Description: "Why the client cannot have the extended reply, as a string. A reply with this option only carries the supported_versions option as well; the client is still registered, as a vanilla client. Only sent by the server."},
+	{Type: optSupportedVersions, Name: "supported_versions", Description: "Lowest and highest versions of the extension that the server supports, as one byte each. Sent with the error option when the client offered no version that the server supports."},
+	{Type: optPadding, Name: "padding", Description: "Ignored. Since the reply is never longer than the registration packet, clients send this to make room for every option of the reply."},
+	{Type: optNewAddress, Name: "new_address", Description: "New IPX address of the client, as 6 bytes, sent in a notice to the client's old address. The client must send from the new address from then on; until it does, the server drops packets from the old address and repeats the notice."},
+	{Type: optChallenge, Name: "challenge", Description: "Proof of work that the client must do before it can register during a registration flood: the number of leading zero bits required, as one byte, then an 8 byte challenge. Sent instead of the registration reply, with a null destination address, if the registration packet is long enough to carry it. The challenge changes every 30 seconds."},
+	{Type: optSolution, Name: "solution", Description: "Solution to a challenge, as 8 bytes, sent in a repeated registration packet: the SHA-256 hash of the challenge followed by the solution must start with the required number of zero bits. Only sent by clients."},
+	{Type: optObservedAddress, Name: "observed_address", Description: "Address and port that the client's registration came from, as seen by the server: a 4 byte IPv4 or 16 byte IPv6 address, then a 16-bit big-endian port. A client whose own address or port differs is behind NAT. Only sent by the server."},
+	{Type: optMaxPacketSize, Name: "max_packet_size", Description: "Size in bytes of the largest packet, including the IPX header, that the server found it could deliver to the client, as a 16-bit big-endian integer, or zero if none of its probes got through. Sent in a notice once probing has finished, if the server has MTU probing enabled. Probes are pings padded to sizes between 576 and 1472 bytes, sent from addresses beginning 02:ff:ff:fe."},
+	{Type: optRedirect, Name: "redirect", Description: "Address of another server on the same network, as a \"host:port\" string, that the client should register with instead. Sent instead of the registration reply, with a null destination address, when the server is busy. Only sent by the server."},
+	{Type: optPathEcho, Name: "path_echo", Description: "Request to measure the path between two clients that both advertise the \"path_echo\" capability: an 8 byte token, then a 6 byte IPX address. Sent in a notice to the first client, which sends the option on, with its own address in place of the one it was sent, in a packet after the magic from its socket 2 to socket 2 of the given address. The second client echoes the option back the same way, with a null address, and the server times the echo as it passes through. A client that receives the option with a null address ignores it."},
+}
+
+// extendedRegistration describes the extended registration, with example
+// messages built by the same code as the server uses.
+func extendedRegistration(header protodoc.Format) (protodoc.Extension, error) {
+	ext := protodoc.Extension{
+		Name:        "extended_registration",
+		Description: "Clients that understand it add the magic bytes \"IPXB\" and a list of options after the 30 byte header of their registration packet. The server replies with the normal registration reply, with the same magic and its own options after the header; the length field of the header still says 30, so clients that ignore the trailer see a normal reply. Each option is a type byte, a 16-bit big-endian length, and that many bytes of value. Options of unknown types are skipped. The reply is never longer than the registration packet, so options that do not fit are left out, least important first. Clients that were given a protocol version may later be sent notices: packets with the header of a registration reply and the same trailer, that the server sends of its own accord.",
+		Options:     extOptionDocs,
+	}
+	options := []struct {
+		t     byte
+		value []byte
+	}{
+		{optOfferedVersions, []byte{minProtocolVersion, maxProtocolVersion}},
+		{optCapabilities, []byte("no_keepalive")},
+		{optPadding, make([]byte, 32)},
+	}
+	trailer := append([]byte{}, extMagic...)
+	for _, opt := range options {
+		var err error
+		if trailer, err = tlv.Append(trailer, opt.t, opt.value); err != nil {
+			return ext, err
+		}
+	}
+	reg := &ipx.Header{
+		Checksum: 0xffff,
+		Length:   30,
+		Dest:     ipx.HeaderAddr{Socket: 2},
+		Src:      ipx.HeaderAddr{Socket: 2},
+	}
+	msg, err := protodoc.ExampleWithTrailer("extended_registration", "Registration packet from a client that offers every version of the extension that the server supports, does not need keepalives, and pads the packet so that the reply has room for every option.", header, reg, trailer)
+	if err != nil {
+		return ext, err
+	}
+	ext.Messages = append(ext.Messages, msg)
+
+	replyHeader := registrationReply(exampleAddr)
+	encoded, err := replyHeader.MarshalBinary()
+	if err != nil {
+		return ext, err
+	}
+	var features [4]byte
+	features[3] = featureMTUProbe
+	reply, err := appendOptions(encoded, []tlv.Option{
+		{Type: optProtocolVersion, Value: []byte{maxProtocolVersion}},
+		{Type: optOfferedVersions, Value: []byte{minProtocolVersion, maxProtocolVersion}},
+		{Type: optRoom, Value: []byte(DefaultRoom)},
+		{Type: optFeatures, Value: features[:]},
+		{Type: optObservedAddress, Value: observedAddress(exampleUDPAddr)},
+		{Type: optVersion, Value: []byte("v1")},
+	}, 30+len(trailer))
+	if err != nil {
+		return ext, err
+	}
+	msg, err = protodoc.ExampleWithTrailer("extended_registration_reply", "Reply to the extended registration packet above, from a server with MTU probing enabled, to a client at 192.0.2.1:40000.", header, replyHeader, reply[30:])
+	if err != nil {
+		return ext, err
+	}
+	ext.Messages = append(ext.Messages, msg)
+	return ext, nil
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// TestProtocolExtendedRegistration checks that the documented extended
+// registration reply answers the documented registration packet as the
+// server would, with every option it was given.
+func TestProtocolExtendedRegistration(t *testing.T) {
+	doc, err := Protocol()
+	if err != nil {
+		t.Fatalf("Protocol failed: %v", err)
+	}
+	if len(doc.Extensions) != 1 || len(doc.Extensions[0].Messages) != 2 {
+		t.Fatalf("extended registration not documented: %+v", doc.Extensions)
+	}
+	var packets [][]byte
+	for _, msg := range doc.Extensions[0].Messages {
+		packet, err := hex.DecodeString(msg.Encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", msg.Name, err)
+		}
+		if _, ok := extendedOptions(packet); !ok {
+			t.Errorf("%s: example has no valid extended trailer", msg.Name)
+		}
+		packets = append(packets, packet)
+	}
+	request, reply := packets[0], packets[1]
+	if len(reply) > len(request) {
+		t.Errorf("example reply is %d bytes, longer than the %d byte registration", len(reply), len(request))
+	}
+	options, _ := extendedOptions(reply)
+	if len(options) != 6 {
+		t.Errorf("example reply has %d options, want 6", len(options))
+	}
+	documented := map[byte]bool{}
+	for _, opt := range doc.Extensions[0].Options {
+		documented[byte(opt.Type)] = true
+	}
+	for _, opt := range options {
+		if !documented[opt.Type] {
+			t.Errorf("example reply has undocumented option %d", opt.Type)
+		}
+	}
+}
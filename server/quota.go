@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// Clients are warned when they have this much connected time left for the
+// day.
+var quotaWarningTimes = []time.Duration{
+	time.Minute,
+	10 * time.Minute,
+}
+
+// quota tracks how long clients from each IP address have been connected
+// today. It is only accessed while holding the server's mutex.
+type quota struct {
+	limit time.Duration
+	day   string
+	used  map[string]time.Duration
+}
+
+func newQuota(limit time.Duration) *quota {
+	return &quota{
+		limit: limit,
+		used:  map[string]time.Duration{},
+	}
+}
+
+// rollover resets all usage when a new day starts.
+func (q *quota) rollover(now time.Time) {
+	if day := now.Format("2006-01-02"); day != q.day {
+		q.day = day
+		q.used = map[string]time.Duration{}
+	}
+}
+
+// remaining returns how much connected time the given IP address has left
+// today.
+func (q *quota) remaining(ip string, now time.Time) time.Duration {
+	q.rollover(now)
+	return q.limit - q.used[ip]
+}
+
+// charge adds to the time used today by the given IP address.
+func (q *quota) charge(ip string, d time.Duration, now time.Time) {
+	q.rollover(now)
+	q.used[ip] += d
+}
+
+// sendQuotaWarning sends a text message to the client telling it how long it
+// has left before it is disconnected.
+func (s *Server) sendQuotaWarning(c *client, left time.Duration) {
+	minutes := (left + time.Minute - 1) / time.Minute
+	text := fmt.Sprintf("Guest time limit: %d min left today", minutes)
+	header := &ipx.Header{
+		Length: uint16(30 + len(text)),
+		Dest: ipx.HeaderAddr{
+			Addr:   c.node.Address(),
+			Socket: s.config.QuotaWarningSocket,
+		},
+		Src: ipx.HeaderAddr{
+			Addr:   addrPingReply,
+			Socket: s.config.QuotaWarningSocket,
+		},
+	}
+	encodedHeader, err := header.MarshalBinary()
+	if err == nil {
+		s.writeToUDP(append(encodedHeader, text...), c)
+	}
+}
+
+// chargeQuota charges the client's IP address for the time since it was last
+// charged, and warns the client if it is close to its limit. It returns true
+// if the client has used up its time and should be disconnected.
+func (s *Server) chargeQuota(c *client, now time.Time) bool {
+	ip := c.addr.IP.String()
+	s.quota.charge(ip, now.Sub(c.lastChargeTime), now)
+	c.lastChargeTime = now
+	left := s.quota.remaining(ip, now)
+	if left <= 0 {
+		logger.Printf("client %s (%s): daily time limit reached", c.addr, c.node.Address())
+		return true
+	}
+	for _, w := range quotaWarningTimes {
+		if left > w {
+			continue
+		}
+		if c.quotaWarning == 0 || w < c.quotaWarning {
+			s.sendQuotaWarning(c, left)
+			c.quotaWarning = w
+		}
+		break
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+// Maximum number of timed out clients remembered for Config.RejoinWindow.
+// When there are more, the ones that timed out longest ago are forgotten.
+const maxRejoinRecords = 256
+
+// rejoinRecord remembers a client that timed out, so that it gets its old
+// identity back if it registers again soon.
+type rejoinRecord struct {
+	addr     string
+	ip       net.IP
+	ipxAddr  ipx.Addr
+	room     string
+	departed time.Time
+}
+
+// rememberTimedOut records a client that is being removed because it timed
+// out.
+func (s *Server) rememberTimedOut(c *client, now time.Time) {
+	if s.config.RejoinWindow == 0 {
+		return
+	}
+	s.rejoins = append(s.rejoins, rejoinRecord{
+		addr:     c.addr.String(),
+		ip:       c.addr.IP,
+		ipxAddr:  c.node.Address(),
+		room:     c.room,
+		departed: now,
+	})
+	if len(s.rejoins) > maxRejoinRecords {
+		s.rejoins = s.rejoins[len(s.rejoins)-maxRejoinRecords:]
+	}
+}
+
+// takeRejoin returns, and forgets, the record of a client that timed out
+// within RejoinWindow and that the client registering from the given address
+// is likely to be. A client reconnecting from the same IP address and port
+// is always matched. A brief disconnect often changes the port too, so
+// otherwise a record from the same IP address is matched, but only if
+// there is exactly one, so that players behind the same NAT gateway are
+// not given each other's identities.
+func (s *Server) takeRejoin(addr *net.UDPAddr, now time.Time) (rejoinRecord, bool) {
+	s.expireRejoins(now)
+	match, sameIP := -1, 0
+	for i, r := range s.rejoins {
+		if r.addr == addr.String() {
+			match, sameIP = i, 1
+			break
+		}
+		if r.ip.Equal(addr.IP) {
+			match = i
+			sameIP++
+		}
+	}
+	if sameIP != 1 {
+		return rejoinRecord{}, false
+	}
+	r := s.rejoins[match]
+	s.rejoins = append(s.rejoins[:match], s.rejoins[match+1:]...)
+	return r, true
+}
+
+// expireRejoins forgets clients that timed out more than RejoinWindow ago.
+func (s *Server) expireRejoins(now time.Time) {
+	i := 0
+	for i < len(s.rejoins) && now.Sub(s.rejoins[i].departed) >= s.config.RejoinWindow {
+		i++
+	}
+	s.rejoins = s.rejoins[i:]
+}
+
+// rejoinNode creates the node for a client that is rejoining the given room,
+// giving it its old address if that is still free. If it is not, or the
+// room's network cannot create nodes with a particular address, the client
+// gets a new one.
+func rejoinNode(n network.Network, r rejoinRecord) network.Node {
+	if an, ok := n.(network.AddrNetwork); ok {
+		if node, err := an.NewNodeWithAddr(r.ipxAddr); err == nil {
+			return node
+		}
+	}
+	return n.NewNode()
+}
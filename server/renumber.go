@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/tlv"
+)
+
+// NotExtendedError is returned by Renumber if the client did not negotiate
+// a version of the extended protocol, and so cannot be told of a new
+// address.
+var NotExtendedError = errors.New("client does not use the extended protocol")
+
+// Minimum interval between repeated renumber notices to a client that is
+// still sending from its old address.
+const renumberNoticeInterval = time.Second
+
+// renumbering tracks a client that has been given a new address but has not
+// yet sent anything from it. It is only accessed while holding the server's
+// mutex.
+type renumbering struct {
+	oldAddr    ipx.Addr
+	lastNotice time.Time
+}
+
+// Renumber gives the client with the given IPX address a new address in the
+// same room, without disconnecting it, and tells it of the new address with
+// a notice. This resolves address conflicts without the game having to be
+// restarted. Only clients that negotiated a version of the extended
+// protocol can be renumbered; for others, NotExtendedError is returned.
+func (s *Server) Renumber(addr ipx.Addr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.clientByAddr(addr)
+	if c == nil {
+		return UnknownClientError
+	}
+	if c.protocolVersion == 0 {
+		return NotExtendedError
+	}
+	n, ok := s.rooms[c.room]
+	if !ok {
+		return UnknownRoomError
+	}
+	s.renumber(c, n.NewNode())
+	return nil
+}
+
+// renumber replaces the given client's node with the given one, which has a
+// new address, and sends the client a notice of its new address. Until the
+// client sends a packet from the new address, packets from its old address
+// are dropped, and answered with another notice. The caller must hold the
+// server's mutex.
+func (s *Server) renumber(c *client, node network.Node) {
+	old := c.node.Address()
+	logger.Printf("client %s (%s): renumbered to %s", c.addr, old, node.Address())
+	c.node.Close()
+	s.renameCapture(old, node.Address())
+	c.node = node
+	c.renumbering = &renumbering{oldAddr: old}
+	go s.runClient(c, node)
+	s.sendRenumberNotice(c, time.Now())
+}
+
+// sendRenumberNotice tells a client that is being renumbered its new
+// address, unless it was told too recently. The caller must hold the
+// server's mutex.
+func (s *Server) sendRenumberNotice(c *client, now time.Time) {
+	r := c.renumbering
+	if now.Sub(r.lastNotice) < renumberNoticeInterval {
+		return
+	}
+	r.lastNotice = now
+	addr := c.node.Address()
+	packet, err := notice(r.oldAddr, []tlv.Option{
+		{Type: optNewAddress, Value: addr[:]},
+	})
+	if err != nil {
+		logger.Printf("client %s (%s): failed to build renumber notice: %v", c.addr, addr, err)
+		return
+	}
+	c.lastSendTime = now
+	s.writeToUDP(packet, c)
+}
+
+// renumberedSource checks the source address of a packet from a client that
+// may be being renumbered. It returns true if the packet came from the
+// client's old address and must be dropped. A packet from the new address
+// completes the renumbering.
+func (s *Server) renumberedSource(c *client, src ipx.Addr, now time.Time) bool {
+	r := c.renumbering
+	switch {
+	case r == nil:
+		return false
+	case src == r.oldAddr:
+		s.sendRenumberNotice(c, now)
+		return true
+	case src == c.node.Address():
+		logger.Debugf("client %s (%s): now using its new address", c.addr, src)
+		c.renumbering = nil
+	}
+	return false
+}
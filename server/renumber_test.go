@@ -0,0 +1,108 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/tlv"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+// readNotice waits for a notice from the server, returning its destination
+// and options.
+func readNotice(c *testClient, timeout time.Duration) (ipx.Addr, tlv.Options, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		packet, ok := c.read(time.Until(deadline))
+		if !ok {
+			return ipx.Addr{}, nil, false
+		}
+		var hdr ipx.Header
+		if hdr.UnmarshalBinary(packet) != nil || hdr.Src.Addr != ipx.AddrBroadcast {
+			continue
+		}
+		if options, ok := extendedOptions(packet); ok {
+			return hdr.Dest.Addr, options, true
+		}
+	}
+}
+
+// newAddress returns the address in a renumber notice.
+func newAddress(t *testing.T, options tlv.Options) ipx.Addr {
+	var addr ipx.Addr
+	value, _ := options.Get(optNewAddress)
+	if len(value) != len(addr) {
+		t.Fatalf("notice has new address %x", value)
+	}
+	copy(addr[:], value)
+	return addr
+}
+
+func TestRenumber(t *testing.T) {
+	s := newTestServer(t, nil)
+	runServer(s, contextForTest(t))
+	vanilla := newTestClient(t, s)
+	vanilla.register(nil)
+	if err := s.Renumber(vanilla.addr); err != NotExtendedError {
+		t.Errorf("Renumber of a vanilla client = %v, want NotExtendedError", err)
+	}
+
+	c := newTestClient(t, s)
+	c.register(padded(nil))
+	old := c.addr
+	if err := s.Renumber(old); err != nil {
+		t.Fatalf("Renumber failed: %v", err)
+	}
+	dest, options, ok := readNotice(c, 2*time.Second)
+	if !ok {
+		t.Fatalf("no renumber notice")
+	}
+	if dest != old {
+		t.Errorf("notice sent to %s, want the old address %s", dest, old)
+	}
+	addr := newAddress(t, options)
+	if addr == old {
+		t.Fatalf("client was not given a new address")
+	}
+
+	// Packets from the old address are dropped, and the notice is
+	// repeated.
+	time.Sleep(renumberNoticeInterval)
+	c.send(ipx.AddrBroadcast, 0x869c, []byte("old"))
+	if _, options, ok := readNotice(c, 2*time.Second); !ok || newAddress(t, options) != addr {
+		t.Errorf("notice not repeated for packet from the old address")
+	}
+	if receivedFrom(vanilla, old, 200*time.Millisecond) {
+		t.Errorf("packet from the old address delivered")
+	}
+	c.addr = addr
+	c.send(ipx.AddrBroadcast, 0x869c, []byte("new"))
+	if !receivedFrom(vanilla, addr, 2*time.Second) {
+		t.Errorf("packet from the new address not delivered")
+	}
+}
+
+// TestMoveRenumbersOnConflict checks that an extended client moving into a
+// room where its address is in use is given a new one.
+func TestMoveRenumbersOnConflict(t *testing.T) {
+	s := newTestServer(t, nil)
+	other := virtual.New()
+	s.AddRoom("other", other)
+	runServer(s, contextForTest(t))
+	c := newTestClient(t, s)
+	c.register(padded(nil))
+	if _, err := other.NewNodeWithAddr(c.addr); err != nil {
+		t.Fatalf("failed to take the client's address: %v", err)
+	}
+	if err := s.MoveClient(c.addr, "other"); err != nil {
+		t.Fatalf("MoveClient failed: %v", err)
+	}
+	dest, options, ok := readNotice(c, 2*time.Second)
+	if !ok {
+		t.Fatalf("no renumber notice")
+	}
+	if dest != c.addr || newAddress(t, options) == c.addr {
+		t.Errorf("notice to %s gives new address %s", dest, newAddress(t, options))
+	}
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	"syscall"
+)
+
+// setReusePort is a net.ListenConfig control function that sets the
+// SO_REUSEPORT option on a socket.
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
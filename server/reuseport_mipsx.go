@@ -0,0 +1,8 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+// +build linux
+// +build mips mipsle mips64 mips64le
+
+package server
+
+// The syscall package does not define SO_REUSEPORT on all architectures.
+const soReusePort = 0x200
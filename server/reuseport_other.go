@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setReusePort is a net.ListenConfig control function that sets the
+// SO_REUSEPORT option on a socket. This is only supported on Linux.
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("multiple sockets not supported on this OS")
+}
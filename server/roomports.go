@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net"
+	"sort"
+)
+
+// openRoomSockets opens a socket for each port in Config.RoomPorts, on the
+// same address as the server's main socket.
+func (s *Server) openRoomSockets(addr *net.UDPAddr) error {
+	ports := []int{}
+	for port := range s.config.RoomPorts {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		socket, err := openSocket(&net.UDPAddr{IP: addr.IP, Port: port}, s.config)
+		if err != nil {
+			return err
+		}
+		s.sockets = append(s.sockets, socket)
+		s.socketRooms[socket] = s.config.RoomPorts[port]
+	}
+	return nil
+}
+
+// registrationRoom returns the room that clients join when they register on
+// the given socket and local address.
+func (s *Server) registrationRoom(socket *net.UDPConn, local net.IP) string {
+	if room, ok := s.socketRooms[socket]; ok {
+		return room
+	}
+	if local != nil {
+		if room, ok := s.config.RoomAddrs[local.String()]; ok {
+			return room
+		}
+	}
+	return DefaultRoom
+}
+
+// RoomPort returns the UDP port that clients connect to in order to join the
+// given room directly, if it has one.
+func (s *Server) RoomPort(room string) (int, bool) {
+	for port, name := range s.config.RoomPorts {
+		if name == room {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// RoomAddr returns the local IP address that clients connect to in order to
+// join the given room directly, if it has one.
+func (s *Server) RoomAddr(room string) (net.IP, bool) {
+	for addr, name := range s.config.RoomAddrs {
+		if name == room {
+			return net.ParseIP(addr), true
+		}
+	}
+	return nil, false
+}
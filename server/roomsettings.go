@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"sort"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+var (
+	// RoomFullError is returned by MoveClient and JoinRoom if the room
+	// already has as many clients as it allows.
+	RoomFullError = errors.New("room is full")
+
+	// WrongPasswordError is returned by JoinRoom if the password is
+	// wrong, or the room has no password and so cannot be joined.
+	WrongPasswordError = errors.New("wrong room password")
+)
+
+// RoomSettings contains settings for a room that can be delegated to
+// whoever runs it.
+type RoomSettings struct {
+	// If non-empty, players can move themselves into the room with
+	// JoinRoom by giving this password.
+	Password string `json:"-"`
+
+	// If non-zero, the maximum number of clients in the room.
+	MaxPlayers int `json:"max_players"`
+
+	// If non-empty, whoever has this token can moderate the room: list
+	// and kick its clients, but not touch any other room.
+	ModeratorToken string `json:"-"`
+}
+
+// SetRoomSettings changes the settings of the given room. UnknownRoomError is
+// returned if there is no such room.
+func (s *Server) SetRoomSettings(room string, rs RoomSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[room]; !ok {
+		return UnknownRoomError
+	}
+	s.roomSettings[room] = rs
+	logger.Printf("room %q: settings changed; password=%v, max players=%d, moderator=%v",
+		room, rs.Password != "", rs.MaxPlayers, rs.ModeratorToken != "")
+	return nil
+}
+
+// roomFull returns true if the given room cannot take another client. The
+// caller must hold the server's mutex.
+func (s *Server) roomFull(room string) bool {
+	max := s.roomSettings[room].MaxPlayers
+	if max == 0 {
+		return false
+	}
+	count := 0
+	for _, c := range s.clients {
+		if c.room == room {
+			count++
+		}
+	}
+	return count >= max
+}
+
+// roomPasswordOK returns true if the given password is the password of the
+// given room. Rooms without a password cannot be joined by password at all.
+// The caller must hold the server's mutex.
+func (s *Server) roomPasswordOK(room, password string) bool {
+	want := s.roomSettings[room].Password
+	return want != "" && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
+
+// JoinRoom moves the client with the given IPX address into the given room,
+// if the password is right. This lets players choose a room without an
+// admin, since the DOSBox protocol has no way for a vanilla client to ask
+// for one. The client is identified by its IPX address rather than where
+// the request came from, since many players may share an IP address behind
+// NAT, and requests may arrive through a proxy. If Config.NewRoom is set, a
+// room that does not exist is created, with the given password, but only
+// if there is such a client to move into it.
+func (s *Server) JoinRoom(addr ipx.Addr, room, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.clientByAddr(addr)
+	if c == nil {
+		return UnknownClientError
+	}
+	if _, ok := s.rooms[room]; !ok {
+		if err := s.createRoom(room, password); err != nil {
+			return err
+		}
+	}
+	if !s.roomPasswordOK(room, password) {
+		return WrongPasswordError
+	}
+	return s.moveClient(c, room)
+}
+
+// CheckRoomModerator returns true if the given token is the moderator token
+// of the given room.
+func (s *Server) CheckRoomModerator(room, token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	want := s.roomSettings[room].ModeratorToken
+	return want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// RoomClients returns statistics about the clients in the given room.
+func (s *Server) RoomClients(room string) []ClientStats {
+	result := []ClientStats{}
+	for _, c := range s.ClientStats() {
+		if c.Room == room {
+			result = append(result, c)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].IPXAddr < result[j].IPXAddr
+	})
+	return result
+}
+
+// KickFromRoom removes the client with the given IPX address from the given
+// room: it is moved back to DefaultRoom, or disconnected if it is already
+// there. UnknownClientError is returned if there is no such client in the
+// room.
+func (s *Server) KickFromRoom(room string, addr ipx.Addr) error {
+	s.mu.Lock()
+	found := false
+	for _, c := range s.clients {
+		if c.node.Address() == addr && c.room == room {
+			found = true
+		}
+	}
+	s.mu.Unlock()
+	if !found {
+		return UnknownClientError
+	}
+	if room == DefaultRoom {
+		return s.Disconnect(addr)
+	}
+	return s.MoveClient(addr, DefaultRoom)
+}
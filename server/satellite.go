@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+// satelliteMember is a node on the network that stands for a player behind
+// a satellite server. It is only accessed while holding the server's mutex.
+type satelliteMember struct {
+	node     network.Node
+	lastSeen time.Time
+}
+
+// isSatellite returns true if clients from the given IP address are allowed
+// to act as satellite uplinks.
+func (s *Server) isSatellite(ip net.IP) bool {
+	for _, n := range s.config.SatelliteRanges {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// satelliteMember returns the node for the player with the given address
+// behind the given satellite client, creating it if necessary. Unicast
+// packets sent to it are forwarded to the satellite; broadcasts are not,
+// because the satellite already receives them through its own node.
+func (s *Server) satelliteMember(c *client, addr ipx.Addr, now time.Time) (network.Node, error) {
+	if m, ok := c.members[addr]; ok {
+		m.lastSeen = now
+		return m.node, nil
+	}
+	an, ok := s.rooms[c.room].(network.AddrNetwork)
+	if !ok {
+		return nil, fmt.Errorf("room %q does not support satellites", c.room)
+	}
+	node, err := an.NewNodeWithAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.members == nil {
+		c.members = map[ipx.Addr]*satelliteMember{}
+	}
+	c.members[addr] = &satelliteMember{node: node, lastSeen: now}
+	logger.Debugf("client %s (%s): satellite player %s joined", c.addr, c.node.Address(), addr)
+	go s.runSatelliteMember(c, node)
+	return node, nil
+}
+
+// fromOwnMember returns true if the given packet was sent by one of the
+// players behind the given satellite client. The satellite has already
+// delivered such packets to its own players, so they must not be sent back
+// down the uplink; that would happen to every broadcast they send, since
+// the satellite's own node receives it.
+func (s *Server) fromOwnMember(c *client, packet []byte) bool {
+	if !c.satellite {
+		return false
+	}
+	var hdr ipx.Header
+	if hdr.UnmarshalBinary(packet) != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := c.members[hdr.Src.Addr]
+	return ok
+}
+
+// runSatelliteMember copies unicast packets from the given satellite member
+// node to the satellite client, other than those sent by the satellite's
+// own players. It returns when the node is closed.
+func (s *Server) runSatelliteMember(c *client, node network.Node) {
+	if s.crashRing != nil {
+		defer s.crashRing.HandlePanic(s.config.CrashDumpDir)
+	}
+	var buf [1500]byte
+	for {
+		packetLen, err := node.Read(buf[:])
+		if err == io.EOF {
+			return
+		} else if err != nil || c.isQuarantined() {
+			continue
+		}
+		var hdr ipx.Header
+		if hdr.UnmarshalBinary(buf[:packetLen]) != nil || hdr.IsBroadcast() || s.fromOwnMember(c, buf[:packetLen]) {
+			continue
+		}
+		s.writeToUDP(buf[0:packetLen], c)
+		atomic.StoreInt64(&c.lastForwardTime, monotonicNow())
+	}
+}
+
+// expireSatelliteMembers removes the members of the given satellite client
+// that have sent nothing for ClientTimeout. If all is true, every member is
+// removed.
+func (s *Server) expireSatelliteMembers(c *client, now time.Time, all bool) {
+	for addr, m := range c.members {
+		if all || now.Sub(m.lastSeen) > s.config.ClientTimeout {
+			m.node.Close()
+			delete(c.members, addr)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/validate"
+)
+
+// satelliteServer returns a running server that accepts satellites from
+// the loopback address, and a registered satellite client. If configure is
+// not nil, it is called to change the server's configuration.
+func satelliteServer(t *testing.T, configure func(*Config)) (*Server, *testClient) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.SatelliteRanges = []*net.IPNet{loopback}
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+	runServer(s, contextForTest(t))
+	sat := newTestClient(t, s)
+	sat.register(nil)
+	return s, sat
+}
+
+// receivedFrom returns true if the client receives a packet from the given
+// address before the timeout.
+func receivedFrom(c *testClient, src ipx.Addr, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		packet, ok := c.read(time.Until(deadline))
+		if !ok {
+			return false
+		}
+		var hdr ipx.Header
+		if hdr.UnmarshalBinary(packet) == nil && hdr.Src.Addr == src {
+			return true
+		}
+	}
+}
+
+func TestSatelliteTrafficNotReflected(t *testing.T) {
+	s, sat := satelliteServer(t, nil)
+	other := newTestClient(t, s)
+	other.register(nil)
+
+	member := ipx.Addr{0x02, 0xaa, 0xbb, 0xcc, 0xdd, 0x01}
+	member2 := ipx.Addr{0x02, 0xaa, 0xbb, 0xcc, 0xdd, 0x02}
+	own := sat.addr
+	sat.addr = member
+	sat.send(ipx.AddrBroadcast, 0x869c, []byte("hello"))
+	if !receivedFrom(other, member, 2*time.Second) {
+		t.Fatalf("broadcast from satellite player not received")
+	}
+	if receivedFrom(sat, member, 200*time.Millisecond) {
+		t.Errorf("broadcast from satellite player sent back down the uplink")
+	}
+
+	// Unicast between two players behind the satellite is not sent back
+	// either, but unicast from elsewhere is.
+	sat.addr = member2
+	sat.send(ipx.AddrBroadcast, 0x869c, []byte("hello"))
+	sat.send(member, 0x869c, []byte("hello"))
+	if receivedFrom(sat, member2, 200*time.Millisecond) {
+		t.Errorf("packet between satellite players sent back down the uplink")
+	}
+	other.send(member, 0x869c, []byte("hello"))
+	if !receivedFrom(sat, other.addr, 2*time.Second) {
+		t.Errorf("packet to satellite player not forwarded")
+	}
+	sat.addr = own
+}
+
+func TestSatelliteSocketSpreadExempt(t *testing.T) {
+	s, sat := satelliteServer(t, nil)
+	for i := 0; i < 2*maxSocketsPerSecond; i++ {
+		sat.addr[5]++
+		sat.send(ipx.AddrBroadcast, uint16(0x4000+i), nil)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, a := range s.Alerts() {
+		if a.Kind == AlertSocketSpread {
+			t.Errorf("satellite raised alert: %+v", a)
+		}
+	}
+}
+
+// TestSatellitePlayersValidatedSeparately checks that each player behind a
+// satellite has its own share of a per-source rate limit.
+func TestSatellitePlayersValidatedSeparately(t *testing.T) {
+	v := validate.New()
+	v.Add("source_rate=1", validate.SourceRate(1))
+	s, sat := satelliteServer(t, func(cfg *Config) {
+		cfg.Validator = v
+	})
+	other := newTestClient(t, s)
+	other.register(nil)
+
+	for i := byte(1); i <= 3; i++ {
+		member := ipx.Addr{0x02, 0xaa, 0xbb, 0xcc, 0xdd, i}
+		sat.addr = member
+		sat.send(ipx.AddrBroadcast, 0x869c, []byte("hello"))
+		if !receivedFrom(other, member, 2*time.Second) {
+			t.Errorf("packet from satellite player %d was dropped", i)
+		}
+	}
+}
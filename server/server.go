@@ -2,16 +2,28 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/fragglet/ipxbox/annotate"
+	"github.com/fragglet/ipxbox/crashdump"
+	"github.com/fragglet/ipxbox/debuglog"
+	"github.com/fragglet/ipxbox/drop"
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/validate"
+	"github.com/fragglet/ipxbox/virtual"
 )
 
+var logger = debuglog.New("server")
+
 // Config contains configuration parameters for an IPX server.
 type Config struct {
 	// Clients time out if nothing is received for this amount of time.
@@ -23,73 +35,644 @@ type Config struct {
 	// packets on particular ports if nothing is received for a while.
 	// This controls the time for keepalives.
 	KeepaliveTime time.Duration
+
+	// If greater than KeepaliveTime, the keepalive interval for each
+	// client is tuned between KeepaliveTime and this, by learning how
+	// long the client's NAT keeps its mapping open when idle. While
+	// tuning, a client may briefly become unreachable until it next
+	// sends something.
+	KeepaliveMaxTime time.Duration
+
+	// If non-zero, a room is idle once no client in it has sent any game
+	// traffic for this long. Clients in idle rooms are only sent
+	// keepalives every IdleKeepaliveTime, and are not probed by MTUProbe
+	// until the room becomes active again. This cuts the baseline
+	// bandwidth of a server that sits idle most of the time.
+	IdleRoomTime      time.Duration
+	IdleKeepaliveTime time.Duration
+
+	// Sizes in bytes of the OS receive and send buffers for the server's
+	// socket. If zero, the OS default is used.
+	ReceiveBufferSize int
+	SendBufferSize    int
+
+	// If non-empty, the most recently received packets are written to
+	// a pcap file and JSON summary in this directory if the server
+	// crashes. CrashDumpPackets controls how many packets are kept.
+	CrashDumpDir     string
+	CrashDumpPackets int
+
+	// If set, packets sent by quarantined clients are written here
+	// instead of being delivered to the network, so that evidence of
+	// misbehavior can be captured.
+	QuarantineTap io.Writer
+
+	// If non-zero, hosts that send traffic that is not part of the
+	// DOSBox IPX protocol (eg. port scans) are tracked and sent a
+	// minimal reply after this delay, instead of being ignored.
+	// TarpitSources limits the number of hosts that are tracked.
+	TarpitDelay   time.Duration
+	TarpitSources int
+
+	// Number of UDP sockets to receive on. If more than one, the sockets
+	// share the same port using SO_REUSEPORT and the kernel spreads
+	// clients between them, each served by its own goroutine. This is
+	// only supported on Linux.
+	Sockets int
+
+	// Maps UDP ports to rooms. The server also listens on each port, and
+	// clients that connect to it join its room instead of DefaultRoom,
+	// without needing a password. This lets players choose a room with
+	// nothing more than the server:port that DOSBox can express. The
+	// rooms must be added with AddRoom.
+	RoomPorts map[int]string
+
+	// Maps local IP addresses to rooms, so that rooms can be given DNS
+	// names that resolve to different addresses of the same host.
+	// Clients that connect to one of these addresses on the main port
+	// join its room. Only used if PreserveLocalAddr is set, since
+	// otherwise the address a packet arrived on is not known.
+	RoomAddrs map[string]string
+
+	// If non-zero, clients from each IP address may only be connected
+	// for this long each day. Clients are warned before they are cut
+	// off with a text message sent to QuotaWarningSocket.
+	DailyQuota         time.Duration
+	QuotaWarningSocket uint16
+
+	// If non-zero, more than this many registrations from new clients
+	// in a second is treated as a flood. While a flood is in progress,
+	// each IP address may only have FloodClientsPerIP clients, except
+	// that if FloodWorkBits is non-zero, extended clients must instead
+	// do a proof of work with that many bits before they are given an
+	// address, and are then not limited per IP address.
+	FloodRegistrationRate int
+	FloodClientsPerIP     int
+	FloodWorkBits         int
+
+	// If the host is suspended (eg. a laptop lid is closed), clients
+	// are not timed out for this long after it resumes, which gives
+	// them a chance to reply to pings first.
+	ResumeGracePeriod time.Duration
+
+	// If true, replies to each client are sent from the local address
+	// that its registration arrived on, instead of one chosen by the
+	// OS. This matters when listening on all addresses of a host that
+	// has more than one, because some NATs drop replies that come from
+	// a different address. Only supported on Linux.
+	PreserveLocalAddr bool
+
+	// If true, the largest packet that can be delivered to each client
+	// is probed shortly after it connects, by sending it pings padded
+	// to different sizes. Some paths silently drop large packets, which
+	// makes games appear to be broken.
+	MTUProbe bool
+
+	// If set, registrations from banned IP addresses are refused, and
+	// connected clients that become banned are disconnected.
+	Bans Banlist
+
+	// Limits for each trust tier, keyed by tier name, and ranges of IP
+	// addresses whose clients are assigned to tiers other than
+	// TierNormal. Tiers that are not in the map have no limits.
+	Tiers      map[string]TierLimits
+	TierRanges []TierRange
+
+	// Clients connecting from these IP ranges may act as uplinks for
+	// satellite servers: they may send packets from any address, and
+	// unicast packets sent to those addresses are forwarded to them.
+	// See package satellite.
+	SatelliteRanges []*net.IPNet
+
+	// If non-zero, game sessions are tracked, and once a session has
+	// been running for this long with at least two members, it is
+	// locked: broadcasts to its socket from other nodes are dropped, so
+	// that late joiners cannot inject discovery packets into a match in
+	// progress. A session is a run of traffic to the same socket in a
+	// room, and its members are the nodes that sent that traffic.
+	SessionLockDelay time.Duration
+
+	// If set, this is called in a new goroutine for every alert raised
+	// about suspicious behavior by a client. See Server.Alerts.
+	AlertHook func(Alert)
+
+	// If set, JoinRoom creates rooms that do not exist yet, calling this
+	// to create each room's network. Rooms created this way are
+	// ephemeral: they are removed once their last client has left.
+	NewRoom func(name string) (network.Network, error)
+
+	// If set, this is called in a new goroutine when an ephemeral room
+	// is removed, before the room's network is closed.
+	RoomClosed func(name string)
+
+	// If non-zero, the maximum number of ephemeral rooms that can exist
+	// at once.
+	MaxEphemeralRooms int
+
+	// If true, pings are sent from the address ff:ff:ff:ff:00:00 used by
+	// older versions of ipxbox, instead of 02:ff:ff:ff:00:00. Replies to
+	// either address are always accepted, and clients seen replying to
+	// the old address are pinged from it regardless of this setting.
+	LegacyPingReply bool
+
+	// Version of the server software and URL of its message of the day,
+	// sent to clients that ask for the extended registration reply.
+	Version string
+	MOTDURL string
+
+	// If non-zero, clients that time out are remembered for this long,
+	// and if one registers again within that time, it gets back its
+	// old IPX address and room, and so its place in any game session
+	// it was part of. This smooths over brief disconnects.
+	RejoinWindow time.Duration
+
+	// If non-nil, packets from clients that fail its checks are
+	// dropped before they reach the network.
+	Validator *validate.Validator
+
+	// Endpoints that the server contacts first, for clients that can
+	// be reached but cannot reach the server themselves. Until each
+	// endpoint registers, it is sent a ping every KeepaliveTime.
+	DialAddrs []*net.UDPAddr
+
+	// Other servers on the same network, as host:port, eg. satellites
+	// linked to this one. Once this server has RedirectAbove clients,
+	// new clients using the extended protocol are redirected to
+	// whichever of them this server has sent the fewest clients to.
+	// Other clients cannot be redirected, so they are always accepted.
+	RedirectAddrs []string
+	RedirectAbove int
+}
+
+// Banlist decides whether clients are banned.
+type Banlist interface {
+	// Banned returns true, with the reason, if a client with the given
+	// IP address, IPX address and fingerprint is banned. At
+	// registration, the IPX address and fingerprint are not yet known
+	// and are given as ipx.AddrNull and an empty string.
+	Banned(ip net.IP, addr ipx.Addr, fingerprint string) (string, bool)
 }
 
 // client represents a client that is connected to an IPX server.
 type client struct {
+	// These are accessed atomically and are kept at the start of the
+	// struct to ensure 64-bit alignment.
+	errors           [numErrorCategories]uint64
+	lastErrorLogTime int64
+	lastForwardTime  int64
+	quarantined      int32
+
 	addr            *net.UDPAddr
 	node            network.Node
+	flavor          string
+	room            string
+	connectTime     time.Time
 	lastReceiveTime time.Time
 	lastSendTime    time.Time
+	lastChargeTime  time.Time
+
+	// Smallest of quotaWarningTimes that the client has been warned of.
+	quotaWarning time.Duration
+
+	fingerprint fingerprint
+	mtu         mtuProbe
+
+	// If non-nil, keepalives to the client are tuned by this.
+	keepalive *keepaliveTuner
+
+	// Trust tier of the client, and its use of the tier's rate limits.
+	tier      string
+	rateLimit rateLimit
+
+	// If the client is a satellite uplink, the nodes standing for the
+	// players behind it, by address.
+	satellite bool
+	members   map[ipx.Addr]*satelliteMember
+
+	// When the last ping was sent, if it has not been answered yet, and
+	// the smoothed round trip time measured from pings.
+	pingSentTime time.Time
+	rtt          time.Duration
+
+	// When the last ping reply was received, and the round trip time of
+	// that ping alone.
+	lastPingReply time.Time
+	lastPingRTT   time.Duration
+
+	anomalies anomalies
+
+	// If non-nil, out-of-band data for sending packets to the client
+	// from the local address that it registered on.
+	replyOOB []byte
+
+	// Socket the client registered on, which replies are sent from.
+	socket *net.UDPConn
+
+	// True if the client replies to pings at the legacy address.
+	legacyPing bool
+
+	// Extended protocol version negotiated at registration, or zero,
+	// and the capabilities the client advertised.
+	protocolVersion int
+	advertised      []string
+
+	// True if the client advertised that it does not need keepalives.
+	noKeepalive bool
+
+	// If non-nil, the client has been given a new address that it has
+	// not used yet.
+	renumbering *renumbering
+}
+
+// Stats contains counters describing the operation of the server.
+type Stats struct {
+	// Number of clients currently connected.
+	Clients int `json:"clients"`
+
+	// Number of times that sending a UDP packet failed.
+	WriteErrors uint64 `json:"write_errors"`
+
+	// Number of received packets that could not be decoded.
+	DecodeErrors uint64 `json:"decode_errors"`
+
+	// Number of inbound packets that the kernel dropped because the
+	// socket receive buffer was full. Only available on Linux.
+	KernelDrops uint64 `json:"kernel_drops"`
+
+	// Number of hosts currently being tarpitted, and the total number
+	// of non-protocol packets that were received from such hosts.
+	ScanSources int    `json:"scan_sources"`
+	ScanPackets uint64 `json:"scan_packets"`
+
+	// True if new clients are not being accepted, and the number of
+	// registrations from new clients that have been refused, either
+	// because of this, because of DailyQuota or Bans, or during a
+	// flood.
+	RegistrationClosed   bool   `json:"registration_closed"`
+	RefusedRegistrations uint64 `json:"refused_registrations"`
+
+	// True if a flood of registrations is in progress.
+	Flood bool `json:"flood"`
+
+	// Number of packets dropped for each reason.
+	Drops map[string]uint64 `json:"drops"`
+}
+
+// ClientStats contains statistics about a connected client.
+type ClientStats struct {
+	Addr    string `json:"addr"`
+	IPXAddr string `json:"ipx_addr"`
+
+	// Number of errors that occurred forwarding packets to or from the
+	// client, by category.
+	Errors map[string]uint64 `json:"errors"`
+
+	// Kind of client, as detected from its registration packet: either
+	// "dosbox" or "extended".
+	Flavor string `json:"flavor"`
+
+	// Soft fingerprint derived from the client's behavior, which can
+	// help to recognize the same client connecting from a different
+	// address. Unrelated clients may share a fingerprint, eg. if they
+	// are playing the same game.
+	Fingerprint string `json:"fingerprint"`
+
+	// Name of the room (network) that the client is connected to.
+	Room string `json:"room"`
+
+	// Smoothed round trip time to the client in milliseconds, measured
+	// from replies to pings. Zero if not yet known.
+	RTTMS float64 `json:"rtt_ms,omitempty"`
+
+	// True if the client replies to pings at the legacy address; see
+	// Config.LegacyPingReply.
+	LegacyPing bool `json:"legacy_ping,omitempty"`
+
+	// Extended protocol version negotiated at registration, or zero
+	// for clients that use the plain DOSBox protocol, and the
+	// capabilities the client has; see Capabilities.
+	ProtocolVersion int      `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+
+	// If the client is a satellite uplink, the number of players behind
+	// it that have recently sent packets.
+	SatellitePlayers int `json:"satellite_players,omitempty"`
+
+	// Trust tier of the client, and the number of packets it sent that
+	// were dropped because they exceeded the tier's rate limits.
+	Tier        string `json:"tier"`
+	RateLimited uint64 `json:"rate_limited"`
+
+	// If MTUProbe is enabled, the size in bytes of the largest packet
+	// known to have reached the client. Zero if not known.
+	MaxPacketSize int `json:"max_packet_size,omitempty"`
+
+	// If KeepaliveMaxTime is set, the current keepalive interval for
+	// the client, eg. "45s".
+	KeepaliveInterval string `json:"keepalive_interval,omitempty"`
+
+	// True if IdleRoomTime is set and the client's room is idle.
+	RoomIdle bool `json:"room_idle,omitempty"`
+
+	// When the client connected, and when a packet was last received
+	// from it.
+	ConnectTime     time.Time `json:"connect_time"`
+	LastReceiveTime time.Time `json:"last_receive_time"`
+
+	// True if the client is quarantined, which means that it remains
+	// connected but is isolated from the rest of the network.
+	Quarantined bool `json:"quarantined"`
 }
 
 // Server is the top-level struct representing an IPX server that listens
 // on a UDP port.
 type Server struct {
+	// These are accessed atomically and are kept at the start of the
+	// struct to ensure 64-bit alignment.
+	writeErrors  uint64
+	decodeErrors uint64
+	lastPollTime int64
+	numClients   int64
+	kernelDrops  uint64
+	scanPackets  uint64
+	refusedRegs  uint64
+
+	numScanSources     int64
+	registrationClosed int32
+	numTraces          int32
+	numCaptures        int32
+
 	net              network.Network
+	rooms            map[string]network.Network
 	mu               sync.Mutex
 	config           *Config
 	socket           *net.UDPConn
+	sockets          []*net.UDPConn
+	socketRooms      map[*net.UDPConn]string
+	socketPackets    map[*net.UDPConn]uint64
+	redirects        map[string]int
 	clients          map[string]*client
 	timeoutCheckTime time.Time
+	lastDialTime     time.Time
+	graceUntil       time.Time
+	dropCheckTime    time.Time
+	crashRing        *crashdump.Ring
+	tarpit           *tarpit
+	quota            *quota
+	flood            *floodGuard
+	departed         []departedClient
+	rejoins          []rejoinRecord
+	drops            *drop.Counter
+	faults           faultInjector
+
+	// Kernel drops counted by previous runs of the server, restored by
+	// RestoreCounters. The kernel's own count starts again from zero.
+	kernelDropsBase uint64
+
+	// Time that game traffic was last received from a client in each
+	// room, for IdleRoomTime.
+	roomTraffic map[string]time.Time
+
+	// Name of the game most recently played in each room, for the room
+	// directory.
+	roomGames map[string]string
+
+	// Trust tiers assigned to IP addresses by SetTier.
+	tiers map[string]string
+
+	// Game sessions in progress, if SessionLockDelay is set.
+	sessions map[sessionKey]*session
+
+	// Most recent alerts about suspicious client behavior.
+	alerts []Alert
+
+	// Settings of rooms that have any.
+	roomSettings map[string]RoomSettings
+
+	// Rooms created on demand, if Config.NewRoom is set.
+	ephemeral map[string]*ephemeralRoom
+
+	// Path measurements waiting for their echo, by token.
+	pathEchoes map[[8]byte]*pathEcho
+
+	traceMu sync.Mutex
+	traces  map[string]*Trace
+
+	captureMu sync.Mutex
+	captures  map[ipx.Addr]io.Writer
 }
 
 var (
-	// UnknownClientError is returned by Server.Write() if the destination
-	// MAC address is not associated with any known client.
+	// UnknownClientError is returned if an IPX address is not associated
+	// with any known client.
 	UnknownClientError = errors.New("unknown destination address")
 
+	// UnknownRoomError is returned if there is no room with a given
+	// name.
+	UnknownRoomError = errors.New("unknown room")
+
 	DefaultConfig = &Config{
-		ClientTimeout: 10 * time.Minute,
-		KeepaliveTime: 5 * time.Second,
+		ClientTimeout:    10 * time.Minute,
+		KeepaliveTime:    5 * time.Second,
+		CrashDumpPackets: 1000,
+		TarpitSources:    1024,
+
+		// Same socket as the announcement service.
+		QuotaWarningSocket: 0x8062,
+
+		FloodClientsPerIP: 1,
+		FloodWorkBits:     16,
+		ResumeGracePeriod: time.Minute,
+		IdleKeepaliveTime: 25 * time.Second,
 	}
 
-	// Server-initiated pings come from this address.
+	// Server-initiated pings come from this address, which is reserved
+	// so that it is never given to a node (see virtual.Reserved).
 	addrPingReply = [6]byte{0x02, 0xff, 0xff, 0xff, 0x00, 0x00}
 
 	_ = (io.Closer)(&Server{})
 )
 
+// DefaultRoom is the name of the room that clients join when they connect.
+const DefaultRoom = "default"
+
+// If the main loop has not run in this long, it is assumed to be stuck. The
+// loop normally runs at least every 10 seconds even if nothing is received.
+const maxPollInterval = 30 * time.Second
+
+// Interval between checks of the kernel's count of dropped packets.
+const dropCheckInterval = time.Minute
+
+// openSocket opens a UDP socket listening on the given address, configured
+// as specified in the given config.
+func openSocket(addr *net.UDPAddr, c *Config) (*net.UDPConn, error) {
+	var socket *net.UDPConn
+	if c.Sockets > 1 {
+		lc := net.ListenConfig{Control: setReusePort}
+		conn, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+		if err != nil {
+			return nil, err
+		}
+		socket = conn.(*net.UDPConn)
+	} else {
+		var err error
+		socket, err = net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.ReceiveBufferSize != 0 {
+		if err := socket.SetReadBuffer(c.ReceiveBufferSize); err != nil {
+			socket.Close()
+			return nil, err
+		}
+	}
+	if c.SendBufferSize != 0 {
+		if err := socket.SetWriteBuffer(c.SendBufferSize); err != nil {
+			socket.Close()
+			return nil, err
+		}
+	}
+	if c.PreserveLocalAddr {
+		if err := enablePktinfo(socket); err != nil {
+			socket.Close()
+			return nil, err
+		}
+	}
+	return socket, nil
+}
+
 // New creates a new Server, listening on the given address.
 func New(addr string, n network.Network, c *Config) (*Server, error) {
 	udp4Addr, err := net.ResolveUDPAddr("udp4", addr)
 	if err != nil {
 		return nil, err
 	}
-	socket, err := net.ListenUDP("udp", udp4Addr)
+	socket, err := openSocket(udp4Addr, c)
 	if err != nil {
 		return nil, err
 	}
+	sockets := []*net.UDPConn{socket}
+	// If the port was chosen by the OS, the other sockets must use the
+	// same one.
+	udp4Addr.Port = socket.LocalAddr().(*net.UDPAddr).Port
+	for len(sockets) < c.Sockets {
+		socket, err := openSocket(udp4Addr, c)
+		if err != nil {
+			for _, socket := range sockets {
+				socket.Close()
+			}
+			return nil, err
+		}
+		sockets = append(sockets, socket)
+	}
 	s := &Server{
 		net:              n,
+		rooms:            map[string]network.Network{DefaultRoom: n},
 		config:           c,
-		socket:           socket,
+		socket:           sockets[0],
+		sockets:          sockets,
+		socketRooms:      map[*net.UDPConn]string{},
+		socketPackets:    map[*net.UDPConn]uint64{},
+		redirects:        map[string]int{},
 		clients:          map[string]*client{},
+		traces:           map[string]*Trace{},
+		captures:         map[ipx.Addr]io.Writer{},
+		roomTraffic:      map[string]time.Time{},
+		roomGames:        map[string]string{},
+		tiers:            map[string]string{},
+		sessions:         map[sessionKey]*session{},
+		roomSettings:     map[string]RoomSettings{},
+		ephemeral:        map[string]*ephemeralRoom{},
+		pathEchoes:       map[[8]byte]*pathEcho{},
+		drops:            drop.NewCounter("server"),
 		timeoutCheckTime: time.Now().Add(10e9),
+		dropCheckTime:    time.Now(),
+		lastPollTime:     monotonicNow(),
+	}
+	if err := s.openRoomSockets(udp4Addr); err != nil {
+		for _, socket := range s.sockets {
+			socket.Close()
+		}
+		return nil, err
+	}
+	if c.CrashDumpDir != "" {
+		s.crashRing = crashdump.NewRing(c.CrashDumpPackets, udp4Addr)
+	}
+	if c.TarpitDelay != 0 {
+		s.tarpit = newTarpit(c.TarpitDelay, c.TarpitSources)
+	}
+	if c.DailyQuota != 0 {
+		s.quota = newQuota(c.DailyQuota)
+	}
+	if c.FloodRegistrationRate != 0 {
+		s.flood = newFloodGuard(c.FloodRegistrationRate, c.FloodClientsPerIP, c.FloodWorkBits)
 	}
 	return s, nil
 }
 
-// runClient continually copies packets from the client's node and sends them
-// to the connected UDP client. The function will only return when the client's
-// network node is Close()d.
-func (s *Server) runClient(c *client) {
+// writeToUDP sends a UDP packet to the given client, counting any errors.
+func (s *Server) writeToUDP(packet []byte, c *client) {
+	var err error
+	if s.faults != nil {
+		var delay time.Duration
+		delay, err = s.faults.writeFault()
+		if err == nil && delay > 0 {
+			// The write happens in the background, since the
+			// caller may be holding the server's mutex.
+			packet = append([]byte{}, packet...)
+			time.AfterFunc(delay, func() {
+				s.sendToUDP(packet, c, nil)
+			})
+			return
+		}
+	}
+	s.sendToUDP(packet, c, err)
+}
+
+// sendToUDP sends a packet to a client, unless err is already set, and
+// counts and traces the result.
+func (s *Server) sendToUDP(packet []byte, c *client, err error) {
+	switch {
+	case err != nil:
+	case c.replyOOB != nil:
+		_, _, err = c.socket.WriteMsgUDP(packet, c.replyOOB, c.addr)
+	default:
+		_, err = c.socket.WriteToUDP(packet, c.addr)
+	}
+	if err != nil {
+		atomic.AddUint64(&s.writeErrors, 1)
+		s.drops.Drop(drop.WriteError, "%d bytes to %s: %v", len(packet), c.addr, err)
+		c.recordError(categorizeError(err), err)
+		s.tracePacket(c.addr, traceOut, packet, err.Error())
+	} else {
+		s.tracePacket(c.addr, traceOut, packet, "")
+	}
+	s.capturePacket(c, packet)
+}
+
+// isQuarantined returns true if the client is quarantined.
+func (c *client) isQuarantined() bool {
+	return atomic.LoadInt32(&c.quarantined) != 0
+}
+
+// runClient continually copies packets from the given node and sends them to
+// the connected UDP client. The function will only return when the node is
+// Close()d.
+func (s *Server) runClient(c *client, node network.Node) {
+	if s.crashRing != nil {
+		defer s.crashRing.HandlePanic(s.config.CrashDumpDir)
+	}
 	var buf [1500]byte
 	for {
-		packetLen, err := c.node.Read(buf[:])
+		packetLen, err := node.Read(buf[:])
 		switch {
+		case err == nil && c.isQuarantined():
+			// Quarantined clients don't see any network traffic.
+		case err == nil && s.fromOwnMember(c, buf[0:packetLen]):
 		case err == nil:
-			s.socket.WriteToUDP(buf[0:packetLen], c.addr)
+			s.writeToUDP(buf[0:packetLen], c)
+			atomic.StoreInt64(&c.lastForwardTime, monotonicNow())
 		case err == io.EOF:
 			return
 		default:
@@ -99,29 +682,157 @@ func (s *Server) runClient(c *client) {
 }
 
 // newClient processes a registration packet, adding a new client if necessary.
-func (s *Server) newClient(header *ipx.Header, addr *net.UDPAddr) {
+// Clients may send more than one registration packet, eg. if the reply was
+// lost. Every registration is replied to with the same address; the contents
+// of the packet other than the destination are ignored. New clients join the
+// room of the socket the packet was received on.
+func (s *Server) newClient(socket *net.UDPConn, header *ipx.Header, packet []byte, addr *net.UDPAddr, local net.IP) {
 	addrStr := addr.String()
 	c, ok := s.clients[addrStr]
 
+	if !ok && atomic.LoadInt32(&s.registrationClosed) != 0 {
+		atomic.AddUint64(&s.refusedRegs, 1)
+		s.dropPacket(addr, packet, drop.Refused, "refused: registration is closed")
+		return
+	}
+	exempt := s.exempt(addr.IP)
+	if !ok && s.quota != nil && !exempt && s.quota.remaining(addr.IP.String(), time.Now()) <= 0 {
+		atomic.AddUint64(&s.refusedRegs, 1)
+		s.dropPacket(addr, packet, drop.Refused, "refused: daily limit reached")
+		return
+	}
+	if !ok && s.config.Bans != nil {
+		if reason, banned := s.config.Bans.Banned(addr.IP, ipx.AddrNull, ""); banned {
+			atomic.AddUint64(&s.refusedRegs, 1)
+			s.dropPacket(addr, packet, drop.Refused, "refused: banned: "+reason)
+			return
+		}
+	}
+	if !ok && s.flood != nil && !exempt && !s.allowDuringFlood(socket, packet, addr) {
+		atomic.AddUint64(&s.refusedRegs, 1)
+		s.dropPacket(addr, packet, drop.Refused, "refused: registration flood in progress")
+		return
+	}
+	if !ok && s.redirect(socket, packet, addr) {
+		s.tracePacket(addr, traceIn, packet, "redirected")
+		return
+	}
+	room := s.registrationRoom(socket, local)
+	tier := s.tierFor(addr.IP)
+	// A client that registered on a room's own port or address asked
+	// for that room, so it is only returned to its old room if it
+	// registered on the main one, and only if it can still join it.
+	// Extended clients can instead name the room they want, which
+	// takes precedence over the one they were last in.
+	var rejoin rejoinRecord
+	var rejoining bool
+	if !ok && room == DefaultRoom {
+		if requested, found := s.requestedRoom(packet, tier); found {
+			room = requested
+		} else {
+			rejoin, rejoining = s.takeRejoin(addr, time.Now())
+			_, exists := s.rooms[rejoin.room]
+			if rejoining && exists && s.roomAllowed(tier, rejoin.room) && !s.roomFull(rejoin.room) {
+				room = rejoin.room
+			}
+		}
+	}
+	n, roomOK := s.rooms[room]
+	switch {
+	case ok:
+	case !roomOK:
+		atomic.AddUint64(&s.refusedRegs, 1)
+		s.dropPacket(addr, packet, drop.Refused, fmt.Sprintf("refused: no room %q", room))
+		return
+	case !s.roomAllowed(tier, room):
+		atomic.AddUint64(&s.refusedRegs, 1)
+		s.dropPacket(addr, packet, drop.Refused, fmt.Sprintf("refused: %s tier not allowed in room %q", tier, room))
+		return
+	case s.roomFull(room):
+		atomic.AddUint64(&s.refusedRegs, 1)
+		s.dropPacket(addr, packet, drop.Refused, fmt.Sprintf("refused: room %q is full", room))
+		return
+	}
+	switch {
+	case ok:
+		s.tracePacket(addr, traceIn, packet, "repeated registration; replying with the same address")
+	case rejoining:
+		s.tracePacket(addr, traceIn, packet, "rejoining client")
+	default:
+		s.tracePacket(addr, traceIn, packet, "new client")
+	}
 	if !ok {
+		var node network.Node
+		if rejoining {
+			node = rejoinNode(n, rejoin)
+		} else {
+			node = n.NewNode()
+		}
 		c = &client{
 			addr:            addr,
+			socket:          socket,
+			connectTime:     time.Now(),
 			lastReceiveTime: time.Now(),
-			node:            s.net.NewNode(),
+			lastChargeTime:  time.Now(),
+			node:            node,
+			room:            room,
+			tier:            tier,
+			satellite:       s.isSatellite(addr.IP),
+		}
+		if local != nil {
+			c.replyOOB = pktinfoControl(local)
+		}
+		if s.config.KeepaliveMaxTime > s.config.KeepaliveTime {
+			c.keepalive = newKeepaliveTuner(s.config.KeepaliveTime, s.config.KeepaliveMaxTime)
 		}
 
 		s.clients[addrStr] = c
-		go s.runClient(c)
+		atomic.AddInt64(&s.numClients, 1)
+		if rejoining {
+			logger.Debugf("client %s (%s): rejoined room %q; was %s", addr, c.node.Address(), room, rejoin.ipxAddr)
+		} else {
+			logger.Debugf("client %s (%s): connected", addr, c.node.Address())
+		}
+		if s.flood != nil {
+			s.flood.added(addr.IP.String())
+		}
+		go s.runClient(c, c.node)
 	}
+	c.flavor = registrationFlavor(header, packet)
+	c.fingerprint.registrations++
 
 	// Send a reply back to the client
-	reply := &ipx.Header{
+	c.lastSendTime = time.Now()
+	encodedReply, err := registrationReply(c.node.Address()).MarshalBinary()
+	if options, ok := extendedOptions(packet); ok {
+		version, offered, verr := negotiateVersion(options)
+		c.protocolVersion = int(version)
+		c.advertised = advertisedCapabilities(options)
+		c.noKeepalive = hasCapability(c.advertised, "no_keepalive")
+		switch {
+		case err != nil:
+		case verr != nil:
+			logger.Debugf("client %s (%s): no extended reply: %v", addr, c.node.Address(), verr)
+			encodedReply, err = errorReply(encodedReply, verr, len(packet))
+		default:
+			encodedReply, err = s.extendedReply(encodedReply, c, version, offered, len(packet))
+		}
+	}
+	if err == nil {
+		s.writeToUDP(encodedReply, c)
+	}
+}
+
+// registrationReply returns the reply sent to a registration packet, which
+// tells the client the address it has been assigned.
+func registrationReply(addr ipx.Addr) *ipx.Header {
+	return &ipx.Header{
 		Checksum:     0xffff,
 		Length:       30,
 		TransControl: 0,
 		Dest: ipx.HeaderAddr{
 			Network: [4]byte{0, 0, 0, 0},
-			Addr:    c.node.Address(),
+			Addr:    addr,
 			Socket:  2,
 		},
 		Src: ipx.HeaderAddr{
@@ -130,78 +841,189 @@ func (s *Server) newClient(header *ipx.Header, addr *net.UDPAddr) {
 			Socket:  2,
 		},
 	}
+}
 
-	c.lastSendTime = time.Now()
-	encodedReply, err := reply.MarshalBinary()
-	if err == nil {
-		s.socket.WriteToUDP(encodedReply, c.addr)
+// pingHeader returns the header of the ping packets sent to clients.
+func pingHeader() *ipx.Header {
+	return &ipx.Header{
+		Dest: ipx.HeaderAddr{
+			Addr:   ipx.AddrBroadcast,
+			Socket: 2,
+		},
+		// We "send" the pings from an imaginary "ping reply" address
+		// because if we used ipx.AddrNull the reply would be
+		// indistinguishable from a registration packet.
+		Src: ipx.HeaderAddr{
+			Addr:   addrPingReply,
+			Socket: 0,
+		},
 	}
 }
 
+// dropPacket counts and traces a packet received from the given address that
+// is being dropped for the given reason.
+func (s *Server) dropPacket(addr *net.UDPAddr, packet []byte, r drop.Reason, note string) {
+	s.drops.Drop(r, "%d bytes from %s: %s", len(packet), addr, note)
+	s.tracePacket(addr, traceIn, packet, note)
+}
+
 // processPacket decodes and processes a received UDP packet, sending responses
-// and forwarding the packet on to other clients as appropriate.
-func (s *Server) processPacket(packet []byte, addr *net.UDPAddr) {
+// and forwarding the packet on to other clients as appropriate. If known, local
+// is the local address that the packet was received on.
+func (s *Server) processPacket(socket *net.UDPConn, packet []byte, addr *net.UDPAddr, local net.IP) {
 	var header ipx.Header
-	if err := header.UnmarshalBinary(packet); err != nil {
-		return
-	}
-
-	if header.IsRegistrationPacket() {
-		s.newClient(&header, addr)
+	err := header.UnmarshalBinary(packet)
+	if err == nil && header.IsRegistrationPacket() {
+		s.newClient(socket, &header, packet, addr, local)
 		return
 	}
 
 	// Find which client sent it; it must be a registered client sending
 	// from their own IPX address.
 	srcClient, ok := s.clients[addr.String()]
-	if !ok {
+	switch {
+	case err != nil && !ok && s.tarpit != nil:
+		// Garbage from a host that isn't a client; probably a scan.
+		s.dropPacket(addr, packet, drop.Malformed, "")
+		s.tarpitPacket(addr)
+		return
+	case err != nil:
+		atomic.AddUint64(&s.decodeErrors, 1)
+		s.dropPacket(addr, packet, drop.Malformed, "")
+		if ok {
+			s.observeMalformed(srcClient, time.Now())
+		}
+		return
+	case !ok:
+		s.dropPacket(addr, packet, drop.NotRegistered, "not registered; dropped")
+		return
+	}
+	now := time.Now()
+	// Packets that fail validation must not affect the client's state at
+	// all. Each player behind a satellite is a separate source, so that
+	// one player cannot use up the others' share of a per-source limit.
+	source := addr.String()
+	if srcClient.satellite {
+		source = header.Src.Addr.String()
+	}
+	if r, check, ok := s.config.Validator.Validate(source, &header, packet, now); !ok {
+		s.dropPacket(addr, packet, r, "failed "+check+"; dropped")
+		return
+	}
+	if s.renumberedSource(srcClient, header.Src.Addr, now) {
+		s.dropPacket(addr, packet, drop.Spoofed, "sent from the client's address before it was renumbered; dropped")
+		return
+	}
+	srcNode := srcClient.node
+	switch {
+	case header.Src.Addr == srcClient.node.Address():
+	case srcClient.satellite:
+		srcNode, err = s.satelliteMember(srcClient, header.Src.Addr, now)
+		if err == virtual.AddrInUseError {
+			s.raiseAlert(srcClient, AlertDuplicateAddress, now, "satellite player uses address %s, which is already in use", header.Src.Addr)
+		}
+		if err != nil {
+			s.dropPacket(addr, packet, drop.Refused, fmt.Sprintf("satellite player %s: %v; dropped", header.Src.Addr, err))
+			return
+		}
+	default:
+		s.dropPacket(addr, packet, drop.Spoofed, fmt.Sprintf("source address is not the client's address %s; dropped", srcClient.node.Address()))
+		s.raiseAlert(srcClient, AlertSpoof, now, "sent a packet from address %s", header.Src.Addr)
+		return
+	}
+	s.observeSocket(srcClient, header.Src.Socket, now)
+	s.capturePacket(srcClient, packet)
+	srcClient.fingerprint.observePacket(&header, now.Sub(srcClient.lastReceiveTime))
+	srcClient.lastReceiveTime = now
+	isPingReply := isPingReplyAddr(header.Dest)
+	if isPingReply {
+		s.observePingReply(srcClient, &header)
+		srcClient.pingReplied(now)
+	}
+	if isPingReply && srcClient.keepalive != nil {
+		srcClient.keepalive.pingReply()
+	}
+	s.observePathEcho(srcClient, &header, packet, now)
+	if s.config.MTUProbe && s.mtuProbeReply(srcClient, &header) {
+		s.tracePacket(addr, traceIn, packet, "")
 		return
 	}
-	if header.Src.Addr != srcClient.node.Address() {
+	if srcClient.isQuarantined() {
+		s.dropPacket(addr, packet, drop.Quarantined, "client is quarantined; not delivered")
+		if s.config.QuarantineTap != nil {
+			s.config.QuarantineTap.Write(packet)
+		}
 		return
 	}
+	if !isPingReply && !s.allowPacket(srcClient, &header, now) {
+		s.dropPacket(addr, packet, drop.RateLimited, fmt.Sprintf("%s tier rate limit exceeded; dropped", srcClient.tier))
+		return
+	}
+	if !isPingReply && s.config.SessionLockDelay != 0 && !s.observeSession(srcClient.room, &header, now) {
+		s.dropPacket(addr, packet, drop.SessionLocked, "broadcast into a locked game session; dropped")
+		return
+	}
+	if !isPingReply {
+		s.roomTraffic[srcClient.room] = now
+		if game := annotate.SocketName(header.Dest.Socket); game != "" {
+			s.roomGames[srcClient.room] = game
+		}
+	}
 	// Deliver packet to the network.
-	srcClient.lastReceiveTime = time.Now()
-	srcClient.node.Write(packet)
+	if _, err := srcNode.Write(packet); err != nil {
+		srcClient.recordError(errorNetwork, err)
+		s.dropPacket(addr, packet, drop.WriteError, err.Error())
+	} else {
+		s.tracePacket(addr, traceIn, packet, "")
+	}
 }
 
 // sendPing transmits a ping packet to the given client. The DOSbox IPX client
 // code recognizes broadcast packets sent to socket=2 and will send a reply to
 // the source address that we provide.
 func (s *Server) sendPing(c *client) {
-	header := &ipx.Header{
-		Dest: ipx.HeaderAddr{
-			Addr:   ipx.AddrBroadcast,
-			Socket: 2,
-		},
-		// We "send" the pings from an imaginary "ping reply" address
-		// because if we used ipx.AddrNull the reply would be
-		// indistinguishable from a registration packet.
-		Src: ipx.HeaderAddr{
-			Addr:   addrPingReply,
-			Socket: 0,
-		},
-	}
-
 	c.lastSendTime = time.Now()
+	c.pingSentTime = c.lastSendTime
+	header := pingHeader()
+	header.Src.Addr = s.pingSource(c)
 	encodedHeader, err := header.MarshalBinary()
 	if err == nil {
-		s.socket.WriteToUDP(encodedHeader, c.addr)
+		s.writeToUDP(encodedHeader, c)
 	}
 }
 
+// removeClient removes the given client from the server. The reason is
+// recorded if the client is being traced.
+func (s *Server) removeClient(c *client, reason string) {
+	s.traceEvent(c.addr, TraceEvent{Kind: traceDisconnect, Note: reason})
+	logger.Debugf("client %s (%s): removed: %s", c.addr, c.node.Address(), reason)
+	s.departClient(c)
+	if s.flood != nil {
+		s.flood.removed(c.addr.IP.String())
+	}
+	delete(s.clients, c.addr.String())
+	atomic.AddInt64(&s.numClients, -1)
+	s.endCapture(c)
+	c.node.Close()
+	s.expireSatelliteMembers(c, time.Now(), true)
+}
+
 // checkClientTimeouts checks all clients that are connected to the server and
 // handles idle clients to which we have no sent data or from which we have not
 // received data recently. This function should be called regularly; it returns
 // the time that it should next be invoked.
 func (s *Server) checkClientTimeouts() time.Time {
-	now := time.Now()
+	now := s.now()
 
 	// At absolute max we should check again in 10 seconds, as a new client
 	// might connect in the mean time.
 	nextCheckTime := now.Add(10 * time.Second)
 
 	for _, c := range s.clients {
+		if c.keepalive != nil {
+			c.keepalive.check(c.lastReceiveTime, now)
+		}
+
 		// Nothing sent in a while? Send a keepalive.
 		// This is important because some types of game use a
 		// client/server type arrangement where the server does not
@@ -209,64 +1031,426 @@ func (s *Server) checkClientTimeouts() time.Time {
 		// An example is Warcraft 2. If there is no activity between
 		// the client and server in a long time, some NAT gateways or
 		// firewalls can drop the association.
-		keepaliveTime := c.lastSendTime.Add(s.config.KeepaliveTime)
+		keepaliveTime := s.nextKeepalive(c, now)
 		if now.After(keepaliveTime) {
 			// We send a keepalive in the form of a ping packet
 			// that the client should respond to, thus keeping us
 			// from timing out the client from our own table if it
 			// really is still there.
+			gap := idleTime(c, now)
 			s.sendPing(c)
-			keepaliveTime = c.lastSendTime.Add(s.config.KeepaliveTime)
+			if c.keepalive != nil {
+				c.keepalive.pingSent(gap, now)
+			}
+			keepaliveTime = s.nextKeepalive(c, now)
+		}
+		if s.config.MTUProbe && !s.roomIdle(c.room, now) {
+			s.probeMTU(c, now)
 		}
 
 		// Nothing received in a long time? Time out the connection.
 		timeoutTime := c.lastReceiveTime.Add(s.config.ClientTimeout)
+		if timeoutTime.Before(s.graceUntil) {
+			timeoutTime = s.graceUntil
+		}
 		if now.After(timeoutTime) {
-			delete(s.clients, c.addr.String())
-			c.node.Close()
+			s.rememberTimedOut(c, now)
+			s.removeClient(c, fmt.Sprintf("timed out; nothing received for %v", now.Sub(c.lastReceiveTime).Round(time.Second)))
+			continue
+		}
+
+		if s.quota != nil && !s.tierLimits(c.tier).Exempt && s.chargeQuota(c, now) {
+			s.removeClient(c, "daily limit reached")
+			continue
+		}
+		if s.config.Bans != nil && s.checkBanned(c) {
+			continue
 		}
+		s.expireSatelliteMembers(c, now, false)
 
 		if keepaliveTime.Before(nextCheckTime) {
 			nextCheckTime = keepaliveTime
 		}
+		if c.keepalive != nil && c.keepalive.pending != 0 {
+			replyTime := c.keepalive.pendingSent.Add(pingReplyTimeout)
+			if replyTime.Before(nextCheckTime) {
+				nextCheckTime = replyTime
+			}
+		}
 		if timeoutTime.Before(nextCheckTime) {
 			nextCheckTime = timeoutTime
 		}
 	}
 
+	s.expireSessions(now)
+	s.expireEphemeralRooms(now)
+	if len(s.config.DialAddrs) > 0 {
+		if dialTime := s.dialClients(now); dialTime.Before(nextCheckTime) {
+			nextCheckTime = dialTime
+		}
+	}
+
 	return nextCheckTime
 }
 
-// poll listens for new packets, blocking until one is received, or until
-// a timeout is reached.
-func (s *Server) poll() error {
+// checkKernelDrops checks whether the kernel has dropped any inbound packets
+// for the server's socket since the last check, and logs a warning if it has.
+func (s *Server) checkKernelDrops() {
+	var drops uint64
+	for _, socket := range s.sockets {
+		socketDrops, err := socketDrops(socket)
+		if err != nil {
+			return
+		}
+		drops += socketDrops
+	}
+	drops += s.kernelDropsBase
+	last := atomic.SwapUint64(&s.kernelDrops, drops)
+	if drops > last {
+		logger.Printf("kernel dropped %d inbound packets in the last %v; "+
+			"consider increasing the socket receive buffer size",
+			drops-last, dropCheckInterval)
+	}
+}
+
+// poll listens for new packets on the given socket, blocking until one is
+// received, or until a timeout is reached or the context is cancelled.
+func (s *Server) poll(ctx context.Context, socket *net.UDPConn) error {
 	var buf [1500]byte
+	// Large enough for an IP_PKTINFO control message.
+	var oob [64]byte
 
-	s.socket.SetReadDeadline(s.timeoutCheckTime)
-	packetLen, addr, err := s.socket.ReadFromUDP(buf[:])
+	atomic.StoreInt64(&s.lastPollTime, monotonicNow())
+	s.mu.Lock()
+	deadline := s.timeoutCheckTime
+	s.mu.Unlock()
+	socket.SetReadDeadline(deadline)
+	// Run() interrupts a blocked read when the context is cancelled by
+	// setting a deadline in the past. We only check the context after
+	// setting our own deadline, so that we cannot overwrite that.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var packetLen int
+	var addr *net.UDPAddr
+	var local net.IP
+	var err error
+	if s.config.PreserveLocalAddr {
+		var oobLen int
+		packetLen, oobLen, _, addr, err = socket.ReadMsgUDP(buf[:], oob[:])
+		local = parsePktinfo(oob[:oobLen])
+	} else {
+		packetLen, addr, err = socket.ReadFromUDP(buf[:])
+	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if err == nil {
-		s.processPacket(buf[0:packetLen], addr)
+		if s.crashRing != nil {
+			s.crashRing.Add(addr, buf[0:packetLen])
+		}
+		s.socketPackets[socket]++
+		s.processPacket(socket, s.corrupt(buf[0:packetLen]), addr, local)
 	} else if nerr, ok := err.(net.Error); ok && !nerr.Timeout() {
 		return err
 	}
 
 	// We must regularly call checkClientTimeouts(); when we do, update
 	// server.timeoutCheckTime with the next time it should be invoked.
-	if time.Now().After(s.timeoutCheckTime) {
+	if now := s.now(); now.After(s.timeoutCheckTime) {
+		s.checkResume(now)
 		s.timeoutCheckTime = s.checkClientTimeouts()
+		if s.tarpit != nil {
+			s.tarpit.expire(time.Now())
+			atomic.StoreInt64(&s.numScanSources, int64(len(s.tarpit.sources)))
+		}
+	}
+	if time.Now().After(s.dropCheckTime) {
+		s.checkKernelDrops()
+		s.dropCheckTime = time.Now().Add(dropCheckInterval)
 	}
 
 	return nil
 }
 
-// Run runs the server, blocking until the socket is closed or an error occurs.
-func (s *Server) Run() {
+// runSocket runs the main loop for the given socket until an error occurs.
+func (s *Server) runSocket(ctx context.Context, socket *net.UDPConn) error {
+	if s.crashRing != nil {
+		defer s.crashRing.HandlePanic(s.config.CrashDumpDir)
+	}
 	for {
-		if err := s.poll(); err != nil {
-			return
+		if err := s.poll(ctx, socket); err != nil {
+			return err
+		}
+	}
+}
+
+// Run runs the server, blocking until the socket is closed, an error occurs,
+// or the given context is cancelled. The error that caused the server to
+// stop is returned; it is not closed if the context is cancelled, so it can
+// be run again.
+func (s *Server) Run(ctx context.Context) error {
+	// If the loop for one socket fails, the others are stopped too.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		for _, socket := range s.sockets {
+			socket.SetReadDeadline(time.Now())
 		}
+	}()
+	errs := make(chan error, len(s.sockets))
+	for _, socket := range s.sockets {
+		go func(socket *net.UDPConn) {
+			errs <- s.runSocket(ctx, socket)
+		}(socket)
 	}
+	// The first error is the one that caused the server to stop; the
+	// rest are just the other loops stopping in response.
+	err := <-errs
+	cancel()
+	for range s.sockets[1:] {
+		<-errs
+	}
+	return err
+}
+
+// Stats returns a snapshot of the server's counters. It does not block, even
+// if the main loop is stuck.
+func (s *Server) Stats() Stats {
+	var flood bool
+	if s.flood != nil {
+		flood = s.flood.flooding(time.Now())
+	}
+	return Stats{
+		Clients:      int(atomic.LoadInt64(&s.numClients)),
+		WriteErrors:  atomic.LoadUint64(&s.writeErrors),
+		DecodeErrors: atomic.LoadUint64(&s.decodeErrors),
+		KernelDrops:  atomic.LoadUint64(&s.kernelDrops),
+		ScanSources:  int(atomic.LoadInt64(&s.numScanSources)),
+		ScanPackets:  atomic.LoadUint64(&s.scanPackets),
+
+		RegistrationClosed:   atomic.LoadInt32(&s.registrationClosed) != 0,
+		RefusedRegistrations: atomic.LoadUint64(&s.refusedRegs),
+		Flood:                flood,
+		Drops:                s.drops.Counts(),
+	}
+}
+
+// ClientStats returns statistics about every connected client.
+func (s *Server) ClientStats() []ClientStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []ClientStats{}
+	now := time.Now()
+	for _, c := range s.clients {
+		var keepalive string
+		if c.keepalive != nil {
+			keepalive = c.keepalive.interval().String()
+		}
+		result = append(result, ClientStats{
+			Addr:        c.addr.String(),
+			IPXAddr:     c.node.Address().String(),
+			Errors:      c.errorCounts(),
+			Flavor:      c.flavor,
+			Fingerprint: c.fingerprint.key(c.flavor),
+			Room:        c.room,
+			Quarantined: c.isQuarantined(),
+
+			RTTMS:            float64(c.rtt) / float64(time.Millisecond),
+			LegacyPing:       c.legacyPing,
+			ProtocolVersion:  c.protocolVersion,
+			Capabilities:     c.capabilities(),
+			SatellitePlayers: len(c.members),
+
+			Tier:        c.tier,
+			RateLimited: c.rateLimit.dropped,
+
+			MaxPacketSize:     c.mtu.largest,
+			KeepaliveInterval: keepalive,
+			RoomIdle:          s.roomIdle(c.room, now),
+
+			ConnectTime:     c.connectTime,
+			LastReceiveTime: c.lastReceiveTime,
+		})
+	}
+	return result
+}
+
+// SetQuarantined quarantines or releases the client with the given IPX
+// address. A quarantined client stays connected, but packets it sends are
+// not delivered to the network and it does not receive any packets from the
+// network. UnknownClientError is returned if there is no such client.
+func (s *Server) SetQuarantined(addr ipx.Addr, quarantined bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.clients {
+		if c.node.Address() != addr {
+			continue
+		}
+		var value int32
+		if quarantined {
+			value = 1
+		}
+		if atomic.SwapInt32(&c.quarantined, value) != value {
+			logger.Printf("client %s (%s): quarantined=%v", c.addr, addr, quarantined)
+		}
+		return nil
+	}
+	return UnknownClientError
+}
+
+// Disconnect disconnects the client with the given IPX address, as though it
+// had timed out. The client is free to reconnect, in which case it will be
+// assigned a new address. UnknownClientError is returned if there is no
+// such client.
+func (s *Server) Disconnect(addr ipx.Addr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.clients {
+		if c.node.Address() != addr {
+			continue
+		}
+		logger.Printf("client %s (%s): disconnected", c.addr, addr)
+		s.removeClient(c, "disconnected by the server")
+		return nil
+	}
+	return UnknownClientError
+}
+
+// checkBanned disconnects the given client if it is banned, returning true
+// if it was.
+func (s *Server) checkBanned(c *client) bool {
+	reason, banned := s.config.Bans.Banned(c.addr.IP, c.node.Address(), c.fingerprint.key(c.flavor))
+	if !banned {
+		return false
+	}
+	logger.Printf("client %s (%s): banned: %s", c.addr, c.node.Address(), reason)
+	s.removeClient(c, "banned: "+reason)
+	return true
+}
+
+// EnforceBans disconnects all connected clients that are banned. Connected
+// clients are checked regularly anyway, but this can be called after adding
+// a ban so that it takes effect immediately.
+func (s *Server) EnforceBans() {
+	if s.config.Bans == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.clients {
+		s.checkBanned(c)
+	}
+}
+
+// SetRegistrationClosed sets whether new clients are accepted. While
+// registration is closed, connected clients are unaffected but registration
+// packets from new clients are ignored.
+func (s *Server) SetRegistrationClosed(closed bool) {
+	var value int32
+	if closed {
+		value = 1
+	}
+	if atomic.SwapInt32(&s.registrationClosed, value) != value {
+		logger.Printf("registration closed=%v", closed)
+	}
+}
+
+// AddRoom adds a room that clients can be moved into. A room is a separate
+// network; clients in different rooms cannot communicate. New clients always
+// join DefaultRoom, which is the network passed to New.
+func (s *Server) AddRoom(name string, n network.Network) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rooms[name] = n
+}
+
+// Rooms returns the names of all rooms.
+func (s *Server) Rooms() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []string{}
+	for name := range s.rooms {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// MoveClient moves the client with the given IPX address into the given
+// room. The client keeps the same address, since the DOSBox protocol has no
+// way to tell a client that its address has changed, so the room's network
+// must implement network.AddrNetwork. UnknownClientError or UnknownRoomError
+// is returned if there is no such client or room, RoomNotAllowedError if
+// the client's trust tier does not allow it into the room, and RoomFullError
+// if the room already has RoomSettings.MaxPlayers clients.
+func (s *Server) MoveClient(addr ipx.Addr, room string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.clientByAddr(addr)
+	if c == nil {
+		if _, ok := s.rooms[room]; !ok {
+			return UnknownRoomError
+		}
+		return UnknownClientError
+	}
+	return s.moveClient(c, room)
+}
+
+// moveClient moves the given client into the given room. The caller must
+// hold the server's mutex.
+func (s *Server) moveClient(c *client, room string) error {
+	n, ok := s.rooms[room]
+	if !ok {
+		return UnknownRoomError
+	}
+	if c.room == room {
+		return nil
+	}
+	if !s.roomAllowed(c.tier, room) {
+		return RoomNotAllowedError
+	}
+	if s.roomFull(room) {
+		return RoomFullError
+	}
+	an, ok := n.(network.AddrNetwork)
+	if !ok {
+		return fmt.Errorf("room %q does not support moving clients", room)
+	}
+	addr := c.node.Address()
+	node, err := an.NewNodeWithAddr(addr)
+	renumbered := false
+	if err == virtual.AddrInUseError && c.protocolVersion > 0 {
+		// An extended client can be given another address.
+		node, err, renumbered = an.NewNode(), nil, true
+	}
+	if err != nil {
+		return fmt.Errorf("room %q: %v", room, err)
+	}
+	logger.Printf("client %s (%s): moved from room %q to %q", c.addr, addr, c.room, room)
+	// Players behind a satellite rejoin the new room when they next
+	// send something.
+	s.expireSatelliteMembers(c, time.Now(), true)
+	c.room = room
+	if renumbered {
+		s.renumber(c, node)
+		return nil
+	}
+	c.node.Close()
+	c.node = node
+	go s.runClient(c, node)
+	return nil
+}
+
+// CheckPollLoop returns an error if the server's main loop appears to have
+// become stuck. It can be used as a health check.
+func (s *Server) CheckPollLoop() error {
+	last := atomic.LoadInt64(&s.lastPollTime)
+	if since := time.Duration(monotonicNow() - last); since > maxPollInterval {
+		return fmt.Errorf("main loop has not run for %v", since)
+	}
+	return nil
 }
 
 // Close closes the socket associated with the server to shut it down.
@@ -276,5 +1460,8 @@ func (s *Server) Close() error {
 	for _, client := range s.clients {
 		client.node.Close()
 	}
+	for _, socket := range s.sockets[1:] {
+		socket.Close()
+	}
 	return s.socket.Close()
 }
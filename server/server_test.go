@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/validate"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+// newTestServer creates a server listening on a loopback port chosen by the
+// OS, with the given changes made to a copy of the default config.
+func newTestServer(t testing.TB, configure func(*Config)) *Server {
+	cfg := *DefaultConfig
+	if configure != nil {
+		configure(&cfg)
+	}
+	s, err := New("127.0.0.1:0", virtual.New(), &cfg)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// runServer runs the server in the background, returning a channel that
+// receives the error that Run returned.
+func runServer(s *Server, ctx context.Context) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- s.Run(ctx)
+	}()
+	return result
+}
+
+func TestRunStopsWhenAnySocketFails(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		s := newTestServer(t, func(cfg *Config) {
+			cfg.Sockets = 3
+		})
+		done := runServer(s, context.Background())
+		// Give the loops time to start blocking in their reads.
+		time.Sleep(50 * time.Millisecond)
+		s.sockets[i].Close()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("socket %d: Run returned nil after socket was closed", i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("socket %d: Run did not return after socket was closed", i)
+		}
+	}
+}
+
+func TestRunStopsOnCancel(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Sockets = 2
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := runServer(s, ctx)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Run returned %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after context was cancelled")
+	}
+}
+
+// testClient is a UDP client of a server under test.
+type testClient struct {
+	t    testing.TB
+	conn *net.UDPConn
+
+	// Address assigned by the server when the client registered.
+	addr ipx.Addr
+}
+
+func newTestClient(t testing.TB, s *Server) *testClient {
+	conn, err := net.DialUDP("udp4", nil, s.socket.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn}
+}
+
+// register sends a registration packet, which is extended if opts is
+// non-nil, and returns the reply.
+func (c *testClient) register(opts []byte) []byte {
+	packet := registrationPacket(c.t, opts)
+	if opts == nil {
+		packet = packet[:30]
+	}
+	if _, err := c.conn.Write(packet); err != nil {
+		c.t.Fatalf("failed to send registration: %v", err)
+	}
+	reply, ok := c.read(2 * time.Second)
+	if !ok {
+		c.t.Fatalf("no reply to registration")
+	}
+	var hdr ipx.Header
+	if err := hdr.UnmarshalBinary(reply); err != nil {
+		c.t.Fatalf("failed to decode registration reply: %v", err)
+	}
+	c.addr = hdr.Dest.Addr
+	return reply
+}
+
+// send sends a packet with the given payload from the client's address to
+// the given destination.
+func (c *testClient) send(dest ipx.Addr, socket uint16, payload []byte) {
+	hdr := &ipx.Header{
+		Checksum: 0xffff,
+		Length:   uint16(30 + len(payload)),
+		Dest:     ipx.HeaderAddr{Addr: dest, Socket: socket},
+		Src:      ipx.HeaderAddr{Addr: c.addr, Socket: socket},
+	}
+	packet, err := hdr.MarshalBinary()
+	if err != nil {
+		c.t.Fatalf("failed to encode header: %v", err)
+	}
+	c.conn.Write(append(packet, payload...))
+}
+
+// read waits for a packet from the server.
+func (c *testClient) read(timeout time.Duration) ([]byte, bool) {
+	var buf [1500]byte
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := c.conn.Read(buf[:])
+	if err != nil {
+		return nil, false
+	}
+	return buf[:n], true
+}
+
+// contextForTest returns a context that is cancelled when the test ends.
+func contextForTest(t testing.TB) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// TestInvalidPacketsIgnored checks that a packet that fails validation has
+// no effect on the client that sent it.
+func TestInvalidPacketsIgnored(t *testing.T) {
+	v := validate.New()
+	v.Add("max_length=40", validate.MaxLength(40))
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Validator = v
+	})
+	runServer(s, contextForTest(t))
+	c := newTestClient(t, s)
+	c.register(nil)
+	lastReceive := func() time.Time {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, client := range s.clients {
+			return client.lastReceiveTime
+		}
+		return time.Time{}
+	}
+	before := lastReceive()
+	c.send(addrPingReply, 2, make([]byte, 20))
+	time.Sleep(100 * time.Millisecond)
+	if after := lastReceive(); !after.Equal(before) {
+		t.Errorf("invalid packet changed the client's last receive time")
+	}
+	if stats := v.Stats(); stats[0].Failed != 1 {
+		t.Errorf("%d packets failed validation, want 1", stats[0].Failed)
+	}
+}
+
+// TestReceivesAfterCheck checks that the server still receives packets once
+// it has checked its clients, when it has no endpoints to dial.
+func TestReceivesAfterCheck(t *testing.T) {
+	s := newTestServer(t, nil)
+	// Check as soon as the server starts, rather than 10s later.
+	s.timeoutCheckTime = time.Now()
+	runServer(s, contextForTest(t))
+	time.Sleep(100 * time.Millisecond)
+	newTestClient(t, s).register(nil)
+}
+
+// TestNetworkErrorsCounted checks that packets the network rejects are
+// counted as network errors for the client that sent them.
+func TestNetworkErrorsCounted(t *testing.T) {
+	s := newTestServer(t, nil)
+	runServer(s, contextForTest(t))
+	c := newTestClient(t, s)
+	c.register(nil)
+	c.send(ipx.Addr{0x02, 0x12, 0x34, 0x56, 0x78, 0x9a}, 0x4000, nil)
+	time.Sleep(100 * time.Millisecond)
+	stats := s.ClientStats()
+	if len(stats) != 1 {
+		t.Fatalf("%d clients, want 1", len(stats))
+	}
+	if n := stats[0].Errors["network"]; n != 1 {
+		t.Errorf("%d network errors, want 1", n)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/fragglet/ipxbox/annotate"
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// A game session ends once nothing has been sent to its socket for this
+// long.
+const sessionIdleTime = time.Minute
+
+// UnknownSessionError is returned if there is no game session on a socket.
+var UnknownSessionError = errors.New("no game session on that socket")
+
+// sessionKey identifies a game session: the traffic to a socket in a room.
+type sessionKey struct {
+	room   string
+	socket uint16
+}
+
+// session tracks a game session. It is only accessed while holding the
+// server's mutex.
+type session struct {
+	started      time.Time
+	lastActivity time.Time
+	members      map[ipx.Addr]bool
+
+	// Once a session is locked, broadcasts to its socket from nodes
+	// that are not members are dropped. If overridden, an admin has
+	// unlocked the session and it is not locked again automatically.
+	locked     bool
+	overridden bool
+}
+
+// SessionInfo describes a game session.
+type SessionInfo struct {
+	Room   string `json:"room"`
+	Socket string `json:"socket"`
+
+	// Name of the game that uses the socket, if it is well known.
+	Game string `json:"game,omitempty"`
+
+	Started time.Time `json:"started"`
+	Members []string  `json:"members"`
+	Locked  bool      `json:"locked"`
+}
+
+// observeSession records a packet sent by the given node in the given room,
+// returning false if it should be dropped because it is a broadcast into a
+// locked session that the node is not a member of.
+func (s *Server) observeSession(room string, header *ipx.Header, now time.Time) bool {
+	if header.Dest.Socket == 2 {
+		return true
+	}
+	key := sessionKey{room, header.Dest.Socket}
+	sess, ok := s.sessions[key]
+	if !ok || now.Sub(sess.lastActivity) >= sessionIdleTime {
+		sess = &session{started: now, members: map[ipx.Addr]bool{}}
+		s.sessions[key] = sess
+	}
+	src := header.Src.Addr
+	if sess.locked && !sess.members[src] {
+		if header.IsBroadcast() {
+			return false
+		}
+		// Unicast packets are still delivered; only members can
+		// be talking to the session's nodes directly.
+		return true
+	}
+	sess.lastActivity = now
+	sess.members[src] = true
+	if !sess.locked && !sess.overridden && len(sess.members) >= 2 && now.Sub(sess.started) >= s.config.SessionLockDelay {
+		sess.locked = true
+		logger.Printf("room %q: locked game session on socket %s with %d members", room, ipx.Socket(key.socket), len(sess.members))
+	}
+	return true
+}
+
+// expireSessions forgets game sessions that have ended.
+func (s *Server) expireSessions(now time.Time) {
+	for key, sess := range s.sessions {
+		if now.Sub(sess.lastActivity) >= sessionIdleTime {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// Sessions returns the game sessions that are in progress.
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	result := []SessionInfo{}
+	for key, sess := range s.sessions {
+		if now.Sub(sess.lastActivity) >= sessionIdleTime {
+			continue
+		}
+		info := SessionInfo{
+			Room:    key.room,
+			Socket:  ipx.Socket(key.socket).String(),
+			Game:    annotate.SocketName(key.socket),
+			Started: sess.started,
+			Members: []string{},
+			Locked:  sess.locked,
+		}
+		for addr := range sess.members {
+			info.Members = append(info.Members, addr.String())
+		}
+		sort.Strings(info.Members)
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Room != result[j].Room {
+			return result[i].Room < result[j].Room
+		}
+		return result[i].Socket < result[j].Socket
+	})
+	return result
+}
+
+// SetSessionLocked locks or unlocks the game session on the given socket in
+// the given room. A session that is unlocked this way is not locked again
+// automatically. UnknownSessionError is returned if there is no session.
+func (s *Server) SetSessionLocked(room string, socket uint16, locked bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[sessionKey{room, socket}]
+	if !ok || time.Since(sess.lastActivity) >= sessionIdleTime {
+		return UnknownSessionError
+	}
+	if sess.locked != locked {
+		logger.Printf("room %q: game session on socket %s locked=%v", room, ipx.Socket(socket), locked)
+	}
+	sess.locked = locked
+	sess.overridden = !locked
+	return nil
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/selftest"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+// TestStress connects and disconnects many clients while they broadcast,
+// and while the client table is read and changed through the API used by
+// the admin server, as well as by timeouts. It is most useful when run with
+// the race detector (go test -race).
+func TestStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping stress test in short mode")
+	}
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.ClientTimeout = 500 * time.Millisecond
+		cfg.KeepaliveTime = 100 * time.Millisecond
+	})
+	s.AddRoom("other", virtual.New())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := runServer(s, ctx)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r := rand.New(rand.NewSource(1))
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			s.Stats()
+			s.Placements()
+			s.Capabilities()
+			clients := s.ClientStats()
+			if len(clients) == 0 {
+				continue
+			}
+			addr, err := ipx.ParseAddr(clients[r.Intn(len(clients))].IPXAddr)
+			if err != nil {
+				t.Errorf("client stats gave invalid address: %v", err)
+				return
+			}
+			switch r.Intn(3) {
+			case 0:
+				s.MoveClient(addr, "other")
+			case 1:
+				s.MoveClient(addr, DefaultRoom)
+			case 2:
+				s.Disconnect(addr)
+			}
+		}
+	}()
+
+	result := selftest.Stress(s.socket.LocalAddr().String(), 16, 2*time.Second)
+	close(stop)
+	wg.Wait()
+
+	select {
+	case err := <-done:
+		t.Fatalf("server stopped during stress test: %v", err)
+	default:
+	}
+	if result.Registrations == 0 || result.Sent == 0 {
+		t.Errorf("stress test did nothing: %+v", result)
+	}
+	checkClientTable(t, s)
+	cancel()
+	<-done
+}
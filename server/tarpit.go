@@ -0,0 +1,122 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Sources that have sent nothing for this long are removed from the tarpit.
+const tarpitSourceTimeout = 10 * time.Minute
+
+// tarpitReply is the payload sent back to scan sources. It is too short to
+// be mistaken for an IPX packet.
+var tarpitReply = []byte{0}
+
+// ScanSource describes a host that has sent traffic to the server that was
+// not part of the DOSBox IPX protocol.
+type ScanSource struct {
+	Addr      string    `json:"addr"`
+	Packets   uint64    `json:"packets"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// scanSource is an entry in the tarpit's table of scan sources.
+type scanSource struct {
+	ScanSource
+	nextReplyTime time.Time
+}
+
+// tarpit tracks hosts that send non-protocol traffic, and sends them slow,
+// minimal replies. It is only accessed while holding the server's mutex.
+type tarpit struct {
+	delay      time.Duration
+	maxSources int
+	sources    map[string]*scanSource
+}
+
+func newTarpit(delay time.Duration, maxSources int) *tarpit {
+	return &tarpit{
+		delay:      delay,
+		maxSources: maxSources,
+		sources:    map[string]*scanSource{},
+	}
+}
+
+// lookup returns the table entry for the given address, creating one if
+// necessary. If the table is full, the least recently seen source is evicted
+// to make room.
+func (t *tarpit) lookup(addr *net.UDPAddr, now time.Time) *scanSource {
+	// Scanners typically vary their source port, so sources are
+	// tracked by IP address only.
+	key := addr.IP.String()
+	if src, ok := t.sources[key]; ok {
+		return src
+	}
+	if len(t.sources) >= t.maxSources {
+		var oldest *scanSource
+		for _, src := range t.sources {
+			if oldest == nil || src.LastSeen.Before(oldest.LastSeen) {
+				oldest = src
+			}
+		}
+		delete(t.sources, oldest.Addr)
+	}
+	src := &scanSource{
+		ScanSource: ScanSource{
+			Addr:      key,
+			FirstSeen: now,
+		},
+	}
+	t.sources[key] = src
+	return src
+}
+
+// expire removes sources that have not been seen recently.
+func (t *tarpit) expire(now time.Time) {
+	for key, src := range t.sources {
+		if now.Sub(src.LastSeen) > tarpitSourceTimeout {
+			delete(t.sources, key)
+		}
+	}
+}
+
+// tarpitPacket records a packet from a host that is not speaking the DOSBox
+// IPX protocol and schedules a delayed reply to it. At most one reply is sent
+// to each source per tarpit delay, so a flood of probes cannot be used to
+// make the server generate a flood of replies.
+func (s *Server) tarpitPacket(addr *net.UDPAddr) {
+	atomic.AddUint64(&s.scanPackets, 1)
+	now := time.Now()
+	src := s.tarpit.lookup(addr, now)
+	src.Packets++
+	src.LastSeen = now
+	atomic.StoreInt64(&s.numScanSources, int64(len(s.tarpit.sources)))
+	if now.Before(src.nextReplyTime) {
+		return
+	}
+	src.nextReplyTime = now.Add(s.tarpit.delay)
+	time.AfterFunc(s.tarpit.delay, func() {
+		s.socket.WriteToUDP(tarpitReply, addr)
+	})
+}
+
+// ScanSources returns the hosts that are currently being tarpitted, most
+// recently seen first. It returns nil if the tarpit is not enabled.
+func (s *Server) ScanSources() []ScanSource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tarpit == nil {
+		return nil
+	}
+	result := []ScanSource{}
+	for _, src := range s.tarpit.sources {
+		result = append(result, src.ScanSource)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastSeen.After(result[j].LastSeen)
+	})
+	return result
+}
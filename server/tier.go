@@ -0,0 +1,185 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// Trust tiers that clients can be assigned to. Clients are in TierNormal
+// unless they are assigned another tier, by IP range or through SetTier.
+const (
+	TierTrusted    = "trusted"
+	TierNormal     = "normal"
+	TierRestricted = "restricted"
+)
+
+// RoomNotAllowedError is returned by MoveClient if the client's tier does not
+// allow it into the room.
+var RoomNotAllowedError = errors.New("client's trust tier does not allow it into the room")
+
+// TierLimits contains the limits that apply to clients in a trust tier.
+type TierLimits struct {
+	// If non-zero, the maximum number of packets that a client may send
+	// each second, and of those, the maximum number of broadcasts.
+	// Excess packets are dropped.
+	PacketRate    int
+	BroadcastRate int
+
+	// If non-empty, clients may only be moved into these rooms, as well
+	// as DefaultRoom, which every client joins when it connects.
+	Rooms []string
+
+	// If true, clients are exempt from DailyQuota and from the limits
+	// that apply during a registration flood.
+	Exempt bool
+}
+
+// TierRange assigns clients connecting from a range of IP addresses to a
+// trust tier.
+type TierRange struct {
+	Net  *net.IPNet
+	Tier string
+}
+
+// rateLimit counts the packets sent by a client in the current one second
+// window. It is only accessed while holding the server's mutex.
+type rateLimit struct {
+	windowStart time.Time
+	packets     int
+	broadcasts  int
+	dropped     uint64
+}
+
+// validTier returns true if the given name is a trust tier.
+func validTier(tier string) bool {
+	return tier == TierTrusted || tier == TierNormal || tier == TierRestricted
+}
+
+// tierFor returns the trust tier for clients from the given IP address.
+func (s *Server) tierFor(ip net.IP) string {
+	if tier, ok := s.tiers[ip.String()]; ok {
+		return tier
+	}
+	for _, r := range s.config.TierRanges {
+		if r.Net.Contains(ip) {
+			return r.Tier
+		}
+	}
+	return TierNormal
+}
+
+// tierLimits returns the limits for the given tier, which are empty if the
+// tier has none configured.
+func (s *Server) tierLimits(tier string) TierLimits {
+	if limits, ok := s.config.Tiers[tier]; ok {
+		return limits
+	}
+	return TierLimits{}
+}
+
+// exempt returns true if clients from the given IP address are exempt from
+// DailyQuota and flood limits.
+func (s *Server) exempt(ip net.IP) bool {
+	return s.tierLimits(s.tierFor(ip)).Exempt
+}
+
+// allowPacket checks whether a packet sent by the given client is within its
+// tier's rate limits, counting it if so.
+func (s *Server) allowPacket(c *client, header *ipx.Header, now time.Time) bool {
+	limits := s.tierLimits(c.tier)
+	if limits.PacketRate == 0 && limits.BroadcastRate == 0 {
+		return true
+	}
+	rl := &c.rateLimit
+	if now.Sub(rl.windowStart) >= time.Second {
+		rl.windowStart, rl.packets, rl.broadcasts = now, 0, 0
+	}
+	broadcast := header.IsBroadcast()
+	switch {
+	case limits.PacketRate != 0 && rl.packets >= limits.PacketRate:
+	case limits.BroadcastRate != 0 && broadcast && rl.broadcasts >= limits.BroadcastRate:
+	default:
+		rl.packets++
+		if broadcast {
+			rl.broadcasts++
+		}
+		return true
+	}
+	rl.dropped++
+	return false
+}
+
+// roomAllowed returns true if clients in the given tier may be moved into
+// the given room.
+func (s *Server) roomAllowed(tier, room string) bool {
+	rooms := s.tierLimits(tier).Rooms
+	if len(rooms) == 0 || room == DefaultRoom {
+		return true
+	}
+	for _, r := range rooms {
+		if r == room {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTier assigns clients from the given IP address to the given trust tier,
+// including any that are already connected. This overrides any TierRanges
+// that the address is in. If tier is empty, the assignment is removed.
+func (s *Server) SetTier(ip string, tier string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid IP address %q", ip)
+	}
+	if tier != "" && !validTier(tier) {
+		return fmt.Errorf("invalid trust tier %q; valid tiers are trusted, normal and restricted", tier)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tier == "" {
+		delete(s.tiers, parsed.String())
+	} else {
+		s.tiers[parsed.String()] = tier
+	}
+	for _, c := range s.clients {
+		if c.addr.IP.Equal(parsed) {
+			c.tier = s.tierFor(parsed)
+			logger.Printf("client %s (%s): trust tier=%s", c.addr, c.node.Address(), c.tier)
+		}
+	}
+	return nil
+}
+
+// Tiers returns the trust tiers assigned to IP addresses through SetTier.
+func (s *Server) Tiers() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := map[string]string{}
+	for ip, tier := range s.tiers {
+		result[ip] = tier
+	}
+	return result
+}
+
+// ParseTierRanges parses a comma-separated list of IP ranges in CIDR
+// notation, assigning them all to the given tier.
+func ParseTierRanges(tier, s string) ([]TierRange, error) {
+	if !validTier(tier) {
+		return nil, fmt.Errorf("invalid trust tier %q", tier)
+	}
+	var result []TierRange
+	for _, str := range strings.Split(s, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(str))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, TierRange{Net: n, Tier: tier})
+	}
+	return result, nil
+}
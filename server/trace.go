@@ -0,0 +1,218 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/fragglet/ipxbox/annotate"
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// Maximum number of events recorded for each trace. Once a trace is full,
+// further events are counted but not recorded; the start of the exchange is
+// usually the interesting part.
+const maxTraceEvents = 500
+
+// Kinds of trace event.
+const (
+	traceRegistration      = "registration"
+	traceRegistrationReply = "registration_reply"
+	tracePing              = "ping"
+	tracePingReply         = "ping_reply"
+	traceMTUProbe          = "mtu_probe"
+	traceMTUProbeReply     = "mtu_probe_reply"
+	traceData              = "data"
+	traceInvalid           = "invalid"
+	traceDisconnect        = "disconnect"
+)
+
+// Directions of trace events.
+const (
+	traceIn  = "in"
+	traceOut = "out"
+)
+
+// TraceEvent is a single step in the message exchange with a traced client.
+type TraceEvent struct {
+	Time time.Time `json:"time"`
+
+	// UDP address of the client.
+	Addr string `json:"addr"`
+
+	// "in" for packets received from the client and "out" for packets
+	// sent to it. Empty for events that are not packets, such as the
+	// client being disconnected.
+	Direction string `json:"direction,omitempty"`
+
+	// Kind of event, eg. "registration", "ping" or "data".
+	Kind string `json:"kind"`
+
+	// Source and destination IPX addresses and sockets, and length of
+	// the packet.
+	Src    string `json:"src,omitempty"`
+	Dest   string `json:"dest,omitempty"`
+	Length int    `json:"length,omitempty"`
+
+	// Name of the well-known socket that the packet was sent to, which
+	// usually identifies the game.
+	Socket string `json:"socket,omitempty"`
+
+	// Explanation of what the server did, eg. why a packet was dropped.
+	Note string `json:"note,omitempty"`
+}
+
+// Trace is the recorded message exchange with the clients connecting from a
+// particular IP address.
+type Trace struct {
+	IP      string       `json:"ip"`
+	Started time.Time    `json:"started"`
+	Events  []TraceEvent `json:"events"`
+
+	// Number of events that were not recorded because the trace was
+	// full.
+	Missed int `json:"missed"`
+}
+
+// UnknownTraceError is returned when there is no trace for an IP address.
+var UnknownTraceError = errors.New("IP address is not being traced")
+
+// StartTrace starts recording the message exchange with clients that connect
+// from the given IP address, including clients that are already connected.
+// If the address is already being traced, the trace is restarted.
+func (s *Server) StartTrace(ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid IP address %q", ip)
+	}
+	s.traceMu.Lock()
+	defer s.traceMu.Unlock()
+	s.traces[parsed.String()] = &Trace{
+		IP:      parsed.String(),
+		Started: time.Now(),
+		Events:  []TraceEvent{},
+	}
+	atomic.StoreInt32(&s.numTraces, int32(len(s.traces)))
+	return nil
+}
+
+// StopTrace stops tracing the given IP address, returning the events that
+// were recorded.
+func (s *Server) StopTrace(ip string) (Trace, error) {
+	s.traceMu.Lock()
+	defer s.traceMu.Unlock()
+	t, ok := s.traces[canonicalIP(ip)]
+	if !ok {
+		return Trace{}, UnknownTraceError
+	}
+	delete(s.traces, t.IP)
+	atomic.StoreInt32(&s.numTraces, int32(len(s.traces)))
+	return *t, nil
+}
+
+// Trace returns the events recorded so far for the given IP address.
+func (s *Server) Trace(ip string) (Trace, error) {
+	s.traceMu.Lock()
+	defer s.traceMu.Unlock()
+	t, ok := s.traces[canonicalIP(ip)]
+	if !ok {
+		return Trace{}, UnknownTraceError
+	}
+	result := *t
+	result.Events = append([]TraceEvent{}, t.Events...)
+	return result, nil
+}
+
+// Traces returns the IP addresses that are being traced.
+func (s *Server) Traces() []string {
+	s.traceMu.Lock()
+	defer s.traceMu.Unlock()
+	result := []string{}
+	for ip := range s.traces {
+		result = append(result, ip)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// canonicalIP returns the given IP address in the form used as a key for
+// traces, or the string unchanged if it is not a valid address.
+func canonicalIP(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// traceEvent records an event if the given address is being traced. It is
+// cheap to call when nothing is being traced.
+func (s *Server) traceEvent(addr *net.UDPAddr, e TraceEvent) {
+	if atomic.LoadInt32(&s.numTraces) == 0 {
+		return
+	}
+	s.traceMu.Lock()
+	defer s.traceMu.Unlock()
+	t, ok := s.traces[addr.IP.String()]
+	if !ok {
+		return
+	}
+	if len(t.Events) >= maxTraceEvents {
+		t.Missed++
+		return
+	}
+	e.Time = time.Now()
+	e.Addr = addr.String()
+	t.Events = append(t.Events, e)
+}
+
+// tracePacket records a packet sent to or received from the given address,
+// if it is being traced.
+func (s *Server) tracePacket(addr *net.UDPAddr, direction string, packet []byte, note string) {
+	if atomic.LoadInt32(&s.numTraces) == 0 {
+		return
+	}
+	e := TraceEvent{
+		Direction: direction,
+		Length:    len(packet),
+		Note:      note,
+	}
+	var hdr ipx.Header
+	if err := hdr.UnmarshalBinary(packet); err != nil {
+		e.Kind = traceInvalid
+		if e.Note == "" {
+			e.Note = err.Error()
+		}
+		s.traceEvent(addr, e)
+		return
+	}
+	e.Kind = traceKind(&hdr, direction)
+	e.Src = fmt.Sprintf("%s/0x%04x", hdr.Src.Addr, hdr.Src.Socket)
+	e.Dest = fmt.Sprintf("%s/0x%04x", hdr.Dest.Addr, hdr.Dest.Socket)
+	e.Socket = annotate.SocketName(hdr.Dest.Socket)
+	s.traceEvent(addr, e)
+}
+
+// traceKind classifies a packet in the DOSBox IPX protocol.
+func traceKind(hdr *ipx.Header, direction string) string {
+	_, srcProbe := mtuProbeSize(hdr.Src.Addr)
+	_, destProbe := mtuProbeSize(hdr.Dest.Addr)
+	switch {
+	case direction == traceIn && hdr.IsRegistrationPacket():
+		return traceRegistration
+	case direction == traceIn && isPingReplyAddr(hdr.Dest):
+		return tracePingReply
+	case direction == traceIn && destProbe && hdr.Dest.Socket == 2:
+		return traceMTUProbeReply
+	case direction == traceOut && srcProbe && hdr.Dest.Socket == 2 && hdr.IsBroadcast():
+		return traceMTUProbe
+	case direction == traceOut && (hdr.Src.Addr == addrPingReply || hdr.Src.Addr == addrLegacyPingReply) && hdr.Dest.Socket == 2 && hdr.IsBroadcast():
+		return tracePing
+	case direction == traceOut && hdr.Src.Addr == ipx.AddrBroadcast && hdr.Src.Socket == 2 && hdr.Dest.Socket == 2:
+		return traceRegistrationReply
+	default:
+		return traceData
+	}
+}
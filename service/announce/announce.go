@@ -0,0 +1,162 @@
+// Package announce implements a service that warns clients of a scheduled
+// event, such as server maintenance. Warnings are broadcast at intervals
+// leading up to the event as IPX packets whose payload is the text of the
+// warning, so that a chat program or TSR on the DOS side can display them.
+//
+// Each warning is a single packet broadcast to the announcement socket. Its
+// payload is the warning as ASCII text, eg. "Maintenance in 10 minutes",
+// with no length prefix or terminator; the length is that of the packet.
+// The server's guest time limit warnings are sent to the same socket, in the
+// same format, but only to the client concerned.
+package announce
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/debuglog"
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/ipxsocket"
+)
+
+var logger = debuglog.New("announce")
+
+// DefaultSocket is the socket number that warnings are sent to by default.
+// Every node on the network receives them, so it is outside the range that
+// IPX drivers allocate sockets from dynamically (see
+// ipxsocket.MinDynamicSocket), where a game could be listening without
+// having chosen to.
+const DefaultSocket = 0x8062
+
+// Warnings are sent this long before the event; the last is sent when the
+// event happens.
+var warningTimes = []time.Duration{
+	time.Hour,
+	30 * time.Minute,
+	10 * time.Minute,
+	5 * time.Minute,
+	time.Minute,
+	0,
+}
+
+// Event is an event that clients are warned about before it happens.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// plural returns a count of the given unit, eg. "2 minutes".
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// warning returns the text of the warning sent the given time before the
+// event happens.
+func (e *Event) warning(before time.Duration) string {
+	before = before.Round(time.Minute)
+	switch {
+	case before <= 0:
+		return e.Message + " now"
+	case before%time.Hour == 0:
+		return fmt.Sprintf("%s in %s", e.Message, plural(int(before/time.Hour), "hour"))
+	default:
+		return fmt.Sprintf("%s in %s", e.Message, plural(int(before/time.Minute), "minute"))
+	}
+}
+
+// Service is an announcement service.
+type Service struct {
+	mux     *ipxsocket.Mux
+	socket  *ipxsocket.Socket
+	dest    uint16
+	event   Event
+	onEvent func()
+
+	mu      sync.Mutex
+	pending bool
+	done    chan struct{}
+	closed  bool
+}
+
+// New creates a new Service which uses the given network node to broadcast
+// warnings of the given event to the given socket number. If non-nil,
+// onEvent is called when the event happens.
+func New(node network.Node, socket uint16, e Event, onEvent func()) (*Service, error) {
+	mux := ipxsocket.New(node)
+	sock, err := mux.OpenSocket(0)
+	if err != nil {
+		mux.Close()
+		return nil, err
+	}
+	return &Service{
+		mux:     mux,
+		socket:  sock,
+		dest:    socket,
+		event:   e,
+		onEvent: onEvent,
+		pending: true,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// broadcast sends the given text to every node on the network.
+func (s *Service) broadcast(text string) {
+	logger.Printf("announcement: %s", text)
+	s.socket.WriteTo(context.Background(), []byte(text), ipx.HeaderAddr{
+		Addr:   ipx.AddrBroadcast,
+		Socket: s.dest,
+	})
+}
+
+// Run sends warnings until the event happens or the service is closed. If
+// Run is called late, warnings that are already due are skipped and replaced
+// by a single warning of how long is left.
+func (s *Service) Run() {
+	remaining := time.Until(s.event.Time)
+	i := 0
+	for i < len(warningTimes) && warningTimes[i] > remaining {
+		i++
+	}
+	if i > 0 && i < len(warningTimes) && remaining-warningTimes[i] >= time.Minute {
+		s.broadcast(s.event.warning(remaining))
+	}
+	for ; i < len(warningTimes); i++ {
+		before := warningTimes[i]
+		select {
+		case <-time.After(time.Until(s.event.Time.Add(-before))):
+		case <-s.done:
+			return
+		}
+		s.broadcast(s.event.warning(before))
+	}
+	s.mu.Lock()
+	s.pending = false
+	s.mu.Unlock()
+	if s.onEvent != nil {
+		s.onEvent()
+	}
+}
+
+// Pending returns the event if it has not happened yet.
+func (s *Service) Pending() (Event, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.event, s.pending
+}
+
+// Close shuts down the service.
+func (s *Service) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		close(s.done)
+		s.closed = true
+	}
+	s.mu.Unlock()
+	return s.mux.Close()
+}
@@ -0,0 +1,42 @@
+package announce
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/network/ipxsocket"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+func TestWarningFormat(t *testing.T) {
+	n := virtual.New()
+	mux := ipxsocket.New(n.NewNode())
+	defer mux.Close()
+	sock, err := mux.OpenSocket(DefaultSocket)
+	if err != nil {
+		t.Fatalf("failed to open socket: %v", err)
+	}
+
+	e := Event{Time: time.Now().Add(100 * time.Millisecond), Message: "Maintenance"}
+	s, err := New(n.NewNode(), DefaultSocket, e, nil)
+	if err != nil {
+		t.Fatalf("failed to start service: %v", err)
+	}
+	defer s.Close()
+	go s.Run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var buf [1500]byte
+	length, hdr, err := sock.ReadFrom(ctx, buf[:])
+	if err != nil {
+		t.Fatalf("no warning received: %v", err)
+	}
+	if got, want := string(buf[:length]), "Maintenance now"; got != want {
+		t.Errorf("warning is %q, want %q", got, want)
+	}
+	if int(hdr.Length) != 30+length {
+		t.Errorf("header length is %d, want %d", hdr.Length, 30+length)
+	}
+}
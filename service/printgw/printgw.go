@@ -0,0 +1,175 @@
+// Package printgw implements a gateway service that accepts print jobs and
+// file transfers over SPX and writes them to a directory on the host, so that
+// machines on the IPX network can "print" to the host.
+//
+// Every SPX connection to the gateway is one job. By default the data sent
+// over the connection is treated as a print job and saved to a file with a
+// generated name. A companion program can instead transfer a named file by
+// starting the stream with a line of the form:
+//
+//	IPXBOXFILE filename.ext\n
+//
+// in which case the remainder of the stream is saved under that name.
+package printgw
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/debuglog"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/ipxsocket"
+	"github.com/fragglet/ipxbox/spx"
+)
+
+var logger = debuglog.New("printgw")
+
+// DefaultSocket is the socket number the gateway listens on by default;
+// this is the socket number used by Novell print servers.
+const DefaultSocket = 0x8060
+
+// Prefix that identifies a file transfer rather than a print job.
+const fileTransferMagic = "IPXBOXFILE "
+
+// Maximum size of a single job. Jobs larger than this are truncated.
+const maxJobSize = 64 * 1024 * 1024
+
+// Maximum number of jobs that can be saved under the same name, with a
+// number added to it.
+const maxDuplicateNames = 1000
+
+// Gateway is a print/file gateway service.
+type Gateway struct {
+	dir      string
+	mux      *ipxsocket.Mux
+	listener *spx.Listener
+
+	mu      sync.Mutex
+	nextJob int
+}
+
+// New creates a new Gateway that listens on the given IPX socket number
+// using the given network node, and writes jobs to the given directory.
+func New(node network.Node, socket uint16, dir string) (*Gateway, error) {
+	mux := ipxsocket.New(node)
+	l, err := spx.Listen(mux, socket)
+	if err != nil {
+		mux.Close()
+		return nil, err
+	}
+	return &Gateway{
+		dir:      dir,
+		mux:      mux,
+		listener: l,
+	}, nil
+}
+
+// jobFilename generates a filename for a print job from the given client.
+func (g *Gateway) jobFilename(c *spx.Conn) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.nextJob++
+	addr := strings.Replace(c.RemoteAddr().Addr.String(), ":", "", -1)
+	return fmt.Sprintf("job-%s-%s-%d.prn", time.Now().Format("20060102-150405"), addr, g.nextJob)
+}
+
+// sanitizeFilename strips any directory components from a filename supplied
+// by a client, so that files can only be written inside the directory.
+func sanitizeFilename(name string) (string, error) {
+	name = filepath.Base(strings.Replace(strings.TrimSpace(name), "\\", "/", -1))
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return "", fmt.Errorf("invalid filename")
+	}
+	return name, nil
+}
+
+// publish gives a received job, written to the temporary file tmp, its
+// final name in the directory, returning the name used. Existing files are
+// never replaced: if the name is taken, a number is added to it. The file is
+// hard linked rather than renamed, since unlike renaming, linking fails if
+// the name is already taken.
+func (g *Gateway) publish(tmp, filename string) (string, error) {
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	name := filename
+	for i := 1; ; i++ {
+		err := os.Link(tmp, filepath.Join(g.dir, name))
+		switch {
+		case err == nil:
+			return name, os.Remove(tmp)
+		case !errors.Is(err, fs.ErrExist) || i > maxDuplicateNames:
+			return "", err
+		}
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
+
+// handleConn receives a single job.
+func (g *Gateway) handleConn(c *spx.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(io.LimitReader(c, maxJobSize))
+
+	filename := g.jobFilename(c)
+	if prefix, err := r.Peek(len(fileTransferMagic)); err == nil && bytes.Equal(prefix, []byte(fileTransferMagic)) {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			logger.Printf("print gateway: %s: bad file transfer header: %v", c.RemoteAddr(), err)
+			return
+		}
+		filename, err = sanitizeFilename(line[len(fileTransferMagic):])
+		if err != nil {
+			logger.Printf("print gateway: %s: %v", c.RemoteAddr(), err)
+			return
+		}
+	}
+
+	// The job is written to a temporary file first so that other programs
+	// watching the directory never see a partially received job.
+	f, err := os.CreateTemp(g.dir, ".incoming-")
+	if err != nil {
+		logger.Printf("print gateway: %v", err)
+		return
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		logger.Printf("print gateway: %s: failed receiving %s: %v", c.RemoteAddr(), filename, err)
+		os.Remove(f.Name())
+		return
+	}
+	filename, err = g.publish(f.Name(), filename)
+	if err != nil {
+		logger.Printf("print gateway: %v", err)
+		os.Remove(f.Name())
+		return
+	}
+	logger.Printf("print gateway: received %s (%d bytes) from %s", filename, n, c.RemoteAddr())
+}
+
+// Run accepts incoming jobs until the gateway is closed.
+func (g *Gateway) Run() {
+	for {
+		c, err := g.listener.Accept()
+		if err != nil {
+			return
+		}
+		go g.handleConn(c)
+	}
+}
+
+// Close shuts down the gateway.
+func (g *Gateway) Close() error {
+	g.listener.Close()
+	return g.mux.Close()
+}
@@ -0,0 +1,39 @@
+package printgw
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPublishKeepsExistingFiles checks that a job sent with the name of an
+// existing file is saved under a new name, rather than replacing it.
+func TestPublishKeepsExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	g := &Gateway{dir: dir}
+	want := []string{"game.sav", "game-1.sav", "game-2.sav"}
+	for i, name := range want {
+		tmp, err := os.CreateTemp(dir, ".incoming-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmp.WriteString(name)
+		tmp.Close()
+		got, err := g.publish(tmp.Name(), "game.sav")
+		if err != nil {
+			t.Fatalf("job %d: publish failed: %v", i, err)
+		}
+		if got != name {
+			t.Errorf("job %d: saved as %q, want %q", i, got, name)
+		}
+		if _, err := os.Stat(tmp.Name()); !os.IsNotExist(err) {
+			t.Errorf("job %d: temporary file not removed", i)
+		}
+	}
+	for _, name := range want {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != name {
+			t.Errorf("%s contains %q, %v; want %q", name, data, err, name)
+		}
+	}
+}
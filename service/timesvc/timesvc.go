@@ -0,0 +1,126 @@
+// Package timesvc implements a simple time service, allowing DOS machines on
+// the network to set their clocks from the server.
+//
+// The service answers the NetWare Core Protocol (NCP) request for function
+// 20, "Get File Server Date and Time", which is what the NetWare shell sends
+// when a DOS client runs SYSTIME or logs in with SET_TIME ON. Requests are
+// sent to the NCP socket, 0x0451, with IPX packet type 17, and have the
+// usual 7 byte NCP request header, all fields big-endian:
+//
+//	request type (0x2222), sequence number, connection number (low byte),
+//	task number, connection number (high byte), function code (20)
+//
+// Anything after the header is ignored. The reply copies the sequence,
+// connection and task numbers from the request, as the client expects:
+//
+//	reply type (0x3333), sequence number, connection number (low byte),
+//	task number, connection number (high byte), completion code (0),
+//	connection status (0), then 7 bytes of the current local time:
+//	year (years since 1900), month (1-12), day (1-31),
+//	hour (0-23), minute, second, day of week (0 = Sunday)
+//
+// The service does not track connections; it answers function 20 on any
+// connection number, and ignores every other request, so that it does not
+// get in the way if a real file server is also on the network.
+package timesvc
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/ipxsocket"
+)
+
+// DefaultSocket is the socket number the service listens on by default;
+// this is the socket that NetWare file servers receive NCP requests on.
+const DefaultSocket = 0x0451
+
+const (
+	// IPX packet type used for NCP packets.
+	packetTypeNCP = 17
+
+	ncpRequest = 0x2222
+	ncpReply   = 0x3333
+
+	// Function code for "Get File Server Date and Time".
+	funcGetDateAndTime = 20
+
+	// Length of the request header, up to and including the function
+	// code.
+	requestHeaderLen = 7
+)
+
+// Service is a time service.
+type Service struct {
+	mux    *ipxsocket.Mux
+	socket *ipxsocket.Socket
+}
+
+// New creates a new Service which listens for requests on the given socket
+// number using the given network node.
+func New(node network.Node, socket uint16) (*Service, error) {
+	mux := ipxsocket.New(node)
+	sock, err := mux.OpenSocket(socket)
+	if err != nil {
+		mux.Close()
+		return nil, err
+	}
+	sock.PacketType = packetTypeNCP
+	return &Service{
+		mux:    mux,
+		socket: sock,
+	}, nil
+}
+
+// encodeTime encodes the given time in the format sent in replies.
+func encodeTime(t time.Time) []byte {
+	return []byte{
+		byte(t.Year() - 1900),
+		byte(t.Month()),
+		byte(t.Day()),
+		byte(t.Hour()),
+		byte(t.Minute()),
+		byte(t.Second()),
+		byte(t.Weekday()),
+	}
+}
+
+// reply returns the reply to the given request, or nil if it is not a
+// request that the service answers.
+func reply(request []byte, now time.Time) []byte {
+	if len(request) < requestHeaderLen ||
+		binary.BigEndian.Uint16(request[0:2]) != ncpRequest ||
+		request[6] != funcGetDateAndTime {
+		return nil
+	}
+	result := make([]byte, 8, 15)
+	binary.BigEndian.PutUint16(result[0:2], ncpReply)
+	// Sequence, connection and task numbers.
+	copy(result[2:6], request[2:6])
+	// Completion code and connection status are both zero.
+	return append(result, encodeTime(now)...)
+}
+
+// Run answers time requests until the service is closed.
+func (s *Service) Run() {
+	var buf [1500]byte
+	ctx := context.Background()
+	for {
+		n, hdr, err := s.socket.ReadFrom(ctx, buf[:])
+		if err == ipxsocket.ErrClosed {
+			return
+		} else if err != nil {
+			continue
+		}
+		if r := reply(buf[:n], time.Now()); r != nil {
+			s.socket.WriteTo(ctx, r, hdr.Src)
+		}
+	}
+}
+
+// Close shuts down the service.
+func (s *Service) Close() error {
+	return s.mux.Close()
+}
@@ -0,0 +1,82 @@
+package timesvc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/ipxsocket"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+func TestReply(t *testing.T) {
+	now := time.Date(1994, time.December, 10, 13, 45, 30, 0, time.UTC)
+	tests := []struct {
+		request []byte
+		want    []byte
+	}{
+		{
+			[]byte{0x22, 0x22, 0x05, 0x03, 0x01, 0x00, 20},
+			[]byte{0x33, 0x33, 0x05, 0x03, 0x01, 0x00, 0, 0,
+				94, 12, 10, 13, 45, 30, 6},
+		},
+		// Trailing data after the header is ignored.
+		{
+			[]byte{0x22, 0x22, 0xff, 0x01, 0x02, 0x03, 20, 0xaa},
+			[]byte{0x33, 0x33, 0xff, 0x01, 0x02, 0x03, 0, 0,
+				94, 12, 10, 13, 45, 30, 6},
+		},
+		// Other functions are not answered.
+		{[]byte{0x22, 0x22, 0x05, 0x03, 0x01, 0x00, 21}, nil},
+		// Create Service Connection is not answered.
+		{[]byte{0x11, 0x11, 0x00, 0xff, 0x01, 0xff}, nil},
+		// Not an NCP request.
+		{[]byte("game data"), nil},
+		{[]byte{0x22, 0x22, 0x05}, nil},
+		{nil, nil},
+	}
+	for _, test := range tests {
+		got := reply(test.request, now)
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("reply(%x) = %x, want %x", test.request, got, test.want)
+		}
+	}
+}
+
+func TestService(t *testing.T) {
+	v := virtual.New()
+	s, err := New(v.NewNode(), DefaultSocket)
+	if err != nil {
+		t.Fatalf("failed to start service: %v", err)
+	}
+	defer s.Close()
+	go s.Run()
+
+	mux := ipxsocket.New(v.NewNode())
+	defer mux.Close()
+	sock, err := mux.OpenSocket(0)
+	if err != nil {
+		t.Fatalf("failed to open socket: %v", err)
+	}
+	sock.PacketType = packetTypeNCP
+	dest := ipx.HeaderAddr{Addr: s.mux.Address(), Socket: DefaultSocket}
+	request := []byte{0x22, 0x22, 0x01, 0x01, 0x01, 0x00, 20}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := sock.WriteTo(ctx, request, dest); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	var buf [1500]byte
+	n, hdr, err := sock.ReadFrom(ctx, buf[:])
+	if err != nil {
+		t.Fatalf("no reply: %v", err)
+	}
+	if n != 15 {
+		t.Errorf("reply is %d bytes, want 15", n)
+	}
+	if hdr.PacketType != packetTypeNCP {
+		t.Errorf("reply has packet type %d, want %d", hdr.PacketType, packetTypeNCP)
+	}
+}
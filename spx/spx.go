@@ -0,0 +1,716 @@
+// Package spx implements Novell's Sequenced Packet Exchange (SPX) protocol,
+// a reliable stream protocol that runs on top of IPX. It allows programs to
+// converse with SPX-based DOS software over an IPX network.
+package spx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/ipxsocket"
+)
+
+const (
+	// IPX packet type used for SPX packets.
+	packetTypeSPX = 5
+
+	headerLength = 12
+
+	// Maximum amount of data in a single SPX packet.
+	maxDataLength = 534
+
+	// Bits in the connection control field.
+	ccSystem       = 0x80
+	ccSendAck      = 0x40
+	ccAttention    = 0x20
+	ccEndOfMessage = 0x10
+
+	// Special values of the datastream type field used when terminating
+	// a connection.
+	dsEndOfConnection    = 0xfe
+	dsEndOfConnectionAck = 0xff
+
+	// Destination connection ID used in connection requests, before the
+	// remote side's ID is known.
+	unknownConnID = 0xffff
+
+	// Number of packets that can be in flight in each direction.
+	windowSize = 8
+
+	// Time after which unacknowledged packets are retransmitted, and the
+	// number of retransmissions before the connection is abandoned.
+	retransmitTime = 500 * time.Millisecond
+	maxRetries     = 10
+
+	// Number of incoming connections that can be waiting for Accept().
+	acceptBacklog = 16
+)
+
+// Watchdog timing. If nothing is received on a connection for
+// watchdogTime, the remote side is sent a probe asking it to acknowledge;
+// if nothing is received for watchdogTimeout, the connection is abandoned.
+// These are variables so that tests can shorten them.
+var (
+	watchdogTime    = 3 * time.Second
+	watchdogTimeout = 15 * time.Second
+)
+
+var (
+	// ErrClosed is returned when using a connection or listener that has
+	// been closed.
+	ErrClosed = errors.New("spx: connection closed")
+
+	// ErrTimeout is returned if the remote side stops acknowledging
+	// packets.
+	ErrTimeout = errors.New("spx: connection timed out")
+
+	_ = (io.ReadWriteCloser)(&Conn{})
+)
+
+// header represents an SPX header, which follows the IPX header.
+type header struct {
+	ConnControl    byte
+	DatastreamType byte
+	SrcConnID      uint16
+	DestConnID     uint16
+	Seq            uint16
+	Ack            uint16
+	Alloc          uint16
+}
+
+func (h *header) marshal() []byte {
+	result := make([]byte, headerLength)
+	result[0] = h.ConnControl
+	result[1] = h.DatastreamType
+	binary.BigEndian.PutUint16(result[2:4], h.SrcConnID)
+	binary.BigEndian.PutUint16(result[4:6], h.DestConnID)
+	binary.BigEndian.PutUint16(result[6:8], h.Seq)
+	binary.BigEndian.PutUint16(result[8:10], h.Ack)
+	binary.BigEndian.PutUint16(result[10:12], h.Alloc)
+	return result
+}
+
+func (h *header) unmarshal(data []byte) error {
+	if len(data) < headerLength {
+		return fmt.Errorf("SPX header too short to decode: %d < %d", len(data), headerLength)
+	}
+	h.ConnControl = data[0]
+	h.DatastreamType = data[1]
+	h.SrcConnID = binary.BigEndian.Uint16(data[2:4])
+	h.DestConnID = binary.BigEndian.Uint16(data[4:6])
+	h.Seq = binary.BigEndian.Uint16(data[6:8])
+	h.Ack = binary.BigEndian.Uint16(data[8:10])
+	h.Alloc = binary.BigEndian.Uint16(data[10:12])
+	return nil
+}
+
+// seqLess returns true if sequence number a comes before b, taking into
+// account wraparound.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// endpoint is an IPX socket over which one or more SPX connections run. A
+// dialed connection has its own endpoint; a listener's endpoint is shared by
+// all accepted connections.
+type endpoint struct {
+	sock *ipxsocket.Socket
+
+	mu        sync.Mutex
+	conns     map[uint16]*Conn
+	nextID    uint16
+	accept    chan *Conn
+	listening bool
+}
+
+func newEndpoint(sock *ipxsocket.Socket, listening bool) *endpoint {
+	var b [2]byte
+	rand.Read(b[:])
+	e := &endpoint{
+		sock:      sock,
+		conns:     map[uint16]*Conn{},
+		nextID:    binary.BigEndian.Uint16(b[:]),
+		listening: listening,
+	}
+	if listening {
+		e.accept = make(chan *Conn, acceptBacklog)
+	}
+	sock.PacketType = packetTypeSPX
+	go e.run()
+	return e
+}
+
+// newConn creates a new connection on the endpoint to the given address,
+// allocating an unused connection ID. Must be called with e.mu held.
+func (e *endpoint) newConn(remote ipx.HeaderAddr) *Conn {
+	for {
+		id := e.nextID
+		e.nextID++
+		if _, ok := e.conns[id]; ok || id == unknownConnID {
+			continue
+		}
+		c := &Conn{
+			ep:            e,
+			localID:       id,
+			remoteID:      unknownConnID,
+			remote:        remote,
+			establishedCh: make(chan struct{}),
+			done:          make(chan struct{}),
+			lastReceive:   time.Now(),
+
+			watchdogTime:    watchdogTime,
+			watchdogTimeout: watchdogTimeout,
+		}
+		c.cond = sync.NewCond(&c.mu)
+		e.conns[id] = c
+		go c.runTimers()
+		return c
+	}
+}
+
+// removeConn removes a connection from the endpoint, closing the socket if
+// there is nothing left that is using it.
+func (e *endpoint) removeConn(c *Conn) {
+	e.mu.Lock()
+	delete(e.conns, c.localID)
+	unused := len(e.conns) == 0 && !e.listening
+	e.mu.Unlock()
+	if unused {
+		e.sock.Close()
+	}
+}
+
+// closeListener stops the endpoint accepting new connections.
+func (e *endpoint) closeListener() {
+	e.mu.Lock()
+	wasListening := e.listening
+	e.listening = false
+	unused := len(e.conns) == 0
+	e.mu.Unlock()
+	if wasListening {
+		close(e.accept)
+	}
+	if unused {
+		e.sock.Close()
+	}
+}
+
+// handleConnectRequest handles a connection request received by a listening
+// endpoint.
+func (e *endpoint) handleConnectRequest(h *header, src ipx.HeaderAddr) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.listening {
+		return
+	}
+	// The request may be a retransmission because the reply was lost, in
+	// which case we just send the reply again.
+	for _, c := range e.conns {
+		if c.remote == src && c.remoteID == h.SrcConnID {
+			c.mu.Lock()
+			c.sendAck(0, 0)
+			c.mu.Unlock()
+			return
+		}
+	}
+	c := e.newConn(src)
+	c.mu.Lock()
+	c.remoteID = h.SrcConnID
+	c.remoteAlloc = h.Alloc
+	c.setEstablished()
+	c.sendAck(0, 0)
+	c.mu.Unlock()
+	select {
+	case e.accept <- c:
+	default:
+		// Backlog is full; the connection is dropped and the remote
+		// side will eventually time out.
+		delete(e.conns, c.localID)
+		c.mu.Lock()
+		c.teardown(ErrClosed)
+		c.mu.Unlock()
+	}
+}
+
+// run continually reads packets from the endpoint's socket and dispatches
+// them to the appropriate connection.
+func (e *endpoint) run() {
+	var buf [1500]byte
+	for {
+		n, ipxHeader, err := e.sock.ReadFrom(context.Background(), buf[:])
+		if err == ipxsocket.ErrClosed {
+			break
+		} else if err != nil {
+			continue
+		}
+		var h header
+		if ipxHeader.PacketType != packetTypeSPX || h.unmarshal(buf[:n]) != nil {
+			continue
+		}
+		if h.DestConnID == unknownConnID && h.ConnControl&ccSystem != 0 {
+			e.handleConnectRequest(&h, ipxHeader.Src)
+			continue
+		}
+		e.mu.Lock()
+		c, ok := e.conns[h.DestConnID]
+		e.mu.Unlock()
+		if ok && c.remote == ipxHeader.Src {
+			c.handlePacket(&h, buf[headerLength:n])
+		}
+	}
+	e.mu.Lock()
+	conns := []*Conn{}
+	for _, c := range e.conns {
+		conns = append(conns, c)
+	}
+	e.mu.Unlock()
+	for _, c := range conns {
+		c.mu.Lock()
+		c.teardown(ErrClosed)
+		c.mu.Unlock()
+	}
+}
+
+// segment is a data packet that has been sent but not yet acknowledged.
+type segment struct {
+	hdr  header
+	data []byte
+}
+
+// Conn is an SPX connection.
+type Conn struct {
+	ep       *endpoint
+	localID  uint16
+	remoteID uint16
+	remote   ipx.HeaderAddr
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	established   bool
+	establishedCh chan struct{}
+	done          chan struct{}
+	err           error
+
+	// Deadlines set with SetDeadline etc., and timers that wake blocked
+	// callers when they pass.
+	readDeadline, writeDeadline time.Time
+	readTimer, writeTimer       *time.Timer
+
+	// Send side state.
+	nextSeq      uint16
+	remoteAlloc  uint16
+	unacked      []segment
+	lastTransmit time.Time
+	retries      int
+
+	// Receive side state.
+	expectedSeq  uint16
+	recvQueue    [][]byte
+	recvPartial  []byte
+	remoteClosed bool
+
+	// When a packet was last received, and when the remote side was
+	// last sent a probe, by the watchdog or because the window closed.
+	lastReceive time.Time
+	lastProbe   time.Time
+
+	// Copied from the package variables when the connection is created.
+	watchdogTime, watchdogTimeout time.Duration
+}
+
+// send transmits a packet with the given SPX header and data. Must be called
+// with c.mu held.
+func (c *Conn) send(h *header, data []byte) {
+	h.SrcConnID = c.localID
+	h.DestConnID = c.remoteID
+	h.Ack = c.expectedSeq
+	h.Alloc = c.expectedSeq + uint16(windowSize-len(c.recvQueue)) - 1
+	packet := append(h.marshal(), data...)
+	c.ep.sock.WriteTo(context.Background(), packet, c.remote)
+}
+
+// sendAck sends a system packet acknowledging received packets, with any
+// extra connection control bits given. Must be called with c.mu held.
+func (c *Conn) sendAck(datastreamType byte, connControl byte) {
+	c.send(&header{
+		ConnControl:    ccSystem | connControl,
+		DatastreamType: datastreamType,
+		Seq:            c.nextSeq,
+	}, nil)
+}
+
+// setEstablished marks the connection as established. Must be called with
+// c.mu held.
+func (c *Conn) setEstablished() {
+	if !c.established {
+		c.established = true
+		close(c.establishedCh)
+	}
+}
+
+// teardown shuts down the connection, waking up any blocked callers, which
+// will receive the given error. Must be called with c.mu held.
+func (c *Conn) teardown(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.cond.Broadcast()
+	go c.ep.removeConn(c)
+}
+
+// handlePacket processes a packet received for this connection.
+func (c *Conn) handlePacket(h *header, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.lastReceive = time.Now()
+	if !c.established {
+		// Reply to our connection request.
+		c.remoteID = h.SrcConnID
+		c.setEstablished()
+	}
+
+	// Every packet acknowledges the packets that the remote side has
+	// received so far, and tells us how many more we can send.
+	if !seqLess(c.nextSeq, h.Ack) {
+		for len(c.unacked) > 0 && seqLess(c.unacked[0].hdr.Seq, h.Ack) {
+			c.unacked = c.unacked[1:]
+			c.retries = 0
+			c.lastTransmit = time.Now()
+		}
+		c.remoteAlloc = h.Alloc
+		c.cond.Broadcast()
+	}
+
+	if h.ConnControl&ccSystem != 0 {
+		if h.ConnControl&ccSendAck != 0 {
+			c.sendAck(0, 0)
+		}
+		return
+	}
+
+	if h.Seq == c.expectedSeq && len(c.recvQueue) < windowSize && !c.remoteClosed {
+		c.expectedSeq++
+		if h.DatastreamType == dsEndOfConnection {
+			c.remoteClosed = true
+			c.sendAck(dsEndOfConnectionAck, 0)
+			c.cond.Broadcast()
+			return
+		}
+		if len(data) > 0 {
+			c.recvQueue = append(c.recvQueue, append([]byte{}, data...))
+			c.cond.Broadcast()
+		}
+	}
+	// Out of order packets are dropped and will be retransmitted by the
+	// remote side. Duplicates are acknowledged again in case our earlier
+	// acknowledgement was lost.
+	if h.ConnControl&ccSendAck != 0 {
+		c.sendAck(0, 0)
+	}
+}
+
+// runTimers periodically retransmits unacknowledged packets and probes the
+// remote side until the connection is torn down.
+func (c *Conn) runTimers() {
+	ticker := time.NewTicker(retransmitTime / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+		c.mu.Lock()
+		c.checkTimers(time.Now())
+		c.mu.Unlock()
+	}
+}
+
+// checkTimers retransmits unacknowledged packets and sends probes when they
+// are due. Must be called with c.mu held.
+func (c *Conn) checkTimers(now time.Time) {
+	if len(c.unacked) > 0 && now.Sub(c.lastTransmit) >= retransmitTime {
+		if c.retries >= maxRetries {
+			c.teardown(ErrTimeout)
+			return
+		}
+		c.retries++
+		c.lastTransmit = now
+		for i := range c.unacked {
+			c.send(&c.unacked[i].hdr, c.unacked[i].data)
+		}
+	}
+	if !c.established {
+		return
+	}
+	idle := now.Sub(c.lastReceive)
+	if idle >= c.watchdogTimeout {
+		c.teardown(ErrTimeout)
+		return
+	}
+	// Once everything sent has been acknowledged, nothing is
+	// retransmitted, so if the acknowledgement that reopens a closed
+	// window is lost, only a probe recovers it.
+	windowClosed := len(c.unacked) == 0 && seqLess(c.remoteAlloc, c.nextSeq)
+	interval := c.watchdogTime
+	if windowClosed {
+		interval = retransmitTime
+	}
+	if idle >= interval || windowClosed {
+		if now.Sub(c.lastProbe) >= interval {
+			c.lastProbe = now
+			c.sendAck(0, ccSendAck)
+		}
+	}
+}
+
+// sendData sends a data packet, blocking until the remote side has space to
+// receive it. Must be called with c.mu held.
+func (c *Conn) sendData(connControl, datastreamType byte, data []byte) error {
+	for c.err == nil && (len(c.unacked) >= windowSize || seqLess(c.remoteAlloc, c.nextSeq)) {
+		if expired(c.writeDeadline) {
+			return os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return c.err
+	}
+	seg := segment{
+		hdr: header{
+			ConnControl:    ccSendAck | connControl,
+			DatastreamType: datastreamType,
+			Seq:            c.nextSeq,
+		},
+		data: append([]byte{}, data...),
+	}
+	c.nextSeq++
+	if len(c.unacked) == 0 {
+		c.lastTransmit = time.Now()
+	}
+	c.unacked = append(c.unacked, seg)
+	c.send(&seg.hdr, seg.data)
+	return nil
+}
+
+// Write sends the given data over the connection. The data is split into
+// packets as necessary; the last packet is marked as the end of a message.
+// Write blocks until all the data has been sent, though not necessarily
+// acknowledged by the remote side, or the write deadline passes.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remoteClosed {
+		return 0, ErrClosed
+	}
+	written := 0
+	for {
+		chunk := p[written:]
+		var cc byte = ccEndOfMessage
+		if len(chunk) > maxDataLength {
+			chunk = chunk[:maxDataLength]
+			cc = 0
+		}
+		if err := c.sendData(cc, 0, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		if written >= len(p) {
+			return written, nil
+		}
+	}
+}
+
+// Read reads data received over the connection, blocking until some is
+// available or the read deadline passes. io.EOF is returned once the remote
+// side has closed the connection and all data has been read.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.recvPartial) == 0 {
+		if len(c.recvQueue) > 0 {
+			wasFull := len(c.recvQueue) == windowSize
+			c.recvPartial = c.recvQueue[0]
+			c.recvQueue = c.recvQueue[1:]
+			// Let the remote side know there is space again.
+			if wasFull && c.err == nil {
+				c.sendAck(0, 0)
+			}
+			break
+		}
+		switch {
+		case c.remoteClosed:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case expired(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+	n := copy(p, c.recvPartial)
+	c.recvPartial = c.recvPartial[n:]
+	return n, nil
+}
+
+// Close terminates the connection. If the connection is still open, the
+// remote side is sent a termination request and Close blocks until it is
+// acknowledged, the connection times out or the write deadline passes.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil
+	}
+	if c.established && !c.remoteClosed && c.sendData(0, dsEndOfConnection, nil) == nil {
+		for c.err == nil && len(c.unacked) > 0 && !expired(c.writeDeadline) {
+			c.cond.Wait()
+		}
+	}
+	c.teardown(ErrClosed)
+	return nil
+}
+
+// expired returns true if the given deadline has passed.
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// setDeadline sets the given deadline, and wakes blocked callers when it
+// passes, as well as now so that they see the change.
+func (c *Conn) setDeadline(deadline *time.Time, timer **time.Timer, t time.Time) {
+	*deadline = t
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+	}
+	c.cond.Broadcast()
+}
+
+// SetDeadline sets both the read and write deadlines, as for net.Conn. Once
+// a deadline passes, calls that would block return os.ErrDeadlineExceeded.
+// A zero time means no deadline.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setDeadline(&c.readDeadline, &c.readTimer, t)
+	c.setDeadline(&c.writeDeadline, &c.writeTimer, t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setDeadline(&c.readDeadline, &c.readTimer, t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write and Close.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setDeadline(&c.writeDeadline, &c.writeTimer, t)
+	return nil
+}
+
+// LocalAddr returns the local IPX address of the connection.
+func (c *Conn) LocalAddr() ipx.HeaderAddr {
+	return c.ep.sock.Addr()
+}
+
+// RemoteAddr returns the IPX address of the remote side of the connection.
+func (c *Conn) RemoteAddr() ipx.HeaderAddr {
+	return c.remote
+}
+
+// Dial establishes an SPX connection to the given address. A new dynamic
+// socket is opened on the given mux for the connection.
+func Dial(ctx context.Context, mux *ipxsocket.Mux, addr ipx.HeaderAddr) (*Conn, error) {
+	sock, err := mux.OpenSocket(0)
+	if err != nil {
+		return nil, err
+	}
+	e := newEndpoint(sock, false)
+	e.mu.Lock()
+	c := e.newConn(addr)
+	e.mu.Unlock()
+	for i := 0; i < maxRetries; i++ {
+		c.mu.Lock()
+		c.send(&header{ConnControl: ccSystem | ccSendAck}, nil)
+		c.mu.Unlock()
+		select {
+		case <-c.establishedCh:
+			return c, nil
+		case <-time.After(retransmitTime):
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = ErrTimeout
+	}
+	c.mu.Lock()
+	c.teardown(err)
+	c.mu.Unlock()
+	return nil, err
+}
+
+// Listener listens for incoming SPX connections on a particular socket.
+type Listener struct {
+	ep *endpoint
+}
+
+// Listen opens the given socket number on the given mux and listens for
+// incoming SPX connections.
+func Listen(mux *ipxsocket.Mux, socket uint16) (*Listener, error) {
+	sock, err := mux.OpenSocket(socket)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{newEndpoint(sock, true)}, nil
+}
+
+// Accept blocks until a new connection is received.
+func (l *Listener) Accept() (*Conn, error) {
+	c, ok := <-l.ep.accept
+	if !ok {
+		return nil, ErrClosed
+	}
+	return c, nil
+}
+
+// Close stops listening for new connections. Connections that have already
+// been accepted are unaffected.
+func (l *Listener) Close() error {
+	l.ep.closeListener()
+	return nil
+}
+
+// Addr returns the IPX address on which the listener is listening.
+func (l *Listener) Addr() ipx.HeaderAddr {
+	return l.ep.sock.Addr()
+}
@@ -0,0 +1,269 @@
+package spx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/ipxsocket"
+	"github.com/fragglet/ipxbox/virtual"
+)
+
+const testSocket = 0x9000
+
+// lossyNode is a node that drops the packets it is told to.
+type lossyNode struct {
+	network.Node
+
+	mu   sync.Mutex
+	drop func(h *header) bool
+}
+
+func (n *lossyNode) setDrop(drop func(h *header) bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.drop = drop
+}
+
+func (n *lossyNode) dropped(packet []byte) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var h header
+	return n.drop != nil && len(packet) >= 30 && h.unmarshal(packet[30:]) == nil && n.drop(&h)
+}
+
+func (n *lossyNode) Write(packet []byte) (int, error) {
+	if n.dropped(packet) {
+		return len(packet), nil
+	}
+	return n.Node.Write(packet)
+}
+
+func (n *lossyNode) WritePacket(ctx context.Context, packet []byte) error {
+	if n.dropped(packet) {
+		return nil
+	}
+	return n.Node.WritePacket(ctx, packet)
+}
+
+// pair is a connected pair of SPX connections, each sending through a
+// lossy node.
+type pair struct {
+	dialed, accepted         *Conn
+	dialerNode, listenerNode *lossyNode
+	dialerMux, listenerMux   *ipxsocket.Mux
+}
+
+// connect returns a connected pair. If non-nil, drop is applied to the
+// dialer's packets from the start, including its connection requests.
+func connect(t *testing.T, drop func(h *header) bool) *pair {
+	n := virtual.New()
+	p := &pair{
+		dialerNode:   &lossyNode{Node: n.NewNode(), drop: drop},
+		listenerNode: &lossyNode{Node: n.NewNode()},
+	}
+	p.dialerMux = ipxsocket.New(p.dialerNode)
+	p.listenerMux = ipxsocket.New(p.listenerNode)
+	t.Cleanup(func() {
+		p.dialerMux.Close()
+		p.listenerMux.Close()
+	})
+	l, err := Listen(p.listenerMux, testSocket)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p.dialed, err = Dial(ctx, p.dialerMux, l.Addr())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	p.accepted, err = l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	return p
+}
+
+// readAll reads from the connection until EOF or an error.
+func readAll(c *Conn, timeout time.Duration) ([]byte, error) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	var result bytes.Buffer
+	_, err := io.Copy(&result, c)
+	return result.Bytes(), err
+}
+
+// testData returns n bytes of data that needs several packets to send.
+func testData(n int) []byte {
+	result := make([]byte, n)
+	for i := range result {
+		result[i] = byte(i * 7)
+	}
+	return result
+}
+
+func TestHandshake(t *testing.T) {
+	// The first connection request is lost, so Dial must retry.
+	var requests int
+	p := connect(t, func(h *header) bool {
+		if h.DestConnID == unknownConnID {
+			requests++
+			return requests == 1
+		}
+		return false
+	})
+	if got, want := p.dialed.RemoteAddr(), p.accepted.LocalAddr(); got != want {
+		t.Errorf("dialed connection's remote address is %s, want %s", got, want)
+	}
+	if got, want := p.accepted.RemoteAddr(), p.dialed.LocalAddr(); got != want {
+		t.Errorf("accepted connection's remote address is %s, want %s", got, want)
+	}
+	if requests < 2 {
+		t.Errorf("%d connection requests sent, want at least 2", requests)
+	}
+}
+
+func TestCloseGivesEOF(t *testing.T) {
+	p := connect(t, nil)
+	data := testData(2000)
+	closed := make(chan error)
+	go func() {
+		p.dialed.Write(data)
+		closed <- p.dialed.Close()
+	}()
+	got, err := readAll(p.accepted, 5*time.Second)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes, want %d", len(got), len(data))
+	}
+	if err := <-closed; err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if _, err := p.dialed.Write([]byte("x")); err == nil {
+		t.Errorf("write after close succeeded")
+	}
+	if _, err := p.accepted.Write([]byte("x")); err != ErrClosed {
+		t.Errorf("write to a connection closed by the remote side = %v, want ErrClosed", err)
+	}
+}
+
+func TestRetransmitAfterLoss(t *testing.T) {
+	// The first transmission of every data packet is lost.
+	seen := map[uint16]bool{}
+	p := connect(t, func(h *header) bool {
+		if h.ConnControl&ccSystem != 0 || seen[h.Seq] {
+			return false
+		}
+		seen[h.Seq] = true
+		return true
+	})
+	data := testData(5000)
+	go func() {
+		p.dialed.Write(data)
+		p.dialed.Close()
+	}()
+	got, err := readAll(p.accepted, 10*time.Second)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes, want %d", len(got), len(data))
+	}
+}
+
+// stalled returns true if the connection cannot send because the remote
+// side's window is full, and everything it has sent was acknowledged.
+func stalled(c *Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.unacked) == 0 && seqLess(c.remoteAlloc, c.nextSeq)
+}
+
+// waitStalled waits for the connection to stall.
+func waitStalled(t *testing.T, c *Conn) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !stalled(c) {
+		if time.Now().After(deadline) {
+			t.Fatalf("window never filled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestWindowReopenLost checks that the sender recovers when the
+// acknowledgement that reopens the receiver's window is lost.
+func TestWindowReopenLost(t *testing.T) {
+	p := connect(t, nil)
+	data := bytes.Repeat([]byte("message"), 3*windowSize)
+	go func() {
+		for i := 0; i < len(data); i += 7 {
+			p.dialed.Write(data[i : i+7])
+		}
+		p.dialed.Close()
+	}()
+	waitStalled(t, p.dialed)
+
+	p.listenerNode.setDrop(func(h *header) bool { return true })
+	var buf [7]byte
+	p.accepted.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(p.accepted, buf[:]); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	p.listenerNode.setDrop(nil)
+
+	rest, err := readAll(p.accepted, 10*time.Second)
+	if err != nil {
+		t.Fatalf("read failed after the window reopened: %v", err)
+	}
+	if got := append(buf[:], rest...); !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	p := connect(t, nil)
+	p.dialed.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	var err error
+	for i := 0; i < 2*windowSize && err == nil; i++ {
+		_, err = p.dialed.Write([]byte("message"))
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("write to a full window = %v, want deadline exceeded", err)
+	}
+	start := time.Now()
+	p.dialed.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Close took %v after the write deadline passed", d)
+	}
+}
+
+// TestWatchdog checks that an idle connection is kept open while the remote
+// side answers probes, and abandoned once it stops.
+func TestWatchdog(t *testing.T) {
+	oldTime, oldTimeout := watchdogTime, watchdogTimeout
+	watchdogTime, watchdogTimeout = 100*time.Millisecond, 500*time.Millisecond
+	defer func() {
+		watchdogTime, watchdogTimeout = oldTime, oldTimeout
+	}()
+	p := connect(t, nil)
+	p.accepted.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := p.accepted.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("idle connection failed: %v", err)
+	}
+
+	// The dialer goes away without closing the connection.
+	p.dialerNode.setDrop(func(h *header) bool { return true })
+	p.accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := p.accepted.Read(make([]byte, 1)); err != ErrTimeout {
+		t.Errorf("read from a dead connection = %v, want ErrTimeout", err)
+	}
+}
@@ -0,0 +1,78 @@
+// Package tlv encodes and decodes the type-length-value options used by
+// extensions to the DOSBox IPX protocol. Each option is a type byte and a
+// 16-bit big-endian length, followed by that many bytes of value. Decoders
+// skip options whose types they do not know, so that new options can be
+// added without breaking older implementations.
+package tlv
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// HeaderLen is the length of the type and length fields of an option.
+const HeaderLen = 3
+
+// MaxValueLen is the longest value that an option can hold.
+const MaxValueLen = 0xffff
+
+var (
+	// TruncatedError is returned by Parse if an option's header or value
+	// extends past the end of the data.
+	TruncatedError = errors.New("truncated option")
+
+	// ValueTooLongError is returned by Append if a value is longer than
+	// MaxValueLen.
+	ValueTooLongError = errors.New("option value too long")
+)
+
+// Option is a single option.
+type Option struct {
+	Type  byte
+	Value []byte
+}
+
+// Options is a list of options, in the order they were encoded.
+type Options []Option
+
+// Append appends an option with the given type and value to buf.
+func Append(buf []byte, t byte, value []byte) ([]byte, error) {
+	if len(value) > MaxValueLen {
+		return buf, ValueTooLongError
+	}
+	var hdr [HeaderLen]byte
+	hdr[0] = t
+	binary.BigEndian.PutUint16(hdr[1:], uint16(len(value)))
+	return append(append(buf, hdr[:]...), value...), nil
+}
+
+// Parse decodes all the options in data. The values returned refer to the
+// same memory as data.
+func Parse(data []byte) (Options, error) {
+	var result Options
+	for len(data) > 0 {
+		if len(data) < HeaderLen {
+			return nil, TruncatedError
+		}
+		length := int(binary.BigEndian.Uint16(data[1:HeaderLen]))
+		if len(data) < HeaderLen+length {
+			return nil, TruncatedError
+		}
+		result = append(result, Option{
+			Type:  data[0],
+			Value: data[HeaderLen : HeaderLen+length],
+		})
+		data = data[HeaderLen+length:]
+	}
+	return result, nil
+}
+
+// Get returns the value of the first option of the given type.
+func (o Options) Get(t byte) ([]byte, bool) {
+	for _, opt := range o {
+		if opt.Type == t {
+			return opt.Value, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,106 @@
+package tlv
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	want := Options{
+		{Type: 1, Value: []byte("hello")},
+		{Type: 2, Value: []byte{}},
+		{Type: 200, Value: bytes.Repeat([]byte{0xaa}, 300)},
+		{Type: 1, Value: []byte("again")},
+	}
+	var buf []byte
+	for _, opt := range want {
+		var err error
+		buf, err = Append(buf, opt.Type, opt.Value)
+		if err != nil {
+			t.Fatalf("Append(%d) failed: %v", opt.Type, err)
+		}
+	}
+	got, err := Parse(buf)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Parse returned %d options, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Type != want[i].Type || !bytes.Equal(got[i].Value, want[i].Value) {
+			t.Errorf("option %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if v, ok := got.Get(1); !ok || string(v) != "hello" {
+		t.Errorf("Get(1) = %q, %v; want first option", v, ok)
+	}
+	if _, ok := got.Get(3); ok {
+		t.Errorf("Get(3) found an option that was never encoded")
+	}
+}
+
+func TestUnknownOptionsSkipped(t *testing.T) {
+	data := []byte{
+		99, 0, 3, 'x', 'y', 'z',
+		1, 0, 2, 'o', 'k',
+	}
+	got, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if v, ok := got.Get(1); !ok || string(v) != "ok" {
+		t.Errorf("Get(1) = %q, %v; want \"ok\"", v, ok)
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	for _, data := range [][]byte{
+		{1},
+		{1, 0},
+		{1, 0, 5, 'a', 'b'},
+		{1, 0, 0, 2, 0},
+	} {
+		if _, err := Parse(data); err != TruncatedError {
+			t.Errorf("Parse(%v) = %v, want TruncatedError", data, err)
+		}
+	}
+}
+
+func TestAppendTooLong(t *testing.T) {
+	buf := []byte{1, 2, 3}
+	got, err := Append(buf, 1, make([]byte, MaxValueLen+1))
+	if err != ValueTooLongError {
+		t.Errorf("Append of oversized value = %v, want ValueTooLongError", err)
+	}
+	if !bytes.Equal(got, buf) {
+		t.Errorf("Append modified the buffer on error")
+	}
+	if _, err := Append(nil, 1, make([]byte, MaxValueLen)); err != nil {
+		t.Errorf("Append of MaxValueLen value failed: %v", err)
+	}
+}
+
+// FuzzParse checks that Parse never panics or reads out of bounds, and that
+// anything it accepts encodes back to the same bytes.
+func FuzzParse(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{1, 0, 2, 'o', 'k'})
+	f.Add([]byte{1, 0xff, 0xff})
+	f.Add([]byte{99, 0, 0, 1, 0, 1, 'x'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		options, err := Parse(data)
+		if err != nil {
+			return
+		}
+		var buf []byte
+		for _, opt := range options {
+			if buf, err = Append(buf, opt.Type, opt.Value); err != nil {
+				t.Fatalf("Append of parsed option failed: %v", err)
+			}
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("re-encoded options differ: got %v, want %v", buf, data)
+		}
+	})
+}
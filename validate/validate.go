@@ -0,0 +1,182 @@
+// Package validate implements checks that a transport applies to the
+// packets it reads, before they reach the shared network. Each transport
+// (the UDP server, bridges, the satellite uplink) has its own Validator
+// with checks suited to it, but drops are described with the reasons in
+// package drop and counted per check in the same way for all of them.
+package validate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fragglet/ipxbox/drop"
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// Check checks a packet read by a transport from the given source, which
+// identifies the sender in a way that makes sense for the transport, eg. a
+// UDP address or an IPX address. If the packet must be dropped, it returns
+// false, with the reason.
+type Check func(source string, hdr *ipx.Header, packet []byte, now time.Time) (drop.Reason, bool)
+
+type namedCheck struct {
+	// Number of packets the check has rejected; accessed atomically.
+	failed uint64
+
+	name  string
+	check Check
+}
+
+// CheckStats contains statistics about one of a Validator's checks.
+type CheckStats struct {
+	Check  string `json:"check"`
+	Failed uint64 `json:"failed"`
+}
+
+// Validator runs the checks registered for a transport.
+type Validator struct {
+	mu     sync.RWMutex
+	checks []*namedCheck
+}
+
+// New creates a Validator with no checks; every packet is valid.
+func New() *Validator {
+	return &Validator{}
+}
+
+// Add registers a check with the given descriptive name. Checks are run in
+// the order that they were added.
+func (v *Validator) Add(name string, c Check) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.checks = append(v.checks, &namedCheck{name: name, check: c})
+}
+
+// Validate runs the checks on the given packet, returning false with the
+// reason and the name of the failed check if it must be dropped. A nil
+// Validator accepts every packet.
+func (v *Validator) Validate(source string, hdr *ipx.Header, packet []byte, now time.Time) (drop.Reason, string, bool) {
+	if v == nil {
+		return 0, "", true
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for _, nc := range v.checks {
+		if r, ok := nc.check(source, hdr, packet, now); !ok {
+			atomic.AddUint64(&nc.failed, 1)
+			return r, nc.name, false
+		}
+	}
+	return 0, "", true
+}
+
+// Stats returns the number of packets that each check has rejected.
+func (v *Validator) Stats() []CheckStats {
+	if v == nil {
+		return nil
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	result := []CheckStats{}
+	for _, nc := range v.checks {
+		result = append(result, CheckStats{
+			Check:  nc.name,
+			Failed: atomic.LoadUint64(&nc.failed),
+		})
+	}
+	return result
+}
+
+// MaxLength returns a Check that rejects packets longer than n bytes.
+func MaxLength(n int) Check {
+	return func(source string, hdr *ipx.Header, packet []byte, now time.Time) (drop.Reason, bool) {
+		return drop.Malformed, len(packet) <= n
+	}
+}
+
+// LengthField returns a Check that rejects packets whose IPX header gives a
+// length longer than the packet itself. Packets may be longer than the
+// header says, since some transports pad short frames.
+func LengthField() Check {
+	return func(source string, hdr *ipx.Header, packet []byte, now time.Time) (drop.Reason, bool) {
+		return drop.Malformed, int(hdr.Length) <= len(packet)
+	}
+}
+
+// Sources that have sent nothing for this long are forgotten by SourceRate.
+const sourceMaxAge = time.Minute
+
+type sourceBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// SourceRate returns a Check that limits each source to the given number of
+// packets per second, with bursts of up to a second's worth.
+func SourceRate(perSecond int) Check {
+	var mu sync.Mutex
+	buckets := map[string]*sourceBucket{}
+	var lastExpiry time.Time
+	return func(source string, hdr *ipx.Header, packet []byte, now time.Time) (drop.Reason, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if now.Sub(lastExpiry) >= sourceMaxAge {
+			for s, b := range buckets {
+				if now.Sub(b.lastSeen) >= sourceMaxAge {
+					delete(buckets, s)
+				}
+			}
+			lastExpiry = now
+		}
+		b, ok := buckets[source]
+		if !ok {
+			b = &sourceBucket{tokens: float64(perSecond), lastSeen: now}
+			buckets[source] = b
+		}
+		b.tokens += now.Sub(b.lastSeen).Seconds() * float64(perSecond)
+		if b.tokens > float64(perSecond) {
+			b.tokens = float64(perSecond)
+		}
+		b.lastSeen = now
+		if b.tokens < 1 {
+			return drop.RateLimited, false
+		}
+		b.tokens--
+		return drop.RateLimited, true
+	}
+}
+
+// Parse creates a Validator from a comma-separated list of checks:
+// "max_length=N", "length_field" and "source_rate=N".
+func Parse(spec string) (*Validator, error) {
+	v := New()
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		name, value := item, ""
+		if i := strings.Index(item, "="); i >= 0 {
+			name, value = item[:i], item[i+1:]
+		}
+		switch name {
+		case "length_field":
+			v.Add(item, LengthField())
+			continue
+		case "max_length", "source_rate":
+		default:
+			return nil, fmt.Errorf("unknown validation check %q", name)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid validation check %q: want %s=N", item, name)
+		}
+		if name == "max_length" {
+			v.Add(item, MaxLength(n))
+		} else {
+			v.Add(item, SourceRate(n))
+		}
+	}
+	return v, nil
+}
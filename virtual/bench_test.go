@@ -0,0 +1,56 @@
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+// benchmarkBroadcast measures the time taken to deliver a broadcast to the
+// given number of nodes, each of which has an owner reading packets from it
+// as the server's client goroutines do.
+func benchmarkBroadcast(b *testing.B, nodes int) {
+	n := NewWithConfig(&Config{QueueLength: 1024})
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	var all []network.Node
+	for i := 0; i < nodes; i++ {
+		node := n.NewNode()
+		all = append(all, node)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf [1500]byte
+			for {
+				if _, err := node.ReadPacket(ctx, buf[:]); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	sender := all[0]
+	packet := testPacket(b, sender.Address(), ipx.AddrBroadcast, 0x869c)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sender.Write(packet); err != nil {
+			b.Fatalf("write failed: %v", err)
+		}
+	}
+	b.StopTimer()
+	cancel()
+	wg.Wait()
+}
+
+// BenchmarkBroadcast measures how broadcast delivery scales with the number
+// of nodes on the network.
+func BenchmarkBroadcast(b *testing.B) {
+	for _, nodes := range []int{16, 64, 256, 512} {
+		b.Run(fmt.Sprintf("nodes=%d", nodes), func(b *testing.B) {
+			benchmarkBroadcast(b, nodes)
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package virtual
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// Endpoint is the kind of thing that a packet is forwarded from or to:
+// either a node, or a tap such as a bridge or satellite uplink.
+type Endpoint int
+
+const (
+	EndpointNode Endpoint = 1 << iota
+	EndpointTap
+
+	EndpointAny = EndpointNode | EndpointTap
+)
+
+var endpointNames = map[string]Endpoint{
+	"node": EndpointNode,
+	"tap":  EndpointTap,
+	"any":  EndpointAny,
+}
+
+func (e Endpoint) String() string {
+	for name, ep := range endpointNames {
+		if ep == e {
+			return name
+		}
+	}
+	return fmt.Sprintf("Endpoint(%d)", int(e))
+}
+
+// PolicyRule is a forwarding rule that allows or denies packets from one
+// kind of endpoint to another.
+type PolicyRule struct {
+	Allow bool
+	From  Endpoint
+	To    Endpoint
+
+	// If non-zero, the rule only matches packets sent to this socket.
+	Socket uint16
+}
+
+// String returns the rule in the form accepted by ParsePolicyRule.
+func (r PolicyRule) String() string {
+	action := "deny"
+	if r.Allow {
+		action = "allow"
+	}
+	if r.Socket == 0 {
+		return fmt.Sprintf("%s:%s:%s", action, r.From, r.To)
+	}
+	return fmt.Sprintf("%s:%s:%s:%s", action, r.From, r.To, ipx.Socket(r.Socket))
+}
+
+// ParsePolicyRule parses a rule of the form "action:from:to[:socket]",
+// where action is "allow" or "deny", and from and to are "node", "tap" or
+// "any". For example, "deny:tap:tap" stops packets that arrive through one
+// bridge from being sent out through another.
+func ParsePolicyRule(s string) (PolicyRule, error) {
+	var r PolicyRule
+	parts := strings.Split(s, ":")
+	if len(parts) < 3 || len(parts) > 4 {
+		return r, fmt.Errorf("invalid forwarding rule %q: want action:from:to[:socket]", s)
+	}
+	switch parts[0] {
+	case "allow":
+		r.Allow = true
+	case "deny":
+	default:
+		return r, fmt.Errorf("invalid action %q in forwarding rule %q", parts[0], s)
+	}
+	var ok bool
+	if r.From, ok = endpointNames[parts[1]]; !ok {
+		return r, fmt.Errorf("invalid endpoint %q in forwarding rule %q", parts[1], s)
+	}
+	if r.To, ok = endpointNames[parts[2]]; !ok {
+		return r, fmt.Errorf("invalid endpoint %q in forwarding rule %q", parts[2], s)
+	}
+	if len(parts) == 4 {
+		socket, err := ipx.ParseSocket(parts[3])
+		if err != nil {
+			return r, err
+		}
+		r.Socket = uint16(socket)
+	}
+	return r, nil
+}
+
+// ParsePolicy parses a comma-separated list of rules in the form accepted
+// by ParsePolicyRule.
+func ParsePolicy(s string) ([]PolicyRule, error) {
+	var rules []PolicyRule
+	for _, rs := range strings.Split(s, ",") {
+		r, err := ParsePolicyRule(strings.TrimSpace(rs))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// PolicyRuleStats describes an entry in the network's forwarding rule table.
+type PolicyRuleStats struct {
+	// The rule in the form accepted by ParsePolicyRule. The split
+	// horizon and hairpin rules cannot be written in that form, so they
+	// are named instead: "split-horizon", and "hairpin=" followed by the
+	// hairpin policy.
+	Rule string `json:"rule"`
+
+	// True for the rules that the network always applies, which
+	// cannot be changed except through Config.Hairpin.
+	Builtin bool `json:"builtin,omitempty"`
+
+	// Number of packets whose delivery the rule decided, for at least
+	// one recipient. A broadcast packet is counted once by each rule
+	// that decided whether some recipient received it.
+	Packets uint64 `json:"packets"`
+}
+
+// Indexes of the built-in rules' counters in policy.counts. The operator's
+// rules follow them, then the final default rule.
+const (
+	ruleSplitHorizon = iota
+	ruleHairpin
+	numBuiltinRules
+)
+
+// policy decides whether each packet is delivered to each recipient. The
+// built-in rules are checked first, then Config.Policy in order; the first
+// rule that matches decides. Packets that match no rule are delivered.
+type policy struct {
+	// Number of packets decided by each rule; accessed atomically.
+	counts  []uint64
+	hairpin HairpinPolicy
+	rules   []PolicyRule
+}
+
+func newPolicy(c *Config) *policy {
+	return &policy{
+		counts:  make([]uint64, numBuiltinRules+len(c.Policy)+1),
+		hairpin: c.Hairpin,
+		rules:   c.Policy,
+	}
+}
+
+// endpointOf returns the kind of endpoint that the given source or
+// recipient is.
+func endpointOf(w io.Writer) Endpoint {
+	if _, ok := w.(*Tap); ok {
+		return EndpointTap
+	}
+	return EndpointNode
+}
+
+// decisions records which rules decided the delivery of one packet, so
+// that each rule counts the packet once however many recipients it
+// decided for.
+type decisions []bool
+
+func (p *policy) newDecisions() decisions {
+	return make(decisions, len(p.counts))
+}
+
+// count adds the packet to the counts of the rules that decided its
+// delivery.
+func (p *policy) count(d decisions) {
+	for rule, decided := range d {
+		if decided {
+			atomic.AddUint64(&p.counts[rule], 1)
+		}
+	}
+}
+
+// permit returns true if the given packet from src may be delivered to dst,
+// recording the rule that decided in d.
+func (p *policy) permit(d decisions, hdr *ipx.Header, src, dst io.Writer) bool {
+	rule, allow := p.decide(hdr, src, dst)
+	d[rule] = true
+	return allow
+}
+
+// decide returns the index of the rule that decides whether the given
+// packet from src may be delivered to dst, and its decision.
+func (p *policy) decide(hdr *ipx.Header, src, dst io.Writer) (int, bool) {
+	if t, ok := dst.(*Tap); ok && t.sameHorizon(src) {
+		return ruleSplitHorizon, false
+	}
+	if dst == src {
+		switch {
+		case hdr.IsBroadcast():
+			return ruleHairpin, p.hairpin == HairpinReflect
+		case p.hairpin == HairpinDrop:
+			return ruleHairpin, false
+		}
+	}
+	from, to := endpointOf(src), endpointOf(dst)
+	for i, r := range p.rules {
+		if r.From&from == 0 || r.To&to == 0 {
+			continue
+		}
+		if r.Socket != 0 && r.Socket != hdr.Dest.Socket {
+			continue
+		}
+		return numBuiltinRules + i, r.Allow
+	}
+	return len(p.counts) - 1, true
+}
+
+// stats returns the rule table, with the number of packets that each rule
+// has decided.
+func (p *policy) stats() []PolicyRuleStats {
+	hairpin := "hairpin=deliver"
+	switch p.hairpin {
+	case HairpinDrop:
+		hairpin = "hairpin=drop"
+	case HairpinReflect:
+		hairpin = "hairpin=reflect"
+	}
+	result := []PolicyRuleStats{
+		{Rule: "split-horizon", Builtin: true},
+		{Rule: hairpin, Builtin: true},
+	}
+	for _, r := range p.rules {
+		result = append(result, PolicyRuleStats{Rule: r.String()})
+	}
+	result = append(result, PolicyRuleStats{Rule: "allow:any:any", Builtin: true})
+	for i := range result {
+		result[i].Packets = atomic.LoadUint64(&p.counts[i])
+	}
+	return result
+}
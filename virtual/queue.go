@@ -0,0 +1,111 @@
+package virtual
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// DropPolicy specifies what happens when a packet is delivered to a node or
+// tap whose queue is already full.
+type DropPolicy int
+
+const (
+	// DropTail discards the newly delivered packet.
+	DropTail DropPolicy = iota
+
+	// DropOldest discards the oldest packet in the queue to make room
+	// for the newly delivered packet.
+	DropOldest
+)
+
+// queue holds packets waiting to be read by a node or tap. Packets in the
+// queue are shared: when a broadcast packet is forwarded, the same underlying
+// bytes are pushed to the queue of every recipient. Packets must therefore
+// never be modified once they have been pushed.
+type queue struct {
+	// Accessed atomically; kept first to ensure 64-bit alignment.
+	drops uint64
+
+	packets   chan []byte
+	policy    DropPolicy
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newQueue(length int, policy DropPolicy) *queue {
+	return &queue{
+		packets: make(chan []byte, length),
+		policy:  policy,
+		closed:  make(chan struct{}),
+	}
+}
+
+// push adds a packet to the queue. If the queue is full, a packet is dropped
+// according to the queue's drop policy; push never blocks. An error is
+// returned if the queue is closed.
+func (q *queue) push(packet []byte) error {
+	for {
+		select {
+		case <-q.closed:
+			return io.ErrClosedPipe
+		default:
+		}
+		select {
+		case q.packets <- packet:
+			return nil
+		default:
+		}
+		if q.policy == DropTail {
+			atomic.AddUint64(&q.drops, 1)
+			return nil
+		}
+		// Discard the oldest packet and try again. The reader may
+		// have emptied the queue in the mean time, in which case
+		// there is nothing to discard.
+		select {
+		case <-q.packets:
+			atomic.AddUint64(&q.drops, 1)
+		default:
+		}
+	}
+}
+
+// pop removes the next packet from the queue and copies it into the given
+// buffer, blocking until a packet is available or the context is cancelled.
+// If the buffer is too small, the packet is truncated. io.EOF is returned
+// once the queue is closed.
+func (q *queue) pop(ctx context.Context, data []byte) (int, error) {
+	select {
+	case <-q.closed:
+		return 0, io.EOF
+	default:
+	}
+	select {
+	case packet := <-q.packets:
+		return copy(data, packet), nil
+	case <-q.closed:
+		return 0, io.EOF
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// close closes the queue; any blocked calls to pop() will return.
+func (q *queue) close() {
+	q.closeOnce.Do(func() {
+		close(q.closed)
+	})
+}
+
+// queued returns the number of packets currently waiting in the queue.
+func (q *queue) queued() int {
+	return len(q.packets)
+}
+
+// dropCount returns the number of packets the queue has dropped because it
+// was full.
+func (q *queue) dropCount() uint64 {
+	return atomic.LoadUint64(&q.drops)
+}
@@ -0,0 +1,95 @@
+package virtual
+
+import (
+	"context"
+	"crypto/rand"
+	"sync/atomic"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+// Spectator is a read-only node. Like a tap, it receives a copy of every
+// packet on the network, but packets written to it are silently discarded,
+// so an observer using a spectator cannot disturb the network.
+type Spectator struct {
+	// Accessed atomically; kept first to ensure 64-bit alignment.
+	droppedWrites uint64
+
+	tap  *Tap
+	addr ipx.Addr
+}
+
+var (
+	_ = (network.Node)(&Spectator{})
+)
+
+// Spectator creates a new spectator node on the network. Like a tap, the
+// caller must call Read() on it regularly otherwise packets will be dropped
+// once its queue fills up.
+func (n *Network) Spectator() *Spectator {
+	s := &Spectator{tap: n.Tap()}
+	// The spectator's address is reserved so that it is never given to
+	// a node, though packets sent to it are not delivered any
+	// differently from other unicast packets.
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		var addr ipx.Addr
+		addr[0] = 0x02
+		rand.Read(addr[1:])
+		if !n.addrInUse(addr) {
+			s.addr = addr
+			n.spectators[addr] = s
+			return s
+		}
+	}
+}
+
+// Read reads a packet from the network.
+func (s *Spectator) Read(data []byte) (int, error) {
+	return s.tap.Read(data)
+}
+
+// ReadPacket reads a packet from the network, blocking until one is received
+// or the context is cancelled.
+func (s *Spectator) ReadPacket(ctx context.Context, data []byte) (int, error) {
+	return s.tap.ReadPacket(ctx, data)
+}
+
+// Write discards the given packet.
+func (s *Spectator) Write(packet []byte) (int, error) {
+	atomic.AddUint64(&s.droppedWrites, 1)
+	return len(packet), nil
+}
+
+// WritePacket discards the given packet.
+func (s *Spectator) WritePacket(ctx context.Context, packet []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.droppedWrites, 1)
+	return nil
+}
+
+// Address returns the reserved address of the spectator.
+func (s *Spectator) Address() ipx.Addr {
+	return s.addr
+}
+
+// DroppedWrites returns the number of packets written to the spectator that
+// were discarded.
+func (s *Spectator) DroppedWrites() uint64 {
+	return atomic.LoadUint64(&s.droppedWrites)
+}
+
+// Close removes the spectator from the network.
+func (s *Spectator) Close() error {
+	n := s.tap.net
+	n.mu.Lock()
+	if n.spectators[s.addr] == s {
+		delete(n.spectators, s.addr)
+	}
+	n.mu.Unlock()
+	return s.tap.Close()
+}
@@ -3,61 +3,150 @@
 package virtual
 
 import (
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
 )
 
+// Config contains configuration parameters for a virtual network.
+type Config struct {
+	// Maximum number of packets that can be waiting to be read by a
+	// node or tap. If a node's owner falls behind in reading packets,
+	// further packets are dropped according to DropPolicy.
+	QueueLength int
+	DropPolicy  DropPolicy
+
+	// Hairpin controls what happens to packets that would be delivered
+	// back to the node that sent them.
+	Hairpin HairpinPolicy
+
+	// Forwarding rules, checked in order after the built-in split
+	// horizon and hairpin rules. See ParsePolicyRule.
+	Policy []PolicyRule
+}
+
+// HairpinPolicy specifies how packets are handled that a node sends to
+// itself, either directly or as a broadcast. Packets are never sent back to
+// the tap that they came from, or to other taps on its segment, regardless
+// of this policy, since that would reflect them back onto the bridged LAN
+// they arrived from.
+type HairpinPolicy int
+
+const (
+	// HairpinDeliver delivers packets that a node addresses to itself,
+	// but does not echo broadcasts back to their sender.
+	HairpinDeliver HairpinPolicy = iota
+
+	// HairpinDrop drops packets that a node addresses to itself as
+	// well. Some game network stacks get confused when they receive
+	// their own packets.
+	HairpinDrop
+
+	// HairpinReflect delivers packets that a node addresses to itself,
+	// and also echoes broadcasts back to their sender, like a network
+	// card that receives its own broadcasts.
+	HairpinReflect
+)
+
+// Stats contains statistics about a virtual network.
+type Stats struct {
+	// Number of nodes and spectators currently on the network.
+	Nodes      int `json:"nodes"`
+	Spectators int `json:"spectators"`
+
+	// Total number of packets dropped because a node or tap's queue
+	// was full, including nodes and taps that have since been closed.
+	QueueDrops uint64 `json:"queue_drops"`
+}
+
+// NodeStats contains statistics about a node on a virtual network.
+type NodeStats struct {
+	Addr string `json:"addr"`
+
+	// Number of packets waiting to be read by the node's owner.
+	Queued int `json:"queued"`
+
+	// Number of packets dropped because the node's queue was full.
+	QueueDrops uint64 `json:"queue_drops"`
+}
+
 type Network struct {
+	// Accessed atomically; kept first to ensure 64-bit alignment.
+	closedQueueDrops uint64
+
+	config     *Config
+	policy     *policy
 	mu         sync.RWMutex
 	nodesByIPX map[ipx.Addr]*node
 	nextTapID  int
 	taps       map[int]*Tap
+	spectators map[ipx.Addr]*Spectator
 }
 
 type Tap struct {
-	net   *Network
-	pipeR *io.PipeReader
-	pipeW *io.PipeWriter
-	id    int
+	net     *Network
+	queue   *queue
+	id      int
+	segment string
 }
 
 type node struct {
 	net   *Network
 	addr  ipx.Addr
-	pipeR *io.PipeReader
-	pipeW *io.PipeWriter
+	queue *queue
 }
 
 var (
-	_ = (network.Network)(&Network{})
+	_ = (network.AddrNetwork)(&Network{})
 	_ = (network.Node)(&node{})
 	_ = (io.ReadWriteCloser)(&Tap{})
 
 	// UnknownNodeError is returned by Network.Write() if the destination
 	// MAC address is not associated with any known node.
 	UnknownNodeError = errors.New("unknown destination address")
+
+	// AddrInUseError is returned by NewNodeWithAddr if there is already
+	// a node with the requested address, or the address is reserved.
+	AddrInUseError = errors.New("address already in use")
+
+	DefaultConfig = &Config{
+		QueueLength: 64,
+		DropPolicy:  DropTail,
+	}
 )
 
 // Close removes the node from its parent network; future calls to Read() will
-// return EOF and packets sent to its address will not be delivered.
+// return EOF and packets sent to its address will not be delivered. Closing a
+// node more than once is harmless, even if its address has since been given
+// to a new node.
 func (n *node) Close() error {
-	n.pipeW.Close()
+	n.queue.close()
 	n.net.mu.Lock()
-	delete(n.net.nodesByIPX, n.addr)
+	if n.net.nodesByIPX[n.addr] == n {
+		delete(n.net.nodesByIPX, n.addr)
+		atomic.AddUint64(&n.net.closedQueueDrops, n.queue.dropCount())
+	}
 	n.net.mu.Unlock()
 	return nil
 }
 
 // Read reads a packet from the network for this node.
 func (n *node) Read(data []byte) (int, error) {
-	return n.pipeR.Read(data)
+	return n.ReadPacket(context.Background(), data)
+}
+
+// ReadPacket reads a packet from the network for this node, blocking until
+// one is received or the context is cancelled.
+func (n *node) ReadPacket(ctx context.Context, data []byte) (int, error) {
+	return n.queue.pop(ctx, data)
 }
 
 // Write writes a packet into the network from the given node.
@@ -65,6 +154,15 @@ func (n *node) Write(packet []byte) (int, error) {
 	return n.net.writeFromSource(packet, n)
 }
 
+// WritePacket writes a packet into the network from the given node.
+func (n *node) WritePacket(ctx context.Context, packet []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := n.net.writeFromSource(packet, n)
+	return err
+}
+
 // Address returns the address of the given node.
 func (n *node) Address() ipx.Addr {
 	return n.addr
@@ -73,16 +171,25 @@ func (n *node) Address() ipx.Addr {
 // Close removes the tap from the network; no more packets will be delivered
 // to it and all future calls to Read() will return EOF.
 func (t *Tap) Close() error {
-	t.pipeW.Close()
+	t.queue.close()
 	t.net.mu.Lock()
-	delete(t.net.taps, t.id)
+	if _, ok := t.net.taps[t.id]; ok {
+		delete(t.net.taps, t.id)
+		atomic.AddUint64(&t.net.closedQueueDrops, t.queue.dropCount())
+	}
 	t.net.mu.Unlock()
 	return nil
 }
 
 // Read reads a packet from the network tap.
 func (t *Tap) Read(data []byte) (int, error) {
-	return t.pipeR.Read(data)
+	return t.ReadPacket(context.Background(), data)
+}
+
+// ReadPacket reads a packet from the network tap, blocking until one is
+// received or the context is cancelled.
+func (t *Tap) ReadPacket(ctx context.Context, data []byte) (int, error) {
+	return t.queue.pop(ctx, data)
 }
 
 // Write writes a packet into the network.
@@ -90,6 +197,21 @@ func (t *Tap) Write(packet []byte) (int, error) {
 	return t.net.writeFromSource(packet, t)
 }
 
+// addrInUse returns true if the given address belongs to a node or
+// spectator. The caller must hold the network's mutex.
+func (n *Network) addrInUse(addr ipx.Addr) bool {
+	_, isNode := n.nodesByIPX[addr]
+	_, isSpectator := n.spectators[addr]
+	return isNode || isSpectator || Reserved(addr)
+}
+
+// Reserved returns true if the given address is reserved for the server's
+// own use, eg. as the source of the pings that it sends to clients. Such
+// addresses are never given to nodes.
+func Reserved(addr ipx.Addr) bool {
+	return addr[0] == 0x02 && addr[1] == 0xff && addr[2] == 0xff
+}
+
 // addNode adds a new node to the network, setting its address to an unused
 // address.
 func (n *Network) addNode(node *node) {
@@ -101,7 +223,7 @@ func (n *Network) addNode(node *node) {
 		addr[0] = 0x02
 		rand.Read(addr[1:])
 		n.mu.Lock()
-		if _, ok := n.nodesByIPX[addr]; !ok {
+		if !n.addrInUse(addr) {
 			node.addr = addr
 			n.nodesByIPX[addr] = node
 			n.mu.Unlock()
@@ -113,66 +235,100 @@ func (n *Network) addNode(node *node) {
 
 // NewNode creates a new node on the network.
 func (n *Network) NewNode() network.Node {
-	r, w := io.Pipe()
 	node := &node{
 		net:   n,
-		pipeR: r,
-		pipeW: w,
+		queue: newQueue(n.config.QueueLength, n.config.DropPolicy),
 	}
 	n.addNode(node)
 	return node
 }
 
-// forwardBroadcastPacket takes a broadcast packet received from a node and
-// forwards it to all other clients; however, it is never sent back to the
-// source node from which it came.
-func (n *Network) forwardBroadcastPacket(header *ipx.Header, packet []byte, src io.Writer) error {
+// NewNodeWithAddr creates a new node on the network with the given address.
+func (n *Network) NewNodeWithAddr(addr ipx.Addr) (network.Node, error) {
+	node := &node{
+		net:   n,
+		addr:  addr,
+		queue: newQueue(n.config.QueueLength, n.config.DropPolicy),
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.addrInUse(addr) {
+		return nil, AddrInUseError
+	}
+	n.nodesByIPX[addr] = node
+	return node, nil
+}
+
+// deliverToNodes writes the given packet to each of the given nodes, returning
+// a list of any errors that occurred.
+func deliverToNodes(nodes []*node, packet []byte) []string {
 	errs := []string{}
+	for _, node := range nodes {
+		// Packet is pushed onto the delivery queue for the node; the
+		// owner of the node will receive it by calling Read() on the
+		// node which pops it from the queue.
+		if err := node.queue.push(packet); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return errs
+}
+
+// forwardBroadcastPacket takes a broadcast packet received from a node and
+// forwards it to all other clients that the forwarding policy permits; by
+// default, it is never sent back to the source node from which it came.
+func (n *Network) forwardBroadcastPacket(d decisions, header *ipx.Header, packet []byte, src io.Writer) error {
 	nodes := []*node{}
 	n.mu.RLock()
 	for _, node := range n.nodesByIPX {
-		if node != src {
+		if n.policy.permit(d, header, src, node) {
 			nodes = append(nodes, node)
 		}
 	}
 	n.mu.RUnlock()
-	for _, node := range nodes {
-		// Packet is written into the delivery pipe for the node; the
-		// owner of the node will receive it by calling Read() on the
-		// node which reads from the other end of the pipe.
-		_, err := node.pipeW.Write(packet)
-		if err != nil {
-			errs = append(errs, err.Error())
-		}
-	}
+	errs := deliverToNodes(nodes, packet)
 	if len(errs) > 0 {
 		return fmt.Errorf("errors when forwarding broadcast packets: %v", strings.Join(errs, "; "))
 	}
 	return nil
 }
 
+// sameHorizon returns true if the given tap is the source of a packet, or is
+// attached to the same LAN segment as it. This is split horizon: a packet
+// is never sent back out onto the LAN that it arrived from, through any
+// tap.
+func (t *Tap) sameHorizon(src io.Writer) bool {
+	if t == src {
+		return true
+	}
+	srcTap, ok := src.(*Tap)
+	return ok && t.segment != "" && t.segment == srcTap.segment
+}
+
 // forwardToTaps sends the given packet to all taps which are currently
 // listening to network traffic. We don't forward packets back to the source
-// that sent them, though.
-func (n *Network) forwardToTaps(packet []byte, src io.Writer) {
+// that sent them, though, or to other taps on the same segment.
+func (n *Network) forwardToTaps(d decisions, header *ipx.Header, packet []byte, src io.Writer) {
 	taps := []*Tap{}
 	n.mu.RLock()
 	for _, tap := range n.taps {
-		if tap != src {
+		if n.policy.permit(d, header, src, tap) {
 			taps = append(taps, tap)
 		}
 	}
 	n.mu.RUnlock()
 	for _, tap := range taps {
-		tap.pipeW.Write(packet)
+		tap.queue.push(packet)
 	}
 }
 
 // forwardPacket receives a packet and forwards it on to another node.
 func (n *Network) forwardPacket(header *ipx.Header, packet []byte, src io.Writer) error {
-	n.forwardToTaps(packet, src)
+	d := n.policy.newDecisions()
+	defer n.policy.count(d)
+	n.forwardToTaps(d, header, packet, src)
 	if header.IsBroadcast() {
-		return n.forwardBroadcastPacket(header, packet, src)
+		return n.forwardBroadcastPacket(d, header, packet, src)
 	}
 
 	// We can only forward it on if the destination IPX address corresponds
@@ -183,8 +339,10 @@ func (n *Network) forwardPacket(header *ipx.Header, packet []byte, src io.Writer
 	if !ok {
 		return UnknownNodeError
 	}
-	_, err := node.pipeW.Write(packet)
-	return err
+	if !n.policy.permit(d, header, src, node) {
+		return nil
+	}
+	return node.queue.push(packet)
 }
 
 // writeFromSource writes a packet to the network, forwarding to the right
@@ -194,23 +352,35 @@ func (n *Network) writeFromSource(packet []byte, src io.Writer) (int, error) {
 	if err := header.UnmarshalBinary(packet); err != nil {
 		return 0, err
 	}
-	if err := n.forwardPacket(&header, packet, src); err != nil {
+	// The caller may reuse its buffer once we return, so we make a single
+	// copy of the packet which is then shared between all recipients.
+	shared := make([]byte, len(packet))
+	copy(shared, packet)
+	if err := n.forwardPacket(&header, shared, src); err != nil {
 		return 0, err
 	}
 	return len(packet), nil
 }
 
 // Tap creates a new network tap for listening to network traffic.
-// The caller must call Read() on the tap regularly otherwise it may stall the
-// operation of the network.
+// The caller must call Read() on the tap regularly otherwise packets will be
+// dropped once its queue fills up.
 func (n *Network) Tap() *Tap {
-	r, w := io.Pipe()
+	return n.TapOnSegment("")
+}
+
+// TapOnSegment is like Tap, but creates a tap that is attached to the given
+// LAN segment, eg. by a bridge. Packets written by a tap are never sent to
+// other taps on the same segment, since they would only be reflected back
+// onto the LAN that they came from. An empty segment is shared with no
+// other tap.
+func (n *Network) TapOnSegment(segment string) *Tap {
 	n.mu.Lock()
 	tap := &Tap{
-		id:    n.nextTapID,
-		net:   n,
-		pipeR: r,
-		pipeW: w,
+		id:      n.nextTapID,
+		net:     n,
+		queue:   newQueue(n.config.QueueLength, n.config.DropPolicy),
+		segment: segment,
 	}
 	n.nextTapID++
 	n.taps[tap.id] = tap
@@ -218,10 +388,90 @@ func (n *Network) Tap() *Tap {
 	return tap
 }
 
-// New creates a new Network.
+// Stats returns statistics about the network.
+func (n *Network) Stats() Stats {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	result := Stats{
+		Nodes:      len(n.nodesByIPX),
+		Spectators: len(n.spectators),
+		QueueDrops: atomic.LoadUint64(&n.closedQueueDrops),
+	}
+	for _, node := range n.nodesByIPX {
+		result.QueueDrops += node.queue.dropCount()
+	}
+	for _, tap := range n.taps {
+		result.QueueDrops += tap.queue.dropCount()
+	}
+	return result
+}
+
+// NodeStats returns statistics about every node on the network.
+func (n *Network) NodeStats() []NodeStats {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	result := []NodeStats{}
+	for _, node := range n.nodesByIPX {
+		result = append(result, NodeStats{
+			Addr:       node.addr.String(),
+			Queued:     node.queue.queued(),
+			QueueDrops: node.queue.dropCount(),
+		})
+	}
+	return result
+}
+
+// Policy returns the network's forwarding rule table, in the order that the
+// rules are checked, with the number of packets that each has decided.
+func (n *Network) Policy() []PolicyRuleStats {
+	return n.policy.stats()
+}
+
+// Addrs returns the addresses of every node on the network.
+func (n *Network) Addrs() []ipx.Addr {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	result := []ipx.Addr{}
+	for addr := range n.nodesByIPX {
+		result = append(result, addr)
+	}
+	return result
+}
+
+// Close closes every node, tap and spectator on the network, so that anything
+// reading from them sees EOF. It is used when a network is no longer needed,
+// eg. when a room is removed.
+func (n *Network) Close() error {
+	n.mu.RLock()
+	var closers []io.Closer
+	for _, s := range n.spectators {
+		closers = append(closers, s)
+	}
+	for _, node := range n.nodesByIPX {
+		closers = append(closers, node)
+	}
+	for _, tap := range n.taps {
+		closers = append(closers, tap)
+	}
+	n.mu.RUnlock()
+	for _, c := range closers {
+		c.Close()
+	}
+	return nil
+}
+
+// New creates a new Network using the default configuration.
 func New() *Network {
+	return NewWithConfig(DefaultConfig)
+}
+
+// NewWithConfig creates a new Network using the given configuration.
+func NewWithConfig(c *Config) *Network {
 	return &Network{
+		config:     c,
+		policy:     newPolicy(c),
 		nodesByIPX: map[ipx.Addr]*node{},
 		taps:       map[int]*Tap{},
+		spectators: map[ipx.Addr]*Spectator{},
 	}
 }
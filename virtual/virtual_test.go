@@ -0,0 +1,131 @@
+package virtual
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// testPacket returns a packet from src to dest on the given socket.
+func testPacket(t testing.TB, src, dest ipx.Addr, socket uint16) []byte {
+	hdr := &ipx.Header{
+		Checksum: 0xffff,
+		Length:   30,
+		Dest:     ipx.HeaderAddr{Addr: dest, Socket: socket},
+		Src:      ipx.HeaderAddr{Addr: src, Socket: socket},
+	}
+	packet, err := hdr.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to encode header: %v", err)
+	}
+	return packet
+}
+
+// reader is implemented by nodes and taps.
+type reader interface {
+	ReadPacket(ctx context.Context, data []byte) (int, error)
+}
+
+// received returns true if a packet is waiting to be read.
+func received(r reader) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var buf [1500]byte
+	_, err := r.ReadPacket(ctx, buf[:])
+	return err == nil
+}
+
+func TestHairpin(t *testing.T) {
+	tests := []struct {
+		policy             HairpinPolicy
+		unicast, broadcast bool
+	}{
+		{HairpinDeliver, true, false},
+		{HairpinDrop, false, false},
+		{HairpinReflect, true, true},
+	}
+	for _, test := range tests {
+		n := NewWithConfig(&Config{
+			QueueLength: 8,
+			Hairpin:     test.policy,
+		})
+		node := n.NewNode()
+		other := n.NewNode()
+		node.Write(testPacket(t, node.Address(), node.Address(), 0x4000))
+		if got := received(node); got != test.unicast {
+			t.Errorf("policy %d: packet to self received = %v, want %v", test.policy, got, test.unicast)
+		}
+		node.Write(testPacket(t, node.Address(), ipx.AddrBroadcast, 0x4000))
+		if got := received(node); got != test.broadcast {
+			t.Errorf("policy %d: own broadcast received = %v, want %v", test.policy, got, test.broadcast)
+		}
+		if !received(other) {
+			t.Errorf("policy %d: broadcast not received by other node", test.policy)
+		}
+	}
+}
+
+// TestTapNeverReflected checks that packets from a tap are never sent back
+// to it, or to another tap on the same segment, whatever the hairpin policy.
+func TestTapNeverReflected(t *testing.T) {
+	for _, policy := range []HairpinPolicy{HairpinDeliver, HairpinDrop, HairpinReflect} {
+		n := NewWithConfig(&Config{QueueLength: 8, Hairpin: policy})
+		tap := n.TapOnSegment("lan")
+		sameLAN := n.TapOnSegment("lan")
+		otherLAN := n.TapOnSegment("other")
+		node := n.NewNode()
+		src := ipx.Addr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+		tap.Write(testPacket(t, src, ipx.AddrBroadcast, 0x4000))
+		if received(tap) {
+			t.Errorf("policy %d: broadcast reflected to its own tap", policy)
+		}
+		if received(sameLAN) {
+			t.Errorf("policy %d: broadcast sent to a tap on the same segment", policy)
+		}
+		if !received(otherLAN) {
+			t.Errorf("policy %d: broadcast not sent to a tap on another segment", policy)
+		}
+		if !received(node) {
+			t.Errorf("policy %d: broadcast not received by node", policy)
+		}
+	}
+}
+
+// TestPolicyCountsPackets checks that each rule counts a broadcast packet
+// once, however many recipients it decided for.
+func TestPolicyCountsPackets(t *testing.T) {
+	n := NewWithConfig(&Config{QueueLength: 8})
+	node := n.NewNode()
+	for i := 0; i < 4; i++ {
+		n.NewNode()
+	}
+	node.Write(testPacket(t, node.Address(), ipx.AddrBroadcast, 0x4000))
+	want := map[string]uint64{
+		"split-horizon":   0,
+		"hairpin=deliver": 1,
+		"allow:any:any":   1,
+	}
+	for _, stats := range n.Policy() {
+		if stats.Packets != want[stats.Rule] {
+			t.Errorf("rule %q decided %d packets, want %d", stats.Rule, stats.Packets, want[stats.Rule])
+		}
+	}
+}
+
+// TestReservedAddrs checks that nodes can never be given addresses that the
+// server reserves for its own use.
+func TestReservedAddrs(t *testing.T) {
+	n := New()
+	addr := ipx.Addr{0x02, 0xff, 0xff, 0xfe, 0x05, 0xc0}
+	if !Reserved(addr) {
+		t.Fatalf("Reserved(%s) = false", addr)
+	}
+	if _, err := n.NewNodeWithAddr(addr); err != AddrInUseError {
+		t.Errorf("NewNodeWithAddr(%s) = %v, want AddrInUseError", addr, err)
+	}
+	if Reserved(ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}) {
+		t.Errorf("ordinary address is reserved")
+	}
+}